@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"shellbox/internal/infra"
+	"time"
+)
+
+func main() {
+	infra.SetDefaultLogger()
+
+	dryRun := flag.Bool("dry-run", false, "report orphaned resources without deleting them")
+	minAge := flag.Duration("min-age", infra.DefaultOrphanMinAge, "only delete orphans at least this old")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [--dry-run] [--min-age duration] <suffix>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		slog.Error("resource group suffix argument is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	suffix := flag.Arg(0)
+
+	ctx := context.Background()
+	clients := infra.NewAzureClients(suffix, true)
+	slog.Info("reconciling resource group", "name", clients.ResourceGroupName, "dryRun", *dryRun, "minAge", *minAge)
+
+	// Live sessions are only known to the running server, so connected instances are left to it
+	config := infra.OrphanReconcilerConfig{MinAge: *minAge, DryRun: *dryRun}
+	report, err := infra.NewOrphanReconciler(clients, config, nil, nil).Reconcile(ctx)
+	if err != nil {
+		slog.Error("reconciliation failed", "error", err)
+		os.Exit(1)
+	}
+
+	printReport(report, *minAge)
+}
+
+func printReport(report *infra.OrphanReport, minAge time.Duration) {
+	if len(report.Orphans) == 0 {
+		fmt.Println("no orphaned resources found")
+	}
+
+	failed := 0
+	for _, orphan := range report.Orphans {
+		var action string
+		switch {
+		case orphan.Cleaned:
+			action = "deleted"
+		case orphan.Error != nil:
+			action = fmt.Sprintf("failed: %v", orphan.Error)
+			failed++
+		case orphan.Age < minAge:
+			action = "kept (too young)"
+		default:
+			action = "would delete"
+		}
+		fmt.Printf("%-26s %-70s age=%-10s %s (%s)\n", orphan.Kind, orphan.Name, orphan.Age.Round(time.Minute), action, orphan.Reason)
+	}
+
+	if !report.SessionsChecked {
+		fmt.Println("note: connected instances without a live session are only checked by the running server")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
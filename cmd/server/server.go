@@ -2,46 +2,152 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"shellbox/internal/infra"
 	"shellbox/internal/sshserver"
 	"shellbox/internal/sshutil"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ssh"
+)
+
+// Backends the server can run boxes on
+const (
+	backendAzure = "azure"
+	backendAWS   = "aws"
+	backendLocal = "local"
 )
 
 func main() {
 	logger := infra.NewLogger()
 	infra.SetDefaultLogger()
 
-	logger.Info("starting shellbox server")
-
-	if len(os.Args) < 2 {
-		logger.Error("resource group suffix argument is required")
-		os.Exit(1)
+	backend := flag.String("backend", backendAzure, "where boxes run: azure, aws, or local to run them with QEMU on this host")
+	dataDir := flag.String("data-dir", infra.DefaultLocalDataDir, "state and disk images of the local backend, allocations and events of the aws backend")
+	localInstances := flag.Int("local-instances", infra.DefaultLocalMaxInstances, "number of boxes the local backend runs at once")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "checkpoint running VM boxes this often so they can resume after an unclean shutdown, 0 to disable")
+	checkpointKeep := flag.Int("checkpoint-keep", infra.DefaultCheckpointKeep, "checkpoints kept on each box's volume")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve box resource metrics on at /metrics in the Prometheus text format, e.g. 127.0.0.1:9100; empty to disable")
+	previewDomain := flag.String("preview-domain", "", "serve HTTPS previews of box web servers on <port>-<box>-<user>.<domain>, which must resolve to this server; empty to disable")
+	webHost := flag.String("web-host", "", "serve the browser terminal on https://<host>/, which must resolve to this server; empty to disable")
+	httpsAddr := flag.String("preview-addr", ":443", "address to serve previews and the web terminal on, which must be reachable on port 443 for ACME")
+	acmeEmail := flag.String("acme-email", "", "contact email of the ACME account for HTTPS certificates")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL for HTTPS certificates, e.g. of a local Pebble; Let's Encrypt if empty")
+	acmeCACert := flag.String("acme-ca-cert", "", "PEM file of the CA of --acme-directory's server, if the system doesn't trust it")
+	acmeCache := flag.String("acme-cache", infra.DefaultACMECacheDir, "directory HTTPS certificates are kept in")
+	adminKeys := flag.String("admin-keys", "", "authorized_keys file of the users allowed to run admin commands such as 'admin migrate'")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [--backend azure] <suffix>\n       %s --backend aws [--data-dir dir] <deployment>\n       %s --backend local [--data-dir dir] [--local-instances n]\n", os.Args[0], os.Args[0], os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "The aws backend reads AWS_REGION, AWS_ENDPOINT_URL, the AWS credential variables and SHELLBOX_AWS_SUBNET_ID, SHELLBOX_AWS_SECURITY_GROUP_ID and SHELLBOX_AWS_INSTANCE_TYPE.")
+		flag.PrintDefaults()
 	}
-	suffix := os.Args[1]
-
-	logger.Info("current configuration", "config", infra.FormatConfig(suffix))
-
-	clients := infra.NewAzureClients(suffix, false)
+	flag.Parse()
 
-	// Create network infrastructure first
-	infra.CreateNetworkInfrastructure(context.Background(), clients, false)
+	logger.Info("starting shellbox server", "backend", *backend)
 
 	// Load SSH key from local filesystem (copied during deployment)
-	_, publicKey, err := sshutil.LoadKeyPair()
+	privateKey, publicKey, err := sshutil.LoadKeyPair()
 	if err != nil {
 		logger.Error("failed to load SSH key from file", "error", err)
 		os.Exit(1)
 	}
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		logger.Error("failed to parse SSH key", "error", err)
+		os.Exit(1)
+	}
 
 	logger.Info("using SSH key from file", "path", sshutil.SSHKeyPath)
 	logger.Info("loaded public key", "key", publicKey)
 
+	var (
+		suffix     string
+		clients    *infra.AzureClients
+		provider   *infra.Provider
+		port       = infra.BastionSSHPort
+		poolConfig = infra.NewDevPoolConfig() // Use development pool configuration for now
+		vmSize     = infra.VMSize
+	)
+	switch *backend {
+	case backendAzure:
+		if flag.NArg() < 1 {
+			logger.Error("resource group suffix argument is required")
+			flag.Usage()
+			os.Exit(1)
+		}
+		suffix = flag.Arg(0)
+
+		logger.Info("current configuration", "config", infra.FormatConfig(suffix))
+
+		clients = infra.NewAzureClients(suffix, false)
+
+		// Create network infrastructure first, the provider needs its table storage
+		infra.CreateNetworkInfrastructure(context.Background(), clients, false)
+		provider = infra.NewAzureProvider(clients)
+
+	case backendAWS:
+		if flag.NArg() < 1 {
+			logger.Error("deployment name argument is required")
+			flag.Usage()
+			os.Exit(1)
+		}
+		suffix = flag.Arg(0)
+
+		config := infra.NewAWSConfigFromEnv(suffix)
+		config.DataDir = *dataDir
+		if err := os.MkdirAll(config.DataDir, 0o750); err != nil {
+			logger.Error("failed to create data directory", "error", err)
+			os.Exit(1)
+		}
+		provider, err = infra.NewAWSProvider(config)
+		if err != nil {
+			logger.Error("failed to configure AWS backend", "error", err)
+			os.Exit(1)
+		}
+		if err := provider.Network.EnsureNetwork(context.Background()); err != nil {
+			logger.Error("AWS network is not usable", "error", err)
+			os.Exit(1)
+		}
+		vmSize = config.InstanceType
+		logger.Info("running boxes on EC2", "region", config.Region, "endpoint", config.Endpoint, "instanceType", config.InstanceType)
+
+	case backendLocal:
+		config := infra.NewDefaultLocalProviderConfig(publicKey)
+		config.DataDir = *dataDir
+		config.MaxInstances = *localInstances
+
+		if err := os.MkdirAll(config.DataDir, 0o750); err != nil {
+			logger.Error("failed to create data directory", "error", err)
+			os.Exit(1)
+		}
+		host, err := infra.NewLocalHost(config)
+		if err != nil {
+			logger.Error("failed to load local backend", "error", err)
+			os.Exit(1)
+		}
+		provider = host.Provider()
+		if err := provider.Network.EnsureNetwork(context.Background()); err != nil {
+			logger.Error("local backend is not usable on this host", "error", err)
+			os.Exit(1)
+		}
+		port = infra.LocalBastionSSHPort
+		poolConfig = infra.NewLocalPoolConfig(config.MaxInstances)
+		logger.Info("running boxes on this host", "dataDir", config.DataDir, "instances", config.MaxInstances)
+
+	default:
+		logger.Error("unknown backend", "backend", *backend)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Create golden snapshot if it doesn't exist
 	logger.Info("ensuring golden snapshot exists")
-	goldenSnapshot, err := infra.CreateGoldenSnapshotIfNotExists(context.Background(), clients)
+	goldenSnapshot, err := provider.Snapshots.EnsureGoldenSnapshot(context.Background())
 	if err != nil {
 		logger.Error("failed to create golden snapshot", "error", err)
 		os.Exit(1)
@@ -55,34 +161,142 @@ func main() {
 		RowKey:       fmt.Sprintf("%s_server_start", now.Format("20060102T150405")),
 		Timestamp:    now,
 		EventType:    "server_start",
-		Details:      fmt.Sprintf(`{"suffix":%q}`, suffix),
+		Details:      fmt.Sprintf(`{"backend":%q,"suffix":%q}`, *backend, suffix),
 	}
-	if err := infra.WriteEventLog(context.Background(), clients, &startEvent); err != nil {
+	if err := provider.Events.WriteEvent(context.Background(), &startEvent); err != nil {
 		logger.Warn("Failed to log server start event", "error", err)
 	}
 
 	vmConfig := &infra.VMConfig{
 		AdminUsername: "shellbox",
 		SSHPublicKey:  publicKey,
-		VMSize:        "Standard_D8s_v3",
+		VMSize:        vmSize,
 	}
 
-	// Use development pool configuration for now
-	poolConfig := infra.NewDevPoolConfig()
-
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx := context.Background()
 
 	logger.Info("starting pool management")
-	pool := infra.NewBoxPool(clients, vmConfig, poolConfig, goldenSnapshot)
+	pool := infra.NewBoxPool(provider, vmConfig, poolConfig, goldenSnapshot)
+
+	// The registry drives pool and allocation decisions, so bring it up to date with
+	// the backend first (e.g. resources created before it became authoritative)
+	if err := pool.ReconcileRegistry(ctx); err != nil {
+		logger.Warn("Failed to reconcile resource registry", "error", err)
+	}
 	go pool.MaintainPool(ctx)
 
 	// Start SSH server
-	sshServer, err := sshserver.New(infra.BastionSSHPort, clients)
-	if err != nil {
-		logger.Error("Failed to create SSH server", "error", err)
-		cancel()
-		os.Exit(1)
+	sshServer := sshserver.New(port, signer, provider, pool)
+
+	if *adminKeys != "" {
+		if err := sshServer.LoadAdminKeys(*adminKeys); err != nil {
+			logger.Error("Failed to load admin keys", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Finish what a previous server process left behind before taking new connections
+	logger.Info("recovering interrupted allocations")
+	if err := sshServer.RecoverAllocations(ctx); err != nil {
+		logger.Warn("Failed to recover some allocations", "error", err)
+	}
+
+	// Release boxes their users left and, on Azure, clean up resources leaked by failed
+	// creates and golden snapshot builds
+	reconciler := infra.NewOrphanReconciler(clients, infra.NewDefaultOrphanReconcilerConfig(), sshServer.Allocator(), sshServer)
+	go reconciler.Run(ctx)
+
+	// Watch running boxes for crashes and restart them per their restart policy
+	supervisor := infra.NewBoxSupervisor(provider)
+	supervisor.OnIncident(sshServer.HandleBoxIncident)
+	go supervisor.Run(ctx)
+
+	if *checkpointInterval > 0 {
+		checkpointer := infra.NewBoxCheckpointer(provider, infra.CheckpointConfig{
+			Interval: *checkpointInterval,
+			Keep:     *checkpointKeep,
+		})
+		go checkpointer.Run(ctx)
 	}
+
+	// Sample the resource usage of running boxes for the top command and /metrics
+	boxMetrics := infra.NewBoxMetricsCollector(provider, infra.NewDefaultMetricsConfig())
+	sshServer.SetBoxMetrics(boxMetrics)
+	go boxMetrics.Run(ctx)
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", boxMetrics)
+		metricsServer := &http.Server{
+			Addr:              *metricsAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil {
+				logger.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	// Previews and the web terminal share one HTTPS server, told apart by hostname
+	httpsMux := http.NewServeMux()
+	var hostPolicies []autocert.HostPolicy
+	if *previewDomain != "" {
+		previewConfig := infra.NewDefaultPreviewConfig(*previewDomain)
+		preview, err := infra.NewPreviewProxy(sshServer.Exposures(), previewConfig)
+		if err != nil {
+			logger.Error("Failed to create preview proxy", "error", err)
+			os.Exit(1)
+		}
+		sshServer.SetPreviewProxy(preview)
+		httpsMux.Handle("/", preview)
+		hostPolicies = append(hostPolicies, preview.HostPolicy)
+		logger.Info("serving box previews", "domain", previewConfig.Domain, "addr", *httpsAddr)
+	}
+	if *webHost != "" {
+		host := strings.ToLower(*webHost)
+		terminal, err := sshServer.EnableWebTerminal(host)
+		if err != nil {
+			logger.Error("Failed to create web terminal", "error", err)
+			os.Exit(1)
+		}
+		httpsMux.Handle(host+"/", terminal)
+		hostPolicies = append(hostPolicies, autocert.HostWhitelist(host))
+		logger.Info("serving web terminal", "host", host, "addr", *httpsAddr)
+	}
+	if len(hostPolicies) > 0 {
+		tlsConfig, err := infra.NewACMETLSConfig(infra.ACMEConfig{
+			Email:     *acmeEmail,
+			Directory: *acmeDirectory,
+			CACert:    *acmeCACert,
+			CacheDir:  *acmeCache,
+		}, func(ctx context.Context, host string) error {
+			var err error
+			for _, policy := range hostPolicies {
+				if err = policy(ctx, host); err == nil {
+					return nil
+				}
+			}
+			return err
+		})
+		if err != nil {
+			logger.Error("Failed to configure HTTPS certificates", "error", err)
+			os.Exit(1)
+		}
+		httpsServer := &http.Server{
+			Addr:              *httpsAddr,
+			Handler:           httpsMux,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := httpsServer.ListenAndServeTLS("", ""); err != nil {
+				logger.Error("HTTPS server error", "error", err)
+			}
+		}()
+	}
+
 	go func() {
 		if err := sshServer.Run(); err != nil {
 			logger.Error("SSH server error", "error", err)
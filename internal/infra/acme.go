@@ -0,0 +1,54 @@
+package infra
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultACMECacheDir is where certificates obtained with ACME are kept
+const DefaultACMECacheDir = "/var/lib/shellbox/acme"
+
+// ACMEConfig configures how the HTTPS server obtains certificates: from an ACME CA with
+// the TLS-ALPN-01 challenge on port 443. Directory and CACert point at a local stand-in
+// like Pebble instead of Let's Encrypt.
+type ACMEConfig struct {
+	Email     string
+	Directory string // directory URL, Let's Encrypt if empty
+	CACert    string // PEM file of the CA serving Directory, the system roots if empty
+	CacheDir  string
+}
+
+// NewACMETLSConfig returns a TLS configuration that obtains and renews certificates for
+// the hostnames hostPolicy allows
+func NewACMETLSConfig(config ACMEConfig, hostPolicy autocert.HostPolicy) (*tls.Config, error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.CacheDir),
+		HostPolicy: hostPolicy,
+		Email:      config.Email,
+	}
+	if config.Directory != "" {
+		client := &acme.Client{DirectoryURL: config.Directory}
+		if config.CACert != "" {
+			pem, err := os.ReadFile(config.CACert)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read ACME CA certificate: %w", err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", config.CACert)
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+			client.HTTPClient = &http.Client{Transport: transport}
+		}
+		manager.Client = client
+	}
+	return manager.TLSConfig(), nil
+}
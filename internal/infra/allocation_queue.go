@@ -0,0 +1,168 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultQueueRetryInterval is how often the head of an allocation queue retries
+// when no capacity notification arrives in the meantime
+const DefaultQueueRetryInterval = 15 * time.Second
+
+// QueueStatus describes where a waiting user currently stands in an allocation queue
+type QueueStatus struct {
+	Position      int // 1-based, 1 means next in line
+	QueueLength   int
+	EstimatedWait time.Duration
+}
+
+// AllocationQueue hands out pool capacity of a single resource role in FIFO order.
+// Only the waiter at the head of the queue attempts allocation; everybody else waits
+// for their turn, so a user who arrives later can never take capacity from one who
+// has been waiting longer.
+type AllocationQueue struct {
+	mu            sync.Mutex
+	role          string
+	capacityErr   error
+	pool          *BoxPool
+	waiters       []*queueWaiter
+	retryInterval time.Duration
+}
+
+type queueWaiter struct {
+	userID  string
+	changed chan struct{} // signaled when the queue changes or capacity is added
+}
+
+// NewAllocationQueue creates a queue for the given resource role (instance or volume)
+func NewAllocationQueue(role string, pool *BoxPool) *AllocationQueue {
+	capacityErr := ErrNoFreeInstances
+	if role == ResourceRoleVolume {
+		capacityErr = ErrNoFreeVolumes
+	}
+	return &AllocationQueue{
+		role:          role,
+		capacityErr:   capacityErr,
+		pool:          pool,
+		retryInterval: DefaultQueueRetryInterval,
+	}
+}
+
+// Notify wakes up queued waiters, typically because the pool just added capacity
+func (q *AllocationQueue) Notify() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.signalAllLocked()
+}
+
+// Len returns the number of users currently waiting in the queue
+func (q *AllocationQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiters)
+}
+
+// Do runs attempt once it is the caller's turn and retries it for as long as it fails
+// with a capacity error. onWait is called whenever the caller has to wait, with their
+// current position and an estimated wait. Do returns when attempt succeeds, fails with
+// any other error, or ctx is done (e.g. the user's SSH session went away).
+func (q *AllocationQueue) Do(ctx context.Context, userID string, attempt func(context.Context) error, onWait func(QueueStatus)) error {
+	w := q.enqueue(userID)
+	defer q.remove(w)
+
+	lastPosition := 0
+	for {
+		status := q.status(w)
+
+		if status.Position > 1 {
+			if status.Position != lastPosition && onWait != nil {
+				onWait(status)
+			}
+			lastPosition = status.Position
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-w.changed:
+			}
+			continue
+		}
+
+		err := attempt(ctx)
+		if err == nil || !errors.Is(err, q.capacityErr) {
+			return err
+		}
+
+		// Head of the queue and still no capacity: make sure the pool scales up for
+		// everybody waiting, tell the user, and retry on the next nudge or tick
+		q.pool.RequestScaleUp(q.role, status.QueueLength)
+		status.EstimatedWait = q.pool.EstimateWait(q.role, status.Position)
+		slog.Info("allocation queued", "role", q.role, "userID", userID, "queueLength", status.QueueLength, "estimatedWait", status.EstimatedWait)
+		if onWait != nil {
+			onWait(status)
+		}
+		lastPosition = status.Position
+
+		timer := time.NewTimer(q.retryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-w.changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (q *AllocationQueue) enqueue(userID string) *queueWaiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w := &queueWaiter{userID: userID, changed: make(chan struct{}, 1)}
+	q.waiters = append(q.waiters, w)
+	return w
+}
+
+func (q *AllocationQueue) remove(w *queueWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	// Everybody behind moves up one position
+	q.signalAllLocked()
+}
+
+func (q *AllocationQueue) status(w *queueWaiter) QueueStatus {
+	q.mu.Lock()
+	position := 0
+	for i, other := range q.waiters {
+		if other == w {
+			position = i + 1
+			break
+		}
+	}
+	length := len(q.waiters)
+	q.mu.Unlock()
+
+	return QueueStatus{
+		Position:      position,
+		QueueLength:   length,
+		EstimatedWait: q.pool.EstimateWait(q.role, position),
+	}
+}
+
+func (q *AllocationQueue) signalAllLocked() {
+	for _, w := range q.waiters {
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+	}
+}
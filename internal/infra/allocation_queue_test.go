@@ -0,0 +1,191 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueTestPool is a pool that only estimates waits, scaling up two instances at a time
+func queueTestPool() *BoxPool {
+	return NewBoxPool(nil, nil, PoolConfig{MinFreeInstances: 2, MinFreeVolumes: 3}, nil)
+}
+
+// queueUser runs a user's turn in an allocation queue
+type queueUser struct {
+	statuses chan QueueStatus
+	done     chan error
+	cancel   context.CancelFunc
+}
+
+// testCapacity is pool capacity handed out by allocation attempts, in the order given
+type testCapacity struct {
+	mu    sync.Mutex
+	free  int
+	order []string
+}
+
+func (c *testCapacity) add(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.free += n
+}
+
+func (c *testCapacity) taken() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.order)
+}
+
+// join queues userID for one unit of capacity
+func (c *testCapacity) join(t *testing.T, q *AllocationQueue, userID string) *queueUser {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	user := &queueUser{statuses: make(chan QueueStatus, 16), done: make(chan error, 1), cancel: cancel}
+	go func() {
+		user.done <- q.Do(ctx, userID, func(context.Context) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.free == 0 {
+				return ErrNoFreeInstances
+			}
+			c.free--
+			c.order = append(c.order, userID)
+			return nil
+		}, func(status QueueStatus) { user.statuses <- status })
+	}()
+	return user
+}
+
+// expect waits for the user to be told their position, failing unless it is position
+func (u *queueUser) expect(t *testing.T, position, length int) QueueStatus {
+	t.Helper()
+	for {
+		select {
+		case status := <-u.statuses:
+			if status.Position == position && status.QueueLength == length {
+				return status
+			}
+		case err := <-u.done:
+			t.Fatalf("left the queue with %v, want position %d of %d", err, position, length)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("not told position %d of %d", position, length)
+		}
+	}
+}
+
+func TestAllocationQueueFIFO(t *testing.T) {
+	pool := queueTestPool()
+	q := NewAllocationQueue(ResourceRoleInstance, pool)
+	q.retryInterval = time.Hour // only capacity notifications and queue changes wake waiters
+	capacity := &testCapacity{}
+
+	// The head of the queue finds no capacity and asks for a scale up
+	a := capacity.join(t, q, "a")
+	if status := a.expect(t, 1, 1); status.EstimatedWait != DefaultInstanceScaleUpEstimate {
+		t.Errorf("head waits %s, want one scale up", status.EstimatedWait)
+	}
+	select {
+	case <-pool.scaleUpRequests:
+	default:
+		t.Fatalf("no scale up requested")
+	}
+	if demand := pool.takePendingDemand(ResourceRoleInstance); demand != 1 {
+		t.Errorf("got demand %d, want 1", demand)
+	}
+
+	// Positions beyond a scale up's batch wait for another round
+	b := capacity.join(t, q, "b")
+	if status := b.expect(t, 2, 2); status.EstimatedWait != DefaultInstanceScaleUpEstimate {
+		t.Errorf("second waits %s, want one scale up", status.EstimatedWait)
+	}
+	c := capacity.join(t, q, "c")
+	if status := c.expect(t, 3, 3); status.EstimatedWait != 2*DefaultInstanceScaleUpEstimate {
+		t.Errorf("third waits %s, want two scale ups", status.EstimatedWait)
+	}
+
+	// Those behind a user who gives up move up
+	b.cancel()
+	if err := <-b.done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled user got %v", err)
+	}
+	c.expect(t, 2, 2)
+	e := capacity.join(t, q, "e")
+	e.expect(t, 3, 3)
+
+	// New capacity goes to those waiting longest, not to whoever asks first
+	capacity.add(2)
+	q.Notify()
+	for _, user := range []*queueUser{a, c} {
+		if err := <-user.done; err != nil {
+			t.Fatalf("allocation failed: %v", err)
+		}
+	}
+	e.expect(t, 1, 1)
+	if got := capacity.taken(); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("capacity went to %v, want a then c", got)
+	}
+	if q.Len() != 1 {
+		t.Errorf("got %d waiting, want 1", q.Len())
+	}
+
+	e.cancel()
+	<-e.done
+
+	// Errors other than a lack of capacity end the wait
+	failed := errors.New("attach failed")
+	if err := q.Do(context.Background(), "f", func(context.Context) error { return failed }, nil); !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the allocation error", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("got %d waiting, want none", q.Len())
+	}
+}
+
+func TestEstimateWait(t *testing.T) {
+	pool := queueTestPool()
+	for _, tt := range []struct {
+		role     string
+		position int
+		want     time.Duration
+	}{
+		{ResourceRoleInstance, 1, DefaultInstanceScaleUpEstimate},
+		{ResourceRoleInstance, 2, DefaultInstanceScaleUpEstimate},
+		{ResourceRoleInstance, 5, 3 * DefaultInstanceScaleUpEstimate},
+		{ResourceRoleVolume, 3, DefaultVolumeScaleUpEstimate},
+		{ResourceRoleVolume, 4, 2 * DefaultVolumeScaleUpEstimate},
+	} {
+		if got := pool.EstimateWait(tt.role, tt.position); got != tt.want {
+			t.Errorf("%s at position %d: got %s, want %s", tt.role, tt.position, got, tt.want)
+		}
+	}
+
+	notified := 0
+	pool.OnCapacityAdded(ResourceRoleInstance, func() { notified++ })
+
+	// A scale up under way counts towards the wait
+	finish := pool.startScaleUp(ResourceRoleInstance)
+	time.Sleep(10 * time.Millisecond)
+	if got := pool.EstimateWait(ResourceRoleInstance, 1); got > DefaultInstanceScaleUpEstimate-10*time.Millisecond {
+		t.Errorf("got %s during a scale up, want less than a full one", got)
+	}
+
+	// Scale ups that create nothing neither teach the estimate nor wake the queue
+	finish(0)
+	if got := pool.EstimateWait(ResourceRoleInstance, 1); got != DefaultInstanceScaleUpEstimate || notified != 0 {
+		t.Errorf("got %s and %d notifications after a failed scale up", got, notified)
+	}
+
+	// Quick scale ups bring the estimate down
+	pool.startScaleUp(ResourceRoleInstance)(2)
+	if got, want := pool.EstimateWait(ResourceRoleInstance, 1), DefaultInstanceScaleUpEstimate*7/10; got < want || got > want+time.Second {
+		t.Errorf("got %s after a quick scale up, want about %s", got, want)
+	}
+	if notified != 1 {
+		t.Errorf("got %d notifications, want 1", notified)
+	}
+}
@@ -0,0 +1,311 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Allocation states. An allocation moves free → reserved → attaching → booting → connected
+// and is released through releasing back to free. Any intermediate state can fall back to
+// releasing when a step fails, the user goes away or the owning server crashed.
+const (
+	AllocationStateFree      = "free"
+	AllocationStateReserved  = "reserved"
+	AllocationStateAttaching = "attaching"
+	AllocationStateBooting   = "booting"
+	AllocationStateConnected = "connected"
+	AllocationStateReleasing = "releasing"
+)
+
+const allocationPartitionKey = "allocation"
+
+// allocationTransitions lists the valid next states of every allocation state
+var allocationTransitions = map[string][]string{
+	AllocationStateFree:      {AllocationStateReserved},
+	AllocationStateReserved:  {AllocationStateAttaching, AllocationStateReleasing},
+	AllocationStateAttaching: {AllocationStateBooting, AllocationStateReleasing},
+	AllocationStateBooting:   {AllocationStateConnected, AllocationStateReleasing},
+	AllocationStateConnected: {AllocationStateReleasing},
+	AllocationStateReleasing: {AllocationStateFree},
+}
+
+// AllocationEntity is the persisted state of one allocation of an instance to a user's box
+type AllocationEntity struct {
+	PartitionKey   string    `json:"PartitionKey"`
+	RowKey         string    `json:"RowKey"` // allocation ID
+	Timestamp      time.Time `json:"Timestamp"`
+	State          string    `json:"State"`
+	ReleasingFrom  string    `json:"ReleasingFrom,omitempty"` // state the allocation was in when release started
+	Owner          string    `json:"Owner"`                   // server process driving the allocation
+	UserID         string    `json:"UserID"`
+	BoxName        string    `json:"BoxName"`
+	InstanceID     string    `json:"InstanceID"`
+	VolumeID       string    `json:"VolumeID"`
+	Runtime        string    `json:"Runtime,omitempty"` // box runtime, empty for BoxRuntimeVM
+	InstanceIP     string    `json:"InstanceIP,omitempty"`
+	CreatedAt      time.Time `json:"CreatedAt"`
+	StateChangedAt time.Time `json:"StateChangedAt"`
+	ReservedAt     time.Time `json:"ReservedAt,omitzero"`
+	AttachingAt    time.Time `json:"AttachingAt,omitzero"`
+	BootingAt      time.Time `json:"BootingAt,omitzero"`
+	ConnectedAt    time.Time `json:"ConnectedAt,omitzero"`
+	ReleasingAt    time.Time `json:"ReleasingAt,omitzero"`
+	ReleasedAt     time.Time `json:"ReleasedAt,omitzero"`
+	RecoveredAt    time.Time `json:"RecoveredAt,omitzero"` // when a server process last took the allocation over
+	LastError      string    `json:"LastError,omitempty"`
+}
+
+// newAllocation creates an allocation record in the free state
+func newAllocation(owner, userID, boxName, instanceID, volumeID string) *AllocationEntity {
+	now := time.Now()
+	return &AllocationEntity{
+		PartitionKey:   allocationPartitionKey,
+		RowKey:         uuid.New().String(),
+		Timestamp:      now,
+		State:          AllocationStateFree,
+		Owner:          owner,
+		UserID:         userID,
+		BoxName:        boxName,
+		InstanceID:     instanceID,
+		VolumeID:       volumeID,
+		CreatedAt:      now,
+		StateChangedAt: now,
+	}
+}
+
+// transitionTo moves the allocation to state if that is a valid transition, stamping the time
+func (a *AllocationEntity) transitionTo(state string) error {
+	if !slices.Contains(allocationTransitions[a.State], state) {
+		return fmt.Errorf("invalid allocation transition from %s to %s", a.State, state)
+	}
+
+	now := time.Now()
+	switch state {
+	case AllocationStateReserved:
+		a.ReservedAt = now
+	case AllocationStateAttaching:
+		a.AttachingAt = now
+	case AllocationStateBooting:
+		a.BootingAt = now
+	case AllocationStateConnected:
+		a.ConnectedAt = now
+	case AllocationStateReleasing:
+		a.ReleasingFrom = a.State
+		a.ReleasingAt = now
+	case AllocationStateFree:
+		a.ReleasedAt = now
+	}
+	a.State = state
+	a.StateChangedAt = now
+	a.Timestamp = now
+	return nil
+}
+
+// WriteAllocation persists an allocation record in the Allocations table. Released
+// allocations are deleted rather than kept, so listing the active ones stays cheap; the
+// event log has the history.
+func WriteAllocation(ctx context.Context, clients *AzureClients, allocation *AllocationEntity) error {
+	namer := NewResourceNamer(clients.Suffix)
+	if allocation.State != AllocationStateFree {
+		return upsertTableEntity(ctx, clients, namer.AllocationsTableName(), allocation)
+	}
+
+	if clients.TableClient == nil {
+		return fmt.Errorf("table client not available")
+	}
+	tableClient := clients.TableClient.NewClient(namer.AllocationsTableName())
+	_, err := tableClient.DeleteEntity(ctx, allocationPartitionKey, allocation.RowKey, nil)
+	if err != nil && !isStatusCode(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete allocation %s: %w", allocation.RowKey, err)
+	}
+	return nil
+}
+
+// ListActiveAllocations returns all allocations that have not been released back to free
+func ListActiveAllocations(ctx context.Context, clients *AzureClients) ([]AllocationEntity, error) {
+	filter := fmt.Sprintf("PartitionKey eq '%s' and State ne '%s'", allocationPartitionKey, AllocationStateFree)
+	namer := NewResourceNamer(clients.Suffix)
+	return listTableEntities[AllocationEntity](ctx, clients, namer.AllocationsTableName(), filter)
+}
+
+// newAllocationOwner identifies the current server process, so allocations left behind by
+// a previous process can be told apart from the ones this process is driving
+func newAllocationOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), time.Now().Unix())
+}
+
+// transition moves an allocation to the next state and persists it
+func (ra *ResourceAllocator) transition(ctx context.Context, allocation *AllocationEntity, state string) error {
+	if err := allocation.transitionTo(state); err != nil {
+		return err
+	}
+	if err := ra.provider.Allocations.WriteAllocation(ctx, allocation); err != nil {
+		return fmt.Errorf("failed to persist allocation state %s: %w", state, err)
+	}
+	slog.Debug("allocation state changed", "allocationID", allocation.RowKey, "state", state, "instanceID", allocation.InstanceID, "volumeID", allocation.VolumeID)
+	return nil
+}
+
+// releaseAllocation undoes whatever the allocation had done by the time it left its last
+// active state: it stops the box, detaches the volume and frees the instance. Every step is
+// safe to repeat, so an interrupted release can simply be run again.
+func (ra *ResourceAllocator) releaseAllocation(ctx context.Context, allocation *AllocationEntity) error {
+	if allocation.State != AllocationStateReleasing {
+		if err := ra.transition(ctx, allocation, AllocationStateReleasing); err != nil {
+			slog.Warn("Failed to record allocation release", "allocationID", allocation.RowKey, "error", err)
+		}
+	}
+
+	from := allocation.ReleasingFrom
+	booted := from == AllocationStateBooting || from == AllocationStateConnected
+	attached := booted || from == AllocationStateAttaching
+
+	ra.mu.Lock()
+	listeners := slices.Clone(ra.releaseListeners)
+	ra.mu.Unlock()
+	for _, fn := range listeners {
+		fn(allocation.InstanceID)
+	}
+
+	if booted {
+		instanceIP := allocation.InstanceIP
+		if instanceIP == "" {
+			var err error
+			if instanceIP, err = ra.provider.Compute.GetInstancePrivateIP(ctx, allocation.InstanceID); err != nil {
+				slog.Warn("Failed to get instance IP for cleanup", "instanceID", allocation.InstanceID, "error", err)
+			}
+		}
+		runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+		if err != nil {
+			slog.Warn("Failed to stop box during release", "instanceIP", instanceIP, "error", err)
+		} else if instanceIP != "" {
+			if err := runtime.StopBox(ctx, instanceIP); err != nil {
+				slog.Warn("Failed to stop box during release", "instanceIP", instanceIP, "error", err)
+			}
+		}
+	}
+
+	if attached {
+		if err := ra.provider.Volumes.DetachVolume(ctx, allocation.InstanceID, allocation.VolumeID); err != nil {
+			slog.Warn("Failed to detach volume during release", "instanceID", allocation.InstanceID, "volumeID", allocation.VolumeID, "error", err)
+		}
+	}
+
+	// The volume stays attached to its user and keeps their data, only the instance goes back to the pool
+	if err := ra.provider.Inventory.UpdateInstanceStatus(ctx, allocation.InstanceID, ResourceStatusFree); err != nil {
+		return fmt.Errorf("failed to free instance: %w", err)
+	}
+
+	if err := ra.provider.Claims.Release(ctx, allocation.InstanceID, allocation.RowKey); err != nil {
+		slog.Warn("Failed to release instance claim", "instanceID", allocation.InstanceID, "error", err)
+	}
+
+	if err := ra.transition(ctx, allocation, AllocationStateFree); err != nil {
+		slog.Warn("Failed to record allocation as released", "allocationID", allocation.RowKey, "error", err)
+	}
+	return nil
+}
+
+// RecoverAllocations takes over or rolls back the allocations a previous server process
+// left behind, e.g. after a crash or restart. Connected allocations whose box still runs
+// are taken over, so a restart doesn't take users' boxes down. Every other allocation,
+// including one caught mid-connect, is rolled back. Allocations driven by this process are
+// left alone.
+func (ra *ResourceAllocator) RecoverAllocations(ctx context.Context) error {
+	allocations, err := ra.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list active allocations: %w", err)
+	}
+
+	var errs []error
+	for i := range allocations {
+		allocation := &allocations[i]
+		if allocation.Owner == ra.owner {
+			continue
+		}
+
+		slog.Info("recovering allocation", "allocationID", allocation.RowKey, "state", allocation.State, "owner", allocation.Owner, "instanceID", allocation.InstanceID, "volumeID", allocation.VolumeID, "userID", allocation.UserID)
+		allocation.Owner = ra.owner
+		if allocation.State == AllocationStateConnected && ra.boxStillRunning(ctx, allocation) {
+			allocation.RecoveredAt = time.Now()
+			if err := ra.provider.Allocations.WriteAllocation(ctx, allocation); err != nil {
+				errs = append(errs, fmt.Errorf("allocation %s: failed to take over: %w", allocation.RowKey, err))
+				continue
+			}
+			slog.Info("resumed allocation", "allocationID", allocation.RowKey, "instanceID", allocation.InstanceID, "userID", allocation.UserID, "boxName", allocation.BoxName)
+			continue
+		}
+		if err := ra.releaseAllocation(ctx, allocation); err != nil {
+			errs = append(errs, fmt.Errorf("allocation %s: %w", allocation.RowKey, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// boxStillRunning reports whether the box of a connected allocation is known to still run.
+// Boxes whose runtime can't tell, or that can't be reached, count as down.
+func (ra *ResourceAllocator) boxStillRunning(ctx context.Context, allocation *AllocationEntity) bool {
+	if allocation.InstanceIP == "" {
+		return false
+	}
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return false
+	}
+	checker, ok := runtime.(BoxChecker)
+	if !ok {
+		return false
+	}
+	running, err := checker.BoxRunning(ctx, allocation.InstanceIP)
+	if err != nil {
+		slog.Warn("Failed to check whether box still runs", "allocationID", allocation.RowKey, "instanceIP", allocation.InstanceIP, "error", err)
+		return false
+	}
+	return running
+}
+
+// findActiveAllocation returns the active allocation of an instance, or nil if there is none
+func (ra *ResourceAllocator) findActiveAllocation(ctx context.Context, instanceID string) (*AllocationEntity, error) {
+	allocations, err := ra.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range allocations {
+		if allocations[i].InstanceID == instanceID {
+			return &allocations[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// findBoxAllocation returns the connected allocation of a user's box, or nil if the box
+// isn't running
+func (ra *ResourceAllocator) findBoxAllocation(ctx context.Context, userID, boxName string) (*AllocationEntity, error) {
+	allocations, err := ra.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range allocations {
+		allocation := &allocations[i]
+		if allocation.UserID == userID && allocation.BoxName == boxName && allocation.State == AllocationStateConnected {
+			return allocation, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,52 @@
+package infra
+
+import "testing"
+
+func TestAllocationTransitions(t *testing.T) {
+	allocation := newAllocation("server-1", "user-1", "dev1", "vm-1", "vol-1")
+	if allocation.State != AllocationStateFree {
+		t.Fatalf("new allocation is %s, want free", allocation.State)
+	}
+
+	// The happy path stamps each state as it is reached
+	for _, state := range []string{AllocationStateReserved, AllocationStateAttaching, AllocationStateBooting, AllocationStateConnected} {
+		if err := allocation.transitionTo(state); err != nil {
+			t.Fatalf("transition to %s: %v", state, err)
+		}
+	}
+	if allocation.ReservedAt.IsZero() || allocation.AttachingAt.IsZero() || allocation.BootingAt.IsZero() || allocation.ConnectedAt.IsZero() {
+		t.Errorf("states reached without a time: %+v", allocation)
+	}
+	if allocation.StateChangedAt != allocation.ConnectedAt {
+		t.Errorf("state changed at %s, want when it connected", allocation.StateChangedAt)
+	}
+
+	// Steps can't be skipped or repeated, and a connected box only goes away through release
+	for _, state := range []string{AllocationStateConnected, AllocationStateBooting, AllocationStateFree, "bogus"} {
+		if err := allocation.transitionTo(state); err == nil {
+			t.Errorf("connected allocation moved to %s", state)
+		}
+	}
+	if allocation.State != AllocationStateConnected {
+		t.Fatalf("refused transition left the allocation %s", allocation.State)
+	}
+
+	// Release remembers how far the allocation got, which decides what is undone
+	if err := allocation.transitionTo(AllocationStateReleasing); err != nil {
+		t.Fatalf("transition to releasing: %v", err)
+	}
+	if allocation.ReleasingFrom != AllocationStateConnected {
+		t.Errorf("released from %q, want connected", allocation.ReleasingFrom)
+	}
+	if err := allocation.transitionTo(AllocationStateFree); err != nil || allocation.ReleasedAt.IsZero() {
+		t.Errorf("release didn't finish: %v", err)
+	}
+
+	// A failed attach rolls back from attaching
+	allocation = newAllocation("server-1", "user-1", "dev1", "vm-1", "vol-1")
+	_ = allocation.transitionTo(AllocationStateReserved)
+	_ = allocation.transitionTo(AllocationStateAttaching)
+	if err := allocation.transitionTo(AllocationStateReleasing); err != nil || allocation.ReleasingFrom != AllocationStateAttaching {
+		t.Errorf("got %v releasing from %q, want from attaching", err, allocation.ReleasingFrom)
+	}
+}
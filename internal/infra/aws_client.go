@@ -0,0 +1,462 @@
+package infra
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS backend defaults
+const (
+	DefaultAWSRegion = "us-west-2"
+
+	// DefaultAWSInstanceType runs boxes as nested VMs: EC2 exposes hardware virtualization
+	// to the guest on bare metal instance types
+	DefaultAWSInstanceType = "m5zn.metal"
+
+	awsEC2APIVersion   = "2016-11-15"
+	awsSigningService  = "ec2"
+	awsSigningScheme   = "AWS4-HMAC-SHA256"
+	awsRequestTimeout  = 60 * time.Second
+	awsDataDeviceName  = "/dev/sdf"
+	awsUbuntuOwnerID   = "099720109477" // Canonical
+	awsUbuntuImageName = "ubuntu/images/hvm-ssd-gp3/ubuntu-noble-24.04-amd64-server-*"
+)
+
+// AWSDataDisk is the volume attached as /dev/sdf, which Nitro instances expose as the
+// second NVMe device. Pool instances find it by the label the golden build gives it.
+var AWSDataDisk = DataDiskLayout{
+	Device:       "/dev/nvme1n1",
+	Path:         "/dev/disk/by-label/shellbox-data",
+	Label:        "shellbox-data",
+	MountOptions: "defaults,nofail",
+}
+
+// AWSConfig configures the EC2 backend
+type AWSConfig struct {
+	Region          string
+	Endpoint        string // EC2 API URL; set to use a local stand-in such as moto or LocalStack
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Deployment      string // scopes inventory tags, like the Azure resource group suffix
+	InstanceType    string // must support nested virtualization for VM boxes
+	SubnetID        string // subnet instances are launched in; volumes are created in its zone
+	SecurityGroupID string // must allow SSH, BoxSSHPort and the exposure ports from the server
+	BaseImageID     string // AMI golden builds start from, the latest Ubuntu 24.04 if empty
+	DataDir         string // holds allocations and the event log
+}
+
+// NewAWSConfigFromEnv reads the AWS backend settings from the standard AWS environment
+// variables and the SHELLBOX_AWS_* ones
+func NewAWSConfigFromEnv(deployment string) AWSConfig {
+	return AWSConfig{
+		Region:          firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), DefaultAWSRegion),
+		Endpoint:        firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_EC2"), os.Getenv("AWS_ENDPOINT_URL")),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Deployment:      deployment,
+		InstanceType:    firstNonEmpty(os.Getenv("SHELLBOX_AWS_INSTANCE_TYPE"), DefaultAWSInstanceType),
+		SubnetID:        os.Getenv("SHELLBOX_AWS_SUBNET_ID"),
+		SecurityGroupID: os.Getenv("SHELLBOX_AWS_SECURITY_GROUP_ID"),
+		BaseImageID:     os.Getenv("SHELLBOX_AWS_BASE_IMAGE_ID"),
+		DataDir:         DefaultLocalDataDir,
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// nestedVirtCapable reports whether instanceType exposes hardware virtualization to the
+// guest, which QEMU boxes need for KVM
+func nestedVirtCapable(instanceType string) bool {
+	return strings.Contains(instanceType, ".metal")
+}
+
+// AWSError is an error returned by the EC2 API
+type AWSError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *AWSError) Error() string {
+	return fmt.Sprintf("%s: %s (status %d, request %s)", e.Code, e.Message, e.StatusCode, e.RequestID)
+}
+
+// isAWSNotFound reports whether err says the resource it names does not exist
+func isAWSNotFound(err error) bool {
+	var awsErr *AWSError
+	return errors.As(err, &awsErr) && strings.HasSuffix(awsErr.Code, ".NotFound")
+}
+
+// EC2Client calls the EC2 Query API, signing requests with Signature Version 4
+type EC2Client struct {
+	config     AWSConfig
+	endpoint   string
+	service    string // signing service name
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewEC2Client creates an EC2 API client for config.Region, or config.Endpoint if set
+func NewEC2Client(config AWSConfig) (*EC2Client, error) {
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS credentials are not configured")
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", config.Region)
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid EC2 endpoint %q: %w", endpoint, err)
+	}
+	return &EC2Client{
+		config:     config,
+		endpoint:   endpoint,
+		service:    awsSigningService,
+		httpClient: &http.Client{Timeout: awsRequestTimeout},
+		now:        time.Now,
+	}, nil
+}
+
+// Call runs action with params and decodes the XML response into out, which may be nil
+func (c *EC2Client) Call(ctx context.Context, action string, params url.Values, out any) error {
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("Action", action)
+	form.Set("Version", awsEC2APIVersion)
+	body := form.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", action, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.sign(req, body)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseAWSError(resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", action, err)
+	}
+	return nil
+}
+
+// parseAWSError decodes an EC2 error response
+func parseAWSError(statusCode int, data []byte) error {
+	var response struct {
+		Errors []struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Errors>Error"`
+		RequestID string `xml:"RequestID"`
+	}
+	if err := xml.Unmarshal(data, &response); err != nil || len(response.Errors) == 0 {
+		return &AWSError{StatusCode: statusCode, Code: "Unknown", Message: strings.TrimSpace(string(data))}
+	}
+	return &AWSError{
+		StatusCode: statusCode,
+		Code:       response.Errors[0].Code,
+		Message:    response.Errors[0].Message,
+		RequestID:  response.RequestID,
+	}
+}
+
+// sign adds Signature Version 4 headers for a POST of body to req
+func (c *EC2Client) sign(req *http.Request, body string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.config.SessionToken)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-date"}
+	if c.config.SessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		path,
+		"",
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, c.config.Region, c.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{awsSigningScheme, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := awsSigningKey(c.config.SecretAccessKey, date, c.config.Region, c.service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningScheme, c.config.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// awsSigningKey derives the Signature Version 4 key for date, region and service
+func awsSigningKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// ec2Params builds Query API parameters
+type ec2Params url.Values
+
+func (p ec2Params) set(key, value string) ec2Params {
+	p.values().Set(key, value)
+	return p
+}
+
+func (p ec2Params) values() url.Values {
+	return url.Values(p)
+}
+
+// filter adds a Filter.N parameter matching any of values
+func (p ec2Params) filter(name string, values ...string) ec2Params {
+	n := 1
+	for p.values().Has(fmt.Sprintf("Filter.%d.Name", n)) {
+		n++
+	}
+	p.set(fmt.Sprintf("Filter.%d.Name", n), name)
+	for i, value := range values {
+		p.set(fmt.Sprintf("Filter.%d.Value.%d", n, i+1), value)
+	}
+	return p
+}
+
+// tagSpecification adds a TagSpecification.N parameter tagging resourceType at creation
+func (p ec2Params) tagSpecification(resourceType string, tags map[string]string) ec2Params {
+	n := 1
+	for p.values().Has(fmt.Sprintf("TagSpecification.%d.ResourceType", n)) {
+		n++
+	}
+	prefix := fmt.Sprintf("TagSpecification.%d.", n)
+	p.set(prefix+"ResourceType", resourceType)
+	i := 1
+	for key, value := range tags {
+		p.set(fmt.Sprintf("%sTag.%d.Key", prefix, i), key)
+		p.set(fmt.Sprintf("%sTag.%d.Value", prefix, i), value)
+		i++
+	}
+	return p
+}
+
+// ec2Tags is the tagSet of an EC2 resource
+type ec2Tags []struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+// Map returns the tags by key
+func (t ec2Tags) Map() map[string]string {
+	tags := make(map[string]string, len(t))
+	for _, tag := range t {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// ec2Instance is an instance in a DescribeInstances or RunInstances response
+type ec2Instance struct {
+	InstanceID       string    `xml:"instanceId"`
+	InstanceType     string    `xml:"instanceType"`
+	State            string    `xml:"instanceState>name"`
+	PrivateIPAddress string    `xml:"privateIpAddress"`
+	LaunchTime       time.Time `xml:"launchTime"`
+	BlockDevices     []struct {
+		DeviceName string `xml:"deviceName"`
+		VolumeID   string `xml:"ebs>volumeId"`
+	} `xml:"blockDeviceMapping>item"`
+	Tags ec2Tags `xml:"tagSet>item"`
+}
+
+// ec2Volume is a volume in a DescribeVolumes or CreateVolume response
+type ec2Volume struct {
+	VolumeID    string    `xml:"volumeId"`
+	Size        int32     `xml:"size"`
+	State       string    `xml:"status"`
+	CreateTime  time.Time `xml:"createTime"`
+	Attachments []struct {
+		InstanceID string `xml:"instanceId"`
+		State      string `xml:"status"`
+	} `xml:"attachmentSet>item"`
+	Tags ec2Tags `xml:"tagSet>item"`
+}
+
+// ec2Image is an AMI in a DescribeImages response
+type ec2Image struct {
+	ImageID      string `xml:"imageId"`
+	Name         string `xml:"name"`
+	State        string `xml:"imageState"`
+	CreationDate string `xml:"creationDate"`
+	BlockDevices []struct {
+		DeviceName string `xml:"deviceName"`
+		VolumeSize int32  `xml:"ebs>volumeSize"`
+	} `xml:"blockDeviceMapping>item"`
+}
+
+// ec2Snapshot is an EBS snapshot in a DescribeSnapshots response
+type ec2Snapshot struct {
+	SnapshotID string    `xml:"snapshotId"`
+	State      string    `xml:"status"`
+	VolumeSize int32     `xml:"volumeSize"`
+	StartTime  time.Time `xml:"startTime"`
+}
+
+// DescribeInstances returns the instances matching params, following pagination
+func (c *EC2Client) DescribeInstances(ctx context.Context, params ec2Params) ([]ec2Instance, error) {
+	var instances []ec2Instance
+	for {
+		var response struct {
+			Reservations []struct {
+				Instances []ec2Instance `xml:"instancesSet>item"`
+			} `xml:"reservationSet>item"`
+			NextToken string `xml:"nextToken"`
+		}
+		if err := c.Call(ctx, "DescribeInstances", params.values(), &response); err != nil {
+			return nil, err
+		}
+		for _, reservation := range response.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		if response.NextToken == "" {
+			return instances, nil
+		}
+		params.set("NextToken", response.NextToken)
+	}
+}
+
+// DescribeVolumes returns the volumes matching params, following pagination
+func (c *EC2Client) DescribeVolumes(ctx context.Context, params ec2Params) ([]ec2Volume, error) {
+	var volumes []ec2Volume
+	for {
+		var response struct {
+			Volumes   []ec2Volume `xml:"volumeSet>item"`
+			NextToken string      `xml:"nextToken"`
+		}
+		if err := c.Call(ctx, "DescribeVolumes", params.values(), &response); err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, response.Volumes...)
+		if response.NextToken == "" {
+			return volumes, nil
+		}
+		params.set("NextToken", response.NextToken)
+	}
+}
+
+// DescribeImages returns the AMIs matching params
+func (c *EC2Client) DescribeImages(ctx context.Context, params ec2Params) ([]ec2Image, error) {
+	var response struct {
+		Images []ec2Image `xml:"imagesSet>item"`
+	}
+	if err := c.Call(ctx, "DescribeImages", params.values(), &response); err != nil {
+		return nil, err
+	}
+	return response.Images, nil
+}
+
+// DescribeSnapshots returns the snapshots matching params, following pagination
+func (c *EC2Client) DescribeSnapshots(ctx context.Context, params ec2Params) ([]ec2Snapshot, error) {
+	var snapshots []ec2Snapshot
+	for {
+		var response struct {
+			Snapshots []ec2Snapshot `xml:"snapshotSet>item"`
+			NextToken string        `xml:"nextToken"`
+		}
+		if err := c.Call(ctx, "DescribeSnapshots", params.values(), &response); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, response.Snapshots...)
+		if response.NextToken == "" {
+			return snapshots, nil
+		}
+		params.set("NextToken", response.NextToken)
+	}
+}
+
+// CreateTags sets tags on the EC2 resource resourceID
+func (c *EC2Client) CreateTags(ctx context.Context, resourceID string, tags map[string]string) error {
+	params := ec2Params{}.set("ResourceId.1", resourceID)
+	i := 1
+	for key, value := range tags {
+		params.set(fmt.Sprintf("Tag.%d.Key", i), key)
+		params.set(fmt.Sprintf("Tag.%d.Value", i), value)
+		i++
+	}
+	return c.Call(ctx, "CreateTags", params.values(), nil)
+}
+
+// DeleteTags removes the tags with the given keys from the EC2 resource resourceID
+func (c *EC2Client) DeleteTags(ctx context.Context, resourceID string, keys ...string) error {
+	params := ec2Params{}.set("ResourceId.1", resourceID)
+	for i, key := range keys {
+		params.set("Tag."+strconv.Itoa(i+1)+".Key", key)
+	}
+	return c.Call(ctx, "DeleteTags", params.values(), nil)
+}
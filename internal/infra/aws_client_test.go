@@ -0,0 +1,395 @@
+package infra
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The expected values below are the examples of the AWS Signature Version 4 documentation
+// and test suite
+const (
+	awsExampleAccessKeyID     = "AKIDEXAMPLE"
+	awsExampleSecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func TestAWSSigningKey(t *testing.T) {
+	key := awsSigningKey(awsExampleSecretAccessKey, "20120215", "us-east-1", "iam")
+	if got, want := hex.EncodeToString(key), "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Fatalf("got signing key %s, want %s", got, want)
+	}
+}
+
+func TestAWSSignFormPost(t *testing.T) {
+	client := &EC2Client{
+		config:  AWSConfig{Region: "us-east-1", AccessKeyID: awsExampleAccessKeyID, SecretAccessKey: awsExampleSecretAccessKey},
+		service: "service",
+		now:     func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	}
+	body := "Param1=value1"
+	req := httptest.NewRequest(http.MethodPost, "https://example.amazonaws.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client.sign(req, body)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("got Authorization\n  %s\nwant\n  %s", got, want)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Fatalf("got X-Amz-Date %s, want 20150830T123600Z", got)
+	}
+
+	// Temporary credentials sign their session token too
+	client.config.SessionToken = "token"
+	req = httptest.NewRequest(http.MethodPost, "https://example.amazonaws.com/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client.sign(req, body)
+	if req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Fatalf("session token header not set")
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token,") {
+		t.Fatalf("session token not signed: %s", req.Header.Get("Authorization"))
+	}
+}
+
+// fakeEC2 serves the EC2 Query API actions the provider uses for instances and volumes
+type fakeEC2 struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	calls     []url.Values            // form of each request, in order
+	instances map[string]string       // state by instance ID
+	volumes   map[string]string       // state by EBS volume ID
+	volumeTag map[string]string       // volumeid tag by EBS volume ID
+	failures  map[string]fakeEC2Error // error responses by action
+}
+
+type fakeEC2Error struct {
+	status int
+	body   string
+}
+
+func newFakeEC2(t *testing.T) (*fakeEC2, *EC2Client) {
+	fake := &fakeEC2{
+		t:         t,
+		instances: make(map[string]string),
+		volumes:   make(map[string]string),
+		volumeTag: make(map[string]string),
+		failures:  make(map[string]fakeEC2Error),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := NewEC2Client(AWSConfig{
+		Region:          "us-west-2",
+		Endpoint:        server.URL + "/",
+		AccessKeyID:     awsExampleAccessKeyID,
+		SecretAccessKey: awsExampleSecretAccessKey,
+	})
+	if err != nil {
+		t.Fatalf("NewEC2Client: %v", err)
+	}
+	return fake, client
+}
+
+// fail makes action fail with status and body
+func (f *fakeEC2) fail(action string, status int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[action] = fakeEC2Error{status, body}
+}
+
+// volumeState returns the state of the EBS volume ebsID
+func (f *fakeEC2) volumeState(ebsID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.volumes[ebsID]
+}
+
+// calledActions returns the actions called so far, in order
+func (f *fakeEC2) calledActions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var actions []string
+	for _, form := range f.calls {
+		actions = append(actions, form.Get("Action"))
+	}
+	return actions
+}
+
+// call returns the form of the first call of action
+func (f *fakeEC2) call(action string) url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, form := range f.calls {
+		if form.Get("Action") == action {
+			return form
+		}
+	}
+	f.t.Fatalf("%s was not called", action)
+	return nil
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost || form.Get("Version") != awsEC2APIVersion {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(auth, "/us-west-2/ec2/aws4_request") {
+		http.Error(w, "unsigned request: "+auth, http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, form)
+	action := form.Get("Action")
+	if failure, ok := f.failures[action]; ok {
+		w.WriteHeader(failure.status)
+		_, _ = io.WriteString(w, failure.body)
+		return
+	}
+
+	var response string
+	switch action {
+	case "RunInstances":
+		instanceID := fmt.Sprintf("i-%04d", len(f.instances)+1)
+		f.instances[instanceID] = "pending"
+		response = fmt.Sprintf(`<instancesSet><item><instanceId>%s</instanceId><instanceState><name>pending</name></instanceState></item></instancesSet>`, instanceID)
+	case "DescribeInstances":
+		instanceID := form.Get("InstanceId.1")
+		state, ok := f.instances[instanceID]
+		if !ok {
+			response = `<reservationSet/>`
+			break
+		}
+		// Instances come up after one look
+		f.instances[instanceID] = "running"
+		response = fmt.Sprintf(`<reservationSet><item><instancesSet><item><instanceId>%s</instanceId><instanceState><name>%s</name></instanceState><privateIpAddress>10.0.0.5</privateIpAddress></item></instancesSet></item></reservationSet>`, instanceID, state)
+	case "CreateVolume":
+		ebsID := fmt.Sprintf("vol-%04d", len(f.volumes)+1)
+		f.volumes[ebsID] = "creating"
+		for key, values := range form {
+			if strings.HasSuffix(key, ".Key") && values[0] == TagKeyVolumeID {
+				f.volumeTag[ebsID] = form.Get(strings.TrimSuffix(key, ".Key") + ".Value")
+			}
+		}
+		response = fmt.Sprintf(`<volumeId>%s</volumeId><status>creating</status>`, ebsID)
+	case "DescribeVolumes":
+		var items strings.Builder
+		for ebsID, state := range f.volumes {
+			if !f.volumeMatches(form, ebsID) {
+				continue
+			}
+			fmt.Fprintf(&items, `<item><volumeId>%s</volumeId><status>%s</status></item>`, ebsID, state)
+			// Volumes finish their transition after one look
+			switch state {
+			case "creating":
+				f.volumes[ebsID] = "available"
+			case "attaching":
+				f.volumes[ebsID] = "in-use"
+			}
+		}
+		response = `<volumeSet>` + items.String() + `</volumeSet>`
+	case "AttachVolume":
+		ebsID := form.Get("VolumeId")
+		if f.volumes[ebsID] != "available" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, `<Response><Errors><Error><Code>IncorrectState</Code><Message>%s is %s</Message></Error></Errors><RequestID>r-1</RequestID></Response>`, ebsID, f.volumes[ebsID])
+			return
+		}
+		f.volumes[ebsID] = "attaching"
+		response = `<status>attaching</status>`
+	case "CreateTags", "TerminateInstances":
+	default:
+		http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+		return
+	}
+	_, _ = fmt.Fprintf(w, `<%[1]sResponse xmlns="http://ec2.amazonaws.com/doc/%[2]s/"><requestId>r-1</requestId>%[3]s</%[1]sResponse>`,
+		action, awsEC2APIVersion, response)
+}
+
+// volumeMatches applies the VolumeId.1 parameter and the volumeid tag filter of a
+// DescribeVolumes request
+func (f *fakeEC2) volumeMatches(form url.Values, ebsID string) bool {
+	if id := form.Get("VolumeId.1"); id != "" && id != ebsID {
+		return false
+	}
+	for n := 1; form.Has(fmt.Sprintf("Filter.%d.Name", n)); n++ {
+		if form.Get(fmt.Sprintf("Filter.%d.Name", n)) == "tag:"+TagKeyVolumeID &&
+			form.Get(fmt.Sprintf("Filter.%d.Value.1", n)) != f.volumeTag[ebsID] {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestAWSProvider(client *EC2Client) *AWSProvider {
+	return &AWSProvider{
+		config:           AWSConfig{Deployment: "test", SubnetID: "subnet-1", SecurityGroupID: "sg-1"},
+		ec2:              client,
+		namer:            NewResourceNamer("test"),
+		instancePoll:     time.Millisecond,
+		volumePoll:       time.Millisecond,
+		availabilityZone: "us-west-2a",
+	}
+}
+
+func TestAWSCreateInstance(t *testing.T) {
+	fake, client := newFakeEC2(t)
+	aws := newTestAWSProvider(client)
+
+	instanceID, err := aws.CreateInstance(context.Background(), &VMConfig{
+		VMSize:        "m5zn.metal",
+		OSImageID:     "ami-1",
+		AdminUsername: "shellbox",
+		SSHPublicKey:  "ssh-ed25519 AAAA",
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	}
+	if instanceID != "i-0001" {
+		t.Fatalf("got instance %s, want i-0001", instanceID)
+	}
+
+	run := fake.call("RunInstances")
+	for key, want := range map[string]string{
+		"ImageId":                         "ami-1",
+		"InstanceType":                    "m5zn.metal",
+		"SubnetId":                        "subnet-1",
+		"SecurityGroupId.1":               "sg-1",
+		"MetadataOptions.HttpTokens":      "required",
+		"TagSpecification.1.ResourceType": "instance",
+		"UserData":                        instanceUserData(&VMConfig{AdminUsername: "shellbox", SSHPublicKey: "ssh-ed25519 AAAA"}),
+	} {
+		if got := run.Get(key); got != want {
+			t.Errorf("RunInstances %s = %q, want %q", key, got, want)
+		}
+	}
+	tags := make(map[string]string)
+	for i := 1; run.Has(fmt.Sprintf("TagSpecification.1.Tag.%d.Key", i)); i++ {
+		tags[run.Get(fmt.Sprintf("TagSpecification.1.Tag.%d.Key", i))] = run.Get(fmt.Sprintf("TagSpecification.1.Tag.%d.Value", i))
+	}
+	if tags[TagKeyDeployment] != "test" || tags[TagKeyRole] != ResourceRoleInstance || tags[TagKeyStatus] != ResourceStatusFree {
+		t.Errorf("got instance tags %v, want this deployment's free instance", tags)
+	}
+	if fake.call("CreateTags").Get("ResourceId.1") != instanceID {
+		t.Errorf("instance ID tags not set on %s", instanceID)
+	}
+
+	ip, err := aws.GetInstancePrivateIP(context.Background(), instanceID)
+	if err != nil || ip != "10.0.0.5" {
+		t.Fatalf("GetInstancePrivateIP = %q, %v, want 10.0.0.5", ip, err)
+	}
+}
+
+func TestAWSCreateInstanceFailure(t *testing.T) {
+	fake, client := newFakeEC2(t)
+	aws := newTestAWSProvider(client)
+	fake.fail("CreateTags", http.StatusServiceUnavailable, "try again later")
+
+	_, err := aws.CreateInstance(context.Background(), &VMConfig{OSImageID: "ami-1"})
+	var awsErr *AWSError
+	if !errors.As(err, &awsErr) || awsErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want the service's error", err)
+	}
+	if awsErr.Code != "Unknown" || awsErr.Message != "try again later" {
+		t.Errorf("got %+v, want a non-XML error kept as its message", awsErr)
+	}
+	if fake.call("TerminateInstances").Get("InstanceId.1") != "i-0001" {
+		t.Errorf("instance that failed to start was not terminated")
+	}
+}
+
+func TestAWSCreateAndAttachVolume(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeEC2(t)
+	aws := newTestAWSProvider(client)
+
+	err := aws.CreateVolumeFromSnapshot(ctx, "snap-1", &VolumeTags{
+		Role:     ResourceRoleVolume,
+		Status:   ResourceStatusFree,
+		VolumeID: "volume-1",
+	})
+	if err != nil {
+		t.Fatalf("CreateVolumeFromSnapshot: %v", err)
+	}
+	create := fake.call("CreateVolume")
+	for key, want := range map[string]string{
+		"SnapshotId":                      "snap-1",
+		"AvailabilityZone":                "us-west-2a",
+		"VolumeType":                      "gp3",
+		"TagSpecification.1.ResourceType": "volume",
+	} {
+		if got := create.Get(key); got != want {
+			t.Errorf("CreateVolume %s = %q, want %q", key, got, want)
+		}
+	}
+
+	if err := aws.AttachVolume(ctx, "i-0001", "volume-1"); err != nil {
+		t.Fatalf("AttachVolume: %v", err)
+	}
+	attach := fake.call("AttachVolume")
+	if attach.Get("VolumeId") != "vol-0001" || attach.Get("InstanceId") != "i-0001" || attach.Get("Device") != awsDataDeviceName {
+		t.Errorf("got AttachVolume %v, want vol-0001 on i-0001 as %s", attach, awsDataDeviceName)
+	}
+	if state := fake.volumeState("vol-0001"); state != "in-use" {
+		t.Errorf("volume is %s after AttachVolume returned, want in-use", state)
+	}
+
+	// Attaching an attached volume fails with EC2's error
+	err = aws.AttachVolume(ctx, "i-0002", "volume-1")
+	var awsErr *AWSError
+	if !errors.As(err, &awsErr) {
+		t.Fatalf("got %v, want an AWSError", err)
+	}
+	if awsErr.StatusCode != http.StatusBadRequest || awsErr.Code != "IncorrectState" ||
+		awsErr.Message != "vol-0001 is in-use" || awsErr.RequestID != "r-1" {
+		t.Errorf("got %+v, want the parsed XML error", awsErr)
+	}
+
+	if err := aws.AttachVolume(ctx, "i-0001", "volume-unknown"); err == nil {
+		t.Fatalf("attaching an unknown volume succeeded")
+	}
+	if actions := fake.calledActions(); actions[len(actions)-1] != "DescribeVolumes" {
+		t.Errorf("attach of an unknown volume called %s, want only the lookup", actions[len(actions)-1])
+	}
+}
+
+func TestAWSNotFoundErrors(t *testing.T) {
+	fake, client := newFakeEC2(t)
+	aws := newTestAWSProvider(client)
+	fake.fail("TerminateInstances", http.StatusBadRequest,
+		`<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>gone</Message></Error></Errors><RequestID>r-2</RequestID></Response>`)
+
+	err := client.Call(context.Background(), "TerminateInstances", ec2Params{}.set("InstanceId.1", "i-9").values(), nil)
+	if !isAWSNotFound(err) {
+		t.Fatalf("got %v, want a not found error", err)
+	}
+	if err := aws.DeleteInstance(context.Background(), "i-9"); err != nil {
+		t.Fatalf("deleting a missing instance: %v", err)
+	}
+
+	fake.fail("TerminateInstances", http.StatusForbidden,
+		`<Response><Errors><Error><Code>UnauthorizedOperation</Code><Message>denied</Message></Error></Errors><RequestID>r-3</RequestID></Response>`)
+	if err := aws.DeleteInstance(context.Background(), "i-9"); err == nil || isAWSNotFound(err) {
+		t.Fatalf("got %v, want the authorization error", err)
+	}
+}
@@ -0,0 +1,297 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"shellbox/internal/sshutil"
+)
+
+// EnsureGoldenSnapshot implements SnapshotProvider. The golden artifacts are an AMI of a
+// builder instance with QEMU installed and a snapshot of its data volume holding the saved
+// box. Like the Azure ones they are named by a hash of the build script and shared by all
+// deployments in the account.
+func (a *AWSProvider) EnsureGoldenSnapshot(ctx context.Context) (*GoldenSnapshotInfo, error) {
+	_, sshPublicKey, err := sshutil.LoadKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key: %w", err)
+	}
+
+	dataSnapshotName, osSnapshotName, err := generateGoldenSnapshotNames(sshPublicKey, AWSDataDisk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate snapshot names: %w", err)
+	}
+	imageName := osSnapshotName + "-image"
+
+	slog.Info("Checking for existing golden snapshot and AMI", "dataSnapshot", dataSnapshotName, "image", imageName)
+	snapshots, err := a.ec2.DescribeSnapshots(ctx, ec2Params{}.
+		set("Owner.1", "self").
+		filter("tag:Name", dataSnapshotName).
+		filter("status", "completed"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up golden snapshot: %w", err)
+	}
+	images, err := a.ec2.DescribeImages(ctx, ec2Params{}.
+		set("Owner.1", "self").
+		filter("name", imageName).
+		filter("state", "available"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up golden image: %w", err)
+	}
+	if len(snapshots) > 0 && len(images) > 0 {
+		slog.Info("Found existing golden snapshot and AMI", "snapshotID", snapshots[0].SnapshotID, "imageID", images[0].ImageID)
+		return a.goldenSnapshotInfo(dataSnapshotName, imageName, &snapshots[0], &images[0]), nil
+	}
+
+	slog.Info("Golden artifacts not found, building them", "dataSnapshot", dataSnapshotName, "image", imageName)
+	builderID, err := a.launchGoldenBuilder(ctx, sshPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		slog.Info("Terminating golden builder", "instanceID", builderID)
+		if err := a.DeleteInstance(context.WithoutCancel(ctx), builderID); err != nil {
+			slog.Warn("Failed to terminate golden builder", "instanceID", builderID, "error", err)
+		}
+	}()
+
+	builder, err := a.waitForInstanceState(ctx, builderID, "running")
+	if err != nil {
+		return nil, fmt.Errorf("golden builder did not start: %w", err)
+	}
+
+	slog.Info("Waiting for QEMU setup to complete on golden builder")
+	if err := waitForQEMUReady(ctx, nil, &tempBoxInfo{VMName: builderID, PrivateIP: builder.PrivateIPAddress}); err != nil {
+		return nil, fmt.Errorf("failed waiting for QEMU setup: %w", err)
+	}
+
+	snapshot, image, err := a.captureGoldenArtifacts(ctx, builder, dataSnapshotName, imageName)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Golden artifacts created", "snapshotID", snapshot.SnapshotID, "imageID", image.ImageID)
+	return a.goldenSnapshotInfo(dataSnapshotName, imageName, snapshot, image), nil
+}
+
+func (a *AWSProvider) goldenSnapshotInfo(dataSnapshotName, imageName string, snapshot *ec2Snapshot, image *ec2Image) *GoldenSnapshotInfo {
+	info := &GoldenSnapshotInfo{
+		DataSnapshotName:       dataSnapshotName,
+		DataSnapshotResourceID: snapshot.SnapshotID,
+		OSImageName:            imageName,
+		OSImageResourceID:      image.ImageID,
+		Location:               a.config.Region,
+		CreatedTime:            snapshot.StartTime,
+		DataSizeGB:             snapshot.VolumeSize,
+	}
+	if len(image.BlockDevices) > 0 {
+		info.OSSizeGB = image.BlockDevices[0].VolumeSize
+	}
+	return info
+}
+
+// launchGoldenBuilder starts an instance from the Ubuntu base image with an empty data
+// volume, running the QEMU setup script
+func (a *AWSProvider) launchGoldenBuilder(ctx context.Context, sshPublicKey string) (string, error) {
+	baseImageID, err := a.baseImageID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	script, err := GenerateQEMUInitScript(goldenScriptConfig(sshPublicKey, AWSDataDisk))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate QEMU setup script: %w", err)
+	}
+	userData, err := goldenBuilderUserData(sshPublicKey, script)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s%d", TempGoldenVMPrefix, time.Now().Unix())
+	params := ec2Params{}.
+		set("ImageId", baseImageID).
+		set("InstanceType", a.config.InstanceType).
+		set("MinCount", "1").
+		set("MaxCount", "1").
+		set("SubnetId", a.config.SubnetID).
+		set("SecurityGroupId.1", a.config.SecurityGroupID).
+		set("UserData", userData).
+		set("MetadataOptions.HttpTokens", "required").
+		set("BlockDeviceMapping.1.DeviceName", awsDataDeviceName).
+		set("BlockDeviceMapping.1.Ebs.VolumeSize", strconv.Itoa(DefaultVolumeSizeGB)).
+		set("BlockDeviceMapping.1.Ebs.VolumeType", "gp3").
+		set("BlockDeviceMapping.1.Ebs.DeleteOnTermination", "true").
+		tagSpecification("instance", map[string]string{
+			"Name":              name,
+			GoldenTagKeyRole:    GoldenRoleTempVM,
+			GoldenTagKeyPurpose: "golden-snapshot-creation",
+			GoldenTagKeyCreated: time.Now().UTC().Format(time.RFC3339),
+		})
+
+	var response struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	}
+	if err := a.ec2.Call(ctx, "RunInstances", params.values(), &response); err != nil {
+		return "", fmt.Errorf("failed to launch golden builder: %w", err)
+	}
+	if len(response.Instances) == 0 {
+		return "", fmt.Errorf("RunInstances returned no instance")
+	}
+	slog.Info("Launched golden builder", "instanceID", response.Instances[0].InstanceID, "baseImage", baseImageID)
+	return response.Instances[0].InstanceID, nil
+}
+
+// baseImageID returns the configured base AMI, or the latest Ubuntu 24.04 one
+func (a *AWSProvider) baseImageID(ctx context.Context) (string, error) {
+	if a.config.BaseImageID != "" {
+		return a.config.BaseImageID, nil
+	}
+	images, err := a.ec2.DescribeImages(ctx, ec2Params{}.
+		set("Owner.1", awsUbuntuOwnerID).
+		filter("name", awsUbuntuImageName).
+		filter("state", "available"))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up Ubuntu image: %w", err)
+	}
+	if len(images) == 0 {
+		return "", fmt.Errorf("no Ubuntu 24.04 image found in %s", a.config.Region)
+	}
+	latest := slices.MaxFunc(images, func(x, y ec2Image) int {
+		return strings.Compare(x.CreationDate, y.CreationDate)
+	})
+	return latest.ImageID, nil
+}
+
+// goldenBuilderUserData combines a cloud-config creating the admin user the golden build
+// is driven over SSH as with the base64 encoded QEMU setup script
+func goldenBuilderUserData(sshPublicKey, encodedScript string) (string, error) {
+	script, err := base64.StdEncoding.DecodeString(encodedScript)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode QEMU setup script: %w", err)
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/cloud-config", fmt.Sprintf(`#cloud-config
+users:
+  - default
+  - name: %s
+    groups: [sudo]
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - '%s'
+`, AdminUsername, sshPublicKey)},
+		{"text/x-shellscript", string(script)},
+	}
+	for _, part := range parts {
+		w, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType + `; charset="us-ascii"`}})
+		if err != nil {
+			return "", fmt.Errorf("failed to build user data: %w", err)
+		}
+		if _, err := w.Write([]byte(part.content)); err != nil {
+			return "", fmt.Errorf("failed to build user data: %w", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to build user data: %w", err)
+	}
+
+	userData := fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n%s", writer.Boundary(), body.String())
+	return base64.StdEncoding.EncodeToString([]byte(userData)), nil
+}
+
+// captureGoldenArtifacts snapshots the builder's data volume and creates an AMI of its
+// root volume, waiting until both are ready
+func (a *AWSProvider) captureGoldenArtifacts(ctx context.Context, builder *ec2Instance, dataSnapshotName, imageName string) (*ec2Snapshot, *ec2Image, error) {
+	dataVolumeID := ""
+	for _, device := range builder.BlockDevices {
+		if device.DeviceName == awsDataDeviceName {
+			dataVolumeID = device.VolumeID
+		}
+	}
+	if dataVolumeID == "" {
+		return nil, nil, fmt.Errorf("golden builder %s has no data volume", builder.InstanceID)
+	}
+
+	created := time.Now().UTC().Format(time.RFC3339)
+	var snapshotResponse struct {
+		SnapshotID string `xml:"snapshotId"`
+	}
+	err := a.ec2.Call(ctx, "CreateSnapshot", ec2Params{}.
+		set("VolumeId", dataVolumeID).
+		set("Description", "shellbox golden data volume").
+		tagSpecification("snapshot", map[string]string{
+			"Name":              dataSnapshotName,
+			GoldenTagKeyRole:    GoldenRoleSnapshot,
+			GoldenTagKeyPurpose: "qemu-data-volume",
+			GoldenTagKeyCreated: created,
+		}).values(), &snapshotResponse)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to snapshot golden data volume: %w", err)
+	}
+
+	// The data volume is left out of the AMI; pool instances get theirs attached per box
+	var imageResponse struct {
+		ImageID string `xml:"imageId"`
+	}
+	err = a.ec2.Call(ctx, "CreateImage", ec2Params{}.
+		set("InstanceId", builder.InstanceID).
+		set("Name", imageName).
+		set("BlockDeviceMapping.1.DeviceName", awsDataDeviceName).
+		set("BlockDeviceMapping.1.NoDevice", "").
+		tagSpecification("image", map[string]string{
+			"Name":              imageName,
+			GoldenTagKeyRole:    GoldenRoleImage,
+			GoldenTagKeyPurpose: "qemu-os-image",
+			GoldenTagKeyCreated: created,
+		}).values(), &imageResponse)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create golden image: %w", err)
+	}
+
+	var snapshot ec2Snapshot
+	err = RetryOperation(ctx, func(ctx context.Context) error {
+		snapshots, err := a.ec2.DescribeSnapshots(ctx, ec2Params{}.set("SnapshotId.1", snapshotResponse.SnapshotID))
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 || snapshots[0].State != "completed" {
+			return fmt.Errorf("snapshot %s not completed yet", snapshotResponse.SnapshotID)
+		}
+		snapshot = snapshots[0]
+		return nil
+	}, AWSGoldenArtifactTimeout, 30*time.Second, "golden snapshot completion")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var image ec2Image
+	err = RetryOperation(ctx, func(ctx context.Context) error {
+		images, err := a.ec2.DescribeImages(ctx, ec2Params{}.set("ImageId.1", imageResponse.ImageID))
+		if err != nil {
+			return err
+		}
+		if len(images) == 0 || images[0].State != "available" {
+			return fmt.Errorf("image %s not available yet", imageResponse.ImageID)
+		}
+		image = images[0]
+		return nil
+	}, AWSGoldenArtifactTimeout, 30*time.Second, "golden image availability")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &snapshot, &image, nil
+}
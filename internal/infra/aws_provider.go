@@ -0,0 +1,560 @@
+package infra
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// AWS wait timeouts
+const (
+	AWSInstanceStartTimeout  = 10 * time.Minute
+	AWSVolumeStateTimeout    = 5 * time.Minute
+	AWSGoldenArtifactTimeout = 2 * time.Hour // EBS snapshots of fresh volumes copy every block
+
+	awsInstancePollInterval = 5 * time.Second
+	awsVolumePollInterval   = 2 * time.Second
+)
+
+// awsLiveInstanceStates are the instance states counted as part of the pool
+var awsLiveInstanceStates = []string{"pending", "running", "stopping", "stopped"}
+
+// AWSProvider implements the provider interfaces on EC2: instances for compute, EBS
+// volumes for box state, an AMI and an EBS snapshot as golden artifacts, and the
+// shellbox:* tags on instances and volumes as the inventory. Allocations and events are
+// kept by the embedded FileStore.
+type AWSProvider struct {
+	*FileStore
+	config AWSConfig
+	ec2    *EC2Client
+	namer  *ResourceNamer
+
+	instancePoll time.Duration // how often waits check instance and volume states
+	volumePoll   time.Duration
+
+	availabilityZone string // zone of config.SubnetID, set by EnsureNetwork
+}
+
+// NewAWSProvider creates a Provider backed by EC2. Point config.Endpoint at a local AWS
+// API stand-in to run it without an AWS account.
+func NewAWSProvider(config AWSConfig) (*Provider, error) {
+	if !nestedVirtCapable(config.InstanceType) {
+		slog.Warn("instance type may not support nested virtualization, VM boxes need a metal type", "instanceType", config.InstanceType)
+	}
+
+	client, err := NewEC2Client(config)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewFileStore(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	aws := &AWSProvider{
+		FileStore: store,
+		config:    config,
+		ec2:       client,
+		namer:     NewResourceNamer(config.Deployment),
+
+		instancePoll: awsInstancePollInterval,
+		volumePoll:   awsVolumePollInterval,
+	}
+
+	return &Provider{
+		Compute:     aws,
+		Volumes:     aws,
+		Snapshots:   aws,
+		Network:     aws,
+		Inventory:   aws,
+		Allocations: aws,
+		// Without a shared table claims can only protect against races within this process
+		Claims:     NewMemoryClaimStore(),
+		Events:     aws,
+		Runtime:    NewQEMUManager(AWSDataDisk, QEMUNetworkUser),
+		BridgedVMs: NewQEMUManager(AWSDataDisk, QEMUNetworkTap),
+		Containers: NewContainerManager(sshContainerHost{dataDisk: AWSDataDisk.Path}),
+	}, nil
+}
+
+// deploymentFilter restricts a query to this deployment's resources with the given role
+func (a *AWSProvider) deploymentFilter(role string) ec2Params {
+	return ec2Params{}.
+		filter("tag:"+TagKeyDeployment, a.config.Deployment).
+		filter("tag:"+TagKeyRole, role)
+}
+
+// instanceUserData is the cloud-config pool instances boot with, authorizing the server's
+// key for the admin user the golden image was built with
+func instanceUserData(config *VMConfig) string {
+	userData := fmt.Sprintf(`#cloud-config
+users:
+  - name: %s
+    groups: [sudo]
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - '%s'
+`, config.AdminUsername, config.SSHPublicKey)
+	return base64.StdEncoding.EncodeToString([]byte(userData))
+}
+
+// CreateInstance implements ComputeProvider by launching config.OSImageID and waiting
+// until it runs. The EC2 instance ID is the instanceID.
+func (a *AWSProvider) CreateInstance(ctx context.Context, config *VMConfig) (string, error) {
+	if config.OSImageID == "" {
+		return "", fmt.Errorf("AWS instances need the golden image")
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	params := ec2Params{}.
+		set("ImageId", config.OSImageID).
+		set("InstanceType", config.VMSize).
+		set("MinCount", "1").
+		set("MaxCount", "1").
+		set("SubnetId", a.config.SubnetID).
+		set("SecurityGroupId.1", a.config.SecurityGroupID).
+		set("UserData", instanceUserData(config)).
+		set("MetadataOptions.HttpTokens", "required").
+		tagSpecification("instance", map[string]string{
+			TagKeyDeployment: a.config.Deployment,
+			TagKeyRole:       ResourceRoleInstance,
+			TagKeyStatus:     ResourceStatusFree,
+			TagKeyCreated:    now,
+			TagKeyLastUsed:   now,
+		})
+
+	var response struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	}
+	if err := a.ec2.Call(ctx, "RunInstances", params.values(), &response); err != nil {
+		return "", fmt.Errorf("failed to run instance: %w", err)
+	}
+	if len(response.Instances) == 0 {
+		return "", fmt.Errorf("RunInstances returned no instance")
+	}
+	instanceID := response.Instances[0].InstanceID
+
+	// Name and instanceid tags can only be set once EC2 assigned the ID
+	tags := map[string]string{
+		"Name":           a.namer.BoxVMName(instanceID),
+		TagKeyInstanceID: instanceID,
+	}
+	err := a.ec2.CreateTags(ctx, instanceID, tags)
+	if err == nil {
+		_, err = a.waitForInstanceState(ctx, instanceID, "running")
+	}
+	if err != nil {
+		if cleanupErr := a.DeleteInstance(context.WithoutCancel(ctx), instanceID); cleanupErr != nil {
+			slog.Warn("Failed to terminate instance that did not start", "instanceID", instanceID, "error", cleanupErr)
+		}
+		return "", fmt.Errorf("instance %s did not start: %w", instanceID, err)
+	}
+	slog.Info("EC2 instance running", "instanceID", instanceID, "instanceType", config.VMSize)
+	return instanceID, nil
+}
+
+// waitForInstanceState polls instanceID until it reaches state
+func (a *AWSProvider) waitForInstanceState(ctx context.Context, instanceID, state string) (*ec2Instance, error) {
+	var instance *ec2Instance
+	err := RetryOperation(ctx, func(ctx context.Context) error {
+		var err error
+		instance, err = a.describeInstance(ctx, instanceID)
+		if err != nil {
+			return err
+		}
+		if instance.State != state {
+			return fmt.Errorf("instance %s is %s", instanceID, instance.State)
+		}
+		return nil
+	}, AWSInstanceStartTimeout, a.instancePoll, "EC2 instance "+state)
+	return instance, err
+}
+
+func (a *AWSProvider) describeInstance(ctx context.Context, instanceID string) (*ec2Instance, error) {
+	instances, err := a.ec2.DescribeInstances(ctx, ec2Params{}.set("InstanceId.1", instanceID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance %s: %w", instanceID, err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+	return &instances[0], nil
+}
+
+// DeleteInstance implements ComputeProvider
+func (a *AWSProvider) DeleteInstance(ctx context.Context, instanceID string) error {
+	err := a.ec2.Call(ctx, "TerminateInstances", ec2Params{}.set("InstanceId.1", instanceID).values(), nil)
+	if err != nil && !isAWSNotFound(err) {
+		return fmt.Errorf("failed to terminate instance %s: %w", instanceID, err)
+	}
+	return nil
+}
+
+// GetInstancePrivateIP implements ComputeProvider
+func (a *AWSProvider) GetInstancePrivateIP(ctx context.Context, instanceID string) (string, error) {
+	instance, err := a.describeInstance(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+	if instance.PrivateIPAddress == "" {
+		return "", fmt.Errorf("instance %s has no private IP", instanceID)
+	}
+	return instance.PrivateIPAddress, nil
+}
+
+// CreateVolumeFromSnapshot implements VolumeProvider by creating an EBS volume in the
+// instances' zone and waiting until it is available
+func (a *AWSProvider) CreateVolumeFromSnapshot(ctx context.Context, snapshotID string, tags *VolumeTags) error {
+	volumeTags := map[string]string{
+		"Name":           a.namer.VolumePoolDiskName(tags.VolumeID),
+		TagKeyDeployment: a.config.Deployment,
+		TagKeyRole:       tags.Role,
+		TagKeyStatus:     tags.Status,
+		TagKeyCreated:    tags.CreatedAt,
+		TagKeyLastUsed:   tags.LastUsed,
+		TagKeyVolumeID:   tags.VolumeID,
+	}
+	if tags.UserID != "" {
+		volumeTags[TagKeyUserID] = tags.UserID
+	}
+	if tags.BoxName != "" {
+		volumeTags[TagKeyBoxName] = tags.BoxName
+	}
+
+	params := ec2Params{}.
+		set("SnapshotId", snapshotID).
+		set("AvailabilityZone", a.availabilityZone).
+		set("VolumeType", "gp3").
+		tagSpecification("volume", volumeTags)
+
+	var volume ec2Volume
+	if err := a.ec2.Call(ctx, "CreateVolume", params.values(), &volume); err != nil {
+		return fmt.Errorf("failed to create volume %s: %w", tags.VolumeID, err)
+	}
+	return a.waitForVolumeState(ctx, volume.VolumeID, "available")
+}
+
+// waitForVolumeState polls the EBS volume ebsID until it reaches state
+func (a *AWSProvider) waitForVolumeState(ctx context.Context, ebsID, state string) error {
+	return RetryOperation(ctx, func(ctx context.Context) error {
+		volumes, err := a.ec2.DescribeVolumes(ctx, ec2Params{}.set("VolumeId.1", ebsID))
+		if err != nil {
+			return err
+		}
+		if len(volumes) == 0 {
+			return fmt.Errorf("volume %s not found", ebsID)
+		}
+		if volumes[0].State != state {
+			return fmt.Errorf("volume %s is %s", ebsID, volumes[0].State)
+		}
+		return nil
+	}, AWSVolumeStateTimeout, a.volumePoll, "EBS volume "+state)
+}
+
+// ebsVolume finds the EBS volume tagged with volumeID
+func (a *AWSProvider) ebsVolume(ctx context.Context, volumeID string) (*ec2Volume, error) {
+	volumes, err := a.ec2.DescribeVolumes(ctx, ec2Params{}.
+		filter("tag:"+TagKeyDeployment, a.config.Deployment).
+		filter("tag:"+TagKeyVolumeID, volumeID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up volume %s: %w", volumeID, err)
+	}
+	if len(volumes) == 0 {
+		return nil, fmt.Errorf("volume %s not found", volumeID)
+	}
+	return &volumes[0], nil
+}
+
+// DeleteVolume implements VolumeProvider
+func (a *AWSProvider) DeleteVolume(ctx context.Context, volumeID string) error {
+	volume, err := a.ebsVolume(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+	err = a.ec2.Call(ctx, "DeleteVolume", ec2Params{}.set("VolumeId", volume.VolumeID).values(), nil)
+	if err != nil && !isAWSNotFound(err) {
+		return fmt.Errorf("failed to delete volume %s: %w", volumeID, err)
+	}
+	return nil
+}
+
+// AttachVolume implements VolumeProvider
+func (a *AWSProvider) AttachVolume(ctx context.Context, instanceID, volumeID string) error {
+	volume, err := a.ebsVolume(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+	params := ec2Params{}.
+		set("VolumeId", volume.VolumeID).
+		set("InstanceId", instanceID).
+		set("Device", awsDataDeviceName)
+	if err := a.ec2.Call(ctx, "AttachVolume", params.values(), nil); err != nil {
+		return fmt.Errorf("failed to attach volume %s to %s: %w", volumeID, instanceID, err)
+	}
+	return a.waitForVolumeState(ctx, volume.VolumeID, "in-use")
+}
+
+// DetachVolume implements VolumeProvider
+func (a *AWSProvider) DetachVolume(ctx context.Context, instanceID, volumeID string) error {
+	volume, err := a.ebsVolume(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+	params := ec2Params{}.
+		set("VolumeId", volume.VolumeID).
+		set("InstanceId", instanceID)
+	if err := a.ec2.Call(ctx, "DetachVolume", params.values(), nil); err != nil {
+		return fmt.Errorf("failed to detach volume %s from %s: %w", volumeID, instanceID, err)
+	}
+	return a.waitForVolumeState(ctx, volume.VolumeID, "available")
+}
+
+// EnsureNetwork implements NetworkProvider by checking the configured subnet and security
+// group exist. The VPC itself is set up outside shellbox.
+func (a *AWSProvider) EnsureNetwork(ctx context.Context) error {
+	if a.config.SubnetID == "" || a.config.SecurityGroupID == "" {
+		return fmt.Errorf("AWS backend needs a subnet and a security group")
+	}
+
+	var subnets struct {
+		Subnets []struct {
+			AvailabilityZone string `xml:"availabilityZone"`
+		} `xml:"subnetSet>item"`
+	}
+	if err := a.ec2.Call(ctx, "DescribeSubnets", ec2Params{}.set("SubnetId.1", a.config.SubnetID).values(), &subnets); err != nil {
+		return fmt.Errorf("failed to describe subnet %s: %w", a.config.SubnetID, err)
+	}
+	if len(subnets.Subnets) == 0 {
+		return fmt.Errorf("subnet %s not found", a.config.SubnetID)
+	}
+	a.availabilityZone = subnets.Subnets[0].AvailabilityZone
+
+	if err := a.ec2.Call(ctx, "DescribeSecurityGroups", ec2Params{}.set("GroupId.1", a.config.SecurityGroupID).values(), nil); err != nil {
+		return fmt.Errorf("failed to describe security group %s: %w", a.config.SecurityGroupID, err)
+	}
+	return nil
+}
+
+// RegisterResource implements InventoryProvider by writing the entry's tags
+func (a *AWSProvider) RegisterResource(ctx context.Context, entry *ResourceRegistryEntity) error {
+	tags := map[string]string{
+		TagKeyDeployment: a.config.Deployment,
+		TagKeyRole:       entry.PartitionKey,
+		TagKeyStatus:     entry.Status,
+		TagKeyCreated:    entry.CreatedAt.UTC().Format(time.RFC3339),
+		TagKeyLastUsed:   entry.LastActivity.UTC().Format(time.RFC3339),
+	}
+	if entry.UserID != "" {
+		tags[TagKeyUserID] = entry.UserID
+	}
+	if entry.BoxName != "" {
+		tags[TagKeyBoxName] = entry.BoxName
+	}
+	if entry.Runtime != "" {
+		tags[TagKeyRuntime] = entry.Runtime
+	}
+	return a.tagResource(ctx, entry.PartitionKey, entry.RowKey, tags)
+}
+
+// UnregisterResource implements InventoryProvider by removing the role tag, which takes a
+// resource that still exists out of every inventory query
+func (a *AWSProvider) UnregisterResource(ctx context.Context, role, resourceID string) error {
+	ec2ID, err := a.ec2ID(ctx, role, resourceID)
+	if isAWSNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.ec2.DeleteTags(ctx, ec2ID, TagKeyRole); err != nil && !isAWSNotFound(err) {
+		return fmt.Errorf("failed to untag %s %s: %w", role, resourceID, err)
+	}
+	return nil
+}
+
+// UpdateInstanceStatus implements InventoryProvider
+func (a *AWSProvider) UpdateInstanceStatus(ctx context.Context, instanceID, status string) error {
+	return a.tagResource(ctx, ResourceRoleInstance, instanceID, map[string]string{
+		TagKeyStatus:   status,
+		TagKeyLastUsed: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// UpdateInstanceStatusAndUser implements InventoryProvider
+func (a *AWSProvider) UpdateInstanceStatusAndUser(ctx context.Context, instanceID, status, userID string) error {
+	return a.tagResource(ctx, ResourceRoleInstance, instanceID, map[string]string{
+		TagKeyStatus:   status,
+		TagKeyUserID:   userID,
+		TagKeyLastUsed: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// UpdateVolumeStatusUserAndBox implements InventoryProvider
+func (a *AWSProvider) UpdateVolumeStatusUserAndBox(ctx context.Context, volumeID, status, userID, boxName string) error {
+	return a.tagResource(ctx, ResourceRoleVolume, volumeID, map[string]string{
+		TagKeyStatus:   status,
+		TagKeyUserID:   userID,
+		TagKeyBoxName:  boxName,
+		TagKeyLastUsed: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// UpdateVolumeRuntime implements InventoryProvider
+func (a *AWSProvider) UpdateVolumeRuntime(ctx context.Context, volumeID, runtime string) error {
+	return a.tagResource(ctx, ResourceRoleVolume, volumeID, map[string]string{
+		TagKeyRuntime: runtime,
+	})
+}
+
+// Reconcile implements InventoryProvider. The tags are the inventory, so there is nothing
+// to drift from.
+func (a *AWSProvider) Reconcile(_ context.Context) error {
+	return nil
+}
+
+// ec2ID returns the EC2 ID of a pool resource: instanceIDs are EC2 instance IDs, volumes
+// are found by their volumeid tag
+func (a *AWSProvider) ec2ID(ctx context.Context, role, resourceID string) (string, error) {
+	if role == ResourceRoleInstance {
+		return resourceID, nil
+	}
+	volume, err := a.ebsVolume(ctx, resourceID)
+	if err != nil {
+		return "", err
+	}
+	return volume.VolumeID, nil
+}
+
+func (a *AWSProvider) tagResource(ctx context.Context, role, resourceID string, tags map[string]string) error {
+	ec2ID, err := a.ec2ID(ctx, role, resourceID)
+	if err != nil {
+		return err
+	}
+	if err := a.ec2.CreateTags(ctx, ec2ID, tags); err != nil {
+		return fmt.Errorf("failed to tag %s %s: %w", role, resourceID, err)
+	}
+	return nil
+}
+
+// CountInstancesByStatus implements ResourceQueries
+func (a *AWSProvider) CountInstancesByStatus(ctx context.Context) (*ResourceCounts, error) {
+	resources, err := a.listInstances(ctx, a.deploymentFilter(ResourceRoleInstance), awsLiveInstanceStates...)
+	if err != nil {
+		return nil, err
+	}
+	return countResources(resources), nil
+}
+
+// CountVolumesByStatus implements ResourceQueries
+func (a *AWSProvider) CountVolumesByStatus(ctx context.Context) (*ResourceCounts, error) {
+	resources, err := a.listVolumes(ctx, a.deploymentFilter(ResourceRoleVolume))
+	if err != nil {
+		return nil, err
+	}
+	return countResources(resources), nil
+}
+
+// GetVolumesByStatus implements ResourceQueries
+func (a *AWSProvider) GetVolumesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
+	return a.listVolumes(ctx, a.deploymentFilter(ResourceRoleVolume).filter("tag:"+TagKeyStatus, status))
+}
+
+// GetVolumesByUserAndBox implements ResourceQueries
+func (a *AWSProvider) GetVolumesByUserAndBox(ctx context.Context, userID, boxName string) ([]ResourceInfo, error) {
+	return a.listVolumes(ctx, a.deploymentFilter(ResourceRoleVolume).
+		filter("tag:"+TagKeyUserID, userID).
+		filter("tag:"+TagKeyBoxName, boxName))
+}
+
+// GetOldestFreeVolumes implements ResourceQueries
+func (a *AWSProvider) GetOldestFreeVolumes(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	resources, err := a.GetVolumesByStatus(ctx, ResourceStatusFree)
+	if err != nil {
+		return nil, err
+	}
+	return oldestFirst(resources, limit), nil
+}
+
+// GetRunningInstancesByStatus implements ResourceQueries
+func (a *AWSProvider) GetRunningInstancesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
+	return a.listInstances(ctx, a.deploymentFilter(ResourceRoleInstance).filter("tag:"+TagKeyStatus, status), "running")
+}
+
+// GetOldestFreeRunningInstances implements ResourceQueries
+func (a *AWSProvider) GetOldestFreeRunningInstances(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	resources, err := a.GetRunningInstancesByStatus(ctx, ResourceStatusFree)
+	if err != nil {
+		return nil, err
+	}
+	return oldestFirst(resources, limit), nil
+}
+
+// listInstances returns the instances matching params in one of states as ResourceInfo
+func (a *AWSProvider) listInstances(ctx context.Context, params ec2Params, states ...string) ([]ResourceInfo, error) {
+	instances, err := a.ec2.DescribeInstances(ctx, params.filter("instance-state-name", states...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instances: %w", err)
+	}
+
+	resources := make([]ResourceInfo, 0, len(instances))
+	for i := range instances {
+		resource := ec2ResourceInfo(instances[i].InstanceID, instances[i].Tags, instances[i].LaunchTime)
+		resource.ResourceID = instances[i].InstanceID
+		resource.PowerState = instances[i].State
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// listVolumes returns the volumes matching params as ResourceInfo
+func (a *AWSProvider) listVolumes(ctx context.Context, params ec2Params) ([]ResourceInfo, error) {
+	volumes, err := a.ec2.DescribeVolumes(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query volumes: %w", err)
+	}
+
+	resources := make([]ResourceInfo, 0, len(volumes))
+	for i := range volumes {
+		resources = append(resources, ec2ResourceInfo(volumes[i].VolumeID, volumes[i].Tags, volumes[i].CreateTime))
+	}
+	return resources, nil
+}
+
+// ec2ResourceInfo converts an EC2 resource's tags to the ResourceInfo shape Resource Graph
+// queries return
+func ec2ResourceInfo(ec2ID string, tagSet ec2Tags, created time.Time) ResourceInfo {
+	resource := ResourceInfo{
+		ID:   ec2ID,
+		Tags: tagSet.Map(),
+	}
+	resource.Name = resource.Tags["Name"]
+	extractTagValues(&resource)
+	parseTimestamps(&resource)
+	extractResourceID(&resource)
+	if resource.CreatedAt == nil {
+		resource.CreatedAt = &created
+	}
+	if resource.LastUsed == nil {
+		resource.LastUsed = resource.CreatedAt
+	}
+	return resource
+}
+
+// countResources counts resources by status
+func countResources(resources []ResourceInfo) *ResourceCounts {
+	counts := &ResourceCounts{}
+	for i := range resources {
+		switch resources[i].Status {
+		case ResourceStatusFree:
+			counts.Free++
+		case ResourceStatusConnected:
+			counts.Connected++
+		case ResourceStatusAttached:
+			counts.Attached++
+		}
+		counts.Total++
+	}
+	return counts
+}
@@ -0,0 +1,147 @@
+package infra
+
+import (
+	"context"
+)
+
+// AzureProvider implements the provider interfaces on Azure: VMs and managed disks for
+// compute and volumes, Table Storage for inventory and state, and QEMU on the instances
+type AzureProvider struct {
+	*ResourceRegistry
+	clients *AzureClients
+	graph   *ResourceGraphQueries
+}
+
+// NewAzureProvider creates a Provider backed by Azure. It runs as the server does, so
+// network setup reads the existing configuration instead of creating it.
+func NewAzureProvider(clients *AzureClients) *Provider {
+	azure := &AzureProvider{
+		ResourceRegistry: NewResourceRegistry(clients),
+		clients:          clients,
+		graph:            NewResourceGraphQueries(clients.ResourceGraphClient, clients.SubscriptionID, clients.ResourceGroupName),
+	}
+
+	var claims ClaimStore = NewTableClaimStore(clients)
+	if clients.TableClient == nil {
+		// Without Table Storage claims can only protect against races within this process
+		claims = NewMemoryClaimStore()
+	}
+
+	return &Provider{
+		Compute:     azure,
+		Volumes:     azure,
+		Snapshots:   azure,
+		Network:     azure,
+		Inventory:   azure,
+		Allocations: azure,
+		Claims:      claims,
+		Events:      azure,
+		Runtime:     NewQEMUManager(AzureDataDisk, QEMUNetworkUser),
+		BridgedVMs:  NewQEMUManager(AzureDataDisk, QEMUNetworkTap),
+		Containers:  NewContainerManager(sshContainerHost{dataDisk: AzureDataDisk.Path}),
+	}
+}
+
+// CreateInstance implements ComputeProvider
+func (a *AzureProvider) CreateInstance(ctx context.Context, config *VMConfig) (string, error) {
+	return CreateInstance(ctx, a.clients, config)
+}
+
+// DeleteInstance implements ComputeProvider
+func (a *AzureProvider) DeleteInstance(ctx context.Context, instanceID string) error {
+	namer := NewResourceNamer(a.clients.Suffix)
+	return DeleteInstance(ctx, a.clients, namer.ResourceGroup(), namer.BoxVMName(instanceID))
+}
+
+// GetInstancePrivateIP implements ComputeProvider
+func (a *AzureProvider) GetInstancePrivateIP(ctx context.Context, instanceID string) (string, error) {
+	return GetInstancePrivateIP(ctx, a.clients, instanceID)
+}
+
+// CreateVolumeFromSnapshot implements VolumeProvider
+func (a *AzureProvider) CreateVolumeFromSnapshot(ctx context.Context, snapshotID string, tags *VolumeTags) error {
+	namer := NewResourceNamer(a.clients.Suffix)
+	_, err := CreateVolumeFromSnapshot(ctx, a.clients, a.clients.ResourceGroupName, namer.VolumePoolDiskName(tags.VolumeID), snapshotID, tags)
+	return err
+}
+
+// DeleteVolume implements VolumeProvider
+func (a *AzureProvider) DeleteVolume(ctx context.Context, volumeID string) error {
+	namer := NewResourceNamer(a.clients.Suffix)
+	return DeleteVolume(ctx, a.clients, a.clients.ResourceGroupName, namer.VolumePoolDiskName(volumeID))
+}
+
+// AttachVolume implements VolumeProvider
+func (a *AzureProvider) AttachVolume(ctx context.Context, instanceID, volumeID string) error {
+	return AttachVolumeToInstance(ctx, a.clients, instanceID, volumeID)
+}
+
+// DetachVolume implements VolumeProvider
+func (a *AzureProvider) DetachVolume(ctx context.Context, instanceID, volumeID string) error {
+	return DetachVolumeFromInstance(ctx, a.clients, instanceID, volumeID)
+}
+
+// EnsureGoldenSnapshot implements SnapshotProvider
+func (a *AzureProvider) EnsureGoldenSnapshot(ctx context.Context) (*GoldenSnapshotInfo, error) {
+	return CreateGoldenSnapshotIfNotExists(ctx, a.clients)
+}
+
+// EnsureNetwork implements NetworkProvider
+func (a *AzureProvider) EnsureNetwork(ctx context.Context) error {
+	CreateNetworkInfrastructure(ctx, a.clients, false)
+	return nil
+}
+
+// RegisterResource implements InventoryProvider
+func (a *AzureProvider) RegisterResource(ctx context.Context, entry *ResourceRegistryEntity) error {
+	if entry.PartitionKey == ResourceRoleInstance && entry.VMName == "" {
+		entry.VMName = NewResourceNamer(a.clients.Suffix).BoxVMName(entry.RowKey)
+	}
+	return WriteResourceRegistry(ctx, a.clients, entry)
+}
+
+// UnregisterResource implements InventoryProvider
+func (a *AzureProvider) UnregisterResource(ctx context.Context, role, resourceID string) error {
+	return DeleteResourceRegistry(ctx, a.clients, role, resourceID)
+}
+
+// UpdateInstanceStatus implements InventoryProvider
+func (a *AzureProvider) UpdateInstanceStatus(ctx context.Context, instanceID, status string) error {
+	return UpdateInstanceStatus(ctx, a.clients, instanceID, status)
+}
+
+// UpdateInstanceStatusAndUser implements InventoryProvider
+func (a *AzureProvider) UpdateInstanceStatusAndUser(ctx context.Context, instanceID, status, userID string) error {
+	return UpdateInstanceStatusAndUser(ctx, a.clients, instanceID, status, userID)
+}
+
+// UpdateVolumeStatusUserAndBox implements InventoryProvider
+func (a *AzureProvider) UpdateVolumeStatusUserAndBox(ctx context.Context, volumeID, status, userID, boxName string) error {
+	return UpdateVolumeStatusUserAndBox(ctx, a.clients, volumeID, status, userID, boxName)
+}
+
+// UpdateVolumeRuntime implements InventoryProvider
+func (a *AzureProvider) UpdateVolumeRuntime(ctx context.Context, volumeID, runtime string) error {
+	return UpdateVolumeRuntime(ctx, a.clients, volumeID, runtime)
+}
+
+// Reconcile implements InventoryProvider by reconciling the registry with Resource Graph
+func (a *AzureProvider) Reconcile(ctx context.Context) error {
+	_, err := ReconcileRegistry(ctx, a.clients, a.graph)
+	return err
+}
+
+// WriteAllocation implements AllocationStore
+func (a *AzureProvider) WriteAllocation(ctx context.Context, allocation *AllocationEntity) error {
+	return WriteAllocation(ctx, a.clients, allocation)
+}
+
+// ListActiveAllocations implements AllocationStore
+func (a *AzureProvider) ListActiveAllocations(ctx context.Context) ([]AllocationEntity, error) {
+	return ListActiveAllocations(ctx, a.clients)
+}
+
+// WriteEvent implements EventStore
+func (a *AzureProvider) WriteEvent(ctx context.Context, event *EventLogEntity) error {
+	return WriteEventLog(ctx, a.clients, event)
+}
@@ -208,51 +208,18 @@ func copySSHKeyToBastion(ctx context.Context, config *VMConfig, bastionIP string
 	slog.Info("Copying SSH key to bastion", "ip", bastionIP)
 
 	// Create the .ssh directory on bastion
-	createDirCmd := exec.CommandContext(ctx, "ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=10",
-		"-i", sshutil.SSHKeyPath,
-		fmt.Sprintf("%s@%s", config.AdminUsername, bastionIP),
-		"mkdir", "-p", "/home/shellbox/.ssh")
-
-	if output, err := createDirCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create .ssh directory: %w: %s", err, string(output))
+	if err := sshutil.ExecuteCommand(ctx, "mkdir -p /home/shellbox/.ssh", config.AdminUsername, bastionIP); err != nil {
+		return fmt.Errorf("failed to create .ssh directory: %w", err)
 	}
 
-	// Copy the SSH key to bastion
-	scpCmd := exec.CommandContext(ctx, "scp",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=10",
-		"-i", sshutil.SSHKeyPath,
-		sshutil.SSHKeyPath,
-		fmt.Sprintf("%s@%s:/home/shellbox/.ssh/id_rsa", config.AdminUsername, bastionIP))
-
-	if output, err := scpCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to copy SSH key: %w: %s", err, string(output))
-	}
-
-	// Set correct permissions on the key file
-	chmodCmd := exec.CommandContext(ctx, "ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=10",
-		"-i", sshutil.SSHKeyPath,
-		fmt.Sprintf("%s@%s", config.AdminUsername, bastionIP),
-		"chmod", "600", "/home/shellbox/.ssh/id_rsa")
-
-	if output, err := chmodCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to set SSH key permissions: %w: %s", err, string(output))
+	// Copy the SSH key to bastion; the copy keeps the key's 0600 permissions
+	if err := sshutil.CopyFile(ctx, sshutil.SSHKeyPath, "/home/shellbox/.ssh/id_rsa", config.AdminUsername, bastionIP); err != nil {
+		return fmt.Errorf("failed to copy SSH key: %w", err)
 	}
 
 	// Set ownership to shellbox user
-	chownCmd := exec.CommandContext(ctx, "ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=10",
-		"-i", sshutil.SSHKeyPath,
-		fmt.Sprintf("%s@%s", config.AdminUsername, bastionIP),
-		"sudo", "chown", "shellbox:shellbox", "/home/shellbox/.ssh/id_rsa")
-
-	if output, err := chownCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to set SSH key ownership: %w: %s", err, string(output))
+	if err := sshutil.ExecuteCommand(ctx, "sudo chown shellbox:shellbox /home/shellbox/.ssh/id_rsa", config.AdminUsername, bastionIP); err != nil {
+		return fmt.Errorf("failed to set SSH key ownership: %w", err)
 	}
 
 	slog.Info("SSH key copied to bastion successfully")
@@ -0,0 +1,55 @@
+package infra
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"time"
+)
+
+// BoxStatus describes a user's running box
+type BoxStatus struct {
+	BoxName       string
+	Runtime       string // one of the BoxRuntime* constants
+	InstanceID    string
+	ConnectedAt   time.Time
+	RestartPolicy string        // empty if the runtime has none
+	Egress        *EgressPolicy // nil if the runtime has none
+	EgressDenied  *EgressDenied // nil if the runtime has no egress policy
+}
+
+// BoxStatus returns the status of a user's running box
+func (ra *ResourceAllocator) BoxStatus(ctx context.Context, userID, boxName string) (*BoxStatus, error) {
+	allocation, err := ra.findBoxAllocation(ctx, userID, boxName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find box: %w", err)
+	}
+	if allocation == nil {
+		return nil, ErrBoxNotRunning
+	}
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &BoxStatus{
+		BoxName:     boxName,
+		Runtime:     cmp.Or(allocation.Runtime, BoxRuntimeVM),
+		InstanceID:  allocation.InstanceID,
+		ConnectedAt: allocation.ConnectedAt,
+	}
+	if supervised, ok := runtime.(SupervisedRuntime); ok {
+		if status.RestartPolicy, err = supervised.RestartPolicy(ctx, allocation.InstanceIP); err != nil {
+			return nil, err
+		}
+	}
+	if egress, ok := runtime.(EgressRuntime); ok {
+		if status.Egress, err = egress.EgressPolicy(ctx, allocation.InstanceIP); err != nil {
+			return nil, err
+		}
+		if status.EgressDenied, err = egress.EgressDenied(ctx, allocation.InstanceIP); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,525 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"shellbox/internal/qga"
+	"shellbox/internal/qmp"
+	"shellbox/internal/sshutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checkpoint defaults
+const (
+	DefaultCheckpointInterval = 15 * time.Minute // time between checkpoints of a running box
+	DefaultCheckpointKeep     = 3                // checkpoints kept on each volume
+)
+
+// Checkpoint space limits. A state file holds all of guest RAM in the worst case, so a
+// volume fits only a few of them next to the box's own data.
+const (
+	checkpointVolumeShare = 0.5     // most of the volume that checkpoint state files may take
+	checkpointSpareBytes  = 2 << 30 // free space left besides a new state file, for disk snapshots and the box's writes
+)
+
+// ErrCheckpointNoSpace is returned when a box's volume has no room for another checkpoint
+var ErrCheckpointNoSpace = errors.New("not enough free space for a checkpoint")
+
+// checkpointCapabilities are set when saving a checkpoint. Unlike the golden state, a
+// checkpoint includes guest RAM: the shared memory-backend file keeps changing after the
+// checkpoint and loses the pages the host hadn't flushed when the instance died, so it
+// can't be paired with device state saved earlier. pause-before-switchover stops the VM
+// before the final copy, so the disks are snapshotted at the same instant as the RAM.
+var checkpointCapabilities = []qmp.MigrationCapability{
+	{Capability: "events", State: true},
+	{Capability: "xbzrle", State: false},
+	{Capability: "x-ignore-shared", State: false},
+	{Capability: "auto-converge", State: false},
+	{Capability: "postcopy-ram", State: false},
+	{Capability: "pause-before-switchover", State: true},
+}
+
+// checkpointRestoreCapabilities are set when loading a checkpoint and must match
+// checkpointCapabilities except for the pause, which only applies to the saving side
+var checkpointRestoreCapabilities = []qmp.MigrationCapability{
+	{Capability: "events", State: true},
+	{Capability: "xbzrle", State: false},
+	{Capability: "x-ignore-shared", State: false},
+	{Capability: "auto-converge", State: false},
+	{Capability: "postcopy-ram", State: false},
+	{Capability: "pause-before-switchover", State: false},
+}
+
+// Checkpoint is a saved state of a running box: its RAM and device state in StateFile and
+// an internal snapshot called ID in each of its disk images
+type Checkpoint struct {
+	ID        string    `json:"id"`
+	Created   time.Time `json:"created"`
+	StateFile string    `json:"stateFile"`
+	StateSize int64     `json:"stateSize"` // bytes, tells a complete state file from a cut-off one
+}
+
+// manifestPath is where the checkpoint's description is stored next to its state file
+func (c *Checkpoint) manifestPath() string {
+	return QEMUCheckpointsPath + "/" + c.ID + ".json"
+}
+
+// Checkpoint implements CheckpointRuntime: it saves the state of the box running on
+// instanceIP to its volume and deletes all but the newest keep checkpoints, or fewer if
+// the volume can't fit keep of them. The box is paused only while its disks are
+// snapshotted and the last dirty pages are written.
+func (qm *QEMUManager) Checkpoint(ctx context.Context, instanceIP string, keep int) (*Checkpoint, error) {
+	config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+	if err != nil {
+		return nil, err
+	}
+	devices := config.DiskDevices()
+
+	// Free pages the balloon reports read back as zeros, which the state file stores compactly
+	if config.Balloon {
+		if _, err := qm.reportFreePages(ctx, instanceIP, guestCompactMemory); err != nil {
+			slog.Warn("Failed to compact guest memory before checkpoint", "instanceIP", instanceIP, "error", err)
+		}
+	}
+
+	created := time.Now().UTC()
+	checkpoint := &Checkpoint{
+		ID:      "ckpt-" + created.Format("20060102T150405Z"),
+		Created: created,
+	}
+	checkpoint.StateFile = QEMUCheckpointsPath + "/" + checkpoint.ID + ".state"
+
+	if err := sshutil.ExecuteCommand(ctx, "sudo mkdir -p "+QEMUCheckpointsPath, AdminUsername, instanceIP); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	if keep, err = makeCheckpointRoom(ctx, instanceIP, config, devices, keep); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Saving checkpoint", "instanceIP", instanceIP, "checkpoint", checkpoint.ID, "devices", devices)
+	err = withQMP(ctx, instanceIP, func(client *qmp.Client) error {
+		return saveCheckpoint(ctx, client, checkpoint, devices)
+	})
+	if err != nil {
+		if rmErr := sshutil.ExecuteCommand(context.WithoutCancel(ctx), "sudo rm -f "+checkpoint.StateFile, AdminUsername, instanceIP); rmErr != nil {
+			slog.Warn("Failed to remove partial checkpoint", "instanceIP", instanceIP, "checkpoint", checkpoint.ID, "error", rmErr)
+		}
+		return nil, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	result, err := sshutil.Run(ctx, "sudo stat -c %s "+checkpoint.StateFile, AdminUsername, instanceIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat checkpoint state: %w", err)
+	}
+	if checkpoint.StateSize, err = strconv.ParseInt(strings.TrimSpace(result.Stdout), 10, 64); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint state size: %w", err)
+	}
+
+	// The manifest is written last, so only complete checkpoints are ever listed
+	manifest, err := json.Marshal(checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode checkpoint manifest: %w", err)
+	}
+	writeManifest := fmt.Sprintf("echo %s | sudo tee %s.tmp > /dev/null && sudo mv %s.tmp %s",
+		shellQuote(string(manifest)), checkpoint.manifestPath(), checkpoint.manifestPath(), checkpoint.manifestPath())
+	if err := sshutil.ExecuteCommand(ctx, writeManifest, AdminUsername, instanceIP); err != nil {
+		return nil, fmt.Errorf("failed to write checkpoint manifest: %w", err)
+	}
+	slog.Info("Checkpoint saved", "instanceIP", instanceIP, "checkpoint", checkpoint.ID, "stateSize", checkpoint.StateSize)
+
+	if err := pruneCheckpoints(ctx, instanceIP, devices, keep); err != nil {
+		slog.Warn("Failed to prune old checkpoints", "instanceIP", instanceIP, "error", err)
+	}
+	return checkpoint, nil
+}
+
+// makeCheckpointRoom checks the volume mounted on instanceIP has room for a checkpoint of
+// the box running with config, deleting the oldest checkpoints first if needed. It returns
+// how many checkpoints the volume can keep, at most keep, so they take no more than
+// checkpointVolumeShare of it.
+func makeCheckpointRoom(ctx context.Context, instanceIP string, config *QEMUConfig, devices []string, keep int) (int, error) {
+	stateBytes := int64(config.MemoryMB) << 20
+	size, available, err := checkpointVolumeSpace(ctx, instanceIP)
+	if err != nil {
+		return 0, err
+	}
+	if fits := checkpointsFitting(size, config.MemoryMB, keep); fits < keep {
+		slog.Debug("Keeping fewer checkpoints, the volume fits no more", "instanceIP", instanceIP, "keep", fits, "memoryMB", config.MemoryMB, "volumeBytes", size)
+		keep = fits
+	}
+	if keep < 1 {
+		return 0, fmt.Errorf("%w: a %d MiB box needs more than a %d GiB volume", ErrCheckpointNoSpace, config.MemoryMB, size>>30)
+	}
+
+	needed := stateBytes + checkpointSpareBytes
+	if available >= needed {
+		return keep, nil
+	}
+	// The new checkpoint replaces the oldest one anyway
+	if err := pruneCheckpoints(ctx, instanceIP, devices, keep-1); err != nil {
+		return 0, fmt.Errorf("failed to make room for checkpoint: %w", err)
+	}
+	if _, available, err = checkpointVolumeSpace(ctx, instanceIP); err != nil {
+		return 0, err
+	}
+	if available < needed {
+		return 0, fmt.Errorf("%w: %d MiB free, %d MiB needed", ErrCheckpointNoSpace, available>>20, needed>>20)
+	}
+	return keep, nil
+}
+
+// checkpointsFitting returns how many state files of a box with memoryMB of RAM fit in
+// checkpointVolumeShare of a volume of volumeBytes, at most keep
+func checkpointsFitting(volumeBytes int64, memoryMB, keep int) int {
+	stateBytes := int64(memoryMB) << 20
+	return min(int(float64(volumeBytes)*checkpointVolumeShare/float64(stateBytes)), keep)
+}
+
+// checkpointVolumeSpace returns the size and free space in bytes of the file system
+// checkpoints are stored on
+func checkpointVolumeSpace(ctx context.Context, instanceIP string) (size, available int64, err error) {
+	result, err := sshutil.Run(ctx, "df --output=size,avail -B1 "+QEMUCheckpointsPath+" | tail -n 1", AdminUsername, instanceIP)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to check free space: %w", err)
+	}
+	if _, err := fmt.Sscan(result.Stdout, &size, &available); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse free space %q: %w", strings.TrimSpace(result.Stdout), err)
+	}
+	return size, available, nil
+}
+
+// saveCheckpoint migrates the VM's state to the checkpoint's state file, snapshotting the
+// disks while the VM is stopped before the switchover, and resumes the VM
+func saveCheckpoint(ctx context.Context, client *qmp.Client, checkpoint *Checkpoint, devices []string) error {
+	// A crashed or hung guest is no state to go back to
+	status, err := client.QueryStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.Running {
+		return fmt.Errorf("VM is not running (%s)", status.Status)
+	}
+
+	events, unsubscribe := client.Subscribe(16)
+	defer unsubscribe()
+
+	if err := client.MigrateSetCapabilities(ctx, checkpointCapabilities...); err != nil {
+		return err
+	}
+	if err := client.Migrate(ctx, "exec:cat > "+checkpoint.StateFile); err != nil {
+		return err
+	}
+
+	err = func() error {
+		if err := qmp.WaitForMigrationStatus(ctx, events, qmp.MigrationPreSwitchover); err != nil {
+			return err
+		}
+		for _, device := range devices {
+			if err := client.SnapshotInternal(ctx, device, checkpoint.ID); err != nil {
+				return fmt.Errorf("failed to snapshot %s: %w", device, err)
+			}
+		}
+		if err := client.MigrateContinue(ctx, qmp.MigrationPreSwitchover); err != nil {
+			return err
+		}
+		return qmp.WaitForMigration(ctx, events)
+	}()
+
+	// Whatever happened, the box must keep running
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), QMPCommandTimeout)
+	defer cancel()
+	if err != nil {
+		if cancelErr := client.MigrateCancel(cleanupCtx); cancelErr != nil {
+			slog.Warn("Failed to cancel checkpoint migration", "error", cancelErr)
+		}
+		for _, device := range devices {
+			// Not every device may have been snapshotted
+			_ = client.DeleteSnapshotInternal(cleanupCtx, device, checkpoint.ID)
+		}
+	}
+	status, statusErr := client.QueryStatus(cleanupCtx)
+	if statusErr == nil && status.Running {
+		return err
+	}
+	if contErr := client.Cont(cleanupCtx); contErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to resume VM after checkpoint: %w", contErr))
+	}
+	return err
+}
+
+// listCheckpoints returns the checkpoints on the volume mounted on instanceIP, newest first
+func listCheckpoints(ctx context.Context, instanceIP string) ([]Checkpoint, error) {
+	result, err := sshutil.Run(ctx, "cat "+QEMUCheckpointsPath+"/*.json 2>/dev/null || true", AdminUsername, instanceIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint manifests: %w", err)
+	}
+	checkpoints, err := parseCheckpointManifests(result.Stdout)
+	if err != nil {
+		slog.Warn("Ignoring unreadable checkpoint manifests", "instanceIP", instanceIP, "error", err)
+	}
+	return checkpoints, nil
+}
+
+// parseCheckpointManifests decodes concatenated checkpoint manifests, newest first. It
+// returns the checkpoints read before any unreadable manifest along with the error.
+func parseCheckpointManifests(manifests string) ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	var err error
+	decoder := json.NewDecoder(strings.NewReader(manifests))
+	for {
+		var checkpoint Checkpoint
+		if decodeErr := decoder.Decode(&checkpoint); decodeErr != nil {
+			if !errors.Is(decodeErr, io.EOF) {
+				err = decodeErr
+			}
+			break
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Created.After(checkpoints[j].Created)
+	})
+	return checkpoints, err
+}
+
+// pruneCheckpoints deletes all but the newest keep checkpoints of the box running on
+// instanceIP. The disk snapshots are deleted through QEMU, which has the images open.
+func pruneCheckpoints(ctx context.Context, instanceIP string, devices []string, keep int) error {
+	checkpoints, err := listCheckpoints(ctx, instanceIP)
+	if err != nil {
+		return err
+	}
+	if len(checkpoints) <= keep {
+		return nil
+	}
+
+	var errs []error
+	for _, checkpoint := range checkpoints[max(keep, 0):] {
+		err := withQMP(ctx, instanceIP, func(client *qmp.Client) error {
+			for _, device := range devices {
+				if err := client.DeleteSnapshotInternal(ctx, device, checkpoint.ID); err != nil {
+					slog.Warn("Failed to delete checkpoint snapshot", "device", device, "checkpoint", checkpoint.ID, "error", err)
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			err = sshutil.ExecuteCommand(ctx, fmt.Sprintf("sudo rm -f %s %s", checkpoint.StateFile, checkpoint.manifestPath()), AdminUsername, instanceIP)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("checkpoint %s: %w", checkpoint.ID, err))
+			continue
+		}
+		slog.Info("Deleted old checkpoint", "instanceIP", instanceIP, "checkpoint", checkpoint.ID)
+	}
+	return errors.Join(errs...)
+}
+
+// RecoverableCheckpoint implements CheckpointRuntime: it mounts the volume attached to
+// instanceIP and, if the box on it was not shut down cleanly, returns the newest intact
+// checkpoint taken while it last ran. It returns nil if there is none.
+func (qm *QEMUManager) RecoverableCheckpoint(ctx context.Context, instanceIP string) (*Checkpoint, error) {
+	if output, err := sshutil.ExecuteCommandWithOutput(ctx, qm.mountVolumeScript(), AdminUsername, instanceIP); err != nil {
+		slog.Error("Failed to mount volume", "error", err, "output", output)
+		return nil, fmt.Errorf("failed to mount volume: %w", err)
+	}
+
+	result, err := sshutil.Run(ctx, "cat "+QEMURunMarkerPath, AdminUsername, instanceIP)
+	if err != nil {
+		if result != nil && result.ExitCode > 0 {
+			return nil, nil // shut down cleanly
+		}
+		return nil, fmt.Errorf("failed to read run marker: %w", err)
+	}
+	runStart, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(result.Stdout))
+	if err != nil {
+		slog.Warn("Unreadable run marker, considering all checkpoints", "instanceIP", instanceIP, "error", err)
+	}
+
+	checkpoints, err := listCheckpoints(ctx, instanceIP)
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+	if err != nil {
+		return nil, err
+	}
+	for i := range checkpoints {
+		checkpoint := &checkpoints[i]
+		// Older checkpoints are from before the box was last started fresh
+		if checkpoint.Created.Before(runStart) {
+			break
+		}
+		if err := verifyCheckpoint(ctx, instanceIP, checkpoint, config); err != nil {
+			slog.Warn("Skipping damaged checkpoint", "instanceIP", instanceIP, "checkpoint", checkpoint.ID, "error", err)
+			continue
+		}
+		return checkpoint, nil
+	}
+	return nil, nil
+}
+
+// verifyCheckpoint checks the checkpoint's state file is complete and its snapshot exists
+// in every disk image
+func verifyCheckpoint(ctx context.Context, instanceIP string, checkpoint *Checkpoint, config *QEMUConfig) error {
+	script := fmt.Sprintf("test \"$(sudo stat -c %%s %s)\" = %d || { echo 'state file incomplete'; exit 1; }\n",
+		checkpoint.StateFile, checkpoint.StateSize)
+	for _, drive := range config.DiskDrives() {
+		script += fmt.Sprintf("sudo qemu-img snapshot -l %s | grep -qw %s || { echo 'snapshot missing in %s'; exit 1; }\n",
+			shellQuote(drive.File), checkpoint.ID, drive.File)
+	}
+	if output, err := sshutil.ExecuteCommandWithOutput(ctx, script, AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// ResumeCheckpoint implements CheckpointRuntime: it reverts the disks of the volume attached
+// to instanceIP to checkpoint and resumes the box from its saved state. Anything the box
+// wrote after the checkpoint is lost.
+func (qm *QEMUManager) ResumeCheckpoint(ctx context.Context, instanceIP string, checkpoint *Checkpoint, progress *ProgressReporter) error {
+	config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Resuming box from checkpoint", "instanceIP", instanceIP, "checkpoint", checkpoint.ID)
+	err = progress.Step("Starting QEMU", func() error {
+		var script strings.Builder
+		for _, drive := range config.DiskDrives() {
+			fmt.Fprintf(&script, "sudo qemu-img snapshot -a %s %s\n", checkpoint.ID, shellQuote(drive.File))
+		}
+		script.WriteString(qm.qemuResumeScript(config))
+		output, err := sshutil.ExecuteCommandWithOutput(ctx, script.String(), AdminUsername, instanceIP)
+		if err != nil {
+			slog.Error("Failed to start QEMU from checkpoint", "error", err, "output", output)
+			return err
+		}
+		return qm.applyStoredEgressPolicy(ctx, instanceIP)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start QEMU: %w", err)
+	}
+
+	err = progress.Step("Restoring checkpoint", func() error {
+		return withQMP(ctx, instanceIP, func(client *qmp.Client) error {
+			return restoreVMState(ctx, client, checkpoint.StateFile, checkpointRestoreCapabilities)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore checkpoint: %w", err)
+	}
+
+	err = progress.Step("Refreshing guest network", func() error {
+		return qm.refreshGuestNetwork(ctx, instanceIP)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The guest clock resumes from when the checkpoint was taken
+	err = qm.GuestAgent(ctx, instanceIP, func(agent *qga.Client) error {
+		return agent.SetTime(ctx, time.Time{})
+	})
+	if err != nil {
+		slog.Warn("Failed to set guest clock after checkpoint restore", "instanceIP", instanceIP, "error", err)
+	}
+
+	return markBoxRunning(ctx, instanceIP)
+}
+
+// markBoxRunning records on the volume mounted on instanceIP that its box runs, and since
+// when. StopBox removes the record, so a volume that still has it was not shut down cleanly.
+func markBoxRunning(ctx context.Context, instanceIP string) error {
+	cmd := fmt.Sprintf("echo %s | sudo tee %s > /dev/null", time.Now().UTC().Format(time.RFC3339Nano), QEMURunMarkerPath)
+	if err := sshutil.ExecuteCommand(ctx, cmd, AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("failed to write run marker: %w", err)
+	}
+	return nil
+}
+
+// CheckpointConfig configures a BoxCheckpointer
+type CheckpointConfig struct {
+	Interval time.Duration // time between checkpoints of each running box
+	Keep     int           // checkpoints kept on each volume, if it has room for them
+}
+
+// NewDefaultCheckpointConfig returns the default checkpointer configuration
+func NewDefaultCheckpointConfig() CheckpointConfig {
+	return CheckpointConfig{
+		Interval: DefaultCheckpointInterval,
+		Keep:     DefaultCheckpointKeep,
+	}
+}
+
+// BoxCheckpointer periodically checkpoints the running boxes whose runtime supports it, so
+// a box whose instance goes away can resume close to where it was
+type BoxCheckpointer struct {
+	provider *Provider
+	config   CheckpointConfig
+}
+
+// NewBoxCheckpointer creates a checkpointer for the boxes allocated on provider
+func NewBoxCheckpointer(provider *Provider, config CheckpointConfig) *BoxCheckpointer {
+	return &BoxCheckpointer{
+		provider: provider,
+		config:   config,
+	}
+}
+
+// Run checkpoints the running boxes every config.Interval until ctx is done
+func (c *BoxCheckpointer) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.CheckpointAll(ctx); err != nil {
+			slog.Error("box checkpointing failed", "error", err)
+		}
+	}
+}
+
+// CheckpointAll checkpoints each connected box once, one box at a time
+func (c *BoxCheckpointer) CheckpointAll(ctx context.Context) error {
+	allocations, err := c.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list active allocations: %w", err)
+	}
+
+	var errs []error
+	for i := range allocations {
+		allocation := &allocations[i]
+		if allocation.State != AllocationStateConnected || allocation.InstanceIP == "" {
+			continue
+		}
+		runtime, err := c.provider.RuntimeFor(allocation.Runtime)
+		if err != nil {
+			continue
+		}
+		checkpointer, ok := runtime.(CheckpointRuntime)
+		if !ok {
+			continue
+		}
+
+		checkpoint, err := checkpointer.Checkpoint(ctx, allocation.InstanceIP, c.config.Keep)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("box %s on %s: %w", allocation.BoxName, allocation.InstanceID, err))
+			continue
+		}
+		slog.Info("box checkpointed", "allocationID", allocation.RowKey, "instanceID", allocation.InstanceID, "boxName", allocation.BoxName, "checkpoint", checkpoint.ID)
+	}
+	return errors.Join(errs...)
+}
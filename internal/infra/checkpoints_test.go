@@ -0,0 +1,218 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shellbox/internal/qmp"
+)
+
+func TestCheckpointsFitting(t *testing.T) {
+	for _, tt := range []struct {
+		volumeGiB int64
+		memoryMB  int
+		keep      int
+		want      int
+	}{
+		{64, 8192, 3, 3},  // room for four, three kept
+		{32, 8192, 3, 2},  // half the volume holds two
+		{16, 8192, 3, 1},  // and one
+		{8, 16384, 3, 0},  // a 16 GiB box checkpoints on no 8 GiB volume
+		{100, 1024, 0, 0}, // checkpoints turned off
+	} {
+		if got := checkpointsFitting(tt.volumeGiB<<30, tt.memoryMB, tt.keep); got != tt.want {
+			t.Errorf("%d MiB box on a %d GiB volume keeping %d: got %d, want %d", tt.memoryMB, tt.volumeGiB, tt.keep, got, tt.want)
+		}
+	}
+}
+
+func TestParseCheckpointManifests(t *testing.T) {
+	created := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	manifest := func(id string, age time.Duration) string {
+		data, _ := json.Marshal(Checkpoint{ID: id, Created: created.Add(-age), StateFile: "/" + id + ".state", StateSize: 42})
+		return string(data) + "\n"
+	}
+
+	checkpoints, err := parseCheckpointManifests(manifest("b", time.Hour) + manifest("c", 0) + manifest("a", 2*time.Hour))
+	if err != nil {
+		t.Fatalf("parseCheckpointManifests: %v", err)
+	}
+	var ids []string
+	for _, checkpoint := range checkpoints {
+		ids = append(ids, checkpoint.ID)
+	}
+	// Pruning keeps the front of the list
+	if !slices.Equal(ids, []string{"c", "b", "a"}) {
+		t.Errorf("got %v, want newest first", ids)
+	}
+	if checkpoints[0].StateFile != "/c.state" || checkpoints[0].StateSize != 42 {
+		t.Errorf("got %+v", checkpoints[0])
+	}
+
+	if checkpoints, err := parseCheckpointManifests(""); err != nil || len(checkpoints) != 0 {
+		t.Errorf("no manifests: got %v, %v", checkpoints, err)
+	}
+	// A manifest cut off by a full disk
+	checkpoints, err = parseCheckpointManifests(manifest("a", time.Hour) + `{"id":"b","crea`)
+	if err == nil || len(checkpoints) != 1 || checkpoints[0].ID != "a" {
+		t.Errorf("cut-off manifest: got %v, %v, want a and an error", checkpoints, err)
+	}
+}
+
+// fakeQMP is the QEMU end of a QMP connection saving a checkpoint. It records the commands
+// it gets and fails the snapshot of failDevice.
+type fakeQMP struct {
+	mu         sync.Mutex
+	commands   []string
+	running    bool
+	failDevice string
+}
+
+// connect returns a client talking to q over a pipe
+func (q *fakeQMP) connect(t *testing.T) *qmp.Client {
+	t.Helper()
+	server, conn := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go q.serve(server)
+	client, err := qmp.NewClient(context.Background(), conn)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func (q *fakeQMP) serve(conn net.Conn) {
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	event := func(status string) {
+		_ = enc.Encode(map[string]any{"event": "MIGRATION", "data": map[string]any{"status": status}, "timestamp": map[string]any{"seconds": 1}})
+	}
+	_ = enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{}}})
+	for {
+		var req struct {
+			Execute   string          `json:"execute"`
+			ID        string          `json:"id"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if dec.Decode(&req) != nil {
+			return
+		}
+		var args struct {
+			Device string `json:"device"`
+			Name   string `json:"name"`
+			URI    string `json:"uri"`
+		}
+		_ = json.Unmarshal(req.Arguments, &args)
+
+		q.mu.Lock()
+		command := strings.Join(strings.Fields(req.Execute+" "+args.Device+" "+args.Name+" "+args.URI), " ")
+		if req.Execute != "qmp_capabilities" {
+			q.commands = append(q.commands, command)
+		}
+		var result any = map[string]any{}
+		var failure string
+		var events []string
+		switch req.Execute {
+		case "query-status":
+			status := "paused"
+			if q.running {
+				status = "running"
+			}
+			result = map[string]any{"running": q.running, "status": status}
+		case "migrate":
+			events = []string{"active", qmp.MigrationPreSwitchover}
+			q.running = false
+		case "migrate-continue":
+			events = []string{qmp.MigrationCompleted}
+		case "migrate_cancel":
+			events = []string{qmp.MigrationCancelled}
+		case "cont":
+			q.running = true
+		case "blockdev-snapshot-internal-sync":
+			if args.Device == q.failDevice {
+				failure = "No space left on device"
+			}
+		}
+		q.mu.Unlock()
+
+		if failure != "" {
+			_ = enc.Encode(map[string]any{"error": map[string]any{"class": "GenericError", "desc": failure}, "id": req.ID})
+		} else {
+			_ = enc.Encode(map[string]any{"return": result, "id": req.ID})
+		}
+		for _, status := range events {
+			event(status)
+		}
+	}
+}
+
+func (q *fakeQMP) got() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.commands)
+}
+
+func TestSaveCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	checkpoint := &Checkpoint{ID: "cp-1", StateFile: QEMUCheckpointsPath + "/cp-1.state"}
+	devices := []string{"virtio0", "virtio1"}
+
+	// The disks are snapshotted while the VM is paused before the last copy of its RAM
+	q := &fakeQMP{running: true}
+	if err := saveCheckpoint(ctx, q.connect(t), checkpoint, devices); err != nil {
+		t.Fatalf("saveCheckpoint: %v", err)
+	}
+	want := []string{
+		"query-status",
+		"migrate-set-capabilities",
+		"migrate exec:cat > " + checkpoint.StateFile,
+		"blockdev-snapshot-internal-sync virtio0 cp-1",
+		"blockdev-snapshot-internal-sync virtio1 cp-1",
+		"migrate-continue",
+		"query-status",
+		"cont",
+	}
+	if got := q.got(); !slices.Equal(got, want) {
+		t.Errorf("got commands\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !q.running {
+		t.Errorf("VM left paused after the checkpoint")
+	}
+
+	// A failed snapshot cancels the migration, drops the snapshots taken and resumes the VM
+	q = &fakeQMP{running: true, failDevice: "virtio1"}
+	err := saveCheckpoint(ctx, q.connect(t), checkpoint, devices)
+	if err == nil || !strings.Contains(err.Error(), "failed to snapshot virtio1") {
+		t.Fatalf("got %v, want the snapshot failure", err)
+	}
+	got := q.got()
+	for _, command := range []string{
+		"migrate_cancel",
+		"blockdev-snapshot-delete-internal-sync virtio0 cp-1",
+		"blockdev-snapshot-delete-internal-sync virtio1 cp-1",
+		"cont",
+	} {
+		if !slices.Contains(got, command) {
+			t.Errorf("failed checkpoint didn't run %q:\n%s", command, strings.Join(got, "\n"))
+		}
+	}
+	if slices.Contains(got, "migrate-continue") || !q.running {
+		t.Errorf("failed checkpoint went on or left the VM paused:\n%s", strings.Join(got, "\n"))
+	}
+
+	// A paused or crashed guest isn't checkpointed
+	q = &fakeQMP{}
+	if err := saveCheckpoint(ctx, q.connect(t), checkpoint, devices); err == nil {
+		t.Fatalf("checkpointed a paused VM")
+	}
+	if got := q.got(); !slices.Equal(got, []string{"query-status"}) {
+		t.Errorf("got commands %v for a paused VM, want only the status query", got)
+	}
+}
@@ -0,0 +1,225 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+)
+
+// DefaultClaimTTL is how long a claim keeps other claimers away from a resource. It only has
+// to outlive the Resource Graph lag: once the resource's status tag shows up as taken, it
+// is no longer offered as a candidate anyway.
+const DefaultClaimTTL = 10 * time.Minute
+
+const claimPartitionKey = "claim"
+
+// ErrAlreadyClaimed is returned when another claimer holds a live claim on a resource
+var ErrAlreadyClaimed = errors.New("resource already claimed")
+
+// ClaimStore hands out exclusive, expiring claims on pool resources. Resource Graph lags
+// behind tag updates, so two servers (or two sessions) can both see the same resource as
+// free; claiming it first guarantees that exactly one of them goes on to use it.
+type ClaimStore interface {
+	// Claim takes resourceID for owner, or fails with ErrAlreadyClaimed if somebody else
+	// holds a claim that hasn't expired yet. Claiming a resource you already hold renews it.
+	Claim(ctx context.Context, resourceID, owner string, ttl time.Duration) error
+	// Release gives up owner's claim on resourceID. Releasing a claim held by somebody
+	// else, or no claim at all, is a no-op.
+	Release(ctx context.Context, resourceID, owner string) error
+}
+
+// ClaimEntity is one claim row in the Claims table
+type ClaimEntity struct {
+	PartitionKey string    `json:"PartitionKey"`
+	RowKey       string    `json:"RowKey"` // resource ID
+	Owner        string    `json:"Owner"`
+	ClaimedAt    time.Time `json:"ClaimedAt"`
+	ExpiresAt    time.Time `json:"ExpiresAt"`
+}
+
+// claimAvailable reports whether a resource with the given current claim can be taken by owner
+func claimAvailable(current *ClaimEntity, owner string, now time.Time) bool {
+	return current == nil || current.Owner == owner || !now.Before(current.ExpiresAt)
+}
+
+// TableClaimStore keeps claims in the Claims table and uses ETag-conditional writes so that
+// of several concurrent claimers exactly one wins
+type TableClaimStore struct {
+	clients *AzureClients
+}
+
+// NewTableClaimStore creates a claim store backed by Azure Table Storage
+func NewTableClaimStore(clients *AzureClients) *TableClaimStore {
+	return &TableClaimStore{clients: clients}
+}
+
+func (s *TableClaimStore) tableClient() (*aztables.Client, error) {
+	if s.clients.TableClient == nil {
+		return nil, fmt.Errorf("table client not available")
+	}
+	namer := NewResourceNamer(s.clients.Suffix)
+	return s.clients.TableClient.NewClient(namer.ClaimsTableName()), nil
+}
+
+// getClaim returns the current claim on resourceID and its ETag, or nil if there is none
+func (s *TableClaimStore) getClaim(ctx context.Context, tableClient *aztables.Client, resourceID string) (*ClaimEntity, azcore.ETag, error) {
+	resp, err := tableClient.GetEntity(ctx, claimPartitionKey, resourceID, nil)
+	if err != nil {
+		if isStatusCode(err, http.StatusNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read claim: %w", err)
+	}
+
+	var claim ClaimEntity
+	if err := json.Unmarshal(resp.Value, &claim); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal claim: %w", err)
+	}
+	return &claim, resp.ETag, nil
+}
+
+// Claim implements ClaimStore
+func (s *TableClaimStore) Claim(ctx context.Context, resourceID, owner string, ttl time.Duration) error {
+	tableClient, err := s.tableClient()
+	if err != nil {
+		return err
+	}
+
+	current, etag, err := s.getClaim(ctx, tableClient, resourceID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !claimAvailable(current, owner, now) {
+		return ErrAlreadyClaimed
+	}
+
+	claim := ClaimEntity{
+		PartitionKey: claimPartitionKey,
+		RowKey:       resourceID,
+		Owner:        owner,
+		ClaimedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+	claimBytes, err := json.Marshal(claim)
+	if err != nil {
+		return fmt.Errorf("failed to marshal claim: %w", err)
+	}
+
+	if current == nil {
+		// Insert fails with a conflict if somebody else inserted first
+		_, err = tableClient.AddEntity(ctx, claimBytes, nil)
+		if isStatusCode(err, http.StatusConflict) {
+			return ErrAlreadyClaimed
+		}
+	} else {
+		// Replace only succeeds if nobody changed the claim since we read it
+		_, err = tableClient.UpdateEntity(ctx, claimBytes, &aztables.UpdateEntityOptions{
+			IfMatch:    &etag,
+			UpdateMode: aztables.UpdateModeReplace,
+		})
+		if isStatusCode(err, http.StatusPreconditionFailed) {
+			return ErrAlreadyClaimed
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write claim: %w", err)
+	}
+	return nil
+}
+
+// Release implements ClaimStore
+func (s *TableClaimStore) Release(ctx context.Context, resourceID, owner string) error {
+	tableClient, err := s.tableClient()
+	if err != nil {
+		return err
+	}
+
+	current, etag, err := s.getClaim(ctx, tableClient, resourceID)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != owner {
+		return nil
+	}
+
+	_, err = tableClient.DeleteEntity(ctx, claimPartitionKey, resourceID, &aztables.DeleteEntityOptions{IfMatch: &etag})
+	if err != nil && !isStatusCode(err, http.StatusNotFound) && !isStatusCode(err, http.StatusPreconditionFailed) {
+		return fmt.Errorf("failed to delete claim: %w", err)
+	}
+	return nil
+}
+
+// MemoryClaimStore is an in-process ClaimStore with the same compare-and-swap semantics as
+// TableClaimStore, for a single server without Table Storage and for exercising claim races
+type MemoryClaimStore struct {
+	mu     sync.Mutex
+	claims map[string]ClaimEntity
+}
+
+// NewMemoryClaimStore creates an empty in-memory claim store
+func NewMemoryClaimStore() *MemoryClaimStore {
+	return &MemoryClaimStore{claims: make(map[string]ClaimEntity)}
+}
+
+// Claim implements ClaimStore
+func (s *MemoryClaimStore) Claim(_ context.Context, resourceID, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if current, ok := s.claims[resourceID]; ok && !claimAvailable(&current, owner, now) {
+		return ErrAlreadyClaimed
+	}
+	s.claims[resourceID] = ClaimEntity{
+		PartitionKey: claimPartitionKey,
+		RowKey:       resourceID,
+		Owner:        owner,
+		ClaimedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+	return nil
+}
+
+// Release implements ClaimStore
+func (s *MemoryClaimStore) Release(_ context.Context, resourceID, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.claims[resourceID]; ok && current.Owner == owner {
+		delete(s.claims, resourceID)
+	}
+	return nil
+}
+
+// ClaimFirst claims the first of candidates that nobody else holds and returns its index.
+// Candidates lost to a concurrent claimer are skipped; if all of them are taken the
+// returned error wraps ErrAlreadyClaimed.
+func ClaimFirst(ctx context.Context, store ClaimStore, candidates []string, owner string, ttl time.Duration) (int, error) {
+	for i, resourceID := range candidates {
+		err := store.Claim(ctx, resourceID, owner, ttl)
+		if err == nil {
+			return i, nil
+		}
+		if !errors.Is(err, ErrAlreadyClaimed) {
+			return -1, fmt.Errorf("failed to claim %s: %w", resourceID, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+	}
+	return -1, fmt.Errorf("all %d candidates taken: %w", len(candidates), ErrAlreadyClaimed)
+}
+
+// isStatusCode reports whether err is an Azure response error with the given HTTP status
+func isStatusCode(err error, statusCode int) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == statusCode
+}
@@ -0,0 +1,161 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// claimConcurrently runs ClaimFirst for the given number of owners at once and returns
+// the index and the error each of them got
+func claimConcurrently(t *testing.T, store ClaimStore, candidates []string, claimers int) ([]int, []error) {
+	t.Helper()
+	indexes := make([]int, claimers)
+	errs := make([]error, claimers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range claimers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			indexes[i], errs[i] = ClaimFirst(context.Background(), store, candidates, fmt.Sprintf("owner-%d", i), time.Minute)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return indexes, errs
+}
+
+// checkOneWinnerEach checks that every candidate went to exactly one claimer and all other
+// claimers were told the candidates are taken. It returns the winner of each candidate.
+func checkOneWinnerEach(t *testing.T, candidates []string, indexes []int, errs []error) map[string]string {
+	t.Helper()
+	winners := make(map[string]string)
+	losers := 0
+	for i, err := range errs {
+		owner := fmt.Sprintf("owner-%d", i)
+		if err != nil {
+			if !errors.Is(err, ErrAlreadyClaimed) {
+				t.Errorf("%s: got error %v, want ErrAlreadyClaimed", owner, err)
+			}
+			if indexes[i] != -1 {
+				t.Errorf("%s: got index %d with an error, want -1", owner, indexes[i])
+			}
+			losers++
+			continue
+		}
+		resourceID := candidates[indexes[i]]
+		if previous, ok := winners[resourceID]; ok {
+			t.Errorf("%s claimed by both %s and %s", resourceID, previous, owner)
+		}
+		winners[resourceID] = owner
+	}
+	if len(winners) != len(candidates) {
+		t.Errorf("got %d claimed candidates, want all %d", len(winners), len(candidates))
+	}
+	if want := len(errs) - len(candidates); losers != want {
+		t.Errorf("got %d losers, want %d", losers, want)
+	}
+	return winners
+}
+
+func TestClaimFirstConcurrentMemory(t *testing.T) {
+	ctx := context.Background()
+	candidates := []string{"instance-0", "instance-1", "instance-2", "instance-3", "instance-4"}
+	store := NewMemoryClaimStore()
+
+	indexes, errs := claimConcurrently(t, store, candidates, 50)
+	winners := checkOneWinnerEach(t, candidates, indexes, errs)
+
+	// Only the winner can give a claim up
+	released := candidates[2]
+	if err := store.Release(ctx, released, "somebody-else"); err != nil {
+		t.Fatalf("release by non-owner: %v", err)
+	}
+	if _, err := ClaimFirst(ctx, store, candidates, "late", time.Minute); !errors.Is(err, ErrAlreadyClaimed) {
+		t.Fatalf("claim after release by non-owner: got %v, want ErrAlreadyClaimed", err)
+	}
+
+	if err := store.Release(ctx, released, winners[released]); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	i, err := ClaimFirst(ctx, store, candidates, "late", time.Minute)
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+	if candidates[i] != released {
+		t.Fatalf("claim after release got %s, want %s", candidates[i], released)
+	}
+}
+
+func TestMemoryClaimStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryClaimStore()
+
+	if err := store.Claim(ctx, "volume-0", "first", -time.Second); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := store.Claim(ctx, "volume-0", "second", time.Minute); err != nil {
+		t.Fatalf("claim of expired claim: %v", err)
+	}
+	if err := store.Claim(ctx, "volume-0", "second", time.Minute); err != nil {
+		t.Fatalf("renewing own claim: %v", err)
+	}
+	if err := store.Claim(ctx, "volume-0", "first", time.Minute); !errors.Is(err, ErrAlreadyClaimed) {
+		t.Fatalf("claim of live claim: got %v, want ErrAlreadyClaimed", err)
+	}
+}
+
+func newFakeTableClaimStore(t *testing.T, service *fakeTableService) *TableClaimStore {
+	t.Helper()
+	return NewTableClaimStore(newFakeTableClients(t, service))
+}
+
+func TestTableClaimStoreConcurrentInsert(t *testing.T) {
+	const claimers = 8
+	service := newFakeTableService()
+	store := newFakeTableClaimStore(t, service)
+
+	// All claimers find no claim, so all but one lose on the insert conflict
+	service.holdReads(claimers)
+	indexes, errs := claimConcurrently(t, store, []string{"instance-0"}, claimers)
+	checkOneWinnerEach(t, []string{"instance-0"}, indexes, errs)
+	if service.lost != claimers-1 {
+		t.Errorf("got %d conflicting inserts, want %d", service.lost, claimers-1)
+	}
+}
+
+func TestTableClaimStoreConcurrentTakeover(t *testing.T) {
+	const claimers = 8
+	ctx := context.Background()
+	service := newFakeTableService()
+	store := newFakeTableClaimStore(t, service)
+	if err := store.Claim(ctx, "instance-0", "crashed", -time.Second); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	// All claimers find the same expired claim, so all but one lose on the ETag
+	service.holdReads(claimers)
+	indexes, errs := claimConcurrently(t, store, []string{"instance-0"}, claimers)
+	winners := checkOneWinnerEach(t, []string{"instance-0"}, indexes, errs)
+	if service.lost != claimers-1 {
+		t.Errorf("got %d replaces with a stale ETag, want %d", service.lost, claimers-1)
+	}
+
+	if err := store.Release(ctx, "instance-0", "crashed"); err != nil {
+		t.Fatalf("release by previous owner: %v", err)
+	}
+	if err := store.Claim(ctx, "instance-0", "late", time.Minute); !errors.Is(err, ErrAlreadyClaimed) {
+		t.Fatalf("claim after release by previous owner: got %v, want ErrAlreadyClaimed", err)
+	}
+	if err := store.Release(ctx, "instance-0", winners["instance-0"]); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := store.Claim(ctx, "instance-0", "late", time.Minute); err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+}
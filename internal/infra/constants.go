@@ -36,6 +36,8 @@ const (
 	// Table name constants (used as base for suffixed table names)
 	tableEventLog         = "EventLog"
 	tableResourceRegistry = "ResourceRegistry"
+	tableAllocations      = "Allocations"
+	tableClaims           = "Claims"
 )
 
 // VM configuration
@@ -52,12 +54,28 @@ const (
 	// Box SSH configuration
 	BoxSSHPort = 2222
 
+	// Live migration ports, open between instances on the boxes subnet
+	MigrationPort    = 4444  // incoming QEMU migration stream
+	MigrationNBDPort = 10809 // NBD server the box's disks are mirrored to
+
+	// Ports of exposed box ports, open on the bastion to the internet, and of forwarded box
+	// ports, open on instances to the bastion
+	ExposurePortMin = 40000
+	ExposurePortMax = 40999
+
 	// VM default configuration
 	VMSize              = "Standard_D8s_v3" // 8 vCPUs, 32GB RAM for good nested VM performance
 	AdminUsername       = "shellbox"
 	BastionComputerName = "shellbox-bastion"
 )
 
+// Box runtimes a box can be created with
+const (
+	BoxRuntimeVM        = "vm"         // nested QEMU VM on user-mode networking, the default
+	BoxRuntimeBridgedVM = "vm-bridged" // nested QEMU VM on a tap device, for network-heavy work
+	BoxRuntimeContainer = "container"  // Linux container sharing the instance's kernel
+)
+
 // Resource roles
 const (
 	ResourceRoleInstance = "instance"
@@ -82,6 +100,10 @@ const (
 	TagKeyInstanceID = "shellbox:instanceid"
 	TagKeyUserID     = "shellbox:userid"
 	TagKeyBoxName    = "shellbox:boxname"
+	TagKeyRuntime    = "shellbox:runtime"
+
+	// TagKeyDeployment scopes resources to a deployment on clouds without resource groups
+	TagKeyDeployment = "shellbox:deployment"
 )
 
 // Tag keys for golden snapshot resources (separate namespace)
@@ -100,8 +122,13 @@ const (
 	EventTypeVolumeDelete    = "volume_delete"
 	EventTypeSessionStart    = "session_start"
 	EventTypeResourceConnect = "resource_connect"
+	EventTypeBoxMigrate      = "box_migrate"
+	EventTypeBoxCrash        = "box_crash"
 )
 
+// TempGoldenVMPrefix prefixes the name of the temporary VM used to build golden snapshots
+const TempGoldenVMPrefix = "temp-golden-"
+
 // Golden snapshot role values
 const (
 	GoldenRoleTempDataDisk = "temp-data-disk"
@@ -119,11 +146,17 @@ const (
 const (
 	QEMUMemoryPath       = "/mnt/userdata/qemu-memory/ubuntu-mem"
 	QEMUStatePath        = "/mnt/userdata/qemu-memory/vm-state"
+	QEMURunMarkerPath    = "/mnt/userdata/qemu-memory/running" // present while a box runs, see StopBox
+	QEMUCheckpointsPath  = "/mnt/userdata/qemu-checkpoints"
+	RestartPolicyPath    = "/mnt/userdata/restart-policy" // the box's restart policy, see BoxSupervisor
+	EgressPolicyPath     = "/mnt/userdata/egress-policy"  // the box's EgressPolicy as JSON
 	QEMUDisksPath        = "/mnt/userdata/qemu-disks"
 	QEMUBaseDiskPath     = "/mnt/userdata/qemu-disks/ubuntu-base.qcow2"
 	QEMUCloudInitPath    = "/mnt/userdata/qemu-disks/cloud-init.iso"
 	QEMUMonitorSocket    = "/tmp/qemu-monitor.sock"
 	QEMUGuestAgentSocket = "/tmp/qga.sock"
+	QEMUEventsSocket     = "/tmp/qemu-events.sock"
+	ContainerHomePath    = "/mnt/userdata/container-home"
 	TempConfigPath       = "/tmp/tablestorage.json"
 )
 
@@ -146,9 +179,13 @@ const (
 	GlobalSharedStorageAccountName = "shellboxshared27"
 )
 
-// Timeout constants
+// Timeout and interval constants
 const (
-	GoldenVMSetupTimeout = 30 * time.Minute // Timeout for golden VM QEMU setup and SSH connectivity
+	GoldenVMSetupTimeout      = 30 * time.Minute // Timeout for golden VM QEMU setup and SSH connectivity
+	AllocationCleanupTimeout  = 5 * time.Minute  // Timeout for undoing a failed or cancelled allocation
+	MigrationTimeout          = time.Hour        // Timeout for a whole live migration, including the disk copy
+	RegistryReconcileInterval = 10 * time.Minute // How often the resource registry is reconciled with Resource Graph
+	RegistryOrphanGracePeriod = 15 * time.Minute // Registry entries younger than this may not be in Resource Graph yet
 )
 
 // Default polling options for Azure operations
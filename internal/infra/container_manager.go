@@ -0,0 +1,229 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"shellbox/internal/sshutil"
+)
+
+// Container box settings
+const (
+	ContainerBoxImage        = "localhost/shellbox-box:1"
+	ContainerBoxMemory       = "8g"
+	ContainerBoxCPUs         = "4"
+	ContainerBoxPidsLimit    = 4096
+	ContainerBoxStartTimeout = 2 * time.Minute
+)
+
+// containerBoxContainerfile builds the image container boxes run: an Ubuntu userland with
+// the same ubuntu user and SSH access the VM boxes have. The server's key is bind-mounted
+// into /etc/ssh/authorized_keys at run time.
+const containerBoxContainerfile = `FROM docker.io/library/ubuntu:24.04
+RUN apt-get update \
+ && apt-get install -y --no-install-recommends openssh-server sudo ca-certificates curl git vim less \
+ && rm -rf /var/lib/apt/lists/* \
+ && echo 'ubuntu ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/ubuntu \
+ && mkdir -p /run/sshd /etc/ssh/authorized_keys \
+ && printf 'PasswordAuthentication no\nAuthorizedKeysFile /etc/ssh/authorized_keys/%%u\n' >> /etc/ssh/sshd_config
+CMD ["/usr/sbin/sshd", "-D", "-e"]
+`
+
+// ContainerBoxHost describes where a container box for a volume runs
+type ContainerBoxHost struct {
+	Podman         string // podman command line, e.g. "sudo podman"
+	Prepare        string // shell commands run before the box starts, e.g. mounting the volume
+	HomeDir        string // persistent directory bind-mounted as the ubuntu user's home
+	AuthorizedKeys string // file with the keys the server connects to boxes with
+	PublishAddr    string // host address the box's SSH server is published on, empty for all
+}
+
+// ContainerHost runs podman for container boxes: on a pool instance over SSH, or on the
+// server's own host with the local backend
+type ContainerHost interface {
+	// ContainerBoxHost returns how volumeID's box is laid out on the host serving instanceIP
+	ContainerBoxHost(instanceIP, volumeID string) (*ContainerBoxHost, error)
+	// RunScript runs a shell script on the host serving instanceIP and returns its output
+	RunScript(ctx context.Context, instanceIP, script string) (string, error)
+}
+
+// ContainerManager implements BoxRuntime with Linux containers: namespaces and cgroups via
+// podman's OCI runtime, with the user's volume bind-mounted as their home directory
+type ContainerManager struct {
+	host ContainerHost
+}
+
+// NewContainerManager creates a container box runtime on host
+func NewContainerManager(host ContainerHost) *ContainerManager {
+	return &ContainerManager{host: host}
+}
+
+// containerBoxName names the box container; there is one box per instance address
+func containerBoxName(instanceIP string) string {
+	return "shellbox-box-" + strings.NewReplacer(".", "-", ":", "-").Replace(instanceIP)
+}
+
+// StartBox implements BoxRuntime
+func (cm *ContainerManager) StartBox(ctx context.Context, instanceIP, volumeID string, progress *ProgressReporter) error {
+	host, err := cm.host.ContainerBoxHost(instanceIP, volumeID)
+	if err != nil {
+		return err
+	}
+
+	publish := fmt.Sprintf("%d:22", BoxSSHPort)
+	if host.PublishAddr != "" {
+		publish = host.PublishAddr + ":" + publish
+	}
+
+	startCmd := fmt.Sprintf(`set -e
+PODMAN=%q
+%s
+if ! $PODMAN image exists %s; then
+    echo "Building container box image..."
+    $PODMAN build -t %s - <<'EOFMARKER'
+%sEOFMARKER
+fi
+
+$PODMAN run -d --replace --name %s \
+    --hostname box \
+    --memory %s --cpus %s --pids-limit %d \
+    -p %s \
+    -v %q:/home/ubuntu \
+    -v %q:/etc/ssh/authorized_keys/ubuntu:ro \
+    %s
+`,
+		host.Podman,
+		host.Prepare,
+		ContainerBoxImage,
+		ContainerBoxImage,
+		containerBoxContainerfile,
+		containerBoxName(instanceIP),
+		ContainerBoxMemory, ContainerBoxCPUs, ContainerBoxPidsLimit,
+		publish,
+		host.HomeDir,
+		host.AuthorizedKeys,
+		ContainerBoxImage)
+
+	slog.Info("Starting container box", "instanceIP", instanceIP, "volumeID", volumeID)
+	err = progress.Step("Starting container", func() error {
+		output, err := cm.host.RunScript(ctx, instanceIP, startCmd)
+		if err != nil {
+			slog.Error("Failed to start container box", "error", err, "output", output)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+
+	return progress.Step("Waiting for SSH", func() error {
+		return RetryOperation(ctx, func(ctx context.Context) error {
+			return checkSSHBanner(ctx, net.JoinHostPort(instanceIP, strconv.Itoa(BoxSSHPort)))
+		}, ContainerBoxStartTimeout, time.Second, "container box SSH")
+	})
+}
+
+// StopBox implements BoxRuntime. The container is removed; the home directory stays on the volume.
+func (cm *ContainerManager) StopBox(ctx context.Context, instanceIP string) error {
+	host, err := cm.host.ContainerBoxHost(instanceIP, "")
+	if err != nil {
+		return err
+	}
+
+	stopCmd := fmt.Sprintf("%s rm -f -t 10 %s || true", host.Podman, containerBoxName(instanceIP))
+	if output, err := cm.host.RunScript(ctx, instanceIP, stopCmd); err != nil {
+		slog.Warn("Error stopping container box", "instanceIP", instanceIP, "error", err, "output", output)
+	}
+
+	slog.Info("container box stopped", "instanceIP", instanceIP)
+	return nil
+}
+
+// BoxRunning implements BoxChecker by asking podman whether the box container runs
+func (cm *ContainerManager) BoxRunning(ctx context.Context, instanceIP string) (bool, error) {
+	host, err := cm.host.ContainerBoxHost(instanceIP, "")
+	if err != nil {
+		return false, err
+	}
+
+	checkCmd := fmt.Sprintf("%s inspect -f '{{.State.Running}}' %s 2>/dev/null || true", host.Podman, containerBoxName(instanceIP))
+	output, err := cm.host.RunScript(ctx, instanceIP, checkCmd)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect container box: %w", err)
+	}
+	return strings.TrimSpace(output) == "true", nil
+}
+
+// sshContainerHost runs container boxes on cloud pool instances. The volume is the data
+// disk the VM runtime uses too; container boxes keep their home in a directory on it.
+type sshContainerHost struct {
+	dataDisk string // path the instances see the volume at
+}
+
+// ContainerBoxHost implements ContainerHost
+func (h sshContainerHost) ContainerBoxHost(_, _ string) (*ContainerBoxHost, error) {
+	return &ContainerBoxHost{
+		Podman: "sudo podman",
+		Prepare: `
+command -v podman >/dev/null || { sudo apt-get update && sudo apt-get install -y podman; }
+
+while [ ! -e ` + h.dataDisk + ` ]; do
+    echo "Waiting for data disk..."
+    sleep 2
+done
+if ! mountpoint -q /mnt/userdata; then
+    sudo mkdir -p /mnt/userdata
+    sudo mount ` + h.dataDisk + ` /mnt/userdata
+fi
+if [ ! -d ` + ContainerHomePath + ` ]; then
+    sudo mkdir -p ` + ContainerHomePath + `
+    sudo chown 1000:1000 ` + ContainerHomePath + `
+fi`,
+		HomeDir:        ContainerHomePath,
+		AuthorizedKeys: "/home/" + AdminUsername + "/.ssh/authorized_keys",
+	}, nil
+}
+
+// RunScript implements ContainerHost
+func (sshContainerHost) RunScript(ctx context.Context, instanceIP, script string) (string, error) {
+	return sshutil.ExecuteCommandWithOutput(ctx, script, AdminUsername, instanceIP)
+}
+
+// ContainerBoxHost implements ContainerHost for the local backend: the box's home lives in
+// the volume directory and its SSH port is published on the slot's loopback address
+func (h *LocalHost) ContainerBoxHost(instanceIP, volumeID string) (*ContainerBoxHost, error) {
+	keys := filepath.Join(h.goldenDir(), "authorized_keys")
+	if err := os.WriteFile(keys, []byte(h.config.SSHPublicKey+"\n"), 0o644); err != nil { // #nosec G306 -- public key, must be readable in the box
+		return nil, fmt.Errorf("failed to write authorized keys: %w", err)
+	}
+
+	// Boxes run rootful so their ubuntu user owns the home directory as uid 1000 on the host too
+	sudo := ""
+	if os.Geteuid() != 0 {
+		sudo = "sudo -n "
+	}
+	home := filepath.Join(h.volumeDir(volumeID), "home")
+	return &ContainerBoxHost{
+		Podman:         sudo + "podman",
+		Prepare:        fmt.Sprintf("if [ ! -d %[1]q ]; then mkdir -p %[1]q && %[2]schown 1000:1000 %[1]q; fi", home, sudo),
+		HomeDir:        home,
+		AuthorizedKeys: keys,
+		PublishAddr:    instanceIP,
+	}, nil
+}
+
+// RunScript implements ContainerHost by running script with the local shell
+func (h *LocalHost) RunScript(ctx context.Context, _, script string) (string, error) {
+	// #nosec G204 -- scripts are built by ContainerManager
+	output, err := exec.CommandContext(ctx, "bash", "-c", script).CombinedOutput()
+	return string(output), err
+}
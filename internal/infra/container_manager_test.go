@@ -0,0 +1,132 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeContainerHost records the scripts container boxes run and answers them with run
+type fakeContainerHost struct {
+	mu      sync.Mutex
+	scripts []string
+	run     func(script string) (string, error)
+}
+
+func (h *fakeContainerHost) ContainerBoxHost(instanceIP, volumeID string) (*ContainerBoxHost, error) {
+	return &ContainerBoxHost{
+		Podman:         "podman",
+		Prepare:        "mount-volume " + volumeID,
+		HomeDir:        "/volumes/" + volumeID + "/home",
+		AuthorizedKeys: "/etc/shellbox/authorized_keys",
+		PublishAddr:    instanceIP,
+	}, nil
+}
+
+func (h *fakeContainerHost) RunScript(_ context.Context, _, script string) (string, error) {
+	h.mu.Lock()
+	h.scripts = append(h.scripts, script)
+	h.mu.Unlock()
+	if h.run == nil {
+		return "", nil
+	}
+	return h.run(script)
+}
+
+// listenBoxSSH serves an SSH banner on BoxSSHPort of a loopback address and returns the address
+func listenBoxSSH(t *testing.T) string {
+	t.Helper()
+	const ip = "127.0.9.9"
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(BoxSSHPort)))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", ip, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+			conn.Close()
+		}
+	}()
+	return ip
+}
+
+func TestContainerStartBox(t *testing.T) {
+	ip := listenBoxSSH(t)
+	host := &fakeContainerHost{}
+	containers := NewContainerManager(host)
+
+	if err := containers.StartBox(context.Background(), ip, "vol-1", nil); err != nil {
+		t.Fatalf("StartBox: %v", err)
+	}
+	if len(host.scripts) != 1 {
+		t.Fatalf("ran %d scripts, want 1", len(host.scripts))
+	}
+	script := host.scripts[0]
+	for _, want := range []string{
+		"mount-volume vol-1\n",
+		"$PODMAN run -d --replace --name shellbox-box-127-0-9-9",
+		"--memory " + ContainerBoxMemory + " --cpus " + ContainerBoxCPUs + " --pids-limit " + strconv.Itoa(ContainerBoxPidsLimit),
+		"-p " + ip + ":" + strconv.Itoa(BoxSSHPort) + ":22",
+		`-v "/volumes/vol-1/home":/home/ubuntu`,
+		`-v "/etc/shellbox/authorized_keys":/etc/ssh/authorized_keys/ubuntu:ro`,
+		"$PODMAN build -t " + ContainerBoxImage,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("start script lacks %q:\n%s", want, script)
+		}
+	}
+	if strings.Index(script, "mount-volume") > strings.Index(script, "$PODMAN run") {
+		t.Errorf("box started before its volume was prepared:\n%s", script)
+	}
+}
+
+func TestContainerStartBoxFailure(t *testing.T) {
+	failed := errors.New("exit status 125")
+	host := &fakeContainerHost{run: func(string) (string, error) { return "Error: no space left", failed }}
+	containers := NewContainerManager(host)
+
+	// The box isn't waited for when podman failed
+	if err := containers.StartBox(context.Background(), "127.0.9.10", "vol-1", nil); !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the podman failure", err)
+	}
+	if len(host.scripts) != 1 {
+		t.Errorf("ran %d scripts, want 1", len(host.scripts))
+	}
+}
+
+func TestContainerStopAndCheck(t *testing.T) {
+	ctx := context.Background()
+	state := "true\n"
+	host := &fakeContainerHost{run: func(script string) (string, error) {
+		if strings.Contains(script, " inspect ") {
+			return state, nil
+		}
+		return "", errors.New("no such container")
+	}}
+	containers := NewContainerManager(host)
+
+	if running, err := containers.BoxRunning(ctx, "10.0.0.5"); err != nil || !running {
+		t.Errorf("got %v, %v, want running", running, err)
+	}
+	state = "false\n"
+	if running, err := containers.BoxRunning(ctx, "10.0.0.5"); err != nil || running {
+		t.Errorf("got %v, %v, want stopped", running, err)
+	}
+
+	// Stopping a box that is gone already is fine, the volume keeps the home directory
+	if err := containers.StopBox(ctx, "10.0.0.5"); err != nil {
+		t.Fatalf("StopBox: %v", err)
+	}
+	if script := host.scripts[len(host.scripts)-1]; script != "podman rm -f -t 10 shellbox-box-10-0-0-5 || true" {
+		t.Errorf("got stop script %q", script)
+	}
+}
@@ -0,0 +1,359 @@
+package infra
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"shellbox/internal/sshutil"
+	"strconv"
+	"strings"
+)
+
+// Egress policy modes
+const (
+	EgressAllowAll  = "allow-all" // the box may connect anywhere, the default
+	EgressDenyAll   = "deny-all"  // the box may only answer connections to it
+	EgressAllowlist = "allowlist" // the box may connect to EgressPolicy.Allow and resolve names
+)
+
+// Egress enforcement on the instance
+const (
+	egressTable     = "shellbox_egress" // nftables table of the egress rules
+	egressCgroup    = "shellbox-qemu"   // cgroup of QEMU, whose sockets carry the traffic of SLIRP boxes
+	egressDNSServer = "8.8.8.8"         // resolver of the boxes, see boxQEMUConfig and boxTapNetwork
+)
+
+// egressDeniedCounters are the nftables counters of denied packets, by protocol
+var egressDeniedCounters = []string{"denied_tcp", "denied_udp", "denied_other"}
+
+// hostnamePattern matches the hostnames egress rules accept, which end up in shell scripts
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// EgressPolicy limits where a box can connect to. It is kept on the box's volume and
+// enforced with nftables on the instance: on the bridge of BoxRuntimeBridgedVM boxes and
+// on the sockets of QEMU, which carries the traffic of user-mode networking.
+type EgressPolicy struct {
+	Mode  string       `json:"mode"`
+	Allow []EgressRule `json:"allow,omitempty"` // destinations of EgressAllowlist
+}
+
+// EgressRule is a destination a box with an allowlist may connect to. Hostnames are
+// resolved whenever the policy is applied.
+type EgressRule struct {
+	Host string `json:"host"`           // hostname, IP address or CIDR
+	Port int    `json:"port,omitempty"` // TCP and UDP port, 0 for any
+}
+
+// EgressDenied counts the packets a box's egress policy denied since it was applied
+type EgressDenied struct {
+	TCP   uint64
+	UDP   uint64
+	Other uint64
+}
+
+// ParseEgressRule parses a destination such as "github.com:22", "10.1.0.0/16" or "[2001:db8::1]:443"
+func ParseEgressRule(s string) (EgressRule, error) {
+	host, portString := s, ""
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		var err error
+		if host, portString, err = net.SplitHostPort(s); err != nil {
+			return EgressRule{}, fmt.Errorf("invalid destination %q: %w", s, err)
+		}
+	}
+
+	rule := EgressRule{Host: host}
+	if portString != "" {
+		port, err := strconv.Atoi(portString)
+		if err != nil || port < 1 || port > 65535 {
+			return EgressRule{}, fmt.Errorf("invalid port in destination %q", s)
+		}
+		rule.Port = port
+	}
+	if err := rule.validate(); err != nil {
+		return EgressRule{}, err
+	}
+	return rule, nil
+}
+
+func (r EgressRule) validate() error {
+	if _, _, err := net.ParseCIDR(r.Host); err == nil {
+		return nil
+	}
+	if net.ParseIP(r.Host) != nil || hostnamePattern.MatchString(r.Host) {
+		return nil
+	}
+	return fmt.Errorf("invalid destination host %q: must be a hostname, IP address or CIDR", r.Host)
+}
+
+func (r EgressRule) String() string {
+	if r.Port == 0 {
+		return r.Host
+	}
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// Validate checks the policy before it is stored
+func (p *EgressPolicy) Validate() error {
+	switch p.Mode {
+	case EgressAllowAll, EgressDenyAll:
+		if len(p.Allow) > 0 {
+			return fmt.Errorf("%s policy takes no destinations", p.Mode)
+		}
+	case EgressAllowlist:
+		if len(p.Allow) == 0 {
+			return fmt.Errorf("allowlist needs at least one destination")
+		}
+		for _, rule := range p.Allow {
+			if err := rule.validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid egress mode %q: must be %s, %s or %s", p.Mode, EgressAllowAll, EgressDenyAll, EgressAllowlist)
+	}
+	return nil
+}
+
+func (p *EgressPolicy) String() string {
+	if p.Mode != EgressAllowlist {
+		return p.Mode
+	}
+	destinations := make([]string, len(p.Allow))
+	for i, rule := range p.Allow {
+		destinations[i] = rule.String()
+	}
+	return p.Mode + " " + strings.Join(destinations, " ")
+}
+
+// EgressPolicy implements EgressRuntime by reading the policy from the volume
+func (qm *QEMUManager) EgressPolicy(ctx context.Context, instanceIP string) (*EgressPolicy, error) {
+	result, err := sshutil.Run(ctx, "cat "+EgressPolicyPath, AdminUsername, instanceIP)
+	if err != nil {
+		if result != nil && result.ExitCode > 0 {
+			return &EgressPolicy{Mode: EgressAllowAll}, nil
+		}
+		return nil, fmt.Errorf("failed to read egress policy: %w", err)
+	}
+	var policy EgressPolicy
+	if err := json.Unmarshal([]byte(result.Stdout), &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse egress policy: %w", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid egress policy on volume: %w", err)
+	}
+	return &policy, nil
+}
+
+// SetEgressPolicy implements EgressRuntime by recording policy on the volume and applying it
+func (qm *QEMUManager) SetEgressPolicy(ctx context.Context, instanceIP string, policy *EgressPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to encode egress policy: %w", err)
+	}
+	write := fmt.Sprintf("echo %s | sudo tee %s > /dev/null", shellQuote(string(data)), EgressPolicyPath)
+	if err := sshutil.ExecuteCommand(ctx, write, AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("failed to write egress policy: %w", err)
+	}
+	return applyEgressPolicy(ctx, instanceIP, policy)
+}
+
+// EgressDenied implements EgressRuntime by reading the counters of the applied policy
+func (qm *QEMUManager) EgressDenied(ctx context.Context, instanceIP string) (*EgressDenied, error) {
+	result, err := sshutil.Run(ctx, "sudo nft -j list counters table inet "+egressTable, AdminUsername, instanceIP)
+	if err != nil {
+		if result != nil && result.ExitCode > 0 {
+			// An allow-all policy has no table
+			return &EgressDenied{}, nil
+		}
+		return nil, fmt.Errorf("failed to read egress counters: %w", err)
+	}
+
+	var listing struct {
+		Nftables []struct {
+			Counter *struct {
+				Name    string `json:"name"`
+				Packets uint64 `json:"packets"`
+			} `json:"counter"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal([]byte(result.Stdout), &listing); err != nil {
+		return nil, fmt.Errorf("failed to parse egress counters: %w", err)
+	}
+	denied := &EgressDenied{}
+	for _, entry := range listing.Nftables {
+		if entry.Counter == nil {
+			continue
+		}
+		switch entry.Counter.Name {
+		case "denied_tcp":
+			denied.TCP = entry.Counter.Packets
+		case "denied_udp":
+			denied.UDP = entry.Counter.Packets
+		case "denied_other":
+			denied.Other = entry.Counter.Packets
+		}
+	}
+	return denied, nil
+}
+
+// applyStoredEgressPolicy applies the policy on the volume to a box that was just started
+func (qm *QEMUManager) applyStoredEgressPolicy(ctx context.Context, instanceIP string) error {
+	policy, err := qm.EgressPolicy(ctx, instanceIP)
+	if err != nil {
+		return err
+	}
+	return applyEgressPolicy(ctx, instanceIP, policy)
+}
+
+// applyEgressPolicy replaces the instance's egress rules with policy's in one nftables
+// transaction, so the box never runs unrestricted in between
+func applyEgressPolicy(ctx context.Context, instanceIP string, policy *EgressPolicy) error {
+	slog.Info("Applying egress policy", "instanceIP", instanceIP, "policy", policy.String())
+	if err := sshutil.ExecuteCommand(ctx, egressPolicyScript(policy), AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("failed to apply egress policy: %w", err)
+	}
+	return nil
+}
+
+// egressPolicyScript renders the instance script enforcing policy. Traffic from the tap
+// bridge and from the sockets of QEMU's cgroup goes through the egress chain, which ends
+// in the counted rejects. Counters survive policy changes but not a move to allow-all.
+func egressPolicyScript(policy *EgressPolicy) string {
+	if policy.Mode == EgressAllowAll {
+		return "sudo nft delete table inet " + egressTable + " 2> /dev/null || true\n"
+	}
+
+	rule := func(chain, spec string) string {
+		return fmt.Sprintf("add rule inet %s %s %s\n", egressTable, chain, spec)
+	}
+
+	var head strings.Builder
+	fmt.Fprintf(&head, "table inet %s {\n", egressTable)
+	for _, counter := range egressDeniedCounters {
+		fmt.Fprintf(&head, "\tcounter %s {}\n", counter)
+	}
+	head.WriteString("\tchain egress {}\n")
+	for _, hook := range []string{"forward", "input", "output"} {
+		fmt.Fprintf(&head, "\tchain %s { type filter hook %s priority filter; policy accept; }\n", hook, hook)
+	}
+	head.WriteString("}\n")
+	for _, chain := range []string{"egress", "forward", "input", "output"} {
+		fmt.Fprintf(&head, "flush chain inet %s %s\n", egressTable, chain)
+	}
+	head.WriteString(rule("forward", fmt.Sprintf("iifname %q jump egress", boxTapNetwork.Bridge)))
+	head.WriteString(rule("input", fmt.Sprintf("iifname %q jump egress", boxTapNetwork.Bridge)))
+	head.WriteString(rule("output", fmt.Sprintf("socket cgroupv2 level 1 %q jump egress", egressCgroup)))
+	head.WriteString(rule("egress", "ct state established,related accept"))
+
+	var resolved strings.Builder
+	if policy.Mode == EgressAllowlist {
+		head.WriteString(rule("egress", fmt.Sprintf("ip daddr %s meta l4proto { tcp, udp } th dport 53 accept", egressDNSServer)))
+		for _, allow := range policy.Allow {
+			match := ""
+			if allow.Port != 0 {
+				match = fmt.Sprintf(" meta l4proto { tcp, udp } th dport %d", allow.Port)
+			}
+			if ip, _, err := net.ParseCIDR(allow.Host); err == nil {
+				head.WriteString(rule("egress", fmt.Sprintf("%s daddr %s%s accept", addressFamily(ip), allow.Host, match)))
+			} else if ip := net.ParseIP(allow.Host); ip != nil {
+				head.WriteString(rule("egress", fmt.Sprintf("%s daddr %s%s accept", addressFamily(ip), allow.Host, match)))
+			} else {
+				// Hostnames are resolved on the instance, which sees the same DNS as the box
+				fmt.Fprintf(&resolved, `for addr in $(getent ahosts %s | awk '{print $1}' | sort -u); do
+    case $addr in *:*) family=ip6 ;; *) family=ip ;; esac
+    echo "add rule inet %s egress $family daddr $addr%s accept"
+done
+`, allow.Host, egressTable, match)
+			}
+		}
+	}
+
+	var tail strings.Builder
+	tail.WriteString(rule("egress", `meta l4proto tcp counter name "denied_tcp" reject with tcp reset`))
+	tail.WriteString(rule("egress", `meta l4proto udp counter name "denied_udp" reject`))
+	tail.WriteString(rule("egress", `counter name "denied_other" drop`))
+
+	return fmt.Sprintf(`
+# Put QEMU in the cgroup the egress rules match its sockets by
+sudo mkdir -p /sys/fs/cgroup/%[1]s
+for pid in $(pgrep -x qemu-system-x86); do
+    echo $pid | sudo tee /sys/fs/cgroup/%[1]s/cgroup.procs > /dev/null
+done
+
+{
+cat << 'EOFMARKER'
+%[2]sEOFMARKER
+%[3]scat << 'EOFMARKER'
+%[4]sEOFMARKER
+} | sudo nft -f -
+`, egressCgroup, head.String(), resolved.String(), tail.String())
+}
+
+// allowEgressTo lets QEMU on instanceIP reach ports of ip despite the box's egress policy,
+// for the traffic of a live migration. Without a policy there is nothing to allow.
+func allowEgressTo(ctx context.Context, instanceIP, ip string, ports ...int) error {
+	portList := make([]string, len(ports))
+	for i, port := range ports {
+		portList[i] = strconv.Itoa(port)
+	}
+	cmd := fmt.Sprintf("if sudo nft list table inet %[1]s > /dev/null 2>&1; then sudo nft insert rule inet %[1]s egress %[2]s daddr %[3]s tcp dport { %[4]s } accept; fi",
+		egressTable, addressFamily(net.ParseIP(ip)), ip, strings.Join(portList, ", "))
+	if err := sshutil.ExecuteCommand(ctx, cmd, AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("failed to allow egress to %s: %w", ip, err)
+	}
+	return nil
+}
+
+// addressFamily returns the nftables family of ip, "ip" or "ip6"
+func addressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+// SetBoxEgressPolicy records and applies the egress policy of a user's running box. The
+// policy is kept on the box's volume, so it sticks across connects.
+func (ra *ResourceAllocator) SetBoxEgressPolicy(ctx context.Context, userID, boxName string, policy *EgressPolicy) error {
+	allocation, egress, err := ra.egressBox(ctx, userID, boxName)
+	if err != nil {
+		return err
+	}
+	return egress.SetEgressPolicy(ctx, allocation.InstanceIP, policy)
+}
+
+// BoxEgressPolicy returns the egress policy of a user's running box
+func (ra *ResourceAllocator) BoxEgressPolicy(ctx context.Context, userID, boxName string) (*EgressPolicy, error) {
+	allocation, egress, err := ra.egressBox(ctx, userID, boxName)
+	if err != nil {
+		return nil, err
+	}
+	return egress.EgressPolicy(ctx, allocation.InstanceIP)
+}
+
+// egressBox returns the allocation of a user's running box and its runtime
+func (ra *ResourceAllocator) egressBox(ctx context.Context, userID, boxName string) (*AllocationEntity, EgressRuntime, error) {
+	allocation, err := ra.findBoxAllocation(ctx, userID, boxName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find box: %w", err)
+	}
+	if allocation == nil {
+		return nil, nil, ErrBoxNotRunning
+	}
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return nil, nil, err
+	}
+	egress, ok := runtime.(EgressRuntime)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s boxes have no egress policy", cmp.Or(allocation.Runtime, BoxRuntimeVM))
+	}
+	return allocation, egress, nil
+}
@@ -0,0 +1,134 @@
+package infra
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEgressRule(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want EgressRule
+	}{
+		{"github.com", EgressRule{Host: "github.com"}},
+		{"github.com:22", EgressRule{Host: "github.com", Port: 22}},
+		{"10.1.0.0/16", EgressRule{Host: "10.1.0.0/16"}},
+		{"1.2.3.4:443", EgressRule{Host: "1.2.3.4", Port: 443}},
+		{"2001:db8::1", EgressRule{Host: "2001:db8::1"}},
+		{"[2001:db8::1]:443", EgressRule{Host: "2001:db8::1", Port: 443}},
+		{"2001:db8::/32", EgressRule{Host: "2001:db8::/32"}},
+	} {
+		got, err := ParseEgressRule(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+		if got.String() != tt.in {
+			t.Errorf("%s: formats as %s", tt.in, got.String())
+		}
+	}
+
+	// Hosts end up in shell scripts
+	for _, in := range []string{"github.com:0", "github.com:65536", "github.com:ssh", "$(reboot)", "a b.com", "-rf", "host.:80", "[::1]"} {
+		if rule, err := ParseEgressRule(in); err == nil {
+			t.Errorf("%s: got %+v, want it refused", in, rule)
+		}
+	}
+}
+
+func TestEgressPolicyValidate(t *testing.T) {
+	allow := []EgressRule{{Host: "github.com", Port: 22}}
+	for _, tt := range []struct {
+		policy EgressPolicy
+		valid  bool
+	}{
+		{EgressPolicy{Mode: EgressAllowAll}, true},
+		{EgressPolicy{Mode: EgressDenyAll}, true},
+		{EgressPolicy{Mode: EgressAllowlist, Allow: allow}, true},
+		{EgressPolicy{Mode: EgressAllowlist}, false},
+		{EgressPolicy{Mode: EgressDenyAll, Allow: allow}, false},
+		{EgressPolicy{Mode: EgressAllowlist, Allow: []EgressRule{{Host: "; reboot"}}}, false},
+		{EgressPolicy{Mode: "open"}, false},
+	} {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid %v", tt.policy.String(), err, tt.valid)
+		}
+	}
+}
+
+// runEgressScript runs an egress policy script with sudo, pgrep and getent stubbed out
+// and returns the ruleset it hands to nft. getent resolves every name to addresses.
+func runEgressScript(t *testing.T, script string, addresses ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	ruleset := filepath.Join(dir, "ruleset")
+	stubs := map[string]string{
+		"sudo":   `if [ "$1" = nft ]; then cat > "$RULESET"; fi`,
+		"pgrep":  "echo 4242",
+		"getent": `for addr in $ADDRESSES; do echo "$addr STREAM $2"; echo "$addr DGRAM"; done`,
+	}
+	for name, body := range stubs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatalf("writing %s stub: %v", name, err)
+		}
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"), "RULESET="+ruleset, "ADDRESSES="+strings.Join(addresses, " "))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v\n%s\n%s", err, output, script)
+	}
+	data, err := os.ReadFile(ruleset)
+	if err != nil {
+		t.Fatalf("script didn't run nft: %v\n%s", err, script)
+	}
+	return string(data)
+}
+
+func TestEgressPolicyScript(t *testing.T) {
+	if script := egressPolicyScript(&EgressPolicy{Mode: EgressAllowAll}); script != "sudo nft delete table inet shellbox_egress 2> /dev/null || true\n" {
+		t.Errorf("allow-all renders %q, want the table deleted", script)
+	}
+
+	// Both the tap bridge and QEMU's own sockets go through the egress chain
+	denyAll := runEgressScript(t, egressPolicyScript(&EgressPolicy{Mode: EgressDenyAll}))
+	for _, want := range []string{
+		"table inet shellbox_egress {\n\tcounter denied_tcp {}\n",
+		"\tchain output { type filter hook output priority filter; policy accept; }\n",
+		"flush chain inet shellbox_egress egress\n",
+		"add rule inet shellbox_egress forward iifname \"shellbox0\" jump egress\n",
+		"add rule inet shellbox_egress output socket cgroupv2 level 1 \"shellbox-qemu\" jump egress\n",
+		"add rule inet shellbox_egress egress ct state established,related accept\n",
+	} {
+		if !strings.Contains(denyAll, want) {
+			t.Errorf("deny-all ruleset lacks %q:\n%s", want, denyAll)
+		}
+	}
+	if strings.Contains(denyAll, "dport 53") {
+		t.Errorf("deny-all ruleset lets DNS through:\n%s", denyAll)
+	}
+	// The rejects come last, after whatever the policy accepts
+	if !strings.HasSuffix(denyAll, `add rule inet shellbox_egress egress meta l4proto tcp counter name "denied_tcp" reject with tcp reset
+add rule inet shellbox_egress egress meta l4proto udp counter name "denied_udp" reject
+add rule inet shellbox_egress egress counter name "denied_other" drop
+`) {
+		t.Errorf("deny-all ruleset doesn't end in the counted rejects:\n%s", denyAll)
+	}
+
+	allowlist := runEgressScript(t, egressPolicyScript(&EgressPolicy{Mode: EgressAllowlist, Allow: []EgressRule{
+		{Host: "10.1.0.0/16"},
+		{Host: "2001:db8::1", Port: 443},
+		{Host: "github.com", Port: 22},
+	}}), "140.82.112.3", "2606:50c0::1")
+	want := `add rule inet shellbox_egress egress ip daddr 8.8.8.8 meta l4proto { tcp, udp } th dport 53 accept
+add rule inet shellbox_egress egress ip daddr 10.1.0.0/16 accept
+add rule inet shellbox_egress egress ip6 daddr 2001:db8::1 meta l4proto { tcp, udp } th dport 443 accept
+add rule inet shellbox_egress egress ip daddr 140.82.112.3 meta l4proto { tcp, udp } th dport 22 accept
+add rule inet shellbox_egress egress ip6 daddr 2606:50c0::1 meta l4proto { tcp, udp } th dport 22 accept
+add rule inet shellbox_egress egress meta l4proto tcp counter name "denied_tcp" reject with tcp reset
+`
+	if !strings.Contains(allowlist, want) {
+		t.Errorf("allowlist ruleset lacks\n%s\nin\n%s", want, allowlist)
+	}
+}
@@ -0,0 +1,499 @@
+package infra
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"shellbox/internal/qmp"
+	"shellbox/internal/sshutil"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exposure limits
+const (
+	MaxExposuresPerBox   = 10 // ports of a box forwarded for exposures and previews
+	exposurePortAttempts = 20 // random ports tried before giving up on finding a free one
+	exposureDialTimeout  = 10 * time.Second
+	exposureSetupTimeout = 30 * time.Second // bound on forwarding a port again before a connection
+)
+
+// ErrTooManyExposures is returned when forwarding another port of a box that has MaxExposuresPerBox
+var ErrTooManyExposures = fmt.Errorf("box already has %d exposed ports", MaxExposuresPerBox)
+
+// ExposePort implements PortExposer. SLIRP forwards the port with a host forwarding rule
+// added through the monitor, a tap device with a DNAT rule like the one of BoxSSHPort.
+func (qm *QEMUManager) ExposePort(ctx context.Context, instanceIP string, port, guestPort int) error {
+	if qm.network == QEMUNetworkTap {
+		if err := sshutil.ExecuteCommand(ctx, boxTapNetwork.exposeScript(port, guestPort), AdminUsername, instanceIP); err != nil {
+			return fmt.Errorf("failed to forward port %d: %w", port, err)
+		}
+		return nil
+	}
+	netdev, err := userNetdev(ctx, instanceIP)
+	if err != nil {
+		return err
+	}
+	err = withQMP(ctx, instanceIP, func(client *qmp.Client) error {
+		return client.HumanMonitorCommand(ctx, fmt.Sprintf("hostfwd_add %s tcp::%d-:%d", netdev, port, guestPort))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forward port %d: %w", port, err)
+	}
+	return nil
+}
+
+// userNetdev returns the ID of the box's user-mode netdev, which host forwarding rules go on
+func userNetdev(ctx context.Context, instanceIP string) (string, error) {
+	config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+	if err != nil {
+		return "", err
+	}
+	for _, netdev := range config.Netdevs {
+		if netdev.Type == "user" {
+			return netdev.ID, nil
+		}
+	}
+	return "", errors.New("box has no user-mode network")
+}
+
+// boxForward is a port of a box's instance forwarded to a port of the box, which the
+// bastion can reach. Exposures and previews share the forward of a box port.
+type boxForward struct {
+	instanceID   string
+	instanceIP   string
+	instancePort int
+	public       bool // previews need no token, see PreviewProxy
+	stale        bool // refused a connection, set up again before the next
+}
+
+// forwardSetup is a forward of a box port being set up. Callers wanting the same forward
+// meanwhile wait for it instead of setting it up again.
+type forwardSetup struct {
+	done     chan struct{} // closed once forward and err are set
+	forward  *boxForward   // the forward being set up, once its port is chosen
+	released []string      // instances released meanwhile; the box may have run on one
+	err      error
+}
+
+// forwardKey identifies the forward of a box port. A box runs on one instance at a time.
+type forwardKey struct {
+	userID    string
+	boxName   string
+	guestPort int
+}
+
+// Exposure is a port of a box that is reachable from the internet. The bastion listens on
+// Port and proxies connections from the allowed sources through the forward of GuestPort.
+type Exposure struct {
+	UserID     string
+	BoxName    string
+	InstanceID string
+	GuestPort  int
+	Port       int            // on the bastion
+	Allowed    []netip.Prefix // sources that may connect
+	CreatedAt  time.Time
+
+	listener net.Listener
+}
+
+// ExposureManager keeps the forwarded and exposed ports of the boxes connected through
+// this server. They live in memory only and end when the box is released, moves to
+// another instance or the server restarts.
+type ExposureManager struct {
+	allocator *ResourceAllocator
+
+	mu        sync.Mutex
+	forwards  map[forwardKey]*boxForward
+	setups    map[forwardKey]*forwardSetup // forwards being set up, without m.mu held
+	exposures map[int]*Exposure            // by bastion port
+}
+
+// NewExposureManager creates an exposure manager. Register its ReleaseInstance with
+// ResourceAllocator.OnRelease so forwards and exposures end with their box.
+func NewExposureManager(allocator *ResourceAllocator) *ExposureManager {
+	return &ExposureManager{
+		allocator: allocator,
+		forwards:  make(map[forwardKey]*boxForward),
+		setups:    make(map[forwardKey]*forwardSetup),
+		exposures: make(map[int]*Exposure),
+	}
+}
+
+// Expose makes guestPort of a user's running box reachable from the allowed sources on a
+// random port of the bastion. Exposing a port again replaces its allowed sources.
+func (m *ExposureManager) Expose(ctx context.Context, userID, boxName string, guestPort int, allowed []netip.Prefix) (Exposure, error) {
+	if len(allowed) == 0 {
+		return Exposure{}, errors.New("no allowed sources")
+	}
+
+	key := forwardKey{userID, boxName, guestPort}
+	if exposure, ok := m.reexpose(key, allowed); ok {
+		return exposure, nil
+	}
+	forward, err := m.forward(ctx, key)
+	if err != nil {
+		return Exposure{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Another Expose may have won the race, or the box may have gone meanwhile
+	if exposure, ok := m.reexposeLocked(key, allowed); ok {
+		return exposure, nil
+	}
+	if m.forwards[key] != forward {
+		return Exposure{}, errForwardGone
+	}
+	listener, port, err := m.listen()
+	if err != nil {
+		return Exposure{}, err
+	}
+	exposure := &Exposure{
+		UserID:     userID,
+		BoxName:    boxName,
+		InstanceID: forward.instanceID,
+		GuestPort:  guestPort,
+		Port:       port,
+		Allowed:    allowed,
+		CreatedAt:  time.Now(),
+		listener:   listener,
+	}
+	m.exposures[port] = exposure
+	go m.serve(exposure)
+
+	slog.Info("Exposed box port", "userID", userID, "boxName", boxName, "guestPort", guestPort, "port", port, "allowed", allowed)
+	return *exposure, nil
+}
+
+// reexpose replaces the allowed sources of an existing exposure of a box port, reporting
+// whether there is one
+func (m *ExposureManager) reexpose(key forwardKey, allowed []netip.Prefix) (Exposure, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reexposeLocked(key, allowed)
+}
+
+// reexposeLocked is reexpose for callers holding m.mu
+func (m *ExposureManager) reexposeLocked(key forwardKey, allowed []netip.Prefix) (Exposure, bool) {
+	for _, exposure := range m.exposures {
+		if exposure.UserID == key.userID && exposure.BoxName == key.boxName && exposure.GuestPort == key.guestPort {
+			exposure.Allowed = allowed
+			return *exposure, true
+		}
+	}
+	return Exposure{}, false
+}
+
+// List returns the exposures of a user's boxes, by box and guest port
+func (m *ExposureManager) List(userID string) []Exposure {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var exposures []Exposure
+	for _, exposure := range m.exposures {
+		if exposure.UserID == userID {
+			exposures = append(exposures, *exposure)
+		}
+	}
+	slices.SortFunc(exposures, func(a, b Exposure) int {
+		return cmp.Or(cmp.Compare(a.BoxName, b.BoxName), cmp.Compare(a.GuestPort, b.GuestPort))
+	})
+	return exposures
+}
+
+// Forward forwards guestPort of a user's running box, so a preview of it is ready when
+// first opened
+func (m *ExposureManager) Forward(ctx context.Context, userID, boxName string, guestPort int) error {
+	_, err := m.forward(ctx, forwardKey{userID, boxName, guestPort})
+	return err
+}
+
+// SetPublic forwards guestPort of a user's running box and sets whether previews of it
+// need a token
+func (m *ExposureManager) SetPublic(ctx context.Context, userID, boxName string, guestPort int, public bool) error {
+	key := forwardKey{userID, boxName, guestPort}
+	forward, err := m.forward(ctx, key)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.forwards[key] != forward {
+		return errForwardGone
+	}
+	forward.public = public
+	return nil
+}
+
+// Public reports whether previews of guestPort of a user's box need no token
+func (m *ExposureManager) Public(userID, boxName string, guestPort int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	forward, ok := m.forwards[forwardKey{userID, boxName, guestPort}]
+	return ok && forward.public
+}
+
+// Dial connects to guestPort of a user's running box, forwarding the port first if it
+// isn't yet. A box restarted after a crash lost its forwards, so a forward that refuses
+// the connection is set up again and dialed once more.
+func (m *ExposureManager) Dial(ctx context.Context, userID, boxName string, guestPort int) (net.Conn, error) {
+	key := forwardKey{userID, boxName, guestPort}
+	var lastErr error
+	for range 2 {
+		forward, err := m.forward(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		dialer := net.Dialer{Timeout: exposureDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(forward.instanceIP, strconv.Itoa(forward.instancePort)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+
+		m.mu.Lock()
+		if m.forwards[key] == forward {
+			forward.stale = true
+		}
+		m.mu.Unlock()
+	}
+	return nil, fmt.Errorf("failed to connect to port %d of box '%s': %w", guestPort, boxName, lastErr)
+}
+
+// ReleaseInstance ends the forwards and exposures of the box on an instance that is being
+// released. The box stops with them, which takes its forwarding rules along.
+func (m *ExposureManager) ReleaseInstance(instanceID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, forward := range m.forwards {
+		if forward.instanceID == instanceID {
+			delete(m.forwards, key)
+		}
+	}
+	for _, setup := range m.setups {
+		setup.released = append(setup.released, instanceID)
+	}
+	for port, exposure := range m.exposures {
+		if exposure.InstanceID != instanceID {
+			continue
+		}
+		exposure.listener.Close()
+		delete(m.exposures, port)
+		slog.Info("Removed box port exposure", "userID", exposure.UserID, "boxName", exposure.BoxName, "guestPort", exposure.GuestPort, "port", port)
+	}
+}
+
+// errForwardGone is returned when a box is released while one of its ports is forwarded
+var errForwardGone = fmt.Errorf("%w: it was stopped while its port was forwarded", ErrBoxNotRunning)
+
+// forward returns the forward of a box port, setting it up on the box's instance if there
+// is none. The box is looked up and the port forwarded without m.mu held; callers wanting
+// the same forward meanwhile wait for the first one's setup.
+func (m *ExposureManager) forward(ctx context.Context, key forwardKey) (*boxForward, error) {
+	if key.guestPort < 1 || key.guestPort > 65535 {
+		return nil, fmt.Errorf("invalid port %d", key.guestPort)
+	}
+
+	m.mu.Lock()
+	forward, ok := m.forwards[key]
+	if ok && !forward.stale {
+		m.mu.Unlock()
+		return forward, nil
+	}
+	if setup, ok := m.setups[key]; ok {
+		m.mu.Unlock()
+		select {
+		case <-setup.done:
+			return setup.forward, setup.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	setup := &forwardSetup{done: make(chan struct{})}
+	m.setups[key] = setup
+	m.mu.Unlock()
+
+	forward, err := m.setUpForward(ctx, key, setup)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.setups, key)
+	if err == nil && slices.Contains(setup.released, forward.instanceID) {
+		err = errForwardGone
+	}
+	if err != nil {
+		forward = nil
+	} else {
+		m.forwards[key] = forward
+		slog.Info("Forwarded box port", "userID", key.userID, "boxName", key.boxName, "guestPort", key.guestPort, "instancePort", forward.instancePort)
+	}
+	setup.forward, setup.err = forward, err
+	close(setup.done)
+	return forward, err
+}
+
+// setUpForward finds the box of a forward and forwards its port on the box's instance
+func (m *ExposureManager) setUpForward(ctx context.Context, key forwardKey, setup *forwardSetup) (*boxForward, error) {
+	allocation, exposer, err := m.allocator.exposerBox(ctx, key.userID, key.boxName)
+	if err != nil {
+		return nil, err
+	}
+	forward, err := m.chooseForwardPort(key, allocation, setup)
+	if err != nil {
+		return nil, err
+	}
+	if err := exposer.ExposePort(ctx, allocation.InstanceIP, forward.instancePort, key.guestPort); err != nil {
+		return nil, err
+	}
+	return forward, nil
+}
+
+// chooseForwardPort picks the instance port of a forward being set up and records it in
+// setup, so concurrent setups on the same instance pick other ports. A stale forward keeps
+// its port while the box stays on its instance.
+func (m *ExposureManager) chooseForwardPort(key forwardKey, allocation *AllocationEntity, setup *forwardSetup) (*boxForward, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stale, ok := m.forwards[key]; ok && stale.instanceID == allocation.InstanceID {
+		setup.forward = &boxForward{instanceID: stale.instanceID, instanceIP: stale.instanceIP, instancePort: stale.instancePort, public: stale.public}
+		return setup.forward, nil
+	}
+	delete(m.forwards, key)
+
+	used := make(map[int]bool)
+	for _, other := range m.forwards {
+		if other.instanceID == allocation.InstanceID {
+			used[other.instancePort] = true
+		}
+	}
+	for _, other := range m.setups {
+		if other.forward != nil && other.forward.instanceID == allocation.InstanceID {
+			used[other.forward.instancePort] = true
+		}
+	}
+	if len(used) >= MaxExposuresPerBox {
+		return nil, ErrTooManyExposures
+	}
+	forward := &boxForward{instanceID: allocation.InstanceID, instanceIP: allocation.InstanceIP}
+	for range exposurePortAttempts {
+		if port := ExposurePortMin + rand.IntN(ExposurePortMax-ExposurePortMin+1); !used[port] {
+			forward.instancePort = port
+			break
+		}
+	}
+	if forward.instancePort == 0 {
+		return nil, errors.New("no free exposure port")
+	}
+	setup.forward = forward
+	return forward, nil
+}
+
+// listen opens a listener on a random free exposure port of the bastion. The caller
+// holds m.mu.
+func (m *ExposureManager) listen() (net.Listener, int, error) {
+	for range exposurePortAttempts {
+		port := ExposurePortMin + rand.IntN(ExposurePortMax-ExposurePortMin+1)
+		if _, taken := m.exposures[port]; taken {
+			continue
+		}
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return listener, port, nil
+		}
+	}
+	return nil, 0, errors.New("no free exposure port")
+}
+
+// serve accepts connections to an exposure until its listener is closed
+func (m *ExposureManager) serve(exposure *Exposure) {
+	for {
+		conn, err := exposure.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Exposure listener failed", "port", exposure.Port, "error", err)
+			}
+			return
+		}
+		go m.proxy(exposure, conn)
+	}
+}
+
+// proxy connects conn to the exposed box port if its source is allowed
+func (m *ExposureManager) proxy(exposure *Exposure, conn net.Conn) {
+	defer conn.Close()
+
+	source, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil || !m.allows(exposure, source.Addr().Unmap()) {
+		slog.Info("Rejected connection to exposed port", "port", exposure.Port, "source", conn.RemoteAddr())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exposureSetupTimeout)
+	target, err := m.Dial(ctx, exposure.UserID, exposure.BoxName, exposure.GuestPort)
+	cancel()
+	if err != nil {
+		slog.Warn("Failed to connect to exposed port", "port", exposure.Port, "error", err)
+		return
+	}
+	defer target.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(target, conn)
+		closeWrite(target)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, target)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// allows reports whether addr is one of the exposure's allowed sources
+func (m *ExposureManager) allows(exposure *Exposure, addr netip.Addr) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.ContainsFunc(exposure.Allowed, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// closeWrite passes the end of one direction of a proxied connection on to the other side
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+}
+
+// exposerBox finds a user's running box and its runtime for exposing ports
+func (ra *ResourceAllocator) exposerBox(ctx context.Context, userID, boxName string) (*AllocationEntity, PortExposer, error) {
+	allocation, err := ra.findBoxAllocation(ctx, userID, boxName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find box: %w", err)
+	}
+	if allocation == nil {
+		return nil, nil, ErrBoxNotRunning
+	}
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return nil, nil, err
+	}
+	exposer, ok := runtime.(PortExposer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s boxes can't expose ports", cmp.Or(allocation.Runtime, BoxRuntimeVM))
+	}
+	return allocation, exposer, nil
+}
@@ -0,0 +1,162 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestExposures allocates a box on an in-memory cloud and returns an exposure manager
+// for it
+func newTestExposures(t *testing.T, latency time.Duration) (*MemoryCloud, *ExposureManager, *AllocatedResources) {
+	t.Helper()
+	cloud := NewMemoryCloud(MemoryProviderConfig{Latency: latency})
+	provider := cloud.Provider()
+	fillPool(context.Background(), newTestPool(t, cloud, provider))
+	allocator := NewResourceAllocator(provider)
+	resources := allocateTestBox(t, allocator, "user-1", "dev1")
+	exposures := NewExposureManager(allocator)
+	allocator.OnRelease(exposures.ReleaseInstance)
+	return cloud, exposures, resources
+}
+
+// forwardConcurrently calls Forward for each of guestPorts at once and returns the errors
+func forwardConcurrently(exposures *ExposureManager, guestPorts []int) []error {
+	errs := make([]error, len(guestPorts))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, guestPort := range guestPorts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs[i] = exposures.Forward(context.Background(), "user-1", "dev1", guestPort)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+func TestForwardConcurrentSamePort(t *testing.T) {
+	cloud, exposures, resources := newTestExposures(t, 5*time.Millisecond)
+
+	guestPorts := make([]int, 20)
+	for i := range guestPorts {
+		guestPorts[i] = 8080
+	}
+	for i, err := range forwardConcurrently(exposures, guestPorts) {
+		if err != nil {
+			t.Fatalf("Forward %d: %v", i, err)
+		}
+	}
+
+	// Every caller got the one forward, which was set up once
+	forwarded := cloud.ForwardedPorts(resources.InstanceIP)
+	if len(forwarded) != 1 {
+		t.Fatalf("got %d forwarded ports %v, want 1", len(forwarded), forwarded)
+	}
+	for port, guestPort := range forwarded {
+		if guestPort != 8080 || port < ExposurePortMin || port > ExposurePortMax {
+			t.Fatalf("got port %d forwarded to %d, want an exposure port forwarded to 8080", port, guestPort)
+		}
+	}
+}
+
+func TestForwardConcurrentPortLimit(t *testing.T) {
+	cloud, exposures, resources := newTestExposures(t, 5*time.Millisecond)
+
+	guestPorts := make([]int, MaxExposuresPerBox+5)
+	for i := range guestPorts {
+		guestPorts[i] = 3000 + i
+	}
+	failed := 0
+	for i, err := range forwardConcurrently(exposures, guestPorts) {
+		switch {
+		case errors.Is(err, ErrTooManyExposures):
+			failed++
+		case err != nil:
+			t.Fatalf("Forward of port %d: %v", guestPorts[i], err)
+		}
+	}
+	if failed != 5 {
+		t.Errorf("got %d forwards refused, want 5", failed)
+	}
+
+	// Forwards set up side by side still get ports of their own
+	forwarded := cloud.ForwardedPorts(resources.InstanceIP)
+	if len(forwarded) != MaxExposuresPerBox {
+		t.Fatalf("got %d forwarded ports, want %d", len(forwarded), MaxExposuresPerBox)
+	}
+	seen := make(map[int]bool)
+	for _, guestPort := range forwarded {
+		if seen[guestPort] {
+			t.Errorf("guest port %d forwarded twice", guestPort)
+		}
+		seen[guestPort] = true
+	}
+}
+
+func TestForwardReleasedDuringSetup(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	cloud, exposures, resources := newTestExposures(t, latency)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- exposures.Forward(context.Background(), "user-1", "dev1", 8080)
+	}()
+	// The setup is still looking the box up when it goes away
+	time.Sleep(latency / 2)
+	exposures.ReleaseInstance(resources.InstanceID)
+
+	if err := <-done; !errors.Is(err, ErrBoxNotRunning) {
+		t.Fatalf("got %v, want ErrBoxNotRunning", err)
+	}
+	if exposures.Public("user-1", "dev1", 8080) {
+		t.Fatalf("forward of a released box is public")
+	}
+	exposures.mu.Lock()
+	forwards := len(exposures.forwards)
+	exposures.mu.Unlock()
+	if forwards != 0 {
+		t.Fatalf("got %d forwards kept after release, want 0", forwards)
+	}
+
+	// The box itself still runs, so the next request forwards the port afresh
+	if err := exposures.Forward(context.Background(), "user-1", "dev1", 8080); err != nil {
+		t.Fatalf("Forward after release: %v", err)
+	}
+	if got := len(cloud.ForwardedPorts(resources.InstanceIP)); got < 1 {
+		t.Fatalf("got %d forwarded ports, want the new forward", got)
+	}
+}
+
+func TestExposeConcurrent(t *testing.T) {
+	_, exposures, _ := newTestExposures(t, 5*time.Millisecond)
+	allowed := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := exposures.Expose(context.Background(), "user-1", "dev1", 8080, allowed); err != nil {
+				t.Errorf("Expose: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Concurrent exposes of one port share one listener on the bastion
+	list := exposures.List("user-1")
+	if len(list) != 1 {
+		t.Fatalf("got %d exposures, want 1", len(list))
+	}
+	exposures.ReleaseInstance(list[0].InstanceID)
+	if len(exposures.List("user-1")) != 0 {
+		t.Fatalf("exposure kept after release")
+	}
+}
@@ -0,0 +1,108 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps allocations and the event log in files under a directory, for backends
+// without a table service: allocations.json is rewritten on every change and events are
+// appended to events.jsonl.
+type FileStore struct {
+	dir string
+
+	mu          sync.Mutex
+	allocations map[string]AllocationEntity
+}
+
+// NewFileStore loads the allocations saved in dir
+func NewFileStore(dir string) (*FileStore, error) {
+	s := &FileStore{
+		dir:         dir,
+		allocations: make(map[string]AllocationEntity),
+	}
+
+	data, err := os.ReadFile(s.allocationsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allocations: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.allocations); err != nil {
+		return nil, fmt.Errorf("failed to parse allocations %s: %w", s.allocationsPath(), err)
+	}
+	return s, nil
+}
+
+func (s *FileStore) allocationsPath() string {
+	return filepath.Join(s.dir, "allocations.json")
+}
+
+// WriteAllocation implements AllocationStore. Finished allocations are dropped rather
+// than kept forever, since the file is rewritten on every change.
+func (s *FileStore) WriteAllocation(_ context.Context, allocation *AllocationEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if allocation.State == AllocationStateFree {
+		delete(s.allocations, allocation.RowKey)
+	} else {
+		s.allocations[allocation.RowKey] = *allocation
+	}
+
+	data, err := json.MarshalIndent(s.allocations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal allocations: %w", err)
+	}
+	return writeFileAtomic(s.allocationsPath(), data)
+}
+
+// ListActiveAllocations implements AllocationStore
+func (s *FileStore) ListActiveAllocations(_ context.Context) ([]AllocationEntity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	allocations := make([]AllocationEntity, 0, len(s.allocations))
+	for _, allocation := range s.allocations {
+		allocations = append(allocations, allocation)
+	}
+	return allocations, nil
+}
+
+// WriteEvent implements EventStore by appending the event to events.jsonl
+func (s *FileStore) WriteEvent(_ context.Context, event *EventLogEntity) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.dir, "events.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
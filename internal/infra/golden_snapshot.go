@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os/exec"
+	"shellbox/internal/qmp"
 	"shellbox/internal/sshutil"
 	"strings"
 	"time"
@@ -22,65 +23,27 @@ type QEMUScriptConfig struct {
 	SSHPublicKey  string
 	WorkingDir    string // "~" for home directory, "/mnt/userdata" for data volume
 	SSHPort       int
-	MountDataDisk bool // Whether to mount and format a data disk first
+	MountDataDisk bool           // Whether to mount and format a data disk first
+	DataDisk      DataDiskLayout // Where the data disk appears, AzureDataDisk if unset
 }
 
-// GenerateQEMUInitScript creates a QEMU initialization script with the given configuration
-func GenerateQEMUInitScript(config QEMUScriptConfig) (string, error) {
-	var mountSection string
-	if config.MountDataDisk {
-		mountSection = `
-# Wait for data disk to be available
-while [ ! -e /dev/disk/azure/scsi1/lun0 ]; do
-    echo "Waiting for data disk..."
-    sleep 5
-done
-
-# Format and mount data disk
-sudo mkfs.ext4 /dev/disk/azure/scsi1/lun0
-sudo mkdir -p /mnt/userdata
-sudo mount /dev/disk/azure/scsi1/lun0 /mnt/userdata
-echo '/dev/disk/azure/scsi1/lun0 /mnt/userdata ext4 defaults 0 2' | sudo tee -a /etc/fstab
-`
-	}
-
-	var ownershipSection string
-	if config.WorkingDir == "/mnt/userdata" {
-		ownershipSection = `
-# Set ownership for data volume
-sudo chown -R $USER:$USER /mnt/userdata/
-`
-	}
-
-	script := fmt.Sprintf(`#!/bin/bash
-
-echo "\$nrconf{restart} = 'a';" | sudo tee /etc/needrestart/conf.d/50-autorestart.conf
-%s
-# Install QEMU and dependencies
-sudo apt update
-sudo apt install qemu-utils qemu-system-x86 qemu-kvm qemu-system libvirt-daemon-system libvirt-clients bridge-utils genisoimage whois libguestfs-tools socat -y
-
-sudo usermod -aG kvm,libvirt $USER
-sudo systemctl enable --now libvirtd
-
-# Create QEMU environment
-mkdir -p %s/qemu-disks %s/qemu-memory
+// DataDiskLayout describes where instances see the data disk holding a box's volume
+type DataDiskLayout struct {
+	Device       string // block device the golden build formats
+	Path         string // stable path pool instances mount the disk from
+	Label        string // filesystem label the golden build sets, if Path relies on one
+	MountOptions string // fstab options for the disk
+}
 
-# Pre-allocate memory backing file for faster resume
-echo "Pre-allocating memory backing file..."
-sudo fallocate -l 24G %s/qemu-memory/ubuntu-mem
-sudo chmod 666 %s/qemu-memory/ubuntu-mem
-sync
-%s
-# Download and prepare Ubuntu image
-cd %s/
-wget https://cloud-images.ubuntu.com/releases/24.04/release/ubuntu-24.04-server-cloudimg-amd64.img
-qemu-img convert -f qcow2 -O qcow2 ubuntu-24.04-server-cloudimg-amd64.img qemu-disks/ubuntu-base.qcow2
-qemu-img resize qemu-disks/ubuntu-base.qcow2 64G
+// AzureDataDisk is the data disk attached at LUN 0 of Azure VMs
+var AzureDataDisk = DataDiskLayout{
+	Device:       "/dev/disk/azure/scsi1/lun0",
+	Path:         "/dev/disk/azure/scsi1/lun0",
+	MountOptions: "defaults",
+}
 
-# Create cloud-init configuration for SSH access
-cat > user-data << 'EOFMARKER'
-#cloud-config
+// boxCloudConfigTemplate is the cloud-init user-data boxes boot with; %s is the authorized SSH key
+const boxCloudConfigTemplate = `#cloud-config
 hostname: ubuntu
 users:
   - name: ubuntu
@@ -98,6 +61,7 @@ packages:
   - net-tools
   - cloud-init
   - qemu-guest-agent
+  - tmux
 bootcmd:
   - systemctl restart systemd-resolved
 write_files:
@@ -133,7 +97,79 @@ ssh:
   install-server: yes
   permit_root_login: false
   password_authentication: false
-EOFMARKER
+`
+
+// boxCloudConfig renders the cloud-init user-data for boxes accepting sshPublicKey
+func boxCloudConfig(sshPublicKey string) string {
+	return fmt.Sprintf(boxCloudConfigTemplate, sshPublicKey)
+}
+
+// GenerateQEMUInitScript creates a QEMU initialization script with the given configuration
+func GenerateQEMUInitScript(config QEMUScriptConfig) (string, error) {
+	var mountSection string
+	if config.MountDataDisk {
+		disk := config.DataDisk
+		if disk == (DataDiskLayout{}) {
+			disk = AzureDataDisk
+		}
+		mkfsArgs := disk.Device
+		if disk.Label != "" {
+			mkfsArgs = "-L " + disk.Label + " " + disk.Device
+		}
+		mountSection = fmt.Sprintf(`
+# Wait for data disk to be available
+while [ ! -e %[1]s ]; do
+    echo "Waiting for data disk..."
+    sleep 5
+done
+
+# Format and mount data disk
+sudo mkfs.ext4 %[2]s
+sudo mkdir -p /mnt/userdata
+sudo mount %[1]s /mnt/userdata
+echo '%[3]s /mnt/userdata ext4 %[4]s 0 2' | sudo tee -a /etc/fstab
+`, disk.Device, mkfsArgs, disk.Path, disk.MountOptions)
+	}
+
+	qemuConfig := boxQEMUConfig(config.WorkingDir, config.SSHPort)
+
+	var ownershipSection string
+	if config.WorkingDir == "/mnt/userdata" {
+		ownershipSection = `
+# Set ownership for data volume
+sudo chown -R $USER:$USER /mnt/userdata/
+`
+	}
+
+	script := fmt.Sprintf(`#!/bin/bash
+
+echo "\$nrconf{restart} = 'a';" | sudo tee /etc/needrestart/conf.d/50-autorestart.conf
+%s
+# Install QEMU and dependencies
+sudo apt update
+sudo apt install qemu-utils qemu-system-x86 qemu-kvm qemu-system libvirt-daemon-system libvirt-clients bridge-utils genisoimage whois libguestfs-tools socat -y
+
+sudo usermod -aG kvm,libvirt $USER
+sudo systemctl enable --now libvirtd
+
+# Create QEMU environment
+mkdir -p %s/qemu-disks %s/qemu-memory
+
+# Create the memory backing file sparse; the balloon hands free guest pages back as holes
+echo "Creating memory backing file..."
+sudo truncate -s 24G %s/qemu-memory/ubuntu-mem
+sudo chmod 666 %s/qemu-memory/ubuntu-mem
+sync
+%s
+# Download and prepare Ubuntu image
+cd %s/
+wget https://cloud-images.ubuntu.com/releases/24.04/release/ubuntu-24.04-server-cloudimg-amd64.img
+qemu-img convert -f qcow2 -O qcow2 ubuntu-24.04-server-cloudimg-amd64.img qemu-disks/ubuntu-base.qcow2
+qemu-img resize qemu-disks/ubuntu-base.qcow2 64G
+
+# Create cloud-init configuration for SSH access
+cat > user-data << 'EOFMARKER'
+%sEOFMARKER
 
 cat > meta-data << 'EOFMARKER'
 instance-id: ubuntu-inst-1
@@ -142,35 +178,21 @@ EOFMARKER
 
 genisoimage -output qemu-disks/cloud-init.iso -volid cidata -joliet -rock user-data meta-data
 
+# Record the QEMU configuration next to the state it will be saved with
+cat > %s/qemu-memory/qemu-config.json << 'EOFMARKER'
+%s
+EOFMARKER
+
 # Start QEMU VM with SSH-ready configuration and monitor socket
-sudo qemu-system-x86_64 \
-   -machine pc,accel=kvm,memory-backend=mem \
-   -cpu host,+kvmclock,+kvm-asyncpf \
-   -m 24G \
-   -object memory-backend-file,id=mem,size=24G,mem-path=%s/qemu-memory/ubuntu-mem,share=on,prealloc=on \
-   -smp 8 \
-   -rtc base=utc,driftfix=slew \
-   -drive file=%s/qemu-disks/ubuntu-base.qcow2,format=qcow2,if=virtio \
-   -cdrom %s/qemu-disks/cloud-init.iso \
-   -device virtio-rng-pci,rng=rng0 -object rng-random,id=rng0,filename=/dev/urandom \
-   -device virtio-net-pci,netdev=net0 \
-   -netdev user,id=net0,hostfwd=tcp::%d-:22,dns=8.8.8.8 \
-   -device virtio-serial \
-   -device virtserialport,chardev=qga0,name=org.qemu.guest_agent.0 \
-   -chardev socket,path=%s,server=on,wait=off,id=qga0 \
-   -nographic \
-   -serial file:%s/qemu-serial.log \
-   -qmp unix:/tmp/qemu-monitor.sock,server,nowait`,
+sudo %s`,
 		mountSection,
 		config.WorkingDir, config.WorkingDir, config.WorkingDir, config.WorkingDir,
 		ownershipSection,
 		config.WorkingDir,
-		config.SSHPublicKey,
+		boxCloudConfig(config.SSHPublicKey),
 		config.WorkingDir,
-		config.WorkingDir, config.WorkingDir,
-		config.SSHPort,
-		QEMUGuestAgentSocket,
-		config.WorkingDir)
+		qemuConfig.Marshal(),
+		qemuConfig.CommandLine())
 
 	return base64.StdEncoding.EncodeToString([]byte(script)), nil
 }
@@ -207,7 +229,7 @@ func CreateGoldenSnapshotIfNotExists(ctx context.Context, clients *AzureClients)
 	}
 
 	// Generate content-based snapshot names for this QEMU configuration
-	dataSnapshotName, osSnapshotName, err := generateGoldenSnapshotNames(sshPublicKey)
+	dataSnapshotName, osSnapshotName, err := generateGoldenSnapshotNames(sshPublicKey, AzureDataDisk)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate snapshot names: %w", err)
 	}
@@ -235,7 +257,7 @@ func CreateGoldenSnapshotIfNotExists(ctx context.Context, clients *AzureClients)
 
 	slog.Info("Golden resources not found, creating new ones", "dataSnapshot", dataSnapshotName, "osImage", osImageName)
 	// Create temporary box VM with data volume for QEMU setup
-	tempBoxName := fmt.Sprintf("temp-golden-%d", time.Now().Unix())
+	tempBoxName := fmt.Sprintf("%s%d", TempGoldenVMPrefix, time.Now().Unix())
 	slog.Info("Creating temporary box VM", "tempBoxName", tempBoxName)
 
 	tempBox, err := createAndProvisionBoxWithDataVolume(ctx, clients, clients.ResourceGroupName, tempBoxName, sshPublicKey)
@@ -386,26 +408,21 @@ func createAndProvisionBoxWithDataVolume(ctx context.Context, clients *AzureClie
 // waitForQEMUReady waits for the QEMU VM to be accessible via SSH on port 2222 and then shuts it down cleanly
 func waitForQEMUReady(ctx context.Context, _ *AzureClients, tempBox *tempBoxInfo) error {
 	slog.Info("Waiting for host VM setup and QEMU to be ready", "vmName", tempBox.VMName, "privateIP", tempBox.PrivateIP)
+	// The builder is a new VM, possibly at the address of one that is gone
+	sshutil.ForgetHostKey(tempBox.PrivateIP)
 
 	// First, check cloud-init completion on the QEMU VM via serial log
 	slog.Info("Checking cloud-init completion on QEMU VM")
 	err := RetryOperation(ctx, func(ctx context.Context) error {
 		// Check QEMU serial log for cloud-init completion
-		cmd := exec.CommandContext(ctx, "ssh",
-			"-o", "ConnectTimeout=5",
-			"-o", "StrictHostKeyChecking=no",
-			"-i", sshutil.SSHKeyPath,
-			fmt.Sprintf("%s@%s", AdminUsername, tempBox.PrivateIP),
-			"if [ -f /mnt/userdata/qemu-serial.log ]; then tail -n 50 /mnt/userdata/qemu-serial.log; else echo 'Log not yet available'; fi")
-		output, err := cmd.CombinedOutput()
+		checkCmd := "if [ -f /mnt/userdata/qemu-serial.log ]; then tail -n 50 /mnt/userdata/qemu-serial.log; else echo 'Log not yet available'; fi"
+		outputStr, err := sshutil.ExecuteCommandWithOutput(ctx, checkCmd, AdminUsername, tempBox.PrivateIP)
 		if err != nil {
-			return fmt.Errorf("failed to check QEMU serial logs: %w: %s", err, string(output))
+			return fmt.Errorf("failed to check QEMU serial logs: %w", err)
 		}
 
-		outputStr := string(output)
-
 		// Check if log file doesn't exist yet
-		if outputStr == "Log not yet available" {
+		if strings.TrimSpace(outputStr) == "Log not yet available" {
 			return fmt.Errorf("QEMU serial log not yet available")
 		}
 
@@ -449,26 +466,28 @@ func waitForQEMUReady(ctx context.Context, _ *AzureClients, tempBox *tempBoxInfo
 	// SSH is ready and cloud-init is complete
 	slog.Info("QEMU VM fully ready, saving VM state")
 
+	// Ensure qemu-memory directory exists with proper permissions
+	prepareCmd := `sudo mkdir -p /mnt/userdata/qemu-memory && sudo chmod 777 /mnt/userdata/qemu-memory`
+	if _, err := sshutil.ExecuteCommandWithOutput(ctx, prepareCmd, AdminUsername, tempBox.PrivateIP); err != nil {
+		return fmt.Errorf("failed to prepare memory directory: %w", err)
+	}
+
 	// Configure migration for maximum speed using QMP
-	setupMigrationCmd := `
-# Ensure qemu-memory directory exists with proper permissions
-sudo mkdir -p /mnt/userdata/qemu-memory
-sudo chmod 777 /mnt/userdata/qemu-memory
-
-# Use a single QMP session for all setup commands
-(
-echo '{"execute":"qmp_capabilities"}'
-sleep 0.1
-# Set migration parameters for maximum speed
-echo '{"execute":"migrate-set-parameters", "arguments":{"max-bandwidth": 0, "downtime-limit": 300, "max-cpu-throttle": 99}}'
-sleep 0.1
-# Enable migration capabilities for better performance
-echo '{"execute":"migrate-set-capabilities", "arguments":{"capabilities":[{"capability": "xbzrle", "state": false}, {"capability": "x-ignore-shared", "state": true}, {"capability": "auto-converge", "state": false}, {"capability": "postcopy-ram", "state": false}]}}'
-sleep 0.1
-) | sudo socat - UNIX-CONNECT:/tmp/qemu-monitor.sock
-`
-	setupOutput, setupErr := sshutil.ExecuteCommandWithOutput(ctx, setupMigrationCmd, AdminUsername, tempBox.PrivateIP)
-	slog.Info("Migration setup completed", "output", setupOutput, "error", setupErr)
+	err = withQMP(ctx, tempBox.PrivateIP, func(client *qmp.Client) error {
+		unlimited := int64(0)
+		if err := client.MigrateSetParameters(ctx, qmp.MigrationParameters{
+			MaxBandwidth:   &unlimited,
+			DowntimeLimit:  300,
+			MaxCPUThrottle: 99,
+		}); err != nil {
+			return err
+		}
+		return client.MigrateSetCapabilities(ctx, boxMigrationCapabilities...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure migration: %w", err)
+	}
+	slog.Info("Migration setup completed")
 
 	// Note: We do NOT stop the VM before migration. QEMU will handle pausing during migration.
 	// Stopping the VM before migration results in an empty state file because there's no active state to save.
@@ -480,11 +499,11 @@ sudo touch %s
 sudo chmod 666 %s
 
 # Verify QEMU is still running
-if ! pgrep -f qemu-system-x86_64 > /dev/null; then
+if ! %s > /dev/null; then
     echo "ERROR: QEMU is not running!"
     exit 1
 fi
-`, QEMUStatePath, QEMUStatePath)
+`, QEMUStatePath, QEMUStatePath, qemuPIDCommand)
 
 	if _, err := sshutil.ExecuteCommandWithOutput(ctx, createStateFileCmd, AdminUsername, tempBox.PrivateIP); err != nil {
 		return fmt.Errorf("failed to create state file: %w", err)
@@ -495,9 +514,8 @@ fi
 	if err := ExecuteMigrationCommand(ctx, tempBox.PrivateIP, QEMUStatePath); err != nil {
 		return fmt.Errorf("failed to execute migration: %w", err)
 	}
-	slog.Info("Migration completed successfully (synchronous)")
+	slog.Info("Migration completed successfully")
 
-	// Migration is synchronous, so it's complete when ExecuteMigrationCommand returns
 	// Force sync to ensure data is written to disk
 	syncCmd := fmt.Sprintf(`
 sync
@@ -533,9 +551,10 @@ fi
 	}
 
 	// Now quit QEMU after state is saved
-	quitCmd := `(echo '{"execute":"qmp_capabilities"}'; sleep 0.1; echo '{"execute":"quit"}') | sudo socat - UNIX-CONNECT:/tmp/qemu-monitor.sock`
-	quitOutput, quitErr := sshutil.ExecuteCommandWithOutput(ctx, quitCmd, AdminUsername, tempBox.PrivateIP)
-	slog.Info("Quit command sent", "output", quitOutput, "error", quitErr)
+	quitErr := withQMP(ctx, tempBox.PrivateIP, func(client *qmp.Client) error {
+		return client.Quit(ctx)
+	})
+	slog.Info("Quit command sent", "error", quitErr)
 
 	// Brief pause to ensure shutdown completes
 	time.Sleep(2 * time.Second)
@@ -705,15 +724,21 @@ func createBoxVMWithDataDisk(ctx context.Context, clients *AzureClients, resourc
 	return &result.VirtualMachine, nil
 }
 
-// generateDataVolumeInitScript creates an init script that sets up and starts QEMU VM on the data volume
-func generateDataVolumeInitScript(_ context.Context, _ *AzureClients, sshPublicKey string) (string, error) {
-	// Use unified QEMU script generation with data volume configuration
-	config := QEMUScriptConfig{
+// goldenScriptConfig is the QEMU script configuration golden builds run with
+func goldenScriptConfig(sshPublicKey string, dataDisk DataDiskLayout) QEMUScriptConfig {
+	return QEMUScriptConfig{
 		SSHPublicKey:  sshPublicKey,
 		WorkingDir:    "/mnt/userdata",
 		SSHPort:       BoxSSHPort,
 		MountDataDisk: true,
+		DataDisk:      dataDisk,
 	}
+}
+
+// generateDataVolumeInitScript creates an init script that sets up and starts QEMU VM on the data volume
+func generateDataVolumeInitScript(_ context.Context, _ *AzureClients, sshPublicKey string) (string, error) {
+	// Use unified QEMU script generation with data volume configuration
+	config := goldenScriptConfig(sshPublicKey, AzureDataDisk)
 
 	scriptContent, err := GenerateQEMUInitScript(config)
 	if err != nil {
@@ -769,25 +794,17 @@ func ensureGoldenSnapshotResourceGroup(ctx context.Context, clients *AzureClient
 	return nil
 }
 
-// generateGoldenSnapshotNames creates content-based names for the golden snapshots
-// This allows us to detect when the QEMU configuration changes and new snapshots are needed
-func generateGoldenSnapshotNames(sshPublicKey string) (dataSnapshotName, imageName string, err error) {
-	// Generate a sample QEMU script to hash its content
-	config := QEMUScriptConfig{
-		SSHPublicKey:  sshPublicKey,
-		WorkingDir:    "/mnt/userdata",
-		SSHPort:       BoxSSHPort,
-		MountDataDisk: true,
-	}
-
-	scriptContent, err := GenerateQEMUInitScript(config)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate script for hashing: %w", err)
-	}
+// generateGoldenSnapshotNames creates content-based names for the golden snapshots from
+// what the saved VM depends on: the QEMU configuration, the guest's cloud-init user-data
+// and the data disk layout
+func generateGoldenSnapshotNames(sshPublicKey string, dataDisk DataDiskLayout) (dataSnapshotName, imageName string, err error) {
+	config := goldenScriptConfig(sshPublicKey, dataDisk)
+	qemuConfig := boxQEMUConfig(config.WorkingDir, config.SSHPort)
 
-	// Hash the script content to create a unique identifier
 	hasher := sha256.New()
-	hasher.Write([]byte(scriptContent))
+	hasher.Write(qemuConfig.Marshal())
+	hasher.Write([]byte(boxCloudConfig(sshPublicKey)))
+	fmt.Fprintf(hasher, "%+v", dataDisk)
 	hash := hex.EncodeToString(hasher.Sum(nil))[:12] // Use first 12 chars
 
 	dataSnapshotName = fmt.Sprintf("golden-qemu-data-%s", hash)
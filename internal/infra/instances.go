@@ -69,12 +69,6 @@ func CreateInstance(ctx context.Context, clients *AzureClients, config *VMConfig
 		return "", fmt.Errorf("creating instance VM: %w", err)
 	}
 
-	// Wait for the instance to be visible in Resource Graph before returning
-	err = waitForInstanceInResourceGraph(ctx, clients, instanceID, &tags)
-	if err != nil {
-		return "", fmt.Errorf("waiting for instance in resource graph: %w", err)
-	}
-
 	return instanceID, nil
 }
 
@@ -122,6 +116,32 @@ func createInstanceNSG(ctx context.Context, clients *AzureClients, nsgName strin
 						Direction:                to.Ptr(armnetwork.SecurityRuleDirectionInbound),
 					},
 				},
+				{
+					Name: to.Ptr("AllowExposuresFromBastion"),
+					Properties: &armnetwork.SecurityRulePropertiesFormat{
+						Protocol:                 to.Ptr(armnetwork.SecurityRuleProtocolTCP),
+						SourceAddressPrefix:      to.Ptr(bastionSubnetCIDR),
+						SourcePortRange:          to.Ptr("*"),
+						DestinationAddressPrefix: to.Ptr("*"),
+						DestinationPortRange:     to.Ptr(fmt.Sprintf("%d-%d", ExposurePortMin, ExposurePortMax)),
+						Access:                   to.Ptr(armnetwork.SecurityRuleAccessAllow),
+						Priority:                 to.Ptr(int32(112)),
+						Direction:                to.Ptr(armnetwork.SecurityRuleDirectionInbound),
+					},
+				},
+				{
+					Name: to.Ptr("AllowMigrationFromBoxes"),
+					Properties: &armnetwork.SecurityRulePropertiesFormat{
+						Protocol:                 to.Ptr(armnetwork.SecurityRuleProtocolTCP),
+						SourceAddressPrefix:      to.Ptr(boxesSubnetCIDR),
+						SourcePortRange:          to.Ptr("*"),
+						DestinationAddressPrefix: to.Ptr("*"),
+						DestinationPortRanges:    []*string{to.Ptr(fmt.Sprintf("%d", MigrationPort)), to.Ptr(fmt.Sprintf("%d", MigrationNBDPort))},
+						Access:                   to.Ptr(armnetwork.SecurityRuleAccessAllow),
+						Priority:                 to.Ptr(int32(120)),
+						Direction:                to.Ptr(armnetwork.SecurityRuleDirectionInbound),
+					},
+				},
 				{
 					Name: to.Ptr("DenyAllInbound"),
 					Properties: &armnetwork.SecurityRulePropertiesFormat{
@@ -135,6 +155,19 @@ func createInstanceNSG(ctx context.Context, clients *AzureClients, nsgName strin
 						Direction:                to.Ptr(armnetwork.SecurityRuleDirectionInbound),
 					},
 				},
+				{
+					Name: to.Ptr("AllowMigrationToBoxes"),
+					Properties: &armnetwork.SecurityRulePropertiesFormat{
+						Protocol:                 to.Ptr(armnetwork.SecurityRuleProtocolTCP),
+						SourceAddressPrefix:      to.Ptr("*"),
+						SourcePortRange:          to.Ptr("*"),
+						DestinationAddressPrefix: to.Ptr(boxesSubnetCIDR),
+						DestinationPortRanges:    []*string{to.Ptr(fmt.Sprintf("%d", MigrationPort)), to.Ptr(fmt.Sprintf("%d", MigrationNBDPort))},
+						Access:                   to.Ptr(armnetwork.SecurityRuleAccessAllow),
+						Priority:                 to.Ptr(int32(90)),
+						Direction:                to.Ptr(armnetwork.SecurityRuleDirectionOutbound),
+					},
+				},
 				{
 					Name: to.Ptr("DenyBoxesSubnet"),
 					Properties: &armnetwork.SecurityRulePropertiesFormat{
@@ -616,8 +649,15 @@ func DeleteNSG(ctx context.Context, clients *AzureClients, resourceGroupName, ns
 	}
 }
 
-// UpdateInstanceStatus updates the status tag of an instance
+// UpdateInstanceStatus updates the status of an instance in the resource registry and its status tag
 func UpdateInstanceStatus(ctx context.Context, clients *AzureClients, instanceID, status string) error {
+	err := UpdateResourceRegistry(ctx, clients, ResourceRoleInstance, instanceID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update instance in registry: %w", err)
+	}
+
 	namer := NewResourceNamer(clients.Suffix)
 	vmName := namer.BoxVMName(instanceID)
 
@@ -646,21 +686,19 @@ func UpdateInstanceStatus(ctx context.Context, clients *AzureClients, instanceID
 		return fmt.Errorf("failed to update VM status: %w", err)
 	}
 
-	// Wait for the instance tags to be visible in Resource Graph before returning
-	expectedTags := map[string]string{
-		TagKeyStatus:   status,
-		TagKeyLastUsed: lastUsedTime,
-	}
-	err = waitForInstanceTagsInResourceGraph(ctx, clients, instanceID, expectedTags)
-	if err != nil {
-		return fmt.Errorf("waiting for instance tags in resource graph: %w", err)
-	}
-
 	return nil
 }
 
-// UpdateInstanceStatusAndUser updates the status and userID tags of an instance
+// UpdateInstanceStatusAndUser updates the status and userID of an instance in the resource registry and its tags
 func UpdateInstanceStatusAndUser(ctx context.Context, clients *AzureClients, instanceID, status, userID string) error {
+	err := UpdateResourceRegistry(ctx, clients, ResourceRoleInstance, instanceID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+		entry.UserID = userID
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update instance in registry: %w", err)
+	}
+
 	namer := NewResourceNamer(clients.Suffix)
 	vmName := namer.BoxVMName(instanceID)
 
@@ -690,17 +728,6 @@ func UpdateInstanceStatusAndUser(ctx context.Context, clients *AzureClients, ins
 		return fmt.Errorf("failed to update VM status: %w", err)
 	}
 
-	// Wait for the instance tags to be visible in Resource Graph before returning
-	expectedTags := map[string]string{
-		TagKeyStatus:   status,
-		TagKeyLastUsed: lastUsedTime,
-		TagKeyUserID:   userID,
-	}
-	err = waitForInstanceTagsInResourceGraph(ctx, clients, instanceID, expectedTags)
-	if err != nil {
-		return fmt.Errorf("waiting for instance tags in resource graph: %w", err)
-	}
-
 	return nil
 }
 
@@ -821,47 +848,3 @@ func DetachVolumeFromInstance(ctx context.Context, clients *AzureClients, instan
 
 	return nil
 }
-
-// waitForInstanceInResourceGraph waits for a newly created instance to be visible in Resource Graph with correct tags.
-// This is necessary because Resource Graph has eventual consistency and tags may not be immediately queryable.
-func waitForInstanceInResourceGraph(ctx context.Context, clients *AzureClients, instanceID string, expectedTags *InstanceTags) error {
-	// Create resource graph queries client
-	rq := NewResourceGraphQueries(clients.ResourceGraphClient, clients.SubscriptionID, clients.ResourceGroupName)
-
-	// Define the verification operation
-	verifyOperation := func(ctx context.Context) error {
-		slog.Debug("Checking Resource Graph for instance", "instanceID", instanceID, "expectedStatus", expectedTags.Status)
-
-		// Get all instances with the expected status
-		instances, err := rq.GetInstancesByStatus(ctx, expectedTags.Status)
-		if err != nil {
-			return fmt.Errorf("querying instances: %w", err)
-		}
-
-		// Check if our instance is in the results
-		for i := range instances {
-			instance := &instances[i]
-			if instance.Tags[TagKeyInstanceID] == instanceID {
-				// Verify all expected tags are present
-				if instance.Tags[TagKeyRole] == expectedTags.Role &&
-					instance.Tags[TagKeyStatus] == expectedTags.Status &&
-					instance.Tags[TagKeyCreated] == expectedTags.CreatedAt &&
-					instance.Tags[TagKeyLastUsed] == expectedTags.LastUsed {
-					slog.Info("Instance visible in Resource Graph", "instanceID", instanceID)
-					return nil
-				}
-			}
-		}
-
-		// Instance not found yet
-		return fmt.Errorf("instance %s not yet visible in Resource Graph (checked %d instances with status %s)", instanceID, len(instances), expectedTags.Status)
-	}
-
-	// Use RetryOperation with a 2-minute timeout and 5-second intervals
-	const (
-		timeout  = 2 * time.Minute
-		interval = 5 * time.Second
-	)
-
-	return RetryOperation(ctx, verifyOperation, timeout, interval, "wait for instance in Resource Graph")
-}
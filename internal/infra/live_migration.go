@@ -0,0 +1,453 @@
+package infra
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"shellbox/internal/qmp"
+	"shellbox/internal/sshutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationProgressInterval is how often a live migration's progress is polled and logged
+const migrationProgressInterval = 2 * time.Second
+
+// migratingBoxSuffix marks the volume a box is being copied to, and migratedBoxSuffix the
+// volume it was moved off, so neither resolves as the user's box
+const (
+	migratingBoxSuffix = "~migrating"
+	migratedBoxSuffix  = "~migrated"
+)
+
+// migrationFirewallComment tags the firewall rules opening the migration ports on a target
+const migrationFirewallComment = "shellbox-migration"
+
+// liveMigrationCapabilities are set on both ends of a live migration. Unlike a state save,
+// guest RAM has to travel with the state, so x-ignore-shared is off; auto-converge throttles
+// guests that dirty memory faster than it can be copied.
+var liveMigrationCapabilities = []qmp.MigrationCapability{
+	{Capability: "events", State: true},
+	{Capability: "xbzrle", State: false},
+	{Capability: "x-ignore-shared", State: false},
+	{Capability: "auto-converge", State: true},
+	{Capability: "postcopy-ram", State: false},
+	{Capability: "pause-before-switchover", State: false},
+}
+
+// MigrateBox implements LiveMigrator. The target starts QEMU paused with the source's
+// configuration and exports its disks over NBD; the source mirrors its disks there and
+// then migrates its RAM and device state over TCP. Once the source paused for the final
+// copy, the mirrors finish and the target takes over.
+func (qm *QEMUManager) MigrateBox(ctx context.Context, sourceIP, targetIP string, progress *ProgressReporter) error {
+	config, err := loadVolumeQEMUConfig(ctx, sourceIP)
+	if err != nil {
+		return err
+	}
+	devices := config.DiskDevices()
+
+	slog.Info("Starting live migration", "sourceIP", sourceIP, "targetIP", targetIP, "devices", devices)
+	err = progress.Step("Starting target QEMU", func() error {
+		script := qm.mountVolumeScript() + writeQEMUConfigScript(config) + openMigrationPortsScript(sourceIP) + qm.qemuResumeScript(config)
+		output, err := sshutil.ExecuteCommandWithOutput(ctx, script, AdminUsername, targetIP)
+		if err != nil {
+			slog.Error("Failed to start target QEMU", "error", err, "output", output)
+			return err
+		}
+		// The box keeps its settings, and the source's egress policy lets the migration through
+		if err := qm.copyBoxSettings(ctx, sourceIP, targetIP); err != nil {
+			return err
+		}
+		if err := allowEgressTo(ctx, sourceIP, targetIP, MigrationPort, MigrationNBDPort); err != nil {
+			return err
+		}
+		return withQMP(ctx, targetIP, func(client *qmp.Client) error {
+			return prepareIncomingMigration(ctx, client, devices)
+		})
+	})
+	defer closeMigrationPorts(ctx, targetIP)
+	if err != nil {
+		return fmt.Errorf("failed to start target QEMU: %w", err)
+	}
+
+	// Until the switchover is done the source is the box, so any failure resumes it there
+	err = progress.Step("Copying disk", func() error {
+		return withQMP(ctx, sourceIP, func(client *qmp.Client) error {
+			return mirrorDisks(ctx, client, targetIP, devices)
+		})
+	})
+	if err != nil {
+		abortMigration(ctx, sourceIP, devices)
+		return fmt.Errorf("failed to copy disks: %w", err)
+	}
+
+	err = progress.Step("Copying memory", func() error {
+		return migrateRAM(ctx, sourceIP, targetIP)
+	})
+	if err != nil {
+		abortMigration(ctx, sourceIP, devices)
+		return fmt.Errorf("failed to migrate VM state: %w", err)
+	}
+
+	err = progress.Step("Switching over", func() error {
+		err := withQMP(ctx, sourceIP, func(client *qmp.Client) error {
+			return finishMirrors(ctx, client, devices)
+		})
+		if err != nil {
+			return err
+		}
+		return withQMP(ctx, targetIP, func(client *qmp.Client) error {
+			return finishIncomingMigration(ctx, client)
+		})
+	})
+	if err != nil {
+		abortMigration(ctx, sourceIP, devices)
+		return fmt.Errorf("failed to switch over: %w", err)
+	}
+
+	slog.Info("Live migration completed", "sourceIP", sourceIP, "targetIP", targetIP)
+	return nil
+}
+
+// migratedSettingFiles are the files on the volume that the disk mirror doesn't carry but
+// the box needs on its new volume: its restart policy, and its run marker, which keeps the
+// supervisor treating the box as running since it was last started
+var migratedSettingFiles = []string{RestartPolicyPath, QEMURunMarkerPath}
+
+// copyBoxSettings records the egress policy, restart policy and run marker of the box on
+// sourceIP on targetIP, and applies the egress policy there
+func (qm *QEMUManager) copyBoxSettings(ctx context.Context, sourceIP, targetIP string) error {
+	policy, err := qm.EgressPolicy(ctx, sourceIP)
+	if err != nil {
+		return err
+	}
+	if err := qm.SetEgressPolicy(ctx, targetIP, policy); err != nil {
+		return err
+	}
+
+	var script strings.Builder
+	for _, path := range migratedSettingFiles {
+		result, err := sshutil.Run(ctx, "cat "+path, AdminUsername, sourceIP)
+		if err != nil {
+			if result != nil && result.ExitCode > 0 {
+				continue // not set on the source either
+			}
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		fmt.Fprintf(&script, "echo %s | sudo tee %s > /dev/null\n", shellQuote(strings.TrimSpace(result.Stdout)), path)
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	if err := sshutil.ExecuteCommand(ctx, script.String(), AdminUsername, targetIP); err != nil {
+		return fmt.Errorf("failed to copy box settings: %w", err)
+	}
+	return nil
+}
+
+// writeQEMUConfigScript records config on the volume mounted on the instance, so the box
+// resumes with the configuration it runs with
+func writeQEMUConfigScript(config *QEMUConfig) string {
+	return `
+# Record the QEMU configuration of the incoming box
+echo ` + shellQuote(string(config.Marshal())) + ` | sudo tee ` + QEMUConfigPath + ` > /dev/null
+`
+}
+
+// openMigrationPortsScript lets only sourceIP reach the migration ports. Other instances
+// share the boxes subnet, and their guests' traffic leaves through their instance.
+func openMigrationPortsScript(sourceIP string) string {
+	ports := fmt.Sprintf("%d,%d", MigrationPort, MigrationNBDPort)
+	return `
+# Only the migration source may reach the migration ports
+sudo iptables -I INPUT -p tcp -m multiport --dports ` + ports + ` -m comment --comment ` + migrationFirewallComment + ` -j DROP
+sudo iptables -I INPUT -p tcp -s ` + shellQuote(sourceIP) + ` -m multiport --dports ` + ports + ` -m comment --comment ` + migrationFirewallComment + ` -j ACCEPT
+`
+}
+
+// closeMigrationPorts removes the rules openMigrationPortsScript added on the target.
+// Failures are only logged.
+func closeMigrationPorts(ctx context.Context, targetIP string) {
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), QMPCommandTimeout)
+	defer cancel()
+
+	script := `sudo iptables -S INPUT | grep -- ` + migrationFirewallComment + ` | sed 's/^-A /-D /' | while read -r rule; do sudo iptables $rule; done`
+	if err := sshutil.ExecuteCommand(cleanupCtx, script, AdminUsername, targetIP); err != nil {
+		slog.Warn("Failed to remove migration firewall rules", "targetIP", targetIP, "error", err)
+	}
+}
+
+// prepareIncomingMigration exports the target's disks for the source to mirror to and
+// starts listening for the migration stream
+func prepareIncomingMigration(ctx context.Context, client *qmp.Client, devices []string) error {
+	if err := client.MigrateSetCapabilities(ctx, liveMigrationCapabilities...); err != nil {
+		return err
+	}
+	if err := client.NBDServerStart(ctx, "0.0.0.0", strconv.Itoa(MigrationNBDPort)); err != nil {
+		return fmt.Errorf("failed to start NBD server: %w", err)
+	}
+	for _, device := range devices {
+		if err := client.NBDExport(ctx, device, true); err != nil {
+			return fmt.Errorf("failed to export %s: %w", device, err)
+		}
+	}
+	if err := client.MigrateIncoming(ctx, fmt.Sprintf("tcp:0.0.0.0:%d", MigrationPort)); err != nil {
+		return fmt.Errorf("failed to listen for migration: %w", err)
+	}
+	return nil
+}
+
+// mirrorDisks copies the source's disks to the target's NBD exports and waits until they
+// caught up. Once ready, guest writes reach both sides before they complete.
+func mirrorDisks(ctx context.Context, client *qmp.Client, targetIP string, devices []string) error {
+	events, unsubscribe := client.Subscribe(16)
+	defer unsubscribe()
+
+	for _, device := range devices {
+		err := client.DriveMirror(ctx, qmp.DriveMirror{
+			Device:   device,
+			Target:   fmt.Sprintf("nbd://%s:%d/%s", targetIP, MigrationNBDPort, device),
+			Format:   "raw",
+			Sync:     "full",
+			Mode:     "existing",
+			CopyMode: "write-blocking",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mirror %s: %w", device, err)
+		}
+	}
+	return qmp.WaitForBlockJobs(ctx, events, devices, qmp.EventBlockJobReady)
+}
+
+// migrateRAM migrates the source's RAM and device state to the target, logging progress
+// until the migration ends. The source is paused when it completed.
+func migrateRAM(ctx context.Context, sourceIP, targetIP string) error {
+	err := withQMP(ctx, sourceIP, func(client *qmp.Client) error {
+		if err := client.MigrateSetCapabilities(ctx, liveMigrationCapabilities...); err != nil {
+			return err
+		}
+		unlimited := int64(0)
+		err := client.MigrateSetParameters(ctx, qmp.MigrationParameters{
+			MaxBandwidth:   &unlimited,
+			DowntimeLimit:  300,
+			MaxCPUThrottle: 99,
+		})
+		if err != nil {
+			return err
+		}
+		return client.Migrate(ctx, fmt.Sprintf("tcp:%s:%d", targetIP, MigrationPort))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start migration: %w", err)
+	}
+
+	// QEMU keeps migrating without a monitor connection, so progress is polled with
+	// fresh ones rather than holding the only monitor slot for the whole copy
+	for {
+		info, err := GetMigrationInfo(ctx, sourceIP)
+		if err != nil {
+			return err
+		}
+		switch info.Status {
+		case qmp.MigrationCompleted:
+			slog.Info("Migration finished", "sourceIP", sourceIP, "totalTimeMs", info.TotalTime, "downtimeMs", info.Downtime)
+			return nil
+		case qmp.MigrationFailed, qmp.MigrationCancelled:
+			return fmt.Errorf("migration %s: %s", info.Status, info.ErrorDesc)
+		}
+		if info.RAM != nil {
+			slog.Info("Migration in progress", "sourceIP", sourceIP, "status", info.Status,
+				"transferredMB", info.RAM.Transferred>>20, "remainingMB", info.RAM.Remaining>>20,
+				"totalMB", info.RAM.Total>>20, "mbps", info.RAM.MBps, "expectedDowntimeMs", info.ExpectedDowntime)
+		}
+		if err := sleepWithContext(ctx, migrationProgressInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// finishMirrors ends the disk mirrors on the paused source, leaving the targets with the
+// disks as they were when the guest stopped
+func finishMirrors(ctx context.Context, client *qmp.Client, devices []string) error {
+	events, unsubscribe := client.Subscribe(16)
+	defer unsubscribe()
+
+	for _, device := range devices {
+		if err := client.BlockJobCancel(ctx, device); err != nil {
+			return fmt.Errorf("failed to finish mirroring %s: %w", device, err)
+		}
+	}
+	return qmp.WaitForBlockJobs(ctx, events, devices, qmp.EventBlockJobCompleted)
+}
+
+// finishIncomingMigration waits for the target to load the final state, stops exporting
+// its disks and resumes the VM
+func finishIncomingMigration(ctx context.Context, client *qmp.Client) error {
+	for {
+		status, err := client.QueryStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Status != "inmigrate" {
+			break
+		}
+		if err := sleepWithContext(ctx, 100*time.Millisecond); err != nil {
+			return err
+		}
+	}
+	info, err := client.QueryMigrate(ctx)
+	if err != nil {
+		return err
+	}
+	if info.Status != qmp.MigrationCompleted {
+		return fmt.Errorf("incoming migration %s: %s", info.Status, info.ErrorDesc)
+	}
+
+	if err := client.NBDServerStop(ctx); err != nil {
+		return fmt.Errorf("failed to stop NBD server: %w", err)
+	}
+	if err := client.Cont(ctx); err != nil {
+		return fmt.Errorf("failed to resume VM: %w", err)
+	}
+	return nil
+}
+
+// abortMigration cancels a migration and its disk mirrors and makes sure the box runs on
+// the source again. The target is left for the caller to stop. Failures are only logged.
+func abortMigration(ctx context.Context, sourceIP string, devices []string) {
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), QMPCommandTimeout)
+	defer cancel()
+
+	err := withQMP(abortCtx, sourceIP, func(client *qmp.Client) error {
+		if err := client.MigrateCancel(abortCtx); err != nil {
+			slog.Warn("Failed to cancel migration", "sourceIP", sourceIP, "error", err)
+		}
+		for _, device := range devices {
+			if err := client.BlockJobCancel(abortCtx, device); err != nil {
+				slog.Debug("No disk mirror to cancel", "sourceIP", sourceIP, "device", device, "error", err)
+			}
+		}
+		status, err := client.QueryStatus(abortCtx)
+		if err != nil {
+			return err
+		}
+		if !status.Running {
+			return client.Cont(abortCtx)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to resume box on migration source", "sourceIP", sourceIP, "error", err)
+		return
+	}
+	slog.Info("Live migration aborted, box keeps running on source", "sourceIP", sourceIP)
+}
+
+// MigrateBox moves the box running on instanceID to a free instance while it keeps running.
+// Its disk is copied to a fresh volume attached to the new instance, which then becomes the
+// box's volume. The old instance goes back to the pool and the old volume is deleted.
+func (ra *ResourceAllocator) MigrateBox(ctx context.Context, instanceID string, progress *ProgressReporter) (*AllocatedResources, error) {
+	source, err := ra.findActiveAllocation(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up allocation: %w", err)
+	}
+	if source == nil || source.State != AllocationStateConnected {
+		return nil, fmt.Errorf("no box is running on instance %s", instanceID)
+	}
+	runtime, err := ra.provider.RuntimeFor(source.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	migrator, ok := runtime.(LiveMigrator)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s boxes can't be migrated", ErrUnsupportedRuntime, cmp.Or(source.Runtime, BoxRuntimeVM))
+	}
+	if source.InstanceIP == "" {
+		if source.InstanceIP, err = ra.provider.Compute.GetInstancePrivateIP(ctx, instanceID); err != nil {
+			return nil, fmt.Errorf("failed to get instance IP: %w", err)
+		}
+	}
+
+	// The copy goes to a fresh volume under a placeholder name, so the box keeps resolving
+	// to the volume it runs from until the move is done
+	volumeID, err := ra.ReserveVolumeForUser(ctx, source.UserID, source.BoxName+migratingBoxSuffix, cmp.Or(source.Runtime, BoxRuntimeVM))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve target volume: %w", err)
+	}
+
+	target := newAllocation(ra.owner, source.UserID, source.BoxName+migratingBoxSuffix, "", volumeID)
+	target.Runtime = source.Runtime
+	resources, err := ra.claimAndRunAllocation(ctx, target, func(ctx context.Context, instanceIP string) error {
+		return migrator.MigrateBox(ctx, source.InstanceIP, instanceIP, progress)
+	}, progress)
+	if err != nil {
+		// The copy holds the user's data, so it can't go back to the pool
+		ra.deleteVolume(ctx, volumeID, "migration_failed")
+		return nil, fmt.Errorf("failed to migrate box: %w", err)
+	}
+
+	// The box runs from the new instance and volume now; retire the old ones. The old volume
+	// is renamed before the copy takes the box's name, so the box never resolves to both.
+	if err := ra.releaseAllocation(ctx, source); err != nil {
+		slog.Warn("Failed to release migration source", "instanceID", instanceID, "error", err)
+	}
+	if err := ra.provider.Inventory.UpdateVolumeStatusUserAndBox(ctx, source.VolumeID, ResourceStatusAttached, source.UserID, source.BoxName+migratedBoxSuffix); err != nil {
+		slog.Warn("Failed to retire migrated volume", "volumeID", source.VolumeID, "error", err)
+	}
+	if err := ra.provider.Inventory.UpdateVolumeStatusUserAndBox(ctx, volumeID, ResourceStatusAttached, source.UserID, source.BoxName); err != nil {
+		return nil, fmt.Errorf("failed to hand box over to volume %s: %w", volumeID, err)
+	}
+	target.BoxName = source.BoxName
+	if err := ra.provider.Allocations.WriteAllocation(ctx, target); err != nil {
+		slog.Warn("Failed to record migrated allocation", "allocationID", target.RowKey, "error", err)
+	}
+	ra.deleteVolume(ctx, source.VolumeID, "migrated")
+
+	now := time.Now()
+	migrateEvent := EventLogEntity{
+		PartitionKey: now.Format("2006-01-02"),
+		RowKey:       fmt.Sprintf("%s_box_migrate", now.Format("20060102T150405")),
+		Timestamp:    now,
+		EventType:    EventTypeBoxMigrate,
+		UserKey:      source.UserID,
+		BoxID:        resources.InstanceID,
+		Details: fmt.Sprintf(`{"fromInstance":%q,"fromVolume":%q,"toInstance":%q,"toVolume":%q}`,
+			source.InstanceID, source.VolumeID, resources.InstanceID, resources.VolumeID),
+	}
+	if err := ra.provider.Events.WriteEvent(ctx, &migrateEvent); err != nil {
+		slog.Warn("Failed to log box migrate event", "error", err)
+	}
+
+	slog.Info("box migrated", "userID", source.UserID, "boxName", source.BoxName, "fromInstance", source.InstanceID, "toInstance", resources.InstanceID, "toVolume", resources.VolumeID)
+	return resources, nil
+}
+
+// deleteVolume deletes a volume that holds a user's data but no longer belongs to a box.
+// Failures are only logged; the volume stays reserved, so it is never handed out.
+func (ra *ResourceAllocator) deleteVolume(ctx context.Context, volumeID, reason string) {
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), AllocationCleanupTimeout)
+	defer cancel()
+
+	if err := ra.provider.Volumes.DeleteVolume(cleanupCtx, volumeID); err != nil {
+		slog.Error("Failed to delete volume", "volumeID", volumeID, "reason", reason, "error", err)
+		return
+	}
+	if err := ra.provider.Inventory.UnregisterResource(cleanupCtx, ResourceRoleVolume, volumeID); err != nil {
+		slog.Warn("Failed to remove volume from resource registry", "volumeID", volumeID, "error", err)
+	}
+
+	now := time.Now()
+	deleteEvent := EventLogEntity{
+		PartitionKey: now.Format("2006-01-02"),
+		RowKey:       fmt.Sprintf("%s_volume_delete", now.Format("20060102T150405")),
+		Timestamp:    now,
+		EventType:    EventTypeVolumeDelete,
+		BoxID:        volumeID,
+		Details:      fmt.Sprintf(`{"reason":%q}`, reason),
+	}
+	if err := ra.provider.Events.WriteEvent(cleanupCtx, &deleteEvent); err != nil {
+		slog.Warn("Failed to log volume delete event", "error", err)
+	}
+}
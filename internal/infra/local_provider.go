@@ -0,0 +1,594 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Local backend defaults
+const (
+	DefaultLocalDataDir      = "/var/lib/shellbox"
+	DefaultLocalMaxInstances = 4
+	DefaultLocalMemoryMB     = 4096
+	DefaultLocalCPUs         = 2
+
+	// LocalBastionSSHPort is where the server listens with the local backend, since boxes
+	// forward BoxSSHPort on loopback addresses of the same host
+	LocalBastionSSHPort = 2022
+
+	// LocalGoldenImageURL is the cloud image the local golden base disk is built from
+	LocalGoldenImageURL = "https://cloud-images.ubuntu.com/releases/24.04/release/ubuntu-24.04-server-cloudimg-amd64.img"
+	localGoldenDiskSize = "64G"
+)
+
+// LocalProviderConfig configures the single-host backend
+type LocalProviderConfig struct {
+	DataDir      string // holds the state file, golden image and volume disks
+	MaxInstances int    // number of box slots on this host
+	MemoryMB     int    // memory per box
+	CPUs         int    // vCPUs per box
+	SSHPublicKey string // key the boxes' cloud-init authorizes for the server
+}
+
+// NewDefaultLocalProviderConfig returns the local backend settings for a laptop-sized host
+func NewDefaultLocalProviderConfig(sshPublicKey string) LocalProviderConfig {
+	return LocalProviderConfig{
+		DataDir:      DefaultLocalDataDir,
+		MaxInstances: DefaultLocalMaxInstances,
+		MemoryMB:     DefaultLocalMemoryMB,
+		CPUs:         DefaultLocalCPUs,
+		SSHPublicKey: sshPublicKey,
+	}
+}
+
+// localInstance is a box slot. Each slot forwards BoxSSHPort on its own loopback address.
+type localInstance struct {
+	Slot     int    `json:"slot"`
+	VolumeID string `json:"volumeID,omitempty"`
+}
+
+// localVolume is a qcow2 overlay on the golden base disk
+type localVolume struct {
+	AttachedTo string `json:"attachedTo,omitempty"`
+}
+
+// localState is everything the local backend persists between server restarts
+type localState struct {
+	Instances map[string]*localInstance                    `json:"instances"`
+	Volumes   map[string]*localVolume                      `json:"volumes"`
+	Registry  map[string]map[string]ResourceRegistryEntity `json:"registry"`
+}
+
+// LocalHost runs boxes with QEMU on the machine the server runs on. Instances are slots
+// on this host, volumes are qcow2 files under DataDir, and state lives in a JSON file.
+// Allocations and events are kept by the embedded FileStore in the same directory.
+type LocalHost struct {
+	*FileStore
+	config LocalProviderConfig
+	namer  *ResourceNamer
+
+	mu    sync.Mutex
+	state localState
+}
+
+// NewLocalHost loads the local backend state from config.DataDir
+func NewLocalHost(config LocalProviderConfig) (*LocalHost, error) {
+	if config.MaxInstances < 1 || config.MaxInstances > 250 {
+		return nil, fmt.Errorf("local backend supports 1 to 250 instances, got %d", config.MaxInstances)
+	}
+
+	h := &LocalHost{
+		config: config,
+		namer:  NewResourceNamer("local"),
+		state: localState{
+			Instances: make(map[string]*localInstance),
+			Volumes:   make(map[string]*localVolume),
+			Registry: map[string]map[string]ResourceRegistryEntity{
+				ResourceRoleInstance: {},
+				ResourceRoleVolume:   {},
+			},
+		},
+	}
+
+	store, err := NewFileStore(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	h.FileStore = store
+
+	data, err := os.ReadFile(h.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local state: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.state); err != nil {
+		return nil, fmt.Errorf("failed to parse local state %s: %w", h.statePath(), err)
+	}
+	return h, nil
+}
+
+// Provider returns a Provider running every backend on this host
+func (h *LocalHost) Provider() *Provider {
+	return &Provider{
+		Compute:     h,
+		Volumes:     h,
+		Snapshots:   h,
+		Network:     h,
+		Inventory:   h,
+		Allocations: h,
+		Claims:      NewMemoryClaimStore(),
+		Events:      h,
+		Runtime:     h,
+		Containers:  NewContainerManager(h),
+	}
+}
+
+func (h *LocalHost) statePath() string {
+	return filepath.Join(h.config.DataDir, "state.json")
+}
+
+func (h *LocalHost) goldenDir() string {
+	return filepath.Join(h.config.DataDir, "golden")
+}
+
+func (h *LocalHost) volumeDir(volumeID string) string {
+	return filepath.Join(h.config.DataDir, "volumes", volumeID)
+}
+
+// saveLocked writes the state file atomically; h.mu must be held
+func (h *LocalHost) saveLocked() error {
+	data, err := json.MarshalIndent(&h.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal local state: %w", err)
+	}
+	return writeFileAtomic(h.statePath(), data)
+}
+
+// slotIP returns the loopback address a slot's box forwards SSH on
+func slotIP(slot int) string {
+	return fmt.Sprintf("127.0.1.%d", slot+1)
+}
+
+// instanceByIPLocked finds the instance serving instanceIP; h.mu must be held
+func (h *LocalHost) instanceByIPLocked(instanceIP string) (string, *localInstance, error) {
+	for instanceID, instance := range h.state.Instances {
+		if slotIP(instance.Slot) == instanceIP {
+			return instanceID, instance, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no local instance with IP %s", instanceIP)
+}
+
+// CreateInstance implements ComputeProvider by taking the lowest free slot
+func (h *LocalHost) CreateInstance(_ context.Context, _ *VMConfig) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	used := make(map[int]bool, len(h.state.Instances))
+	for _, instance := range h.state.Instances {
+		used[instance.Slot] = true
+	}
+	slot := 0
+	for used[slot] {
+		slot++
+	}
+	if slot >= h.config.MaxInstances {
+		return "", fmt.Errorf("all %d local slots are in use", h.config.MaxInstances)
+	}
+
+	instanceID := uuid.New().String()
+	h.state.Instances[instanceID] = &localInstance{Slot: slot}
+	if err := h.saveLocked(); err != nil {
+		delete(h.state.Instances, instanceID)
+		return "", err
+	}
+	return instanceID, nil
+}
+
+// DeleteInstance implements ComputeProvider. The slot's box must already be stopped.
+func (h *LocalHost) DeleteInstance(_ context.Context, instanceID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	instance, ok := h.state.Instances[instanceID]
+	if !ok {
+		return fmt.Errorf("local instance %s not found", instanceID)
+	}
+	if volume, ok := h.state.Volumes[instance.VolumeID]; ok {
+		volume.AttachedTo = ""
+	}
+	delete(h.state.Instances, instanceID)
+	return h.saveLocked()
+}
+
+// GetInstancePrivateIP implements ComputeProvider
+func (h *LocalHost) GetInstancePrivateIP(_ context.Context, instanceID string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	instance, ok := h.state.Instances[instanceID]
+	if !ok {
+		return "", fmt.Errorf("local instance %s not found", instanceID)
+	}
+	return slotIP(instance.Slot), nil
+}
+
+// CreateVolumeFromSnapshot implements VolumeProvider by creating a qcow2 overlay on the
+// golden base disk at snapshotID
+func (h *LocalHost) CreateVolumeFromSnapshot(ctx context.Context, snapshotID string, tags *VolumeTags) error {
+	dir := h.volumeDir(tags.VolumeID)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create volume directory: %w", err)
+	}
+
+	disk := filepath.Join(dir, localBoxDiskName)
+	// #nosec G204 -- arguments are paths under DataDir, not user input
+	output, err := exec.CommandContext(ctx, "qemu-img", "create", "-q", "-f", "qcow2", "-F", "qcow2", "-b", snapshotID, disk).CombinedOutput()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("failed to create volume disk: %w: %s", err, output)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state.Volumes[tags.VolumeID] = &localVolume{}
+	return h.saveLocked()
+}
+
+// DeleteVolume implements VolumeProvider
+func (h *LocalHost) DeleteVolume(_ context.Context, volumeID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	volume, ok := h.state.Volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("local volume %s not found", volumeID)
+	}
+	if volume.AttachedTo != "" {
+		return fmt.Errorf("local volume %s is attached to instance %s", volumeID, volume.AttachedTo)
+	}
+	if err := os.RemoveAll(h.volumeDir(volumeID)); err != nil {
+		return fmt.Errorf("failed to remove volume directory: %w", err)
+	}
+	delete(h.state.Volumes, volumeID)
+	return h.saveLocked()
+}
+
+// AttachVolume implements VolumeProvider. Attaching only assigns the volume to the slot;
+// StartBox boots the slot's box from it.
+func (h *LocalHost) AttachVolume(_ context.Context, instanceID, volumeID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	instance, ok := h.state.Instances[instanceID]
+	if !ok {
+		return fmt.Errorf("local instance %s not found", instanceID)
+	}
+	volume, ok := h.state.Volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("local volume %s not found", volumeID)
+	}
+	if volume.AttachedTo == instanceID {
+		return nil
+	}
+	if volume.AttachedTo != "" {
+		return fmt.Errorf("local volume %s is attached to instance %s", volumeID, volume.AttachedTo)
+	}
+	if instance.VolumeID != "" {
+		return fmt.Errorf("local instance %s already has volume %s attached", instanceID, instance.VolumeID)
+	}
+
+	instance.VolumeID = volumeID
+	volume.AttachedTo = instanceID
+	return h.saveLocked()
+}
+
+// DetachVolume implements VolumeProvider
+func (h *LocalHost) DetachVolume(_ context.Context, instanceID, volumeID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	instance, ok := h.state.Instances[instanceID]
+	if !ok || instance.VolumeID != volumeID {
+		return nil
+	}
+	instance.VolumeID = ""
+	if volume, ok := h.state.Volumes[volumeID]; ok {
+		volume.AttachedTo = ""
+	}
+	return h.saveLocked()
+}
+
+// EnsureGoldenSnapshot implements SnapshotProvider. The golden "snapshot" is a base disk
+// built from LocalGoldenImageURL plus the cloud-init ISO every box boots with.
+func (h *LocalHost) EnsureGoldenSnapshot(ctx context.Context) (*GoldenSnapshotInfo, error) {
+	dir := h.goldenDir()
+	baseDisk := filepath.Join(dir, localGoldenDiskName)
+	cloudInit := filepath.Join(dir, localCloudInitName)
+
+	if _, err := os.Stat(baseDisk); errors.Is(err, os.ErrNotExist) {
+		slog.Info("building local golden disk", "url", LocalGoldenImageURL, "path", baseDisk)
+		if err := buildLocalGoldenDisk(ctx, dir, baseDisk); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to check golden disk: %w", err)
+	}
+
+	if _, err := os.Stat(cloudInit); errors.Is(err, os.ErrNotExist) {
+		if err := buildLocalCloudInit(ctx, dir, cloudInit, h.config.SSHPublicKey); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to check cloud-init image: %w", err)
+	}
+
+	info, err := os.Stat(baseDisk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check golden disk: %w", err)
+	}
+	return &GoldenSnapshotInfo{
+		DataSnapshotName:       localGoldenDiskName,
+		DataSnapshotResourceID: baseDisk,
+		OSImageName:            localCloudInitName,
+		OSImageResourceID:      cloudInit,
+		Location:               "local",
+		CreatedTime:            info.ModTime(),
+	}, nil
+}
+
+// buildLocalGoldenDisk downloads the cloud image and converts it to a resized qcow2 base disk
+func buildLocalGoldenDisk(ctx context.Context, dir, baseDisk string) error {
+	download := filepath.Join(dir, "cloudimg.img.part")
+	defer os.Remove(download)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, LocalGoldenImageURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create image request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download cloud image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download cloud image: %s", resp.Status)
+	}
+
+	f, err := os.Create(download)
+	if err != nil {
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	_, err = io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download cloud image: %w", err)
+	}
+
+	tmpDisk := baseDisk + ".tmp"
+	for _, args := range [][]string{
+		{"convert", "-f", "qcow2", "-O", "qcow2", download, tmpDisk},
+		{"resize", tmpDisk, localGoldenDiskSize},
+	} {
+		if output, err := exec.CommandContext(ctx, "qemu-img", args...).CombinedOutput(); err != nil {
+			_ = os.Remove(tmpDisk)
+			return fmt.Errorf("qemu-img %s failed: %w: %s", args[0], err, output)
+		}
+	}
+	if err := os.Rename(tmpDisk, baseDisk); err != nil {
+		return fmt.Errorf("failed to install golden disk: %w", err)
+	}
+	return nil
+}
+
+// buildLocalCloudInit writes the box cloud-init configuration into a cidata ISO
+func buildLocalCloudInit(ctx context.Context, dir, isoPath, sshPublicKey string) error {
+	userData := filepath.Join(dir, "user-data")
+	metaData := filepath.Join(dir, "meta-data")
+	if err := os.WriteFile(userData, []byte(boxCloudConfig(sshPublicKey)), 0o600); err != nil {
+		return fmt.Errorf("failed to write user-data: %w", err)
+	}
+	if err := os.WriteFile(metaData, []byte("instance-id: ubuntu-inst-1\nlocal-hostname: ubuntu\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write meta-data: %w", err)
+	}
+
+	// #nosec G204 -- arguments are paths under DataDir
+	output, err := exec.CommandContext(ctx, "genisoimage", "-output", isoPath, "-volid", "cidata", "-joliet", "-rock", userData, metaData).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to build cloud-init image: %w: %s", err, output)
+	}
+	return nil
+}
+
+// EnsureNetwork implements NetworkProvider. Boxes use QEMU user networking, so this only
+// creates the data directories and checks the tools the backend runs are installed.
+func (h *LocalHost) EnsureNetwork(_ context.Context) error {
+	for _, dir := range []string{h.goldenDir(), filepath.Join(h.config.DataDir, "volumes")} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	for _, tool := range []string{localQEMUBinary, "qemu-img", "genisoimage"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("local backend needs %s: %w", tool, err)
+		}
+	}
+	return nil
+}
+
+// RegisterResource implements InventoryProvider
+func (h *LocalHost) RegisterResource(_ context.Context, entry *ResourceRegistryEntity) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries, ok := h.state.Registry[entry.PartitionKey]
+	if !ok {
+		return fmt.Errorf("unknown resource role %s", entry.PartitionKey)
+	}
+	entries[entry.RowKey] = *entry
+	return h.saveLocked()
+}
+
+// UnregisterResource implements InventoryProvider
+func (h *LocalHost) UnregisterResource(_ context.Context, role, resourceID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.state.Registry[role], resourceID)
+	return h.saveLocked()
+}
+
+// UpdateInstanceStatus implements InventoryProvider
+func (h *LocalHost) UpdateInstanceStatus(_ context.Context, instanceID, status string) error {
+	return h.updateRegistry(ResourceRoleInstance, instanceID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+	})
+}
+
+// UpdateInstanceStatusAndUser implements InventoryProvider
+func (h *LocalHost) UpdateInstanceStatusAndUser(_ context.Context, instanceID, status, userID string) error {
+	return h.updateRegistry(ResourceRoleInstance, instanceID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+		entry.UserID = userID
+	})
+}
+
+// UpdateVolumeStatusUserAndBox implements InventoryProvider
+func (h *LocalHost) UpdateVolumeStatusUserAndBox(_ context.Context, volumeID, status, userID, boxName string) error {
+	return h.updateRegistry(ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+		entry.UserID = userID
+		entry.BoxName = boxName
+	})
+}
+
+// UpdateVolumeRuntime implements InventoryProvider
+func (h *LocalHost) UpdateVolumeRuntime(_ context.Context, volumeID, runtime string) error {
+	return h.updateRegistry(ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Runtime = runtime
+	})
+}
+
+func (h *LocalHost) updateRegistry(role, resourceID string, update func(*ResourceRegistryEntity)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := h.state.Registry[role][resourceID]
+	if !ok {
+		entry = ResourceRegistryEntity{
+			PartitionKey: role,
+			RowKey:       resourceID,
+			CreatedAt:    now,
+		}
+	}
+	update(&entry)
+	entry.Timestamp = now
+	entry.LastActivity = now
+	h.state.Registry[role][resourceID] = entry
+	return h.saveLocked()
+}
+
+// Reconcile implements InventoryProvider by dropping entries for slots and volumes that no
+// longer exist, e.g. after the state file was edited by hand
+func (h *LocalHost) Reconcile(_ context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for instanceID := range h.state.Registry[ResourceRoleInstance] {
+		if _, ok := h.state.Instances[instanceID]; !ok {
+			slog.Info("removing registry entry for missing local instance", "instanceID", instanceID)
+			delete(h.state.Registry[ResourceRoleInstance], instanceID)
+		}
+	}
+	for volumeID := range h.state.Registry[ResourceRoleVolume] {
+		if _, ok := h.state.Volumes[volumeID]; !ok {
+			slog.Info("removing registry entry for missing local volume", "volumeID", volumeID)
+			delete(h.state.Registry[ResourceRoleVolume], volumeID)
+		}
+	}
+	return h.saveLocked()
+}
+
+// CountInstancesByStatus implements ResourceQueries
+func (h *LocalHost) CountInstancesByStatus(_ context.Context) (*ResourceCounts, error) {
+	return h.count(ResourceRoleInstance), nil
+}
+
+// CountVolumesByStatus implements ResourceQueries
+func (h *LocalHost) CountVolumesByStatus(_ context.Context) (*ResourceCounts, error) {
+	return h.count(ResourceRoleVolume), nil
+}
+
+// GetVolumesByStatus implements ResourceQueries
+func (h *LocalHost) GetVolumesByStatus(_ context.Context, status string) ([]ResourceInfo, error) {
+	return h.list(ResourceRoleVolume, func(entry *ResourceRegistryEntity) bool {
+		return entry.Status == status
+	}), nil
+}
+
+// GetVolumesByUserAndBox implements ResourceQueries
+func (h *LocalHost) GetVolumesByUserAndBox(_ context.Context, userID, boxName string) ([]ResourceInfo, error) {
+	return h.list(ResourceRoleVolume, func(entry *ResourceRegistryEntity) bool {
+		return entry.UserID == userID && entry.BoxName == boxName
+	}), nil
+}
+
+// GetOldestFreeVolumes implements ResourceQueries
+func (h *LocalHost) GetOldestFreeVolumes(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	resources, _ := h.GetVolumesByStatus(ctx, ResourceStatusFree)
+	return oldestFirst(resources, limit), nil
+}
+
+// GetRunningInstancesByStatus implements ResourceQueries
+func (h *LocalHost) GetRunningInstancesByStatus(_ context.Context, status string) ([]ResourceInfo, error) {
+	return h.list(ResourceRoleInstance, func(entry *ResourceRegistryEntity) bool {
+		return entry.Status == status
+	}), nil
+}
+
+// GetOldestFreeRunningInstances implements ResourceQueries
+func (h *LocalHost) GetOldestFreeRunningInstances(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	resources, _ := h.GetRunningInstancesByStatus(ctx, ResourceStatusFree)
+	return oldestFirst(resources, limit), nil
+}
+
+func (h *LocalHost) count(role string) *ResourceCounts {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := make([]ResourceRegistryEntity, 0, len(h.state.Registry[role]))
+	for _, entry := range h.state.Registry[role] {
+		entries = append(entries, entry)
+	}
+	return countRegistryEntries(entries)
+}
+
+func (h *LocalHost) list(role string, match func(*ResourceRegistryEntity) bool) []ResourceInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var resources []ResourceInfo
+	for _, entry := range h.state.Registry[role] {
+		if match(&entry) {
+			resources = append(resources, registryResourceInfo(h.namer, &entry))
+		}
+	}
+	return resources
+}
@@ -0,0 +1,241 @@
+package infra
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestLocalHost returns a local host with two slots keeping its state in dir
+func newTestLocalHost(t *testing.T, dir string) *LocalHost {
+	t.Helper()
+	config := NewDefaultLocalProviderConfig("ssh-ed25519 AAAA test")
+	config.DataDir = dir
+	config.MaxInstances = 2
+	h, err := NewLocalHost(config)
+	if err != nil {
+		t.Fatalf("NewLocalHost: %v", err)
+	}
+	return h
+}
+
+// addLocalVolume records a volume as CreateVolumeFromSnapshot would, without qemu-img
+func addLocalVolume(t *testing.T, h *LocalHost, volumeID string) {
+	t.Helper()
+	if err := os.MkdirAll(h.volumeDir(volumeID), 0o750); err != nil {
+		t.Fatalf("creating volume directory: %v", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state.Volumes[volumeID] = &localVolume{}
+	if err := h.saveLocked(); err != nil {
+		t.Fatalf("saving state: %v", err)
+	}
+}
+
+func TestLocalHostSlots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	h := newTestLocalHost(t, dir)
+
+	first, err := h.CreateInstance(ctx, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	}
+	second, err := h.CreateInstance(ctx, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	}
+	if _, err := h.CreateInstance(ctx, nil); err == nil {
+		t.Fatalf("created a third instance on a host with two slots")
+	}
+	for instanceID, want := range map[string]string{first: "127.0.1.1", second: "127.0.1.2"} {
+		if ip, err := h.GetInstancePrivateIP(ctx, instanceID); err != nil || ip != want {
+			t.Errorf("got IP %s, %v, want %s", ip, err, want)
+		}
+	}
+
+	// A volume is attached to one slot at a time
+	addLocalVolume(t, h, "vol-1")
+	addLocalVolume(t, h, "vol-2")
+	if err := h.AttachVolume(ctx, first, "vol-1"); err != nil {
+		t.Fatalf("AttachVolume: %v", err)
+	}
+	if err := h.AttachVolume(ctx, first, "vol-1"); err != nil {
+		t.Errorf("attaching again: %v", err)
+	}
+	if err := h.AttachVolume(ctx, second, "vol-1"); err == nil {
+		t.Errorf("attached vol-1 to a second slot")
+	}
+	if err := h.AttachVolume(ctx, first, "vol-2"); err == nil {
+		t.Errorf("attached a second volume to a slot")
+	}
+	if err := h.DeleteVolume(ctx, "vol-1"); err == nil {
+		t.Errorf("deleted an attached volume")
+	}
+
+	// The state survives a restart
+	h = newTestLocalHost(t, dir)
+	if err := h.AttachVolume(ctx, second, "vol-1"); err == nil {
+		t.Errorf("attachment lost on restart")
+	}
+	if err := h.DetachVolume(ctx, first, "vol-1"); err != nil {
+		t.Fatalf("DetachVolume: %v", err)
+	}
+	if err := h.AttachVolume(ctx, second, "vol-1"); err != nil {
+		t.Fatalf("AttachVolume after detaching: %v", err)
+	}
+
+	// Deleting a slot frees it and whatever volume it had
+	if err := h.DeleteInstance(ctx, second); err != nil {
+		t.Fatalf("DeleteInstance: %v", err)
+	}
+	if err := h.DeleteVolume(ctx, "vol-1"); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+	if _, err := os.Stat(h.volumeDir("vol-1")); !os.IsNotExist(err) {
+		t.Errorf("volume directory left behind: %v", err)
+	}
+	third, err := h.CreateInstance(ctx, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance in the freed slot: %v", err)
+	}
+	if ip, _ := h.GetInstancePrivateIP(ctx, third); ip != "127.0.1.2" {
+		t.Errorf("got IP %s, want the freed slot's 127.0.1.2", ip)
+	}
+}
+
+func TestLocalHostInventory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	h := newTestLocalHost(t, dir)
+	instanceID, err := h.CreateInstance(ctx, nil)
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	}
+	addLocalVolume(t, h, "vol-1")
+	for role, resourceID := range map[string]string{ResourceRoleInstance: instanceID, ResourceRoleVolume: "vol-1"} {
+		if err := h.RegisterResource(ctx, &ResourceRegistryEntity{PartitionKey: role, RowKey: resourceID, Status: ResourceStatusFree}); err != nil {
+			t.Fatalf("RegisterResource: %v", err)
+		}
+	}
+	// Entries of resources that are gone, e.g. after the state file was edited
+	if err := h.RegisterResource(ctx, &ResourceRegistryEntity{PartitionKey: ResourceRoleVolume, RowKey: "vol-gone", Status: ResourceStatusFree}); err != nil {
+		t.Fatalf("RegisterResource: %v", err)
+	}
+
+	if err := h.UpdateInstanceStatusAndUser(ctx, instanceID, ResourceStatusConnected, "user-1"); err != nil {
+		t.Fatalf("UpdateInstanceStatusAndUser: %v", err)
+	}
+	if err := h.UpdateVolumeStatusUserAndBox(ctx, "vol-1", ResourceStatusAttached, "user-1", "dev1"); err != nil {
+		t.Fatalf("UpdateVolumeStatusUserAndBox: %v", err)
+	}
+
+	h = newTestLocalHost(t, dir)
+	if err := h.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	counts, _ := h.CountVolumesByStatus(ctx)
+	if counts.Total != 1 || counts.Free != 0 {
+		t.Errorf("got volume counts %+v, want only vol-1, attached", counts)
+	}
+	volumes, _ := h.GetVolumesByUserAndBox(ctx, "user-1", "dev1")
+	if len(volumes) != 1 || volumes[0].ResourceID != "vol-1" {
+		t.Errorf("got volumes %+v for dev1, want vol-1", volumes)
+	}
+	instances, _ := h.GetRunningInstancesByStatus(ctx, ResourceStatusConnected)
+	if len(instances) != 1 || instances[0].ResourceID != instanceID {
+		t.Errorf("got connected instances %+v, want %s", instances, instanceID)
+	}
+}
+
+func TestLocalQEMUArgs(t *testing.T) {
+	h := newTestLocalHost(t, t.TempDir())
+	args := h.localQEMUArgs("127.0.1.2", h.volumeDir("vol-1"))
+	joined := strings.Join(args, " ")
+	for _, want := range []string{
+		"-netdev user,id=net0,hostfwd=tcp:127.0.1.2:" + strconv.Itoa(BoxSSHPort) + "-:22",
+		"-drive file=" + filepath.Join(h.volumeDir("vol-1"), localBoxDiskName) + ",format=qcow2,if=virtio",
+		"-m " + strconv.Itoa(DefaultLocalMemoryMB),
+		"-pidfile " + filepath.Join(h.volumeDir("vol-1"), localPIDFileName),
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("QEMU arguments lack %q:\n%s", want, joined)
+		}
+	}
+	accel, _ := localAccelerator()
+	if i := slices.Index(args, "-machine"); i < 0 || args[i+1] != "q35,accel="+accel {
+		t.Errorf("got arguments %v, want the q35 machine with %s", args, accel)
+	}
+}
+
+func TestLocalBoxRunning(t *testing.T) {
+	ctx := context.Background()
+	h := newTestLocalHost(t, t.TempDir())
+	instanceID, _ := h.CreateInstance(ctx, nil)
+	ip, _ := h.GetInstancePrivateIP(ctx, instanceID)
+	if running, err := h.BoxRunning(ctx, ip); err != nil || running {
+		t.Errorf("empty slot: got %v, %v, want not running", running, err)
+	}
+
+	addLocalVolume(t, h, "vol-1")
+	if err := h.AttachVolume(ctx, instanceID, "vol-1"); err != nil {
+		t.Fatalf("AttachVolume: %v", err)
+	}
+	pidFile := filepath.Join(h.volumeDir("vol-1"), localPIDFileName)
+	for _, tt := range []struct {
+		pid  string
+		want bool
+	}{
+		{"", false}, // no pid file, QEMU never started
+		{strconv.Itoa(os.Getpid()) + "\n", true},
+		{"2147483646\n", false}, // QEMU exited
+	} {
+		if tt.pid != "" {
+			if err := os.WriteFile(pidFile, []byte(tt.pid), 0o600); err != nil {
+				t.Fatalf("writing pid file: %v", err)
+			}
+		}
+		if running, err := h.BoxRunning(ctx, ip); err != nil || running != tt.want {
+			t.Errorf("pid file %q: got %v, %v, want %v", tt.pid, running, err, tt.want)
+		}
+	}
+}
+
+func TestCheckSSHBanner(t *testing.T) {
+	serveBanner := func(banner string) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(banner))
+				conn.Close()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	ctx := context.Background()
+	if err := checkSSHBanner(ctx, serveBanner("SSH-2.0-OpenSSH_9.6\r\n")); err != nil {
+		t.Errorf("SSH server: %v", err)
+	}
+	// QEMU accepts forwarded connections and closes them while the guest boots
+	if err := checkSSHBanner(ctx, serveBanner("")); err == nil {
+		t.Errorf("connection closed without a banner passed")
+	}
+	if err := checkSSHBanner(ctx, serveBanner("HTTP/1.1 400 Bad Request\r\n")); err == nil {
+		t.Errorf("other server passed")
+	}
+}
@@ -0,0 +1,213 @@
+package infra
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"shellbox/internal/qmp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Local QEMU files and timeouts
+const (
+	localQEMUBinary     = "qemu-system-x86_64"
+	localGoldenDiskName = "ubuntu-base.qcow2"
+	localCloudInitName  = "cloud-init.iso"
+	localBoxDiskName    = "disk.qcow2"
+	localQMPSocketName  = "qmp.sock"
+	localQGASocketName  = "qga.sock"
+	localPIDFileName    = "qemu.pid"
+
+	// Boxes cold boot locally (there is no saved VM state to restore), and the first boot
+	// of a volume also runs cloud-init
+	LocalBoxBootTimeout = 10 * time.Minute
+)
+
+// localAccelerator returns the QEMU accelerator and CPU model: KVM with the host CPU when
+// /dev/kvm is usable, TCG emulation otherwise
+func localAccelerator() (accel, cpu string) {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return "tcg", "max"
+	}
+	f.Close()
+	return "kvm", "host"
+}
+
+// localQEMUArgs builds the command line for a box booting from volumeDir and forwarding
+// BoxSSHPort on instanceIP
+func (h *LocalHost) localQEMUArgs(instanceIP, volumeDir string) []string {
+	accel, cpu := localAccelerator()
+	return []string{
+		"-name", "shellbox-" + filepath.Base(volumeDir),
+		"-machine", "q35,accel=" + accel,
+		"-cpu", cpu,
+		"-m", strconv.Itoa(h.config.MemoryMB),
+		"-smp", strconv.Itoa(h.config.CPUs),
+		"-rtc", "base=utc,driftfix=slew",
+		"-drive", "file=" + filepath.Join(volumeDir, localBoxDiskName) + ",format=qcow2,if=virtio",
+		"-cdrom", filepath.Join(h.goldenDir(), localCloudInitName),
+		"-device", "virtio-rng-pci,rng=rng0",
+		"-object", "rng-random,id=rng0,filename=/dev/urandom",
+		"-device", "virtio-net-pci,netdev=net0",
+		"-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp:%s:%d-:22", instanceIP, BoxSSHPort),
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		"-chardev", "socket,path=" + filepath.Join(volumeDir, localQGASocketName) + ",server=on,wait=off,id=qga0",
+		"-display", "none",
+		"-serial", "file:" + filepath.Join(volumeDir, "serial.log"),
+		"-qmp", "unix:" + filepath.Join(volumeDir, localQMPSocketName) + ",server=on,wait=off",
+		"-pidfile", filepath.Join(volumeDir, localPIDFileName),
+		"-daemonize",
+	}
+}
+
+// StartBox implements BoxRuntime by launching QEMU on this host for the slot at instanceIP
+// and waiting until the box's SSH server answers
+func (h *LocalHost) StartBox(ctx context.Context, instanceIP, volumeID string, progress *ProgressReporter) error {
+	h.mu.Lock()
+	_, instance, err := h.instanceByIPLocked(instanceIP)
+	if err == nil && instance.VolumeID != volumeID {
+		err = fmt.Errorf("volume %s is not attached to %s", volumeID, instanceIP)
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	volumeDir := h.volumeDir(volumeID)
+	err = progress.Step("Starting QEMU", func() error {
+		args := h.localQEMUArgs(instanceIP, volumeDir)
+		slog.Info("starting local QEMU", "instanceIP", instanceIP, "volumeID", volumeID, "args", strings.Join(args, " "))
+		// #nosec G204 -- arguments are built from paths under DataDir and slot addresses
+		output, err := exec.CommandContext(ctx, localQEMUBinary, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to start QEMU: %w: %s", err, output)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return progress.Step("Booting VM", func() error {
+		return RetryOperation(ctx, func(ctx context.Context) error {
+			return checkSSHBanner(ctx, net.JoinHostPort(instanceIP, strconv.Itoa(BoxSSHPort)))
+		}, LocalBoxBootTimeout, 2*time.Second, "local box SSH")
+	})
+}
+
+// checkSSHBanner succeeds once an SSH server answers at addr. QEMU user networking accepts
+// forwarded connections before the guest listens, so a successful dial alone proves nothing.
+func checkSSHBanner(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no SSH banner yet: %w", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", banner)
+	}
+	return nil
+}
+
+// StopBox implements BoxRuntime by asking QEMU to quit over QMP, killing it if that fails
+func (h *LocalHost) StopBox(ctx context.Context, instanceIP string) error {
+	h.mu.Lock()
+	_, instance, err := h.instanceByIPLocked(instanceIP)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if instance.VolumeID == "" {
+		return nil
+	}
+	volumeDir := h.volumeDir(instance.VolumeID)
+
+	if err := localQMPQuit(ctx, filepath.Join(volumeDir, localQMPSocketName)); err != nil {
+		slog.Warn("Failed to quit local QEMU over QMP, killing it", "instanceIP", instanceIP, "error", err)
+		if err := killLocalQEMU(filepath.Join(volumeDir, localPIDFileName)); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("local QEMU stopped", "instanceIP", instanceIP)
+	return nil
+}
+
+// BoxRunning implements BoxChecker by checking the QEMU process recorded in the box's pid file
+func (h *LocalHost) BoxRunning(_ context.Context, instanceIP string) (bool, error) {
+	h.mu.Lock()
+	_, instance, err := h.instanceByIPLocked(instanceIP)
+	h.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if instance.VolumeID == "" {
+		return false, nil
+	}
+
+	pid, err := readLocalQEMUPID(filepath.Join(h.volumeDir(instance.VolumeID), localPIDFileName))
+	if err != nil || pid == 0 {
+		return false, err
+	}
+	return syscall.Kill(pid, 0) == nil, nil
+}
+
+// localQMPQuit sends quit to the QMP socket at path
+func localQMPQuit(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, QMPCommandTimeout)
+	defer cancel()
+
+	client, err := qmp.DialLocal(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Quit(ctx)
+}
+
+// readLocalQEMUPID returns the QEMU process recorded in pidFile, or 0 if there is none
+func readLocalQEMUPID(pidFile string) (int, error) {
+	data, err := os.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read QEMU pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid QEMU pid file %s: %w", pidFile, err)
+	}
+	return pid, nil
+}
+
+// killLocalQEMU kills the QEMU process recorded in pidFile, if it is still running
+func killLocalQEMU(pidFile string) error {
+	pid, err := readLocalQEMUPID(pidFile)
+	if err != nil || pid == 0 {
+		return err
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to kill QEMU: %w", err)
+	}
+	return nil
+}
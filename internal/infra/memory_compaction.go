@@ -0,0 +1,151 @@
+package infra
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"shellbox/internal/qga"
+	"shellbox/internal/sshutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Memory compaction timings. The guest reports free pages 2s after they were freed, in
+// rounds, and QEMU punches a hole in the memory file for each reported range.
+const (
+	freePageReportingSettle  = 3 * time.Second  // wait before the first measurement
+	freePageReportingPoll    = 1 * time.Second  // between measurements until the file stops shrinking
+	freePageReportingTimeout = 20 * time.Second // longest wait for the guest to finish reporting
+	memoryCompactionTimeout  = 30 * time.Second // bound on compaction before StopBox quits QEMU
+	qemuExitTimeout          = 30 * time.Second // wait for QEMU to exit before punching holes
+)
+
+// Guest commands that free pages for the balloon to report. compact_memory merges free
+// pages into the 2M blocks free-page reporting works on; dropping the page cache frees
+// most of the guest's memory but makes it reread files, so only compact and stop do it.
+const (
+	guestCompactMemory        = "echo 1 > /proc/sys/vm/compact_memory"
+	guestDropCachesAndCompact = "sync && echo 3 > /proc/sys/vm/drop_caches && " + guestCompactMemory
+)
+
+// ErrNoMemoryBalloon is returned when compacting a box whose VM was built without a
+// balloon device, so the guest can't hand free memory back
+var ErrNoMemoryBalloon = errors.New("box has no memory balloon")
+
+// CompactMemory implements MemoryCompactor: it has the guest drop its page cache and
+// compact its free memory, waits for the balloon to report the freed pages and returns
+// how many bytes of the memory file were reclaimed
+func (qm *QEMUManager) CompactMemory(ctx context.Context, instanceIP string) (int64, error) {
+	config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+	if err != nil {
+		return 0, err
+	}
+	if !config.Balloon {
+		return 0, ErrNoMemoryBalloon
+	}
+
+	before, err := memoryFileAllocated(ctx, instanceIP)
+	if err != nil {
+		return 0, err
+	}
+	after, err := qm.reportFreePages(ctx, instanceIP, guestDropCachesAndCompact)
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("Compacted box memory", "instanceIP", instanceIP, "before", before, "after", after)
+	return max(before-after, 0), nil
+}
+
+// reportFreePages runs guestCommand to free guest memory and waits until the memory file
+// stops shrinking, returning its allocated size
+func (qm *QEMUManager) reportFreePages(ctx context.Context, instanceIP, guestCommand string) (int64, error) {
+	err := qm.GuestAgent(ctx, instanceIP, func(agent *qga.Client) error {
+		return guestExec(ctx, agent, "/bin/sh", []string{"-c", guestCommand})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to free guest memory: %w", err)
+	}
+
+	if err := sleepWithContext(ctx, freePageReportingSettle); err != nil {
+		return 0, err
+	}
+	allocated, err := memoryFileAllocated(ctx, instanceIP)
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(freePageReportingTimeout)
+	for time.Now().Before(deadline) {
+		if err := sleepWithContext(ctx, freePageReportingPoll); err != nil {
+			return 0, err
+		}
+		next, err := memoryFileAllocated(ctx, instanceIP)
+		if err != nil {
+			return 0, err
+		}
+		if next >= allocated {
+			return next, nil
+		}
+		allocated = next
+	}
+	return allocated, nil
+}
+
+// memoryFileAllocated returns the disk space the box's memory file takes, which is less
+// than its size where it has holes
+func memoryFileAllocated(ctx context.Context, instanceIP string) (int64, error) {
+	result, err := sshutil.Run(ctx, "sudo stat -c '%b %B' "+QEMUMemoryPath, AdminUsername, instanceIP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat memory file: %w", err)
+	}
+	fields := strings.Fields(result.Stdout)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected stat output %q", result.Stdout)
+	}
+	blocks, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse memory file blocks: %w", err)
+	}
+	blockSize, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse memory file block size: %w", err)
+	}
+	return blocks * blockSize, nil
+}
+
+// digMemoryHoles punches holes in the memory file wherever it holds zeros, which catches
+// freed pages the guest didn't get to report. It waits for QEMU to exit first, killing it
+// if it doesn't in time: punching a range the running guest writes to would lose the write.
+func digMemoryHoles(ctx context.Context, instanceIP string) error {
+	cmd := fmt.Sprintf(`wait_qemu() { timeout "$1" sh -c 'while %[1]s > /dev/null; do sleep 0.5; done'; }
+wait_qemu %[2]d || { sudo %[3]s; wait_qemu 5; }
+sudo fallocate --dig-holes %[4]s`,
+		qemuPIDCommand, int(qemuExitTimeout.Seconds()), qemuKillCommand, QEMUMemoryPath)
+	if err := sshutil.ExecuteCommand(ctx, cmd, AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("failed to punch holes in memory file: %w", err)
+	}
+	return nil
+}
+
+// CompactBox has a user's running box hand its free memory back to the host and returns
+// how many bytes of disk space that reclaimed
+func (ra *ResourceAllocator) CompactBox(ctx context.Context, userID, boxName string) (int64, error) {
+	allocation, err := ra.findBoxAllocation(ctx, userID, boxName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find box: %w", err)
+	}
+	if allocation == nil {
+		return 0, ErrBoxNotRunning
+	}
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return 0, err
+	}
+	compactor, ok := runtime.(MemoryCompactor)
+	if !ok {
+		return 0, fmt.Errorf("%s boxes have no memory file to compact", cmp.Or(allocation.Runtime, BoxRuntimeVM))
+	}
+	return compactor.CompactMemory(ctx, allocation.InstanceIP)
+}
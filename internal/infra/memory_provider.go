@@ -0,0 +1,591 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryResourceSuffix is the naming suffix the in-memory backend reports resource names with
+const memoryResourceSuffix = "memory"
+
+// ErrInjectedFailure is returned by MemoryCloud operations failed by FailureRate
+var ErrInjectedFailure = errors.New("injected failure")
+
+// MemoryProviderConfig controls how the in-memory backend behaves
+type MemoryProviderConfig struct {
+	Latency     time.Duration // added to every operation
+	FailureRate float64       // probability of an operation failing with ErrInjectedFailure
+	Seed        uint64        // seeds the failure injection so test runs are reproducible
+}
+
+type memoryInstance struct {
+	ip       string
+	volumeID string // attached volume, if any
+}
+
+// MemoryCloud keeps instances, volumes, inventory, allocations and running boxes in memory.
+// It implements every provider interface, so BoxPool, ResourceAllocator and the SSH server
+// can run end to end without Azure.
+type MemoryCloud struct {
+	config MemoryProviderConfig
+	namer  *ResourceNamer
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	failNext    map[string][]error
+	instances   map[string]*memoryInstance // by instanceID
+	volumes     map[string]string          // volumeID -> instanceID it is attached to, "" if detached
+	registry    map[string]map[string]ResourceRegistryEntity
+	allocations map[string]AllocationEntity
+	events      []EventLogEntity
+	boxes       map[string]string      // instanceIP -> volumeID of the running box
+	forwards    map[string]map[int]int // instanceIP -> instance port -> guest port of the running box
+	nextIP      int
+}
+
+// NewMemoryCloud creates an empty in-memory cloud
+func NewMemoryCloud(config MemoryProviderConfig) *MemoryCloud {
+	return &MemoryCloud{
+		config:    config,
+		namer:     NewResourceNamer(memoryResourceSuffix),
+		rand:      rand.New(rand.NewPCG(config.Seed, config.Seed)),
+		failNext:  make(map[string][]error),
+		instances: make(map[string]*memoryInstance),
+		volumes:   make(map[string]string),
+		registry: map[string]map[string]ResourceRegistryEntity{
+			ResourceRoleInstance: {},
+			ResourceRoleVolume:   {},
+		},
+		allocations: make(map[string]AllocationEntity),
+		boxes:       make(map[string]string),
+		forwards:    make(map[string]map[int]int),
+	}
+}
+
+// Provider returns a Provider running every backend on this cloud
+func (m *MemoryCloud) Provider() *Provider {
+	return &Provider{
+		Compute:     m,
+		Volumes:     m,
+		Snapshots:   m,
+		Network:     m,
+		Inventory:   m,
+		Allocations: m,
+		Claims:      NewMemoryClaimStore(),
+		Events:      m,
+		Runtime:     m,
+		Containers:  m,
+	}
+}
+
+// FailNext makes the next call of operation op (a provider method name such as
+// "AttachVolume") fail with err. Calls queue up, so failing twice takes two calls.
+func (m *MemoryCloud) FailNext(op string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failNext[op] = append(m.failNext[op], err)
+}
+
+// Events returns a copy of the events written so far
+func (m *MemoryCloud) Events() []EventLogEntity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]EventLogEntity(nil), m.events...)
+}
+
+// RunningBoxes returns the volumeID of the box running on each instance IP
+func (m *MemoryCloud) RunningBoxes() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	boxes := make(map[string]string, len(m.boxes))
+	for ip, volumeID := range m.boxes {
+		boxes[ip] = volumeID
+	}
+	return boxes
+}
+
+// ForwardedPorts returns the guest port each instance port of the box on instanceIP is
+// forwarded to
+func (m *MemoryCloud) ForwardedPorts(instanceIP string) map[int]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ports := make(map[int]int, len(m.forwards[instanceIP]))
+	for port, guestPort := range m.forwards[instanceIP] {
+		ports[port] = guestPort
+	}
+	return ports
+}
+
+// operate applies the configured latency and any injected failure for op
+func (m *MemoryCloud) operate(ctx context.Context, op string) error {
+	if m.config.Latency > 0 {
+		if err := sleepWithContext(ctx, m.config.Latency); err != nil {
+			return err
+		}
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if queued := m.failNext[op]; len(queued) > 0 {
+		m.failNext[op] = queued[1:]
+		return queued[0]
+	}
+	if m.config.FailureRate > 0 && m.rand.Float64() < m.config.FailureRate {
+		return fmt.Errorf("%s: %w", op, ErrInjectedFailure)
+	}
+	return nil
+}
+
+// CreateInstance implements ComputeProvider
+func (m *MemoryCloud) CreateInstance(ctx context.Context, _ *VMConfig) (string, error) {
+	if err := m.operate(ctx, "CreateInstance"); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextIP++
+	instanceID := uuid.New().String()
+	m.instances[instanceID] = &memoryInstance{ip: fmt.Sprintf("10.1.%d.%d", m.nextIP/250, m.nextIP%250+4)}
+	return instanceID, nil
+}
+
+// DeleteInstance implements ComputeProvider
+func (m *MemoryCloud) DeleteInstance(ctx context.Context, instanceID string) error {
+	if err := m.operate(ctx, "DeleteInstance"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instance, ok := m.instances[instanceID]
+	if !ok {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+	if instance.volumeID != "" {
+		m.volumes[instance.volumeID] = ""
+	}
+	delete(m.boxes, instance.ip)
+	delete(m.instances, instanceID)
+	return nil
+}
+
+// GetInstancePrivateIP implements ComputeProvider
+func (m *MemoryCloud) GetInstancePrivateIP(ctx context.Context, instanceID string) (string, error) {
+	if err := m.operate(ctx, "GetInstancePrivateIP"); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instance, ok := m.instances[instanceID]
+	if !ok {
+		return "", fmt.Errorf("instance %s not found", instanceID)
+	}
+	return instance.ip, nil
+}
+
+// CreateVolumeFromSnapshot implements VolumeProvider
+func (m *MemoryCloud) CreateVolumeFromSnapshot(ctx context.Context, _ string, tags *VolumeTags) error {
+	if err := m.operate(ctx, "CreateVolumeFromSnapshot"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.volumes[tags.VolumeID]; ok {
+		return fmt.Errorf("volume %s already exists", tags.VolumeID)
+	}
+	m.volumes[tags.VolumeID] = ""
+	return nil
+}
+
+// DeleteVolume implements VolumeProvider
+func (m *MemoryCloud) DeleteVolume(ctx context.Context, volumeID string) error {
+	if err := m.operate(ctx, "DeleteVolume"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instanceID, ok := m.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume %s not found", volumeID)
+	}
+	if instanceID != "" {
+		return fmt.Errorf("volume %s is attached to instance %s", volumeID, instanceID)
+	}
+	delete(m.volumes, volumeID)
+	return nil
+}
+
+// AttachVolume implements VolumeProvider
+func (m *MemoryCloud) AttachVolume(ctx context.Context, instanceID, volumeID string) error {
+	if err := m.operate(ctx, "AttachVolume"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instance, ok := m.instances[instanceID]
+	if !ok {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+	attachedTo, ok := m.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume %s not found", volumeID)
+	}
+	if attachedTo == instanceID {
+		return nil
+	}
+	if attachedTo != "" {
+		return fmt.Errorf("volume %s is attached to instance %s", volumeID, attachedTo)
+	}
+	if instance.volumeID != "" {
+		return fmt.Errorf("instance %s already has volume %s attached", instanceID, instance.volumeID)
+	}
+	instance.volumeID = volumeID
+	m.volumes[volumeID] = instanceID
+	return nil
+}
+
+// DetachVolume implements VolumeProvider
+func (m *MemoryCloud) DetachVolume(ctx context.Context, instanceID, volumeID string) error {
+	if err := m.operate(ctx, "DetachVolume"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instance, ok := m.instances[instanceID]
+	if !ok {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+	if instance.volumeID == volumeID {
+		instance.volumeID = ""
+		m.volumes[volumeID] = ""
+	}
+	return nil
+}
+
+// EnsureGoldenSnapshot implements SnapshotProvider
+func (m *MemoryCloud) EnsureGoldenSnapshot(ctx context.Context) (*GoldenSnapshotInfo, error) {
+	if err := m.operate(ctx, "EnsureGoldenSnapshot"); err != nil {
+		return nil, err
+	}
+	return &GoldenSnapshotInfo{
+		DataSnapshotName:       "golden-data-memory",
+		DataSnapshotResourceID: "memory/snapshots/golden-data-memory",
+		OSImageName:            "golden-os-memory",
+		OSImageResourceID:      "memory/images/golden-os-memory",
+		Location:               memoryResourceSuffix,
+		CreatedTime:            time.Now(),
+	}, nil
+}
+
+// EnsureNetwork implements NetworkProvider
+func (m *MemoryCloud) EnsureNetwork(ctx context.Context) error {
+	return m.operate(ctx, "EnsureNetwork")
+}
+
+// RegisterResource implements InventoryProvider
+func (m *MemoryCloud) RegisterResource(ctx context.Context, entry *ResourceRegistryEntity) error {
+	if err := m.operate(ctx, "RegisterResource"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries, ok := m.registry[entry.PartitionKey]
+	if !ok {
+		return fmt.Errorf("unknown resource role %s", entry.PartitionKey)
+	}
+	entries[entry.RowKey] = *entry
+	return nil
+}
+
+// UnregisterResource implements InventoryProvider
+func (m *MemoryCloud) UnregisterResource(ctx context.Context, role, resourceID string) error {
+	if err := m.operate(ctx, "UnregisterResource"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.registry[role], resourceID)
+	return nil
+}
+
+// UpdateInstanceStatus implements InventoryProvider
+func (m *MemoryCloud) UpdateInstanceStatus(ctx context.Context, instanceID, status string) error {
+	return m.updateRegistry(ctx, "UpdateInstanceStatus", ResourceRoleInstance, instanceID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+	})
+}
+
+// UpdateInstanceStatusAndUser implements InventoryProvider
+func (m *MemoryCloud) UpdateInstanceStatusAndUser(ctx context.Context, instanceID, status, userID string) error {
+	return m.updateRegistry(ctx, "UpdateInstanceStatusAndUser", ResourceRoleInstance, instanceID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+		entry.UserID = userID
+	})
+}
+
+// UpdateVolumeStatusUserAndBox implements InventoryProvider
+func (m *MemoryCloud) UpdateVolumeStatusUserAndBox(ctx context.Context, volumeID, status, userID, boxName string) error {
+	return m.updateRegistry(ctx, "UpdateVolumeStatusUserAndBox", ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+		entry.UserID = userID
+		entry.BoxName = boxName
+	})
+}
+
+// UpdateVolumeRuntime implements InventoryProvider
+func (m *MemoryCloud) UpdateVolumeRuntime(ctx context.Context, volumeID, runtime string) error {
+	return m.updateRegistry(ctx, "UpdateVolumeRuntime", ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Runtime = runtime
+	})
+}
+
+// updateRegistry applies update to an entry, creating it if it is missing like UpdateResourceRegistry does
+func (m *MemoryCloud) updateRegistry(ctx context.Context, op, role, resourceID string, update func(*ResourceRegistryEntity)) error {
+	if err := m.operate(ctx, op); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	entry, ok := m.registry[role][resourceID]
+	if !ok {
+		entry = ResourceRegistryEntity{
+			PartitionKey: role,
+			RowKey:       resourceID,
+			CreatedAt:    now,
+		}
+	}
+	update(&entry)
+	entry.Timestamp = now
+	entry.LastActivity = now
+	m.registry[role][resourceID] = entry
+	return nil
+}
+
+// Reconcile implements InventoryProvider. The in-memory inventory is updated together with
+// the resources, but entries can still be left behind by injected failures, so drop those.
+func (m *MemoryCloud) Reconcile(ctx context.Context) error {
+	if err := m.operate(ctx, "Reconcile"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for instanceID := range m.registry[ResourceRoleInstance] {
+		if _, ok := m.instances[instanceID]; !ok {
+			delete(m.registry[ResourceRoleInstance], instanceID)
+		}
+	}
+	for volumeID := range m.registry[ResourceRoleVolume] {
+		if _, ok := m.volumes[volumeID]; !ok {
+			delete(m.registry[ResourceRoleVolume], volumeID)
+		}
+	}
+	return nil
+}
+
+// CountInstancesByStatus implements ResourceQueries
+func (m *MemoryCloud) CountInstancesByStatus(ctx context.Context) (*ResourceCounts, error) {
+	return m.count(ctx, "CountInstancesByStatus", ResourceRoleInstance)
+}
+
+// CountVolumesByStatus implements ResourceQueries
+func (m *MemoryCloud) CountVolumesByStatus(ctx context.Context) (*ResourceCounts, error) {
+	return m.count(ctx, "CountVolumesByStatus", ResourceRoleVolume)
+}
+
+// GetVolumesByStatus implements ResourceQueries
+func (m *MemoryCloud) GetVolumesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
+	return m.list(ctx, "GetVolumesByStatus", ResourceRoleVolume, func(entry *ResourceRegistryEntity) bool {
+		return entry.Status == status
+	})
+}
+
+// GetVolumesByUserAndBox implements ResourceQueries
+func (m *MemoryCloud) GetVolumesByUserAndBox(ctx context.Context, userID, boxName string) ([]ResourceInfo, error) {
+	return m.list(ctx, "GetVolumesByUserAndBox", ResourceRoleVolume, func(entry *ResourceRegistryEntity) bool {
+		return entry.UserID == userID && entry.BoxName == boxName
+	})
+}
+
+// GetOldestFreeVolumes implements ResourceQueries
+func (m *MemoryCloud) GetOldestFreeVolumes(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	resources, err := m.GetVolumesByStatus(ctx, ResourceStatusFree)
+	if err != nil {
+		return nil, err
+	}
+	return oldestFirst(resources, limit), nil
+}
+
+// GetRunningInstancesByStatus implements ResourceQueries
+func (m *MemoryCloud) GetRunningInstancesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
+	return m.list(ctx, "GetRunningInstancesByStatus", ResourceRoleInstance, func(entry *ResourceRegistryEntity) bool {
+		return entry.Status == status
+	})
+}
+
+// GetOldestFreeRunningInstances implements ResourceQueries
+func (m *MemoryCloud) GetOldestFreeRunningInstances(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	resources, err := m.GetRunningInstancesByStatus(ctx, ResourceStatusFree)
+	if err != nil {
+		return nil, err
+	}
+	return oldestFirst(resources, limit), nil
+}
+
+func (m *MemoryCloud) count(ctx context.Context, op, role string) (*ResourceCounts, error) {
+	if err := m.operate(ctx, op); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]ResourceRegistryEntity, 0, len(m.registry[role]))
+	for _, entry := range m.registry[role] {
+		entries = append(entries, entry)
+	}
+	return countRegistryEntries(entries), nil
+}
+
+func (m *MemoryCloud) list(ctx context.Context, op, role string, match func(*ResourceRegistryEntity) bool) ([]ResourceInfo, error) {
+	if err := m.operate(ctx, op); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var resources []ResourceInfo
+	for _, entry := range m.registry[role] {
+		if match(&entry) {
+			resources = append(resources, registryResourceInfo(m.namer, &entry))
+		}
+	}
+	return resources, nil
+}
+
+// WriteAllocation implements AllocationStore. Released allocations are dropped, like the
+// other stores do.
+func (m *MemoryCloud) WriteAllocation(ctx context.Context, allocation *AllocationEntity) error {
+	if err := m.operate(ctx, "WriteAllocation"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if allocation.State == AllocationStateFree {
+		delete(m.allocations, allocation.RowKey)
+	} else {
+		m.allocations[allocation.RowKey] = *allocation
+	}
+	return nil
+}
+
+// ListActiveAllocations implements AllocationStore
+func (m *MemoryCloud) ListActiveAllocations(ctx context.Context) ([]AllocationEntity, error) {
+	if err := m.operate(ctx, "ListActiveAllocations"); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var allocations []AllocationEntity
+	for _, allocation := range m.allocations {
+		if allocation.State != AllocationStateFree {
+			allocations = append(allocations, allocation)
+		}
+	}
+	return allocations, nil
+}
+
+// WriteEvent implements EventStore
+func (m *MemoryCloud) WriteEvent(ctx context.Context, event *EventLogEntity) error {
+	if err := m.operate(ctx, "WriteEvent"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, *event)
+	return nil
+}
+
+// StartBox implements BoxRuntime for both VM and container boxes. The box only boots if its volume is attached to the instance.
+func (m *MemoryCloud) StartBox(ctx context.Context, instanceIP, volumeID string, progress *ProgressReporter) error {
+	if err := m.operate(ctx, "StartBox"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, instance := range m.instances {
+		if instance.ip != instanceIP {
+			continue
+		}
+		if instance.volumeID != volumeID {
+			return fmt.Errorf("volume %s is not attached to instance %s", volumeID, instanceIP)
+		}
+		m.boxes[instanceIP] = volumeID
+		return nil
+	}
+	return fmt.Errorf("no instance with IP %s", instanceIP)
+}
+
+// StopBox implements BoxRuntime
+func (m *MemoryCloud) StopBox(ctx context.Context, instanceIP string) error {
+	if err := m.operate(ctx, "StopBox"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.boxes, instanceIP)
+	delete(m.forwards, instanceIP)
+	return nil
+}
+
+// BoxRunning implements BoxChecker
+func (m *MemoryCloud) BoxRunning(ctx context.Context, instanceIP string) (bool, error) {
+	if err := m.operate(ctx, "BoxRunning"); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.boxes[instanceIP]
+	return ok, nil
+}
+
+// ExposePort implements PortExposer
+func (m *MemoryCloud) ExposePort(ctx context.Context, instanceIP string, port, guestPort int) error {
+	if err := m.operate(ctx, "ExposePort"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.boxes[instanceIP]; !ok {
+		return fmt.Errorf("no box running on %s", instanceIP)
+	}
+	if m.forwards[instanceIP] == nil {
+		m.forwards[instanceIP] = make(map[int]int)
+	}
+	m.forwards[instanceIP][port] = guestPort
+	return nil
+}
@@ -0,0 +1,433 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testPoolConfig is a small pool that fills up in one maintenance run
+func testPoolConfig() PoolConfig {
+	return PoolConfig{
+		MinFreeInstances:  2,
+		MaxFreeInstances:  4,
+		MaxTotalInstances: 6,
+		MinFreeVolumes:    3,
+		MaxFreeVolumes:    6,
+		MaxTotalVolumes:   10,
+		CheckInterval:     time.Minute,
+		ScaleDownCooldown: time.Minute,
+	}
+}
+
+// newTestPool creates a pool on cloud with testPoolConfig
+func newTestPool(t *testing.T, cloud *MemoryCloud, provider *Provider) *BoxPool {
+	t.Helper()
+	golden, err := cloud.EnsureGoldenSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("EnsureGoldenSnapshot: %v", err)
+	}
+	return NewBoxPool(provider, &VMConfig{VMSize: "memory"}, testPoolConfig(), golden)
+}
+
+// fillPool runs pool maintenance once
+func fillPool(ctx context.Context, pool *BoxPool) {
+	pool.maintainInstancePool(ctx)
+	pool.maintainVolumePool(ctx)
+}
+
+// registryStatus returns the inventory status of a resource
+func registryStatus(t *testing.T, cloud *MemoryCloud, role, resourceID string) string {
+	t.Helper()
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	entry, ok := cloud.registry[role][resourceID]
+	if !ok {
+		t.Fatalf("%s %s is not in the inventory", role, resourceID)
+	}
+	return entry.Status
+}
+
+// activeAllocations returns the active allocations by instance ID
+func activeAllocations(t *testing.T, provider *Provider) map[string]AllocationEntity {
+	t.Helper()
+	allocations, err := provider.Allocations.ListActiveAllocations(context.Background())
+	if err != nil {
+		t.Fatalf("ListActiveAllocations: %v", err)
+	}
+	byInstance := make(map[string]AllocationEntity)
+	for _, allocation := range allocations {
+		byInstance[allocation.InstanceID] = allocation
+	}
+	return byInstance
+}
+
+// allocateTestBox reserves a volume for a new box and connects to it
+func allocateTestBox(t *testing.T, allocator *ResourceAllocator, userID, boxName string) *AllocatedResources {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := allocator.ReserveVolumeForUser(ctx, userID, boxName, BoxRuntimeVM); err != nil {
+		t.Fatalf("ReserveVolumeForUser(%s): %v", boxName, err)
+	}
+	resources, err := allocator.AllocateResourcesForUser(ctx, userID, boxName, nil, nil)
+	if err != nil {
+		t.Fatalf("AllocateResourcesForUser(%s): %v", boxName, err)
+	}
+	return resources
+}
+
+func TestBoxPoolScaleUp(t *testing.T) {
+	ctx := context.Background()
+	cloud := NewMemoryCloud(MemoryProviderConfig{Latency: time.Millisecond})
+	provider := cloud.Provider()
+	pool := newTestPool(t, cloud, provider)
+	added := 0
+	pool.OnCapacityAdded(ResourceRoleInstance, func() { added++ })
+
+	fillPool(ctx, pool)
+	instances, err := provider.Inventory.CountInstancesByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountInstancesByStatus: %v", err)
+	}
+	volumes, err := provider.Inventory.CountVolumesByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountVolumesByStatus: %v", err)
+	}
+	if instances.Free != 2 || volumes.Free != 3 {
+		t.Fatalf("got %d free instances and %d free volumes, want 2 and 3", instances.Free, volumes.Free)
+	}
+	if added != 1 {
+		t.Fatalf("capacity listener called %d times, want 1", added)
+	}
+
+	// Queued users add to the minimum, up to the total limit
+	pool.RequestScaleUp(ResourceRoleInstance, 10)
+	fillPool(ctx, pool)
+	if instances, _ = provider.Inventory.CountInstancesByStatus(ctx); instances.Total != 6 {
+		t.Fatalf("got %d instances after queued demand, want the limit of 6", instances.Total)
+	}
+
+	// An instance that failed to come up is made up for on the next run
+	cloud2 := NewMemoryCloud(MemoryProviderConfig{})
+	provider2 := cloud2.Provider()
+	pool2 := newTestPool(t, cloud2, provider2)
+	cloud2.FailNext("CreateInstance", errors.New("quota exceeded"))
+	fillPool(ctx, pool2)
+	if instances, _ = provider2.Inventory.CountInstancesByStatus(ctx); instances.Free != 1 {
+		t.Fatalf("got %d free instances after a failed create, want 1", instances.Free)
+	}
+	fillPool(ctx, pool2)
+	if instances, _ = provider2.Inventory.CountInstancesByStatus(ctx); instances.Free != 2 {
+		t.Fatalf("got %d free instances after the next run, want 2", instances.Free)
+	}
+}
+
+func TestBoxPoolScaleUpWithRandomFailures(t *testing.T) {
+	ctx := context.Background()
+	cloud := NewMemoryCloud(MemoryProviderConfig{FailureRate: 0.3, Seed: 42})
+	provider := cloud.Provider()
+	pool := newTestPool(t, cloud, provider)
+
+	for range 20 {
+		fillPool(ctx, pool)
+		if err := pool.ReconcileRegistry(ctx); err != nil && !errors.Is(err, ErrInjectedFailure) {
+			t.Fatalf("ReconcileRegistry: %v", err)
+		}
+	}
+	cloud.config.FailureRate = 0
+	instances, err := provider.Inventory.CountInstancesByStatus(ctx)
+	if err != nil {
+		t.Fatalf("CountInstancesByStatus: %v", err)
+	}
+	if instances.Free < 2 {
+		t.Fatalf("got %d free instances after 20 runs, want at least 2", instances.Free)
+	}
+}
+
+func TestMemoryCloudFailureInjection(t *testing.T) {
+	ctx := context.Background()
+	failures := func(seed uint64) []bool {
+		cloud := NewMemoryCloud(MemoryProviderConfig{FailureRate: 0.5, Seed: seed})
+		var failed []bool
+		for range 50 {
+			err := cloud.EnsureNetwork(ctx)
+			if err != nil && !errors.Is(err, ErrInjectedFailure) {
+				t.Fatalf("got %v, want ErrInjectedFailure", err)
+			}
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+	first, again, other := failures(7), failures(7), failures(8)
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("operation %d failed differently with the same seed", i)
+		}
+	}
+	if slicesEqual(first, other) {
+		t.Fatalf("different seeds failed the same operations")
+	}
+
+	// Queued failures come first, in order, and only for their operation
+	cloud := NewMemoryCloud(MemoryProviderConfig{})
+	errFirst, errSecond := errors.New("first"), errors.New("second")
+	cloud.FailNext("AttachVolume", errFirst)
+	cloud.FailNext("AttachVolume", errSecond)
+	if err := cloud.EnsureNetwork(ctx); err != nil {
+		t.Fatalf("EnsureNetwork: %v", err)
+	}
+	if err := cloud.AttachVolume(ctx, "instance", "volume"); !errors.Is(err, errFirst) {
+		t.Fatalf("got %v, want the first queued failure", err)
+	}
+	if err := cloud.AttachVolume(ctx, "instance", "volume"); !errors.Is(err, errSecond) {
+		t.Fatalf("got %v, want the second queued failure", err)
+	}
+
+	// Latency is cut short by cancellation
+	slow := NewMemoryCloud(MemoryProviderConfig{Latency: time.Hour})
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := slow.EnsureNetwork(cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context's error", err)
+	}
+}
+
+func slicesEqual(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestAllocateAndRelease(t *testing.T) {
+	ctx := context.Background()
+	cloud := NewMemoryCloud(MemoryProviderConfig{Latency: time.Millisecond})
+	provider := cloud.Provider()
+	fillPool(ctx, newTestPool(t, cloud, provider))
+	allocator := NewResourceAllocator(provider)
+	var released []string
+	allocator.OnRelease(func(instanceID string) { released = append(released, instanceID) })
+
+	resources := allocateTestBox(t, allocator, "user-1", "dev1")
+	if got := cloud.RunningBoxes()[resources.InstanceIP]; got != resources.VolumeID {
+		t.Fatalf("box on %s runs volume %q, want %s", resources.InstanceIP, got, resources.VolumeID)
+	}
+	if status := registryStatus(t, cloud, ResourceRoleInstance, resources.InstanceID); status != ResourceStatusConnected {
+		t.Fatalf("instance status %s, want %s", status, ResourceStatusConnected)
+	}
+	allocation, ok := activeAllocations(t, provider)[resources.InstanceID]
+	if !ok || allocation.State != AllocationStateConnected {
+		t.Fatalf("got allocation %+v, want a connected one", allocation)
+	}
+
+	// Connecting again joins the running box
+	again, err := allocator.AllocateResourcesForUser(ctx, "user-1", "dev1", nil, nil)
+	if err != nil {
+		t.Fatalf("second AllocateResourcesForUser: %v", err)
+	}
+	if *again != *resources {
+		t.Fatalf("second connect got %+v, want the running box %+v", again, resources)
+	}
+
+	if err := allocator.ReleaseResources(ctx, resources.InstanceID, resources.VolumeID); err != nil {
+		t.Fatalf("ReleaseResources: %v", err)
+	}
+	if len(cloud.RunningBoxes()) != 0 {
+		t.Fatalf("boxes still running after release: %v", cloud.RunningBoxes())
+	}
+	if status := registryStatus(t, cloud, ResourceRoleInstance, resources.InstanceID); status != ResourceStatusFree {
+		t.Fatalf("instance status %s after release, want %s", status, ResourceStatusFree)
+	}
+	if status := registryStatus(t, cloud, ResourceRoleVolume, resources.VolumeID); status != ResourceStatusAttached {
+		t.Fatalf("volume status %s after release, want it kept for its user", status)
+	}
+	if len(activeAllocations(t, provider)) != 0 {
+		t.Fatalf("allocations still active after release")
+	}
+	if len(released) != 1 || released[0] != resources.InstanceID {
+		t.Fatalf("release listener got %v, want [%s]", released, resources.InstanceID)
+	}
+
+	// The box comes back on a free instance
+	resources = allocateTestBox(t, allocator, "user-1", "dev2")
+	if len(cloud.RunningBoxes()) != 1 {
+		t.Fatalf("got %d running boxes, want 1", len(cloud.RunningBoxes()))
+	}
+}
+
+// checkRolledBack fails unless nothing of an allocation is left: no box running, no
+// allocation active, no volume attached and every instance free
+func checkRolledBack(t *testing.T, cloud *MemoryCloud, provider *Provider) {
+	t.Helper()
+	if len(cloud.RunningBoxes()) != 0 {
+		t.Fatalf("boxes running after rollback: %v", cloud.RunningBoxes())
+	}
+	if len(activeAllocations(t, provider)) != 0 {
+		t.Fatalf("allocations still active after rollback")
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	for volumeID, instanceID := range cloud.volumes {
+		if instanceID != "" {
+			t.Errorf("volume %s still attached to %s after rollback", volumeID, instanceID)
+		}
+	}
+	for instanceID, entry := range cloud.registry[ResourceRoleInstance] {
+		if entry.Status != ResourceStatusFree {
+			t.Errorf("instance %s is %s after rollback, want free", instanceID, entry.Status)
+		}
+	}
+}
+
+func TestAllocationRollback(t *testing.T) {
+	for _, op := range []string{"UpdateInstanceStatusAndUser", "AttachVolume", "GetInstancePrivateIP", "StartBox"} {
+		t.Run(op, func(t *testing.T) {
+			ctx := context.Background()
+			cloud := NewMemoryCloud(MemoryProviderConfig{})
+			provider := cloud.Provider()
+			fillPool(ctx, newTestPool(t, cloud, provider))
+			allocator := NewResourceAllocator(provider)
+			if _, err := allocator.ReserveVolumeForUser(ctx, "user-1", "dev1", BoxRuntimeVM); err != nil {
+				t.Fatalf("ReserveVolumeForUser: %v", err)
+			}
+
+			injected := errors.New("injected " + op)
+			cloud.FailNext(op, injected)
+			if _, err := allocator.AllocateResourcesForUser(ctx, "user-1", "dev1", nil, nil); !errors.Is(err, injected) {
+				t.Fatalf("got %v, want the injected failure", err)
+			}
+
+			checkRolledBack(t, cloud, provider)
+
+			// Nothing is left claimed, so the next try gets through
+			if _, err := allocator.AllocateResourcesForUser(ctx, "user-1", "dev1", nil, nil); err != nil {
+				t.Fatalf("AllocateResourcesForUser after rollback: %v", err)
+			}
+		})
+	}
+}
+
+// cancellingOutput cancels an allocation when the step named step starts or, if
+// afterStep, once it finished
+type cancellingOutput struct {
+	step      string
+	afterStep bool
+	cancel    context.CancelFunc
+}
+
+func (o *cancellingOutput) StepStarted(name string) {
+	if name == o.step && !o.afterStep {
+		o.cancel()
+	}
+}
+
+func (o *cancellingOutput) StepFinished(name string, _ time.Duration, _ error) {
+	if name == o.step && o.afterStep {
+		o.cancel()
+	}
+}
+
+func TestAllocationCancelled(t *testing.T) {
+	for _, tt := range []struct {
+		step      string
+		afterStep bool
+	}{
+		{"Reserving instance", false},
+		{"Reserving volume", true},
+		{"Attaching disk", false},
+		{"Attaching disk", true},              // the disk is attached and has to come off again
+		{"Looking up instance address", true}, // the box is about to boot
+	} {
+		t.Run(fmt.Sprintf("%s/after=%v", tt.step, tt.afterStep), func(t *testing.T) {
+			cloud := NewMemoryCloud(MemoryProviderConfig{})
+			provider := cloud.Provider()
+			fillPool(context.Background(), newTestPool(t, cloud, provider))
+			allocator := NewResourceAllocator(provider)
+			if _, err := allocator.ReserveVolumeForUser(context.Background(), "user-1", "dev1", BoxRuntimeVM); err != nil {
+				t.Fatalf("ReserveVolumeForUser: %v", err)
+			}
+
+			// The user disconnects during the step
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			progress := NewProgressReporter(&cancellingOutput{step: tt.step, afterStep: tt.afterStep, cancel: cancel})
+			if _, err := allocator.AllocateResourcesForUser(ctx, "user-1", "dev1", progress, nil); !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want the allocation cancelled", err)
+			}
+			checkRolledBack(t, cloud, provider)
+
+			if _, err := allocator.AllocateResourcesForUser(context.Background(), "user-1", "dev1", nil, nil); err != nil {
+				t.Fatalf("AllocateResourcesForUser after cancelling: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecoverAllocations(t *testing.T) {
+	ctx := context.Background()
+	cloud := NewMemoryCloud(MemoryProviderConfig{})
+	provider := cloud.Provider()
+	pool := newTestPool(t, cloud, provider)
+	pool.RequestScaleUp(ResourceRoleInstance, 2)
+	fillPool(ctx, pool)
+
+	previous := NewResourceAllocator(provider)
+	previous.owner = "previous"
+	running := allocateTestBox(t, previous, "user-1", "running")
+	crashed := allocateTestBox(t, previous, "user-1", "crashed")
+	booting := allocateTestBox(t, previous, "user-2", "booting")
+
+	// The previous server died with one box crashed and one allocation mid-boot
+	if err := cloud.StopBox(ctx, crashed.InstanceIP); err != nil {
+		t.Fatalf("StopBox: %v", err)
+	}
+	interrupted := activeAllocations(t, provider)[booting.InstanceID]
+	interrupted.State = AllocationStateBooting
+	if err := provider.Allocations.WriteAllocation(ctx, &interrupted); err != nil {
+		t.Fatalf("WriteAllocation: %v", err)
+	}
+
+	current := NewResourceAllocator(provider)
+	current.owner = "current"
+	if err := current.RecoverAllocations(ctx); err != nil {
+		t.Fatalf("RecoverAllocations: %v", err)
+	}
+
+	active := activeAllocations(t, provider)
+	if len(active) != 1 {
+		t.Fatalf("got %d active allocations after recovery, want only the running box's", len(active))
+	}
+	if allocation := active[running.InstanceID]; allocation.State != AllocationStateConnected || allocation.Owner != "current" {
+		t.Fatalf("running box's allocation is %s owned by %s, want connected and taken over", allocation.State, allocation.Owner)
+	}
+	boxes := cloud.RunningBoxes()
+	if len(boxes) != 1 || boxes[running.InstanceIP] != running.VolumeID {
+		t.Fatalf("got running boxes %v, want only %s", boxes, running.InstanceIP)
+	}
+	for _, resources := range []*AllocatedResources{crashed, booting} {
+		if status := registryStatus(t, cloud, ResourceRoleInstance, resources.InstanceID); status != ResourceStatusFree {
+			t.Errorf("instance %s is %s after recovery, want free", resources.InstanceID, status)
+		}
+	}
+
+	// The user reconnects to the box that survived
+	again, err := current.AllocateResourcesForUser(ctx, "user-1", "running", nil, nil)
+	if err != nil {
+		t.Fatalf("AllocateResourcesForUser: %v", err)
+	}
+	if again.InstanceID != running.InstanceID {
+		t.Fatalf("reconnect got instance %s, want %s", again.InstanceID, running.InstanceID)
+	}
+
+	// Recovering again leaves this process's allocations alone
+	if err := current.RecoverAllocations(ctx); err != nil {
+		t.Fatalf("second RecoverAllocations: %v", err)
+	}
+	if len(activeAllocations(t, provider)) != 1 || len(cloud.RunningBoxes()) != 1 {
+		t.Fatalf("second recovery changed this process's allocations")
+	}
+}
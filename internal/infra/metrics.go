@@ -0,0 +1,450 @@
+package infra
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"shellbox/internal/qga"
+	"shellbox/internal/qmp"
+	"shellbox/internal/sshutil"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics defaults
+const (
+	DefaultMetricsInterval = 15 * time.Second // time between samples of each box
+	DefaultMetricsHistory  = 240              // samples kept per box, an hour at the default interval
+	MetricsCollectTimeout  = 10 * time.Second // per box, so a stuck box doesn't hold up the others
+)
+
+// qemuCPUTimeCommand prints the CPU seconds the box's QEMU process has used. It exits
+// with 3 if QEMU isn't running.
+const qemuCPUTimeCommand = `pid=$(` + qemuPIDCommand + ` -o) || exit 3; awk -v hz="$(getconf CLK_TCK)" '{print ($14 + $15) / hz}' /proc/$pid/stat`
+
+// BoxSample is a snapshot of a box's resource usage. Counters are totals since the box's
+// QEMU started; BoxRates turns two samples into rates.
+type BoxSample struct {
+	Time time.Time
+
+	// From the instance and QMP
+	CPUSeconds        float64           // CPU time of the QEMU process
+	DiskReadBytes     int64             // across all disks
+	DiskWriteBytes    int64             //
+	DiskReadOps       int64             //
+	DiskWriteOps      int64             //
+	BalloonBytes      int64             // RAM the balloon leaves the guest, 0 without a balloon
+	VCPUStats         map[string]uint64 // KVM counters, e.g. "exits", summed over vCPUs
+	GuestMetricsValid bool              // the guest agent answered; the fields below are set
+
+	// From the guest agent
+	MemTotalBytes     int64
+	MemAvailableBytes int64
+	MemOnlineBytes    int64 // online memory blocks
+	Load1             float64
+	Load5             float64
+	Load15            float64
+	NetRxBytes        uint64 // across all interfaces but loopback
+	NetTxBytes        uint64
+	NetRxPackets      uint64
+	NetTxPackets      uint64
+}
+
+// BoxRate is a box's resource usage between two samples
+type BoxRate struct {
+	Time              time.Time
+	CPUPercent        float64 // of one host CPU
+	DiskReadPerSec    float64 // bytes
+	DiskWritePerSec   float64
+	NetRxPerSec       float64
+	NetTxPerSec       float64
+	MemUsedBytes      int64
+	Load1             float64
+	GuestMetricsValid bool
+}
+
+// BoxRates returns the usage between consecutive samples, which must be oldest first
+func BoxRates(samples []BoxSample) []BoxRate {
+	var rates []BoxRate
+	for i := 1; i < len(samples); i++ {
+		prev, cur := &samples[i-1], &samples[i]
+		secs := cur.Time.Sub(prev.Time).Seconds()
+		// Counters start over when the box restarts
+		if secs <= 0 || cur.CPUSeconds < prev.CPUSeconds {
+			continue
+		}
+		rate := BoxRate{
+			Time:              cur.Time,
+			CPUPercent:        100 * (cur.CPUSeconds - prev.CPUSeconds) / secs,
+			DiskReadPerSec:    float64(cur.DiskReadBytes-prev.DiskReadBytes) / secs,
+			DiskWritePerSec:   float64(cur.DiskWriteBytes-prev.DiskWriteBytes) / secs,
+			MemUsedBytes:      cur.MemTotalBytes - cur.MemAvailableBytes,
+			Load1:             cur.Load1,
+			GuestMetricsValid: cur.GuestMetricsValid,
+		}
+		if cur.GuestMetricsValid && prev.GuestMetricsValid && cur.NetRxBytes >= prev.NetRxBytes && cur.NetTxBytes >= prev.NetTxBytes {
+			rate.NetRxPerSec = float64(cur.NetRxBytes-prev.NetRxBytes) / secs
+			rate.NetTxPerSec = float64(cur.NetTxBytes-prev.NetTxBytes) / secs
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+// CollectMetrics implements MetricsRuntime. QEMU's counters come from QMP and the
+// instance; guest counters are left out if the guest agent doesn't answer.
+func (qm *QEMUManager) CollectMetrics(ctx context.Context, instanceIP string) (*BoxSample, error) {
+	sample := &BoxSample{Time: time.Now()}
+
+	err := withQMP(ctx, instanceIP, func(client *qmp.Client) error {
+		blockStats, err := client.QueryBlockStats(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to query block stats: %w", err)
+		}
+		for _, device := range blockStats {
+			sample.DiskReadBytes += device.Stats.ReadBytes
+			sample.DiskWriteBytes += device.Stats.WriteBytes
+			sample.DiskReadOps += device.Stats.ReadOperations
+			sample.DiskWriteOps += device.Stats.WriteOperations
+		}
+
+		// Boxes without a balloon device report DeviceNotActive
+		if balloon, err := client.QueryBalloon(ctx); err == nil {
+			sample.BalloonBytes = balloon.Actual
+		}
+
+		vcpus, err := client.QueryStats(ctx, qmp.StatsTargetVCPU)
+		if err != nil {
+			slog.Debug("Failed to query vCPU stats", "instanceIP", instanceIP, "error", err)
+			return nil
+		}
+		sample.VCPUStats = make(map[string]uint64)
+		for _, vcpu := range vcpus {
+			for name, value := range vcpu.Counters() {
+				sample.VCPUStats[name] += value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := sshutil.Run(ctx, qemuCPUTimeCommand, AdminUsername, instanceIP)
+	if err != nil {
+		if result != nil && result.ExitCode == 3 {
+			return nil, fmt.Errorf("%w: QEMU is not running on %s", ErrBoxNotRunning, instanceIP)
+		}
+		return nil, fmt.Errorf("failed to read QEMU CPU time: %w", err)
+	}
+	if sample.CPUSeconds, err = strconv.ParseFloat(strings.TrimSpace(result.Stdout), 64); err != nil {
+		return nil, fmt.Errorf("failed to parse QEMU CPU time: %w", err)
+	}
+
+	err = qm.GuestAgent(ctx, instanceIP, func(agent *qga.Client) error {
+		return collectGuestMetrics(ctx, agent, sample)
+	})
+	if err != nil {
+		slog.Debug("Failed to collect guest metrics", "instanceIP", instanceIP, "error", err)
+	} else {
+		sample.GuestMetricsValid = true
+	}
+	return sample, nil
+}
+
+// collectGuestMetrics fills in the guest side of sample
+func collectGuestMetrics(ctx context.Context, agent *qga.Client, sample *BoxSample) error {
+	load, err := agent.Load(ctx)
+	if err != nil {
+		return err
+	}
+	sample.Load1, sample.Load5, sample.Load15 = load.Load1, load.Load5, load.Load15
+
+	meminfo, err := agent.ReadFile(ctx, "/proc/meminfo")
+	if err != nil {
+		return err
+	}
+	sample.MemTotalBytes, sample.MemAvailableBytes = parseMeminfo(meminfo)
+
+	blocks, err := agent.MemoryBlocks(ctx)
+	if err != nil {
+		return err
+	}
+	blockSize, err := agent.MemoryBlockSize(ctx)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if block.Online {
+			sample.MemOnlineBytes += blockSize
+		}
+	}
+
+	interfaces, err := agent.NetworkInterfaces(ctx)
+	if err != nil {
+		return err
+	}
+	for _, iface := range interfaces {
+		if iface.Name == "lo" || iface.Statistics == nil {
+			continue
+		}
+		sample.NetRxBytes += iface.Statistics.RxBytes
+		sample.NetTxBytes += iface.Statistics.TxBytes
+		sample.NetRxPackets += iface.Statistics.RxPackets
+		sample.NetTxPackets += iface.Statistics.TxPackets
+	}
+	return nil
+}
+
+// parseMeminfo returns MemTotal and MemAvailable from /proc/meminfo, in bytes
+func parseMeminfo(data []byte) (total, available int64) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
+
+// MetricsConfig configures a BoxMetricsCollector
+type MetricsConfig struct {
+	Interval time.Duration // time between samples of each box
+	History  int           // samples kept per box
+}
+
+// NewDefaultMetricsConfig returns the default metrics configuration
+func NewDefaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Interval: DefaultMetricsInterval,
+		History:  DefaultMetricsHistory,
+	}
+}
+
+// boxSeries is the recent samples of one box
+type boxSeries struct {
+	userID     string
+	boxName    string
+	instanceID string
+	samples    []BoxSample // oldest first
+}
+
+// BoxMetricsCollector samples the resource usage of the connected boxes whose runtime
+// supports it and keeps a short history of each. It serves the latest samples in the
+// Prometheus text format.
+type BoxMetricsCollector struct {
+	provider *Provider
+	config   MetricsConfig
+
+	mu     sync.RWMutex
+	series map[string]*boxSeries // by boxKey
+}
+
+// NewBoxMetricsCollector creates a collector for the boxes allocated on provider
+func NewBoxMetricsCollector(provider *Provider, config MetricsConfig) *BoxMetricsCollector {
+	return &BoxMetricsCollector{
+		provider: provider,
+		config:   config,
+		series:   make(map[string]*boxSeries),
+	}
+}
+
+func boxKey(userID, boxName string) string {
+	return userID + "/" + boxName
+}
+
+// Run samples the connected boxes every config.Interval until ctx is done
+func (c *BoxMetricsCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.CollectAll(ctx); err != nil {
+			slog.Error("box metrics collection failed", "error", err)
+		}
+	}
+}
+
+// CollectAll samples every connected box once, in parallel, and forgets boxes that are no
+// longer allocated
+func (c *BoxMetricsCollector) CollectAll(ctx context.Context) error {
+	allocations, err := c.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list active allocations: %w", err)
+	}
+
+	active := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, allocation := range allocations {
+		active[boxKey(allocation.UserID, allocation.BoxName)] = true
+		if allocation.State != AllocationStateConnected || allocation.InstanceIP == "" {
+			continue
+		}
+		runtime, err := c.provider.RuntimeFor(allocation.Runtime)
+		if err != nil {
+			continue
+		}
+		collector, ok := runtime.(MetricsRuntime)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			collectCtx, cancel := context.WithTimeout(ctx, MetricsCollectTimeout)
+			defer cancel()
+			sample, err := collector.CollectMetrics(collectCtx, allocation.InstanceIP)
+			if err != nil {
+				slog.Warn("failed to collect box metrics", "instanceID", allocation.InstanceID, "boxName", allocation.BoxName, "error", err)
+				return
+			}
+			c.record(&allocation, sample)
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.series {
+		if !active[key] {
+			delete(c.series, key)
+		}
+	}
+	return nil
+}
+
+// record appends sample to the box's series, dropping the oldest beyond config.History
+func (c *BoxMetricsCollector) record(allocation *AllocationEntity, sample *BoxSample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := boxKey(allocation.UserID, allocation.BoxName)
+	series := c.series[key]
+	if series == nil || series.instanceID != allocation.InstanceID {
+		// A box that moved starts its counters over
+		series = &boxSeries{userID: allocation.UserID, boxName: allocation.BoxName, instanceID: allocation.InstanceID}
+		c.series[key] = series
+	}
+	series.samples = append(series.samples, *sample)
+	if excess := len(series.samples) - c.config.History; excess > 0 {
+		series.samples = slices.Delete(series.samples, 0, excess)
+	}
+}
+
+// Recent returns up to n of the latest samples of a user's box, oldest first
+func (c *BoxMetricsCollector) Recent(userID, boxName string, n int) []BoxSample {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	series := c.series[boxKey(userID, boxName)]
+	if series == nil {
+		return nil
+	}
+	return slices.Clone(series.samples[max(len(series.samples)-n, 0):])
+}
+
+// Interval returns the time between samples
+func (c *BoxMetricsCollector) Interval() time.Duration {
+	return c.config.Interval
+}
+
+// ServeHTTP serves the latest sample of each box in the Prometheus text format
+func (c *BoxMetricsCollector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := c.WritePrometheus(w); err != nil {
+		slog.Warn("Failed to write metrics", "error", err)
+	}
+}
+
+// boxMetric is one metric family of the Prometheus output
+type boxMetric struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value func(*BoxSample) float64
+	guest bool // only set when GuestMetricsValid
+}
+
+var boxMetrics = []boxMetric{
+	{"shellbox_box_cpu_seconds_total", "counter", "CPU time used by the box's QEMU process.", func(s *BoxSample) float64 { return s.CPUSeconds }, false},
+	{"shellbox_box_disk_read_bytes_total", "counter", "Bytes read from the box's disks.", func(s *BoxSample) float64 { return float64(s.DiskReadBytes) }, false},
+	{"shellbox_box_disk_written_bytes_total", "counter", "Bytes written to the box's disks.", func(s *BoxSample) float64 { return float64(s.DiskWriteBytes) }, false},
+	{"shellbox_box_disk_reads_total", "counter", "Read operations on the box's disks.", func(s *BoxSample) float64 { return float64(s.DiskReadOps) }, false},
+	{"shellbox_box_disk_writes_total", "counter", "Write operations on the box's disks.", func(s *BoxSample) float64 { return float64(s.DiskWriteOps) }, false},
+	{"shellbox_box_balloon_bytes", "gauge", "RAM the balloon leaves the guest.", func(s *BoxSample) float64 { return float64(s.BalloonBytes) }, false},
+	{"shellbox_box_memory_total_bytes", "gauge", "RAM the guest kernel manages.", func(s *BoxSample) float64 { return float64(s.MemTotalBytes) }, true},
+	{"shellbox_box_memory_available_bytes", "gauge", "RAM available to guest programs.", func(s *BoxSample) float64 { return float64(s.MemAvailableBytes) }, true},
+	{"shellbox_box_memory_online_bytes", "gauge", "Online guest memory blocks.", func(s *BoxSample) float64 { return float64(s.MemOnlineBytes) }, true},
+	{"shellbox_box_load1", "gauge", "Guest 1 minute load average.", func(s *BoxSample) float64 { return s.Load1 }, true},
+	{"shellbox_box_load5", "gauge", "Guest 5 minute load average.", func(s *BoxSample) float64 { return s.Load5 }, true},
+	{"shellbox_box_load15", "gauge", "Guest 15 minute load average.", func(s *BoxSample) float64 { return s.Load15 }, true},
+	{"shellbox_box_network_receive_bytes_total", "counter", "Bytes received by the guest.", func(s *BoxSample) float64 { return float64(s.NetRxBytes) }, true},
+	{"shellbox_box_network_transmit_bytes_total", "counter", "Bytes sent by the guest.", func(s *BoxSample) float64 { return float64(s.NetTxBytes) }, true},
+	{"shellbox_box_network_receive_packets_total", "counter", "Packets received by the guest.", func(s *BoxSample) float64 { return float64(s.NetRxPackets) }, true},
+	{"shellbox_box_network_transmit_packets_total", "counter", "Packets sent by the guest.", func(s *BoxSample) float64 { return float64(s.NetTxPackets) }, true},
+}
+
+// WritePrometheus writes the latest sample of each box in the Prometheus text format
+func (c *BoxMetricsCollector) WritePrometheus(w io.Writer) error {
+	type latest struct {
+		labels string
+		sample BoxSample
+	}
+	c.mu.RLock()
+	var boxes []latest
+	for _, key := range slices.Sorted(maps.Keys(c.series)) {
+		series := c.series[key]
+		if len(series.samples) == 0 {
+			continue
+		}
+		labels := fmt.Sprintf("box=%s,user=%s,instance=%s",
+			strconv.Quote(series.boxName), strconv.Quote(series.userID), strconv.Quote(series.instanceID))
+		boxes = append(boxes, latest{labels: labels, sample: series.samples[len(series.samples)-1]})
+	}
+	c.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, metric := range boxMetrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i := range boxes {
+			if metric.guest && !boxes[i].sample.GuestMetricsValid {
+				continue
+			}
+			fmt.Fprintf(bw, "%s{%s} %s\n", metric.name, boxes[i].labels, strconv.FormatFloat(metric.value(&boxes[i].sample), 'g', -1, 64))
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP shellbox_box_vcpu_stat_total KVM vCPU counters, summed over the box's vCPUs.\n# TYPE shellbox_box_vcpu_stat_total counter\n")
+	for i := range boxes {
+		stats := boxes[i].sample.VCPUStats
+		for _, name := range slices.Sorted(maps.Keys(stats)) {
+			fmt.Fprintf(bw, "shellbox_box_vcpu_stat_total{%s,stat=%s} %d\n", boxes[i].labels, strconv.Quote(name), stats[name])
+		}
+	}
+	return bw.Flush()
+}
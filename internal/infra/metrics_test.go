@@ -0,0 +1,146 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoxRates(t *testing.T) {
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	samples := []BoxSample{
+		{Time: start, CPUSeconds: 10, DiskReadBytes: 1000, DiskWriteBytes: 0, NetRxBytes: 500, GuestMetricsValid: true},
+		{Time: start.Add(10 * time.Second), CPUSeconds: 15, DiskReadBytes: 11000, DiskWriteBytes: 2000, NetRxBytes: 5500, NetTxBytes: 100,
+			MemTotalBytes: 8 << 30, MemAvailableBytes: 6 << 30, Load1: 0.5, GuestMetricsValid: true},
+		// The guest agent didn't answer
+		{Time: start.Add(20 * time.Second), CPUSeconds: 16, DiskReadBytes: 11000, DiskWriteBytes: 2000},
+		// The box restarted and its counters started over
+		{Time: start.Add(30 * time.Second), CPUSeconds: 1, GuestMetricsValid: true},
+		{Time: start.Add(40 * time.Second), CPUSeconds: 21, NetRxBytes: 100, GuestMetricsValid: true},
+	}
+
+	rates := BoxRates(samples)
+	if len(rates) != 3 {
+		t.Fatalf("got %d rates, want 3 skipping the restart: %+v", len(rates), rates)
+	}
+	first := rates[0]
+	if first.CPUPercent != 50 || first.DiskReadPerSec != 1000 || first.DiskWritePerSec != 200 {
+		t.Errorf("got %+v, want 50%% CPU, 1000 B/s read and 200 B/s written", first)
+	}
+	if first.NetRxPerSec != 500 || first.NetTxPerSec != 10 || first.MemUsedBytes != 2<<30 || first.Load1 != 0.5 {
+		t.Errorf("got %+v, want guest usage", first)
+	}
+	if second := rates[1]; second.GuestMetricsValid || second.NetRxPerSec != 0 || second.CPUPercent != 10 {
+		t.Errorf("got %+v without guest metrics", second)
+	}
+	if last := rates[2]; last.Time != samples[4].Time || last.CPUPercent != 200 || last.NetRxPerSec != 10 {
+		t.Errorf("got %+v after the restart, want rates against the restarted box", last)
+	}
+
+	if rates := BoxRates(samples[:1]); len(rates) != 0 {
+		t.Errorf("got %v from one sample", rates)
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	meminfo := "MemTotal:        8131072 kB\nMemFree:          512000 kB\nMemAvailable:    6000000 kB\nHugePages_Total:       0\n"
+	total, available := parseMeminfo([]byte(meminfo))
+	if total != 8131072*1024 || available != 6000000*1024 {
+		t.Errorf("got %d and %d bytes", total, available)
+	}
+}
+
+// fakeMetricsRuntime is a box runtime whose boxes each used another CPU second at every sample
+type fakeMetricsRuntime struct {
+	BoxRuntime
+	mu      sync.Mutex
+	samples map[string]int
+	failIP  string
+}
+
+func (r *fakeMetricsRuntime) CollectMetrics(_ context.Context, instanceIP string) (*BoxSample, error) {
+	if instanceIP == r.failIP {
+		return nil, ErrBoxNotRunning
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[instanceIP]++
+	return &BoxSample{
+		Time:       time.Now(),
+		CPUSeconds: float64(r.samples[instanceIP]),
+		VCPUStats:  map[string]uint64{"exits": 7, "halt_exits": 3},
+	}, nil
+}
+
+func TestBoxMetricsCollector(t *testing.T) {
+	ctx := context.Background()
+	cloud := NewMemoryCloud(MemoryProviderConfig{})
+	provider := cloud.Provider()
+	fillPool(ctx, newTestPool(t, cloud, provider))
+	allocator := NewResourceAllocator(provider)
+	dev1 := allocateTestBox(t, allocator, "user-1", "dev1")
+	dev2 := allocateTestBox(t, allocator, "user-1", "dev2")
+	runtime := &fakeMetricsRuntime{BoxRuntime: provider.Runtime, samples: make(map[string]int), failIP: dev2.InstanceIP}
+	provider.Runtime = runtime
+
+	collector := NewBoxMetricsCollector(provider, MetricsConfig{Interval: time.Second, History: 2})
+	for range 3 {
+		if err := collector.CollectAll(ctx); err != nil {
+			t.Fatalf("CollectAll: %v", err)
+		}
+	}
+
+	// Only the latest History samples are kept, and boxes that failed to answer have none
+	samples := collector.Recent("user-1", "dev1", 10)
+	if len(samples) != 2 || samples[0].CPUSeconds != 2 || samples[1].CPUSeconds != 3 {
+		t.Errorf("got samples %+v, want the last two", samples)
+	}
+	if samples := collector.Recent("user-1", "dev1", 1); len(samples) != 1 || samples[0].CPUSeconds != 3 {
+		t.Errorf("got samples %+v, want the latest", samples)
+	}
+	if samples := collector.Recent("user-1", "dev2", 10); len(samples) != 0 {
+		t.Errorf("got samples %+v of a box that failed", samples)
+	}
+	if samples := collector.Recent("user-2", "dev1", 10); len(samples) != 0 {
+		t.Errorf("got samples %+v of another user's box", samples)
+	}
+
+	var out strings.Builder
+	if err := collector.WritePrometheus(&out); err != nil {
+		t.Fatalf("WritePrometheus: %v", err)
+	}
+	labels := `box="dev1",user="user-1",instance="` + dev1.InstanceID + `"`
+	for _, want := range []string{
+		"# TYPE shellbox_box_cpu_seconds_total counter\nshellbox_box_cpu_seconds_total{" + labels + "} 3\n",
+		"# TYPE shellbox_box_balloon_bytes gauge\n",
+		"shellbox_box_vcpu_stat_total{" + labels + `,stat="exits"} 7` + "\n",
+		"shellbox_box_vcpu_stat_total{" + labels + `,stat="halt_exits"} 3` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, out.String())
+		}
+	}
+	// Guest metrics are left out when the guest agent didn't answer
+	if strings.Contains(out.String(), "shellbox_box_load1{") || strings.Contains(out.String(), "dev2") {
+		t.Errorf("metrics include guest or failed boxes:\n%s", out.String())
+	}
+
+	// Released boxes are forgotten
+	if err := allocator.ReleaseResources(ctx, dev1.InstanceID, dev1.VolumeID); err != nil {
+		t.Fatalf("ReleaseResources: %v", err)
+	}
+	if err := collector.CollectAll(ctx); err != nil {
+		t.Fatalf("CollectAll: %v", err)
+	}
+	if samples := collector.Recent("user-1", "dev1", 10); len(samples) != 0 {
+		t.Errorf("got samples %+v of a released box", samples)
+	}
+
+	cloud.FailNext("ListActiveAllocations", errors.New("table unavailable"))
+	if err := collector.CollectAll(ctx); err == nil {
+		t.Errorf("CollectAll succeeded without allocations")
+	}
+}
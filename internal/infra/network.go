@@ -40,6 +40,7 @@ var BastionNSGRules = []*armnetwork.SecurityRule{
 	createNSGRule("AllowSSHFromInternet", "Tcp", "Internet", "*", "22", armnetwork.SecurityRuleAccessAllow, 100, armnetwork.SecurityRuleDirectionInbound),
 	createNSGRule("AllowCustomSSHFromInternet", "Tcp", "Internet", "*", fmt.Sprintf("%d", BastionSSHPort), armnetwork.SecurityRuleAccessAllow, 110, armnetwork.SecurityRuleDirectionInbound),
 	createNSGRule("AllowHTTPSFromInternet", "Tcp", "Internet", "*", "443", armnetwork.SecurityRuleAccessAllow, 120, armnetwork.SecurityRuleDirectionInbound),
+	createNSGRule("AllowExposuresFromInternet", "Tcp", "Internet", "*", fmt.Sprintf("%d-%d", ExposurePortMin, ExposurePortMax), armnetwork.SecurityRuleAccessAllow, 130, armnetwork.SecurityRuleDirectionInbound),
 	createNSGRule("AllowToBoxesSubnet", "*", "*", boxesSubnetCIDR, "*", armnetwork.SecurityRuleAccessAllow, 100, armnetwork.SecurityRuleDirectionOutbound),
 	createNSGRule("AllowToInternet", "*", "*", "Internet", "*", armnetwork.SecurityRuleAccessAllow, 110, armnetwork.SecurityRuleDirectionOutbound),
 }
@@ -162,7 +163,7 @@ func InitializeTableStorage(clients *AzureClients, useAzureCli bool) {
 		// Golden resource group is already ensured in CreateNetworkInfrastructure
 
 		namer := NewResourceNamer(clients.Suffix)
-		tableNames := []string{namer.EventLogTableName(), namer.ResourceRegistryTableName()}
+		tableNames := []string{namer.EventLogTableName(), namer.ResourceRegistryTableName(), namer.AllocationsTableName(), namer.ClaimsTableName()}
 
 		result := CreateTableStorageResourcesInResourceGroup(
 			context.Background(),
@@ -0,0 +1,327 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+)
+
+// Orphan reconciler defaults
+const (
+	DefaultOrphanMinAge            = 1 * time.Hour    // orphans younger than this are reported but left alone
+	DefaultOrphanReconcileInterval = 30 * time.Minute // how often the server looks for orphans
+)
+
+// Kinds of orphaned resources the reconciler looks for
+const (
+	OrphanNICWithoutVM            = "nic-without-vm"
+	OrphanNSGWithoutNIC           = "nsg-without-nic"
+	OrphanTempVM                  = "temp-vm"
+	OrphanTempDisk                = "temp-disk"
+	OrphanConnectedWithoutSession = "connected-without-session"
+)
+
+// SessionChecker tells whether an instance is serving a live user session
+type SessionChecker interface {
+	HasActiveSession(instanceID string) bool
+	// LastSessionEnded returns when the last live session on instanceID ended, or the
+	// zero time if none has in this process
+	LastSessionEnded(instanceID string) time.Time
+}
+
+// OrphanReconcilerConfig controls what the reconciler deletes and how often it runs
+type OrphanReconcilerConfig struct {
+	MinAge   time.Duration // only orphans at least this old are cleaned up
+	Interval time.Duration // time between passes in Run
+	DryRun   bool          // report orphans without touching them
+}
+
+// NewDefaultOrphanReconcilerConfig returns the reconciler settings the server runs with
+func NewDefaultOrphanReconcilerConfig() OrphanReconcilerConfig {
+	return OrphanReconcilerConfig{
+		MinAge:   DefaultOrphanMinAge,
+		Interval: DefaultOrphanReconcileInterval,
+	}
+}
+
+// Orphan is a resource the reconciler found without a reason to exist
+type Orphan struct {
+	Kind       string
+	Name       string
+	ResourceID string // instanceID for connected instances, Azure resource ID otherwise
+	VolumeID   string // volume of a connected instance's allocation, empty if it has none
+	Age        time.Duration
+	Reason     string
+	Cleaned    bool
+	Error      error
+}
+
+// OrphanReport is the outcome of one reconciliation pass
+type OrphanReport struct {
+	Orphans         []Orphan
+	SessionsChecked bool // false when no SessionChecker was available
+}
+
+// OrphanReconciler finds resources leaked by failed creates, interrupted golden snapshot
+// builds and sessions that ended without releasing their instance, and cleans them up
+type OrphanReconciler struct {
+	clients   *AzureClients
+	config    OrphanReconcilerConfig
+	allocator *ResourceAllocator
+	sessions  SessionChecker
+}
+
+// NewOrphanReconciler creates a reconciler. clients may be nil on backends other than
+// Azure, in which case only connected instances are checked. sessions may be nil, in which
+// case connected instances are not checked (only the server knows which sessions are live).
+func NewOrphanReconciler(clients *AzureClients, config OrphanReconcilerConfig, allocator *ResourceAllocator, sessions SessionChecker) *OrphanReconciler {
+	return &OrphanReconciler{
+		clients:   clients,
+		config:    config,
+		allocator: allocator,
+		sessions:  sessions,
+	}
+}
+
+// Run reconciles every config.Interval until ctx is done
+func (r *OrphanReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := r.Reconcile(ctx); err != nil {
+			slog.Error("orphan reconciliation failed", "error", err)
+		}
+	}
+}
+
+// Reconcile finds orphans and, unless in dry-run mode, cleans up those older than config.MinAge
+func (r *OrphanReconciler) Reconcile(ctx context.Context) (*OrphanReport, error) {
+	report := &OrphanReport{SessionsChecked: r.sessions != nil && r.allocator != nil}
+
+	var orphans []Orphan
+	if r.clients != nil {
+		resourceOrphans, err := r.findResourceOrphans(ctx)
+		if err != nil {
+			return nil, err
+		}
+		orphans = resourceOrphans
+	}
+	if report.SessionsChecked {
+		connected, err := r.findConnectedWithoutSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, connected...)
+	}
+
+	for i := range orphans {
+		orphan := &orphans[i]
+		if r.config.DryRun || orphan.Age < r.config.MinAge {
+			slog.Info("orphan found", "kind", orphan.Kind, "name", orphan.Name, "age", orphan.Age.Round(time.Second), "reason", orphan.Reason, "dryRun", r.config.DryRun)
+			continue
+		}
+
+		slog.Info("cleaning up orphan", "kind", orphan.Kind, "name", orphan.Name, "age", orphan.Age.Round(time.Second), "reason", orphan.Reason)
+		orphan.Error = r.clean(ctx, orphan)
+		orphan.Cleaned = orphan.Error == nil
+		if orphan.Error != nil {
+			slog.Warn("Failed to clean up orphan", "kind", orphan.Kind, "name", orphan.Name, "error", orphan.Error)
+		}
+	}
+
+	report.Orphans = orphans
+	return report, nil
+}
+
+// findResourceOrphans lists the resource group and matches resources up by their names
+func (r *OrphanReconciler) findResourceOrphans(ctx context.Context) ([]Orphan, error) {
+	client, err := armresources.NewClient(r.clients.SubscriptionID, r.clients.Cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resources client: %w", err)
+	}
+
+	var resources []*armresources.GenericResourceExpanded
+	pager := client.NewListByResourceGroupPager(r.clients.ResourceGroupName, &armresources.ClientListByResourceGroupOptions{
+		Expand: to.Ptr("createdTime"),
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list resources in %s: %w", r.clients.ResourceGroupName, err)
+		}
+		resources = append(resources, page.Value...)
+	}
+
+	namer := NewResourceNamer(r.clients.Suffix)
+	boxResources := make(map[string]map[string]bool) // box ID -> kinds present
+	addBoxResource := func(boxID, kind string) {
+		if boxResources[boxID] == nil {
+			boxResources[boxID] = make(map[string]bool)
+		}
+		boxResources[boxID][kind] = true
+	}
+	for _, res := range resources {
+		name := stringValue(res.Name)
+		if boxID, kind, ok := namer.ParseBoxResourceName(name); ok {
+			addBoxResource(boxID, kind)
+		} else if strings.HasPrefix(name, TempGoldenVMPrefix) && strings.EqualFold(stringValue(res.Type), AzureResourceTypeVM) {
+			// The golden snapshot build VM uses its plain name as box ID for its NIC and NSG
+			addBoxResource(name, BoxResourceVM)
+		}
+	}
+
+	var orphans []Orphan
+	for _, res := range resources {
+		name := stringValue(res.Name)
+		orphan := Orphan{Name: name, ResourceID: stringValue(res.ID)}
+		if res.CreatedTime != nil {
+			orphan.Age = time.Since(*res.CreatedTime)
+		}
+		resourceType := strings.ToLower(stringValue(res.Type))
+		goldenRole := stringValue(res.Tags[GoldenTagKeyRole])
+
+		switch {
+		case resourceType == strings.ToLower(AzureResourceTypeVM) &&
+			(goldenRole == GoldenRoleTempVM || strings.HasPrefix(name, TempGoldenVMPrefix)):
+			orphan.Kind = OrphanTempVM
+			orphan.Reason = "golden snapshot build VM left behind"
+
+		case resourceType == strings.ToLower(AzureResourceTypeDisk) && res.ManagedBy == nil &&
+			(strings.HasPrefix(goldenRole, "temp-") || strings.HasPrefix(name, TempGoldenVMPrefix)):
+			orphan.Kind = OrphanTempDisk
+			orphan.Reason = "unattached golden snapshot build disk"
+
+		default:
+			boxID, kind, ok := namer.ParseBoxResourceName(name)
+			switch {
+			case ok && kind == BoxResourceNIC && !boxResources[boxID][BoxResourceVM]:
+				orphan.Kind = OrphanNICWithoutVM
+				orphan.Reason = fmt.Sprintf("no VM %s", namer.BoxVMName(boxID))
+			case ok && kind == BoxResourceNSG && !boxResources[boxID][BoxResourceNIC]:
+				orphan.Kind = OrphanNSGWithoutNIC
+				orphan.Reason = fmt.Sprintf("no NIC %s", namer.BoxNICName(boxID))
+			default:
+				continue
+			}
+		}
+		orphans = append(orphans, orphan)
+	}
+	return orphans, nil
+}
+
+// findConnectedWithoutSession returns instances marked connected in the inventory that
+// neither serve a live session nor belong to an allocation that is still in progress
+func (r *OrphanReconciler) findConnectedWithoutSession(ctx context.Context) ([]Orphan, error) {
+	instances, err := r.allocator.provider.Inventory.GetRunningInstancesByStatus(ctx, ResourceStatusConnected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list connected instances: %w", err)
+	}
+	allocations, err := r.allocator.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list active allocations: %w", err)
+	}
+	return connectedWithoutSession(instances, allocations, r.sessions, time.Now()), nil
+}
+
+// connectedWithoutSession picks the connected instances without a live session. Their age
+// is how long their box has gone without one: since the last session ended, or since it
+// connected or was taken over after a restart if no session has ended since.
+func connectedWithoutSession(instances []ResourceInfo, allocations []AllocationEntity, sessions SessionChecker, now time.Time) []Orphan {
+	byInstance := make(map[string]*AllocationEntity)
+	for i := range allocations {
+		byInstance[allocations[i].InstanceID] = &allocations[i]
+	}
+
+	var orphans []Orphan
+	for _, instance := range instances {
+		allocation := byInstance[instance.ResourceID]
+		if allocation != nil && allocation.State != AllocationStateConnected {
+			continue
+		}
+		if sessions.HasActiveSession(instance.ResourceID) {
+			continue
+		}
+
+		orphan := Orphan{
+			Kind:       OrphanConnectedWithoutSession,
+			Name:       instance.Name,
+			ResourceID: instance.ResourceID,
+			Reason:     "instance is connected but has no live session",
+		}
+		var idleSince time.Time
+		if allocation == nil {
+			orphan.Reason = "instance is connected but has no allocation"
+			if instance.LastUsed != nil {
+				idleSince = *instance.LastUsed
+			}
+		} else {
+			orphan.VolumeID = allocation.VolumeID
+			idleSince = latest(allocation.ConnectedAt, allocation.RecoveredAt, sessions.LastSessionEnded(instance.ResourceID))
+		}
+		if !idleSince.IsZero() {
+			orphan.Age = now.Sub(idleSince)
+		}
+		orphans = append(orphans, orphan)
+	}
+	return orphans
+}
+
+// latest returns the latest of times
+func latest(times ...time.Time) time.Time {
+	var t time.Time
+	for _, candidate := range times {
+		if candidate.After(t) {
+			t = candidate
+		}
+	}
+	return t
+}
+
+// clean deletes or releases a single orphan
+func (r *OrphanReconciler) clean(ctx context.Context, orphan *Orphan) error {
+	switch orphan.Kind {
+	case OrphanTempVM:
+		return DeleteInstance(ctx, r.clients, r.clients.ResourceGroupName, orphan.Name)
+	case OrphanTempDisk:
+		DeleteDisk(ctx, r.clients, r.clients.ResourceGroupName, orphan.Name, "temp disk")
+	case OrphanNICWithoutVM:
+		DeleteNIC(ctx, r.clients, r.clients.ResourceGroupName, orphan.Name, orphan.ResourceID)
+	case OrphanNSGWithoutNIC:
+		DeleteNSG(ctx, r.clients, r.clients.ResourceGroupName, orphan.Name)
+	case OrphanConnectedWithoutSession:
+		if r.allocator == nil {
+			return fmt.Errorf("no allocator to release instance with")
+		}
+		// Without its allocation there is no telling what the instance has attached
+		if orphan.VolumeID == "" {
+			return fmt.Errorf("instance %s has no allocation, not releasing it", orphan.ResourceID)
+		}
+		// The user may have come back since the instance was found
+		if r.sessions.HasActiveSession(orphan.ResourceID) {
+			return fmt.Errorf("instance %s has a live session again, not releasing it", orphan.ResourceID)
+		}
+		return r.allocator.ReleaseResources(ctx, orphan.ResourceID, orphan.VolumeID)
+	default:
+		return fmt.Errorf("unknown orphan kind %s", orphan.Kind)
+	}
+	return nil
+}
+
+// stringValue dereferences an optional string from the Azure SDK, treating nil as empty
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
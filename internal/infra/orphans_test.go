@@ -0,0 +1,183 @@
+package infra
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeSessions is a SessionChecker with fixed answers
+type fakeSessions struct {
+	active map[string]bool
+	ended  map[string]time.Time
+}
+
+func (f *fakeSessions) HasActiveSession(instanceID string) bool {
+	return f.active[instanceID]
+}
+
+func (f *fakeSessions) LastSessionEnded(instanceID string) time.Time {
+	return f.ended[instanceID]
+}
+
+// backdateAllocation moves the times a box connected and was taken over into the past
+func backdateAllocation(t *testing.T, provider *Provider, instanceID string, connected, recovered time.Time) {
+	t.Helper()
+	allocation := activeAllocations(t, provider)[instanceID]
+	allocation.ConnectedAt = connected
+	allocation.RecoveredAt = recovered
+	if err := provider.Allocations.WriteAllocation(context.Background(), &allocation); err != nil {
+		t.Fatalf("WriteAllocation: %v", err)
+	}
+}
+
+func TestReconcileConnectedWithoutSession(t *testing.T) {
+	ctx := context.Background()
+	cloud := NewMemoryCloud(MemoryProviderConfig{})
+	provider := cloud.Provider()
+	pool := newTestPool(t, cloud, provider)
+	allocator := NewResourceAllocator(provider)
+	allocate := func(boxName string) *AllocatedResources {
+		fillPool(ctx, pool)
+		return allocateTestBox(t, allocator, "user-1", boxName)
+	}
+	long := time.Now().Add(-2 * time.Hour)
+
+	active := allocate("active")
+	justLeft := allocate("just-left")
+	recovered := allocate("recovered")
+	abandoned := allocate("abandoned")
+	fillPool(ctx, pool)
+	for _, resources := range []*AllocatedResources{active, justLeft, recovered, abandoned} {
+		backdateAllocation(t, provider, resources.InstanceID, long, time.Time{})
+	}
+	// A server restart took this one over a minute ago, and it had no session since
+	backdateAllocation(t, provider, recovered.InstanceID, long, time.Now().Add(-time.Minute))
+
+	// An instance marked connected without an allocation has no known volume
+	untracked, err := provider.Inventory.GetOldestFreeRunningInstances(ctx, 1)
+	if err != nil || len(untracked) != 1 {
+		t.Fatalf("GetOldestFreeRunningInstances: %v, %d instances", err, len(untracked))
+	}
+	if err := provider.Inventory.UpdateInstanceStatus(ctx, untracked[0].ResourceID, ResourceStatusConnected); err != nil {
+		t.Fatalf("UpdateInstanceStatus: %v", err)
+	}
+	cloud.mu.Lock()
+	entry := cloud.registry[ResourceRoleInstance][untracked[0].ResourceID]
+	entry.LastActivity = long
+	cloud.registry[ResourceRoleInstance][untracked[0].ResourceID] = entry
+	cloud.mu.Unlock()
+
+	sessions := &fakeSessions{
+		active: map[string]bool{active.InstanceID: true},
+		ended: map[string]time.Time{
+			justLeft.InstanceID:  time.Now().Add(-time.Second),
+			abandoned.InstanceID: long.Add(time.Minute),
+		},
+	}
+	config := OrphanReconcilerConfig{MinAge: time.Hour}
+	report, err := NewOrphanReconciler(nil, config, allocator, sessions).Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if !report.SessionsChecked {
+		t.Fatalf("sessions not checked")
+	}
+
+	found := make(map[string]Orphan)
+	for _, orphan := range report.Orphans {
+		if orphan.Kind != OrphanConnectedWithoutSession {
+			t.Fatalf("got orphan kind %s without Azure", orphan.Kind)
+		}
+		found[orphan.ResourceID] = orphan
+	}
+	if _, ok := found[active.InstanceID]; ok {
+		t.Errorf("box with a live session reported")
+	}
+	for name, resources := range map[string]*AllocatedResources{"just left": justLeft, "recovered": recovered} {
+		orphan, ok := found[resources.InstanceID]
+		if !ok || orphan.Cleaned || orphan.Age > time.Hour {
+			t.Errorf("%s: got %+v, want it reported as idle for less than an hour and kept", name, orphan)
+		}
+	}
+	if orphan := found[abandoned.InstanceID]; !orphan.Cleaned || orphan.VolumeID != abandoned.VolumeID {
+		t.Errorf("abandoned box: got %+v, want its volume %s released", orphan, abandoned.VolumeID)
+	}
+	if orphan := found[untracked[0].ResourceID]; orphan.Cleaned || orphan.Error == nil {
+		t.Errorf("instance without allocation: got %+v, want it kept with an error", orphan)
+	}
+
+	allocations := activeAllocations(t, provider)
+	for _, resources := range []*AllocatedResources{active, justLeft, recovered} {
+		if _, ok := allocations[resources.InstanceID]; !ok {
+			t.Errorf("allocation of %s released", resources.InstanceID)
+		}
+	}
+	if _, ok := allocations[abandoned.InstanceID]; ok {
+		t.Errorf("allocation of the abandoned box kept")
+	}
+	if got := registryStatus(t, cloud, ResourceRoleInstance, abandoned.InstanceID); got != ResourceStatusFree {
+		t.Errorf("abandoned box's instance is %s, want %s", got, ResourceStatusFree)
+	}
+}
+
+func TestConnectedWithoutSession(t *testing.T) {
+	now := time.Now()
+	long := now.Add(-2 * time.Hour)
+	instance := func(id string) ResourceInfo {
+		return ResourceInfo{Name: "vm-" + id, ResourceID: id, LastUsed: &long}
+	}
+	allocation := func(id string, state string, recovered time.Time) AllocationEntity {
+		return AllocationEntity{InstanceID: id, VolumeID: "vol-" + id, State: state, ConnectedAt: long, RecoveredAt: recovered}
+	}
+
+	instances := []ResourceInfo{
+		instance("active"), instance("allocating"), instance("just-left"),
+		instance("recovered"), instance("abandoned"), instance("untracked"),
+	}
+	allocations := []AllocationEntity{
+		allocation("active", AllocationStateConnected, time.Time{}),
+		allocation("allocating", AllocationStateAttaching, time.Time{}),
+		allocation("just-left", AllocationStateConnected, time.Time{}),
+		allocation("recovered", AllocationStateConnected, now.Add(-time.Minute)),
+		allocation("abandoned", AllocationStateConnected, time.Time{}),
+	}
+	sessions := &fakeSessions{
+		active: map[string]bool{"active": true},
+		ended: map[string]time.Time{
+			"just-left": now.Add(-time.Second),
+			"abandoned": long.Add(time.Minute),
+		},
+	}
+
+	found := make(map[string]Orphan)
+	for _, orphan := range connectedWithoutSession(instances, allocations, sessions, now) {
+		found[orphan.ResourceID] = orphan
+	}
+	for _, id := range []string{"active", "allocating"} {
+		if _, ok := found[id]; ok {
+			t.Errorf("%s reported as an orphan", id)
+		}
+	}
+
+	tests := []struct {
+		id       string
+		age      time.Duration
+		volumeID string
+	}{
+		{"just-left", time.Second, "vol-just-left"},
+		{"recovered", time.Minute, "vol-recovered"},
+		{"abandoned", 2*time.Hour - time.Minute, "vol-abandoned"},
+		{"untracked", 2 * time.Hour, ""},
+	}
+	for _, tt := range tests {
+		orphan, ok := found[tt.id]
+		if !ok {
+			t.Errorf("%s not reported", tt.id)
+			continue
+		}
+		if orphan.Age != tt.age || orphan.VolumeID != tt.volumeID {
+			t.Errorf("%s: got age %v and volume %q, want %v and %q", tt.id, orphan.Age, orphan.VolumeID, tt.age, tt.volumeID)
+		}
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+
+	"shellbox/internal/sshutil"
 )
 
 // Pool configuration constants for production
@@ -22,6 +25,13 @@ const (
 	DefaultScaleDownCooldown = 10 * time.Minute
 )
 
+// Initial scale-up duration estimates, used for queue wait estimates until the pool
+// has measured real scale-up timings
+const (
+	DefaultInstanceScaleUpEstimate = 5 * time.Minute
+	DefaultVolumeScaleUpEstimate   = 2 * time.Minute
+)
+
 // Pool configuration constants for development
 const (
 	DevMinFreeInstances  = 1
@@ -65,50 +75,162 @@ func NewDevPoolConfig() PoolConfig {
 	}
 }
 
-type BoxPool struct {
-	mu              sync.RWMutex
-	clients         *AzureClients
-	vmConfig        *VMConfig
-	poolConfig      PoolConfig
-	resourceQueries *ResourceGraphQueries
-	goldenSnapshot  *GoldenSnapshotInfo
-	lastScaleDown   time.Time // Track last scale down to enforce cooldown
+// NewLocalPoolConfig creates a pool configuration for the local backend, which has
+// maxInstances slots and keeps one of them ready
+func NewLocalPoolConfig(maxInstances int) PoolConfig {
+	config := NewDevPoolConfig()
+	config.MinFreeInstances = 1
+	config.MaxFreeInstances = 1
+	config.MaxTotalInstances = maxInstances
+	return config
 }
 
-func NewBoxPool(clients *AzureClients, vmConfig *VMConfig, poolConfig PoolConfig, goldenSnapshot *GoldenSnapshotInfo) *BoxPool {
-	resourceQueries := NewResourceGraphQueries(
-		clients.ResourceGraphClient,
-		clients.SubscriptionID,
-		clients.ResourceGroupName,
-	)
+type BoxPool struct {
+	mu             sync.RWMutex
+	provider       *Provider
+	vmConfig       *VMConfig
+	poolConfig     PoolConfig
+	goldenSnapshot *GoldenSnapshotInfo
+	lastScaleDown  time.Time // Track last scale down to enforce cooldown
+
+	// Demand-driven scale up (see AllocationQueue)
+	scaleUpRequests   chan struct{}
+	pendingDemand     map[string]int           // queued users per resource role
+	scaleUpEstimate   map[string]time.Duration // moving average of scale-up duration per role
+	scaleUpStartedAt  map[string]time.Time     // start of the in-flight scale up per role
+	capacityListeners map[string][]func()
+}
 
+func NewBoxPool(provider *Provider, vmConfig *VMConfig, poolConfig PoolConfig, goldenSnapshot *GoldenSnapshotInfo) *BoxPool {
 	return &BoxPool{
-		clients:         clients,
+		provider:        provider,
 		vmConfig:        vmConfig,
 		poolConfig:      poolConfig,
-		resourceQueries: resourceQueries,
 		goldenSnapshot:  goldenSnapshot,
+		scaleUpRequests: make(chan struct{}, 1),
+		pendingDemand:   make(map[string]int),
+		scaleUpEstimate: map[string]time.Duration{
+			ResourceRoleInstance: DefaultInstanceScaleUpEstimate,
+			ResourceRoleVolume:   DefaultVolumeScaleUpEstimate,
+		},
+		scaleUpStartedAt:  make(map[string]time.Time),
+		capacityListeners: make(map[string][]func()),
 	}
 }
 
 func (p *BoxPool) MaintainPool(ctx context.Context) {
 	ticker := time.NewTicker(p.poolConfig.CheckInterval)
 	defer ticker.Stop()
+	reconcileTicker := time.NewTicker(RegistryReconcileInterval)
+	defer reconcileTicker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-reconcileTicker.C:
+			if err := p.ReconcileRegistry(ctx); err != nil {
+				slog.Error("failed to reconcile resource registry", "error", err)
+			}
+			continue
 		case <-ticker.C:
-			// Maintain both instance and volume pools
-			p.maintainInstancePool(ctx)
-			p.maintainVolumePool(ctx)
+		case <-p.scaleUpRequests:
+			slog.Info("pool maintenance requested by allocation queue")
+		}
+		// Maintain both instance and volume pools
+		p.maintainInstancePool(ctx)
+		p.maintainVolumePool(ctx)
+	}
+}
+
+// ReconcileRegistry fixes drift between the inventory, which the pool and the allocator
+// read, and the resources that actually exist
+func (p *BoxPool) ReconcileRegistry(ctx context.Context) error {
+	return p.provider.Inventory.Reconcile(ctx)
+}
+
+// RequestScaleUp records how many users are waiting for a resource role and makes
+// MaintainPool run immediately instead of waiting for the next CheckInterval tick
+func (p *BoxPool) RequestScaleUp(role string, waiting int) {
+	p.mu.Lock()
+	p.pendingDemand[role] = waiting
+	p.mu.Unlock()
+
+	select {
+	case p.scaleUpRequests <- struct{}{}:
+	default:
+		// A maintenance run is already pending
+	}
+}
+
+// OnCapacityAdded registers fn to be called whenever new resources of role were added to the pool
+func (p *BoxPool) OnCapacityAdded(role string, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capacityListeners[role] = append(p.capacityListeners[role], fn)
+}
+
+// EstimateWait estimates how long the user at the given queue position will wait for
+// a resource of role, based on measured scale-up timings
+func (p *BoxPool) EstimateWait(role string, position int) time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	perScaleUp := p.scaleUpEstimate[role]
+	batch := p.poolConfig.MinFreeInstances
+	if role == ResourceRoleVolume {
+		batch = p.poolConfig.MinFreeVolumes
+	}
+	batch = max(batch, 1)
+
+	// Every scale up creates at least a batch of resources, so positions beyond the
+	// first batch have to wait for additional rounds
+	rounds := (max(position, 1) + batch - 1) / batch
+	wait := time.Duration(rounds) * perScaleUp
+	if startedAt, ok := p.scaleUpStartedAt[role]; ok {
+		wait -= min(time.Since(startedAt), perScaleUp)
+	}
+	return max(wait, 0)
+}
+
+// takePendingDemand returns and clears the number of queued users for role
+func (p *BoxPool) takePendingDemand(role string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	demand := p.pendingDemand[role]
+	delete(p.pendingDemand, role)
+	return demand
+}
+
+// startScaleUp marks a scale up of role as in flight and returns a function that
+// records its duration and notifies capacity listeners when created > 0
+func (p *BoxPool) startScaleUp(role string) func(created int) {
+	start := time.Now()
+	p.mu.Lock()
+	p.scaleUpStartedAt[role] = start
+	p.mu.Unlock()
+
+	return func(created int) {
+		p.mu.Lock()
+		delete(p.scaleUpStartedAt, role)
+		var listeners []func()
+		if created > 0 {
+			// Exponential moving average so a single slow scale up doesn't dominate
+			const alpha = 0.3
+			elapsed := time.Since(start)
+			p.scaleUpEstimate[role] = time.Duration(alpha*float64(elapsed) + (1-alpha)*float64(p.scaleUpEstimate[role]))
+			listeners = append(listeners, p.capacityListeners[role]...)
+		}
+		p.mu.Unlock()
+
+		for _, fn := range listeners {
+			fn()
 		}
 	}
 }
 
 func (p *BoxPool) maintainInstancePool(ctx context.Context) {
-	counts, err := p.resourceQueries.CountInstancesByStatus(ctx)
+	counts, err := p.provider.Inventory.CountInstancesByStatus(ctx)
 	if err != nil {
 		slog.Error("failed to get instance counts", "error", err)
 		return
@@ -119,15 +241,16 @@ func (p *BoxPool) maintainInstancePool(ctx context.Context) {
 		"connected", counts.Connected,
 		"total", counts.Total)
 
-	if counts.Free < p.poolConfig.MinFreeInstances {
-		p.scaleUpInstances(ctx, counts.Free)
+	demand := p.takePendingDemand(ResourceRoleInstance)
+	if counts.Free < p.poolConfig.MinFreeInstances+demand {
+		p.scaleUpInstances(ctx, counts, demand)
 	} else if counts.Free > p.poolConfig.MaxFreeInstances {
 		p.scaleDownInstances(ctx, counts.Free)
 	}
 }
 
 func (p *BoxPool) maintainVolumePool(ctx context.Context) {
-	counts, err := p.resourceQueries.CountVolumesByStatus(ctx)
+	counts, err := p.provider.Inventory.CountVolumesByStatus(ctx)
 	if err != nil {
 		slog.Error("failed to get volume counts", "error", err)
 		return
@@ -138,16 +261,25 @@ func (p *BoxPool) maintainVolumePool(ctx context.Context) {
 		"attached", counts.Attached,
 		"total", counts.Total)
 
-	if counts.Free < p.poolConfig.MinFreeVolumes {
-		p.scaleUpVolumes(ctx, counts.Free)
+	demand := p.takePendingDemand(ResourceRoleVolume)
+	if counts.Free < p.poolConfig.MinFreeVolumes+demand {
+		p.scaleUpVolumes(ctx, counts, demand)
 	} else if counts.Free > p.poolConfig.MaxFreeVolumes {
 		p.scaleDownVolumes(ctx, counts.Free)
 	}
 }
 
-func (p *BoxPool) scaleUpInstances(ctx context.Context, currentSize int) {
-	instancesToCreate := max(0, p.poolConfig.MinFreeInstances-currentSize)
-	slog.Info("creating instances to maintain pool size", "count", instancesToCreate)
+func (p *BoxPool) scaleUpInstances(ctx context.Context, counts *ResourceCounts, demand int) {
+	instancesToCreate := max(0, p.poolConfig.MinFreeInstances+demand-counts.Free)
+	instancesToCreate = min(instancesToCreate, max(0, p.poolConfig.MaxTotalInstances-counts.Total))
+	slog.Info("creating instances to maintain pool size", "count", instancesToCreate, "queued", demand)
+	if instancesToCreate == 0 {
+		return
+	}
+
+	finishScaleUp := p.startScaleUp(ResourceRoleInstance)
+	var created atomic.Int32
+	defer func() { finishScaleUp(int(created.Load())) }()
 
 	var wg sync.WaitGroup
 	for i := 0; i < instancesToCreate; i++ {
@@ -159,13 +291,15 @@ func (p *BoxPool) scaleUpInstances(ctx context.Context, currentSize int) {
 			if p.goldenSnapshot != nil && p.goldenSnapshot.OSImageResourceID != "" {
 				vmConfig.OSImageID = p.goldenSnapshot.OSImageResourceID
 			}
-			instanceID, err := CreateInstance(ctx, p.clients, &vmConfig)
+			instanceID, err := p.provider.Compute.CreateInstance(ctx, &vmConfig)
 			if err != nil {
 				slog.Error("failed to create instance", "error", err)
 				return
 			}
 
+			created.Add(1)
 			slog.Info("created instance", "instanceID", instanceID)
+			p.forgetHostKey(ctx, instanceID)
 
 			// Log instance creation event
 			now := time.Now()
@@ -177,7 +311,7 @@ func (p *BoxPool) scaleUpInstances(ctx context.Context, currentSize int) {
 				BoxID:        instanceID,
 				Details:      fmt.Sprintf(`{"status":%q}`, ResourceStatusFree),
 			}
-			if err := WriteEventLog(ctx, p.clients, &createEvent); err != nil {
+			if err := p.provider.Events.WriteEvent(ctx, &createEvent); err != nil {
 				slog.Warn("Failed to log instance create event", "error", err)
 			}
 
@@ -191,7 +325,7 @@ func (p *BoxPool) scaleUpInstances(ctx context.Context, currentSize int) {
 				LastActivity: now,
 				Metadata:     fmt.Sprintf(`{"vm_size":%q}`, p.vmConfig.VMSize),
 			}
-			if err := WriteResourceRegistry(ctx, p.clients, &resourceEntry); err != nil {
+			if err := p.provider.Inventory.RegisterResource(ctx, &resourceEntry); err != nil {
 				slog.Warn("Failed to log resource registry entry", "error", err)
 			}
 		}()
@@ -214,7 +348,7 @@ func (p *BoxPool) scaleDownInstances(ctx context.Context, currentSize int) {
 	slog.Info("removing excess instances from pool", "count", instancesToRemove)
 
 	// Get oldest free running instances to remove
-	oldestInstances, err := p.resourceQueries.GetOldestFreeRunningInstances(ctx, instancesToRemove)
+	oldestInstances, err := p.provider.Inventory.GetOldestFreeRunningInstances(ctx, instancesToRemove)
 	if err != nil {
 		slog.Error("failed to get oldest free running instances", "error", err)
 		return
@@ -227,11 +361,8 @@ func (p *BoxPool) scaleDownInstances(ctx context.Context, currentSize int) {
 		go func(idx int) {
 			inst := oldestInstances[idx]
 			defer wg.Done()
-			namer := NewResourceNamer(p.clients.Suffix)
-			vmName := namer.BoxVMName(inst.ResourceID)
-			resourceGroup := namer.ResourceGroup()
-
-			err := DeleteInstance(ctx, p.clients, resourceGroup, vmName)
+			p.forgetHostKey(ctx, inst.ResourceID)
+			err := p.provider.Compute.DeleteInstance(ctx, inst.ResourceID)
 			if err != nil {
 				slog.Error("failed to delete instance", "instanceID", inst.ResourceID, "error", err)
 				return
@@ -239,6 +370,10 @@ func (p *BoxPool) scaleDownInstances(ctx context.Context, currentSize int) {
 
 			slog.Info("deleted instance", "instanceID", inst.ResourceID)
 
+			if err := p.provider.Inventory.UnregisterResource(ctx, ResourceRoleInstance, inst.ResourceID); err != nil {
+				slog.Warn("Failed to remove instance from resource registry", "error", err)
+			}
+
 			// Log instance deletion event
 			now := time.Now()
 			deleteEvent := EventLogEntity{
@@ -249,7 +384,7 @@ func (p *BoxPool) scaleDownInstances(ctx context.Context, currentSize int) {
 				BoxID:        inst.ResourceID,
 				Details:      `{"reason":"pool_shrink"}`,
 			}
-			if err := WriteEventLog(ctx, p.clients, &deleteEvent); err != nil {
+			if err := p.provider.Events.WriteEvent(ctx, &deleteEvent); err != nil {
 				slog.Warn("Failed to log instance delete event", "error", err)
 			}
 		}(i)
@@ -262,9 +397,28 @@ func (p *BoxPool) scaleDownInstances(ctx context.Context, currentSize int) {
 	p.mu.Unlock()
 }
 
-func (p *BoxPool) scaleUpVolumes(ctx context.Context, currentSize int) {
-	volumesToCreate := max(0, p.poolConfig.MinFreeVolumes-currentSize)
-	slog.Info("creating volumes to maintain pool size", "count", volumesToCreate)
+// forgetHostKey drops the SSH host key pinned for an instance's address. Addresses go to
+// new instances once their instance is deleted, and each new one has a key of its own.
+func (p *BoxPool) forgetHostKey(ctx context.Context, instanceID string) {
+	instanceIP, err := p.provider.Compute.GetInstancePrivateIP(ctx, instanceID)
+	if err != nil {
+		slog.Warn("Failed to get instance IP to forget its host key", "instanceID", instanceID, "error", err)
+		return
+	}
+	sshutil.ForgetHostKey(instanceIP)
+}
+
+func (p *BoxPool) scaleUpVolumes(ctx context.Context, counts *ResourceCounts, demand int) {
+	volumesToCreate := max(0, p.poolConfig.MinFreeVolumes+demand-counts.Free)
+	volumesToCreate = min(volumesToCreate, max(0, p.poolConfig.MaxTotalVolumes-counts.Total))
+	slog.Info("creating volumes to maintain pool size", "count", volumesToCreate, "queued", demand)
+	if volumesToCreate == 0 {
+		return
+	}
+
+	finishScaleUp := p.startScaleUp(ResourceRoleVolume)
+	var created atomic.Int32
+	defer func() { finishScaleUp(int(created.Load())) }()
 
 	var wg sync.WaitGroup
 	for i := 0; i < volumesToCreate; i++ {
@@ -272,9 +426,7 @@ func (p *BoxPool) scaleUpVolumes(ctx context.Context, currentSize int) {
 		go func() {
 			defer wg.Done()
 
-			namer := NewResourceNamer(p.clients.Suffix)
 			volumeID := uuid.New().String()
-			volumeName := namer.VolumePoolDiskName(volumeID)
 
 			now := time.Now().UTC()
 			tags := VolumeTags{
@@ -285,13 +437,13 @@ func (p *BoxPool) scaleUpVolumes(ctx context.Context, currentSize int) {
 				VolumeID:  volumeID,
 			}
 
-			_, err := CreateVolumeFromSnapshot(ctx, p.clients, p.clients.ResourceGroupName,
-				volumeName, p.goldenSnapshot.DataSnapshotResourceID, &tags)
+			err := p.provider.Volumes.CreateVolumeFromSnapshot(ctx, p.goldenSnapshot.DataSnapshotResourceID, &tags)
 			if err != nil {
 				slog.Error("failed to create volume from golden snapshot", "error", err)
 				return
 			}
 
+			created.Add(1)
 			slog.Info("created volume from golden snapshot", "volumeID", volumeID)
 
 			// Log volume creation event
@@ -303,7 +455,7 @@ func (p *BoxPool) scaleUpVolumes(ctx context.Context, currentSize int) {
 				BoxID:        volumeID,
 				Details:      fmt.Sprintf(`{"status":%q,"size_gb":%d}`, ResourceStatusFree, DefaultVolumeSizeGB),
 			}
-			if err := WriteEventLog(ctx, p.clients, &createEvent); err != nil {
+			if err := p.provider.Events.WriteEvent(ctx, &createEvent); err != nil {
 				slog.Warn("Failed to log volume create event", "error", err)
 			}
 
@@ -317,7 +469,7 @@ func (p *BoxPool) scaleUpVolumes(ctx context.Context, currentSize int) {
 				LastActivity: now,
 				Metadata:     fmt.Sprintf(`{"size_gb":%d}`, DefaultVolumeSizeGB),
 			}
-			if err := WriteResourceRegistry(ctx, p.clients, &resourceEntry); err != nil {
+			if err := p.provider.Inventory.RegisterResource(ctx, &resourceEntry); err != nil {
 				slog.Warn("Failed to log resource registry entry", "error", err)
 			}
 		}()
@@ -340,7 +492,7 @@ func (p *BoxPool) scaleDownVolumes(ctx context.Context, currentSize int) {
 	slog.Info("removing excess volumes from pool", "count", volumesToRemove)
 
 	// Get oldest free volumes to remove
-	oldestVolumes, err := p.resourceQueries.GetOldestFreeVolumes(ctx, volumesToRemove)
+	oldestVolumes, err := p.provider.Inventory.GetOldestFreeVolumes(ctx, volumesToRemove)
 	if err != nil {
 		slog.Error("failed to get oldest free volumes", "error", err)
 		return
@@ -354,7 +506,7 @@ func (p *BoxPool) scaleDownVolumes(ctx context.Context, currentSize int) {
 			vol := oldestVolumes[idx]
 			defer wg.Done()
 
-			err := DeleteVolume(ctx, p.clients, p.clients.ResourceGroupName, vol.Name)
+			err := p.provider.Volumes.DeleteVolume(ctx, vol.ResourceID)
 			if err != nil {
 				slog.Error("failed to delete volume", "volumeID", vol.ResourceID, "error", err)
 				return
@@ -362,6 +514,10 @@ func (p *BoxPool) scaleDownVolumes(ctx context.Context, currentSize int) {
 
 			slog.Info("deleted volume", "volumeID", vol.ResourceID)
 
+			if err := p.provider.Inventory.UnregisterResource(ctx, ResourceRoleVolume, vol.ResourceID); err != nil {
+				slog.Warn("Failed to remove volume from resource registry", "error", err)
+			}
+
 			// Log volume deletion event
 			now := time.Now()
 			deleteEvent := EventLogEntity{
@@ -372,7 +528,7 @@ func (p *BoxPool) scaleDownVolumes(ctx context.Context, currentSize int) {
 				BoxID:        vol.ResourceID,
 				Details:      `{"reason":"pool_shrink"}`,
 			}
-			if err := WriteEventLog(ctx, p.clients, &deleteEvent); err != nil {
+			if err := p.provider.Events.WriteEvent(ctx, &deleteEvent); err != nil {
 				slog.Warn("Failed to log volume delete event", "error", err)
 			}
 		}(i)
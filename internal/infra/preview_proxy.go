@@ -0,0 +1,258 @@
+package infra
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Preview proxy settings
+const (
+	DefaultPreviewTokenTTL = 24 * time.Hour
+	previewCookie          = "shellbox_preview" // holds the token once a preview link was opened
+	previewTokenParam      = "shellbox_token"   // query parameter of preview links
+	previewTokenPurpose    = "preview"
+)
+
+// PreviewConfig configures the HTTPS preview proxy
+type PreviewConfig struct {
+	Domain   string // previews are served on <port>-<box>-<user>.<Domain>, which must resolve to the bastion
+	TokenTTL time.Duration
+}
+
+// NewDefaultPreviewConfig creates a preview configuration for domain
+func NewDefaultPreviewConfig(domain string) PreviewConfig {
+	return PreviewConfig{
+		Domain:   strings.ToLower(strings.TrimSuffix(domain, ".")),
+		TokenTTL: DefaultPreviewTokenTTL,
+	}
+}
+
+// previewTarget is the box port a preview hostname names
+type previewTarget struct {
+	port    int
+	boxName string
+	userID  string
+}
+
+// previewTargetKey is the context key of the previewTarget of a proxied request
+type previewTargetKey struct{}
+
+// PreviewProxy serves the web servers of running boxes over HTTPS on
+// https://<port>-<box>-<user>.<domain>. Only the box's owner gets through unless the port
+// was made public: they open a token link from the preview command, which leaves the
+// token in a cookie for the preview's hostname. WebSocket upgrades pass through, so dev
+// servers with hot reload work.
+type PreviewProxy struct {
+	exposures *ExposureManager
+	config    PreviewConfig
+	tokens    *TokenSigner
+	proxy     *httputil.ReverseProxy
+}
+
+// NewPreviewProxy creates a preview proxy that reaches box ports through exposures
+func NewPreviewProxy(exposures *ExposureManager, config PreviewConfig) (*PreviewProxy, error) {
+	if config.Domain == "" {
+		return nil, errors.New("preview domain is required")
+	}
+	tokens, err := NewTokenSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PreviewProxy{
+		exposures: exposures,
+		config:    config,
+		tokens:    tokens,
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			target := r.In.Context().Value(previewTargetKey{}).(previewTarget)
+			// Dev servers only answer their own host by default; the preview hostname
+			// goes along in X-Forwarded-Host
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Host
+			r.Out.Host = net.JoinHostPort("localhost", strconv.Itoa(target.port))
+			r.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				target := ctx.Value(previewTargetKey{}).(previewTarget)
+				return exposures.Dial(ctx, target.userID, target.boxName, target.port)
+			},
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Failed to proxy preview request", "host", r.Host, "error", err)
+			status := http.StatusBadGateway
+			if errors.Is(err, ErrBoxNotRunning) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, "The box port is not reachable: "+err.Error(), status)
+		},
+	}
+	return p, nil
+}
+
+// URL returns the preview URL of port of a user's box
+func (p *PreviewProxy) URL(userID, boxName string, port int) string {
+	return fmt.Sprintf("https://%d-%s-%s.%s/", port, boxName, userID, p.config.Domain)
+}
+
+// Link returns a preview URL of port of a user's box with a token that lets whoever opens
+// it preview the box until the token expires
+func (p *PreviewProxy) Link(userID, boxName string, port int) (string, time.Time) {
+	expires := time.Now().Add(p.config.TokenTTL).Truncate(time.Second)
+	token := p.tokens.Sign(previewTokenPurpose, expires, userID, boxName)
+	return p.URL(userID, boxName, port) + "?" + previewTokenParam + "=" + token, expires
+}
+
+// ValidBoxName reports whether a box can be previewed: its name has to fit into a DNS
+// label with the port and user ID
+func (p *PreviewProxy) ValidBoxName(boxName string) bool {
+	_, ok := p.parseHost(fmt.Sprintf("1-%s-%s.%s", boxName, strings.Repeat("0", UserIDLength), p.config.Domain))
+	return ok
+}
+
+// HostPolicy implements autocert.HostPolicy: certificates are only requested for previews
+// of running boxes, so made-up hostnames can't use up the CA's rate limits
+func (p *PreviewProxy) HostPolicy(ctx context.Context, host string) error {
+	target, ok := p.parseHost(host)
+	if !ok {
+		return fmt.Errorf("%q is not a preview hostname", host)
+	}
+	if _, _, err := p.exposures.allocator.exposerBox(ctx, target.userID, target.boxName); err != nil {
+		return fmt.Errorf("no preview for %q: %w", host, err)
+	}
+	return nil
+}
+
+// ServeHTTP proxies a preview request to its box port once the request proved it comes
+// from the box's owner
+func (p *PreviewProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, ok := p.parseHost(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !p.exposures.Public(target.userID, target.boxName, target.port) {
+		// A preview link moves its token into a cookie and drops it from the address bar
+		if token := r.URL.Query().Get(previewTokenParam); token != "" {
+			expires, ok := p.verify(token, target)
+			if !ok {
+				p.unauthorized(w, target)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     previewCookie,
+				Value:    token,
+				Path:     "/",
+				Expires:  expires,
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			query := r.URL.Query()
+			query.Del(previewTokenParam)
+			location := *r.URL
+			location.RawQuery = query.Encode()
+			http.Redirect(w, r, location.RequestURI(), http.StatusSeeOther)
+			return
+		}
+		if !p.authorized(r, target) {
+			p.unauthorized(w, target)
+			return
+		}
+	}
+	removeCookie(r, previewCookie)
+
+	ctx := context.WithValue(r.Context(), previewTargetKey{}, target)
+	p.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authorized reports whether r carries a valid token for target, as a cookie or a bearer
+// token for scripts. A bearer token is removed before the request goes to the box.
+func (p *PreviewProxy) authorized(r *http.Request, target previewTarget) bool {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if _, valid := p.verify(bearer, target); valid {
+			r.Header.Del("Authorization")
+			return true
+		}
+	}
+	if cookie, err := r.Cookie(previewCookie); err == nil {
+		_, valid := p.verify(cookie.Value, target)
+		return valid
+	}
+	return false
+}
+
+// unauthorized tells a visitor without a valid token how to get one
+func (p *PreviewProxy) unauthorized(w http.ResponseWriter, target previewTarget) {
+	http.Error(w, fmt.Sprintf("This preview is private. Its owner can open it with the link the command 'preview %s %d' prints.",
+		target.boxName, target.port), http.StatusUnauthorized)
+}
+
+// verify checks that token is a preview token for the box of target, and returns when
+// it expires
+func (p *PreviewProxy) verify(token string, target previewTarget) (time.Time, bool) {
+	fields, expires, ok := p.tokens.Verify(previewTokenPurpose, token)
+	if !ok || len(fields) != 2 || fields[0] != target.userID || fields[1] != target.boxName {
+		return time.Time{}, false
+	}
+	return expires, true
+}
+
+// parseHost parses a preview hostname, <port>-<box>-<user>.<domain>. Box names may
+// contain dashes; user IDs are hex and of fixed length.
+func (p *PreviewProxy) parseHost(host string) (previewTarget, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+p.config.Domain)
+	if !ok || len(label) > 63 {
+		return previewTarget{}, false
+	}
+	portPart, rest, ok := strings.Cut(label, "-")
+	if !ok {
+		return previewTarget{}, false
+	}
+	port, err := strconv.Atoi(portPart)
+	if err != nil || port < 1 || port > 65535 || strconv.Itoa(port) != portPart {
+		return previewTarget{}, false
+	}
+	separator := len(rest) - UserIDLength - 1
+	if separator < 1 || rest[separator] != '-' {
+		return previewTarget{}, false
+	}
+	boxName, userID := rest[:separator], rest[separator+1:]
+	if _, err := hex.DecodeString(userID); err != nil {
+		return previewTarget{}, false
+	}
+	for _, c := range boxName {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return previewTarget{}, false
+		}
+	}
+	return previewTarget{port: port, boxName: boxName, userID: userID}, true
+}
+
+// removeCookie drops the cookie called name from r, keeping the others
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
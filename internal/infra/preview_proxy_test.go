@@ -0,0 +1,208 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// previewTestUser is a user ID in the format preview hostnames carry
+var previewTestUser = strings.Repeat("ab", UserIDLength/2)
+
+// roundTripFunc is an http.RoundTripper answering requests with a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newTestPreviewProxy runs a box called web on an in-memory cloud and returns a preview
+// proxy for it whose requests to the box end up in the returned channel
+func newTestPreviewProxy(t *testing.T) (*PreviewProxy, *ResourceAllocator, *AllocatedResources, <-chan *http.Request) {
+	t.Helper()
+	cloud := NewMemoryCloud(MemoryProviderConfig{})
+	provider := cloud.Provider()
+	fillPool(context.Background(), newTestPool(t, cloud, provider))
+	allocator := NewResourceAllocator(provider)
+	resources := allocateTestBox(t, allocator, previewTestUser, "web")
+	exposures := NewExposureManager(allocator)
+	allocator.OnRelease(exposures.ReleaseInstance)
+
+	proxy, err := NewPreviewProxy(exposures, NewDefaultPreviewConfig("preview.example.com."))
+	if err != nil {
+		t.Fatalf("NewPreviewProxy: %v", err)
+	}
+	proxied := make(chan *http.Request, 1)
+	proxy.proxy.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		proxied <- r
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("hello from the box")),
+			Request:    r,
+		}, nil
+	})
+	return proxy, allocator, resources, proxied
+}
+
+// servePreview sends a request for url through proxy, passing it to the box if prepare
+// lets it
+func servePreview(proxy *PreviewProxy, url string, prepare func(*http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	if prepare != nil {
+		prepare(r)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	return w
+}
+
+func TestPreviewTokenLink(t *testing.T) {
+	proxy, _, _, proxied := newTestPreviewProxy(t)
+
+	link, expires := proxy.Link(previewTestUser, "web", 3000)
+	wantURL := "https://3000-web-" + previewTestUser + ".preview.example.com/"
+	if !strings.HasPrefix(link, wantURL+"?"+previewTokenParam+"=") {
+		t.Fatalf("got link %s, want one for %s", link, wantURL)
+	}
+
+	// The link signs the browser in and drops the token from the address
+	w := servePreview(proxy, strings.Replace(link, "/?", "/app?tab=2&", 1), nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if location := w.Header().Get("Location"); location != "/app?tab=2" {
+		t.Errorf("redirected to %s, want /app?tab=2", location)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != previewCookie {
+		t.Fatalf("got cookies %v, want the preview cookie", cookies)
+	}
+	cookie := cookies[0]
+	_, token, _ := strings.Cut(link, previewTokenParam+"=")
+	if cookie.Value != token || !cookie.Secure || !cookie.HttpOnly || !cookie.Expires.Equal(expires) {
+		t.Errorf("got cookie %+v, want the token as a secure HTTP-only cookie expiring at %s", cookie, expires)
+	}
+	select {
+	case r := <-proxied:
+		t.Fatalf("token link was proxied to the box: %s", r.URL)
+	default:
+	}
+
+	// With the cookie, requests go to the box without it
+	w = servePreview(proxy, wantURL+"app", func(r *http.Request) {
+		r.AddCookie(cookie)
+		r.AddCookie(&http.Cookie{Name: "app_session", Value: "1"})
+	})
+	if w.Code != http.StatusOK || w.Body.String() != "hello from the box" {
+		t.Fatalf("got %d %q, want the box's answer", w.Code, w.Body.String())
+	}
+	r := <-proxied
+	if r.Host != "localhost:3000" || r.Header.Get("X-Forwarded-Host") != "3000-web-"+previewTestUser+".preview.example.com" {
+		t.Errorf("box got host %s forwarded for %s, want localhost:3000 for the preview", r.Host, r.Header.Get("X-Forwarded-Host"))
+	}
+	if _, err := r.Cookie(previewCookie); err == nil {
+		t.Errorf("preview cookie passed on to the box")
+	}
+	if _, err := r.Cookie("app_session"); err != nil {
+		t.Errorf("box's own cookie dropped")
+	}
+
+	// Scripts pass the token as a bearer token, which the box doesn't see either
+	w = servePreview(proxy, wantURL, func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d with a bearer token, want %d", w.Code, http.StatusOK)
+	}
+	if r := <-proxied; r.Header.Get("Authorization") != "" {
+		t.Errorf("bearer token passed on to the box")
+	}
+}
+
+func TestPreviewRejectsBadTokens(t *testing.T) {
+	proxy, _, _, proxied := newTestPreviewProxy(t)
+	url := "https://3000-web-" + previewTestUser + ".preview.example.com/"
+	otherBox, _ := proxy.Link(previewTestUser, "other", 3000)
+	_, otherBoxToken, _ := strings.Cut(otherBox, previewTokenParam+"=")
+
+	for name, token := range map[string]string{
+		"other box":     otherBoxToken,
+		"other user":    proxy.tokens.Sign(previewTokenPurpose, time.Now().Add(time.Hour), strings.Repeat("cd", UserIDLength/2), "web"),
+		"expired":       proxy.tokens.Sign(previewTokenPurpose, time.Now().Add(-time.Second), previewTestUser, "web"),
+		"other purpose": proxy.tokens.Sign("web-session", time.Now().Add(time.Hour), previewTestUser, "web"),
+		"garbage":       "not-a-token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if w := servePreview(proxy, url+"?"+previewTokenParam+"="+token, nil); w.Code != http.StatusUnauthorized {
+				t.Errorf("token link: got status %d, want %d", w.Code, http.StatusUnauthorized)
+			} else if len(w.Result().Cookies()) != 0 {
+				t.Errorf("token link set a cookie")
+			}
+			w := servePreview(proxy, url, func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: previewCookie, Value: token})
+			})
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("cookie: got status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			w = servePreview(proxy, url, func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+token)
+			})
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("bearer token: got status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+	if w := servePreview(proxy, url, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	select {
+	case r := <-proxied:
+		t.Fatalf("request with a bad token was proxied to the box: %s", r.URL)
+	default:
+	}
+
+	// Public ports need no token
+	if err := proxy.exposures.SetPublic(context.Background(), previewTestUser, "web", 3000, true); err != nil {
+		t.Fatalf("SetPublic: %v", err)
+	}
+	if w := servePreview(proxy, url, nil); w.Code != http.StatusOK {
+		t.Fatalf("public port: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	<-proxied
+}
+
+func TestPreviewHostPolicy(t *testing.T) {
+	ctx := context.Background()
+	proxy, allocator, resources, _ := newTestPreviewProxy(t)
+	host := "3000-web-" + previewTestUser + ".preview.example.com"
+
+	if err := proxy.HostPolicy(ctx, host); err != nil {
+		t.Fatalf("running box: %v", err)
+	}
+	for _, bad := range []string{
+		"3000-other-" + previewTestUser + ".preview.example.com", // no such box
+		"3000-web-" + previewTestUser + ".example.com",           // other domain
+		"web-" + previewTestUser + ".preview.example.com",        // no port
+		"70000-web-" + previewTestUser + ".preview.example.com",  // port out of range
+		"3000-web-user.preview.example.com",                      // not a user ID
+		"preview.example.com",
+	} {
+		if err := proxy.HostPolicy(ctx, bad); err == nil {
+			t.Errorf("HostPolicy accepted %s", bad)
+		}
+	}
+
+	// Once the box stops, its previews get no certificates
+	if err := allocator.ReleaseResources(ctx, resources.InstanceID, resources.VolumeID); err != nil {
+		t.Fatalf("ReleaseResources: %v", err)
+	}
+	if err := proxy.HostPolicy(ctx, host); !errors.Is(err, ErrBoxNotRunning) {
+		t.Fatalf("stopped box: got %v, want ErrBoxNotRunning", err)
+	}
+}
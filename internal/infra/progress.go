@@ -0,0 +1,76 @@
+package infra
+
+import (
+	"sync"
+	"time"
+)
+
+// ProgressOutput renders progress of a long running operation, e.g. on a user's terminal
+type ProgressOutput interface {
+	StepStarted(name string)
+	StepFinished(name string, elapsed time.Duration, err error)
+}
+
+// StepTiming records how long a named step took
+type StepTiming struct {
+	Name     string        `json:"name"`
+	Millis   int64         `json:"ms"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+// ProgressReporter runs named steps, forwards them to an output and records their timings.
+// A nil *ProgressReporter is valid and simply runs the steps, so callers that don't care
+// about progress can pass nil.
+type ProgressReporter struct {
+	output  ProgressOutput
+	mu      sync.Mutex
+	timings []StepTiming
+}
+
+// NewProgressReporter creates a progress reporter writing to output (which may be nil)
+func NewProgressReporter(output ProgressOutput) *ProgressReporter {
+	return &ProgressReporter{output: output}
+}
+
+// Step runs fn as a named step and reports its start, end and elapsed time
+func (p *ProgressReporter) Step(name string, fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+
+	if p.output != nil {
+		p.output.StepStarted(name)
+	}
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+	if p.output != nil {
+		p.output.StepFinished(name, elapsed, err)
+	}
+
+	timing := StepTiming{
+		Name:     name,
+		Millis:   elapsed.Milliseconds(),
+		Duration: elapsed,
+	}
+	if err != nil {
+		timing.Error = err.Error()
+	}
+
+	p.mu.Lock()
+	p.timings = append(p.timings, timing)
+	p.mu.Unlock()
+
+	return err
+}
+
+// Timings returns the timings of all steps run so far, in order
+func (p *ProgressReporter) Timings() []StepTiming {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]StepTiming(nil), p.timings...)
+}
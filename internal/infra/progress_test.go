@@ -0,0 +1,60 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recordedOutput records the progress it is given as lines
+type recordedOutput struct{ lines []string }
+
+func (o *recordedOutput) StepStarted(name string) {
+	o.lines = append(o.lines, "start "+name)
+}
+
+func (o *recordedOutput) StepFinished(name string, _ time.Duration, err error) {
+	o.lines = append(o.lines, fmt.Sprintf("finish %s %v", name, err))
+}
+
+func TestProgressReporter(t *testing.T) {
+	output := &recordedOutput{}
+	progress := NewProgressReporter(output)
+	failed := errors.New("disk busy")
+
+	if err := progress.Step("Reserving box", func() error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	if err := progress.Step("Attaching disk", func() error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the step's error", err)
+	}
+
+	want := []string{"start Reserving box", "finish Reserving box <nil>", "start Attaching disk", "finish Attaching disk disk busy"}
+	if fmt.Sprint(output.lines) != fmt.Sprint(want) {
+		t.Errorf("got output %q, want %q", output.lines, want)
+	}
+	timings := progress.Timings()
+	if len(timings) != 2 || timings[0].Name != "Reserving box" || timings[1].Name != "Attaching disk" {
+		t.Fatalf("got timings %+v", timings)
+	}
+	if timings[0].Duration < 20*time.Millisecond || timings[0].Millis != timings[0].Duration.Milliseconds() || timings[0].Error != "" {
+		t.Errorf("got timing %+v, want at least 20ms without error", timings[0])
+	}
+	if timings[1].Error != "disk busy" {
+		t.Errorf("got timing %+v, want the error recorded", timings[1])
+	}
+
+	// Callers that don't report progress pass nil
+	var none *ProgressReporter
+	ran := false
+	if err := none.Step("Reserving box", func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("nil reporter: got %v, ran %v", err, ran)
+	}
+	if none.Timings() != nil {
+		t.Errorf("nil reporter has timings")
+	}
+}
@@ -0,0 +1,226 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ComputeProvider creates and deletes the pool instances boxes run on
+type ComputeProvider interface {
+	// CreateInstance creates a running instance and returns its instanceID
+	CreateInstance(ctx context.Context, config *VMConfig) (string, error)
+	DeleteInstance(ctx context.Context, instanceID string) error
+	GetInstancePrivateIP(ctx context.Context, instanceID string) (string, error)
+}
+
+// VolumeProvider creates the volumes holding box state and attaches them to instances
+type VolumeProvider interface {
+	// CreateVolumeFromSnapshot creates the volume tags.VolumeID from a snapshot
+	CreateVolumeFromSnapshot(ctx context.Context, snapshotID string, tags *VolumeTags) error
+	DeleteVolume(ctx context.Context, volumeID string) error
+	AttachVolume(ctx context.Context, instanceID, volumeID string) error
+	DetachVolume(ctx context.Context, instanceID, volumeID string) error
+}
+
+// SnapshotProvider provides the golden snapshot new instances and volumes are created from
+type SnapshotProvider interface {
+	EnsureGoldenSnapshot(ctx context.Context) (*GoldenSnapshotInfo, error)
+}
+
+// NetworkProvider sets up the network and storage infrastructure boxes run in
+type NetworkProvider interface {
+	EnsureNetwork(ctx context.Context) error
+}
+
+// InventoryProvider is the authoritative record of pool resources and who they belong to
+type InventoryProvider interface {
+	ResourceQueries
+	RegisterResource(ctx context.Context, entry *ResourceRegistryEntity) error
+	UnregisterResource(ctx context.Context, role, resourceID string) error
+	UpdateInstanceStatus(ctx context.Context, instanceID, status string) error
+	UpdateInstanceStatusAndUser(ctx context.Context, instanceID, status, userID string) error
+	UpdateVolumeStatusUserAndBox(ctx context.Context, volumeID, status, userID, boxName string) error
+	UpdateVolumeRuntime(ctx context.Context, volumeID, runtime string) error
+	// Reconcile fixes drift between the inventory and the actual resources
+	Reconcile(ctx context.Context) error
+}
+
+// AllocationStore persists allocation state for crash recovery
+type AllocationStore interface {
+	WriteAllocation(ctx context.Context, allocation *AllocationEntity) error
+	ListActiveAllocations(ctx context.Context) ([]AllocationEntity, error)
+}
+
+// EventStore records the event log
+type EventStore interface {
+	WriteEvent(ctx context.Context, event *EventLogEntity) error
+}
+
+// BoxRuntime boots and stops a user's box on an instance that has the box's volume attached
+type BoxRuntime interface {
+	// StartBox boots the box from volumeID on the instance, reporting each step to progress (which may be nil)
+	StartBox(ctx context.Context, instanceIP, volumeID string, progress *ProgressReporter) error
+	StopBox(ctx context.Context, instanceIP string) error
+}
+
+// BoxChecker is implemented by box runtimes that can tell whether a box is still running
+type BoxChecker interface {
+	// BoxRunning reports whether the box on instanceIP is running
+	BoxRunning(ctx context.Context, instanceIP string) (bool, error)
+}
+
+// LiveMigrator is implemented by box runtimes that can move a running box to another instance
+type LiveMigrator interface {
+	// MigrateBox moves the box running on sourceIP to targetIP, which has a fresh volume from
+	// the golden snapshot attached, reporting each step to progress (which may be nil). The
+	// box keeps running on sourceIP if the move fails.
+	MigrateBox(ctx context.Context, sourceIP, targetIP string, progress *ProgressReporter) error
+}
+
+// CheckpointRuntime is implemented by box runtimes that can checkpoint a running box and
+// resume it from a checkpoint after it was not shut down cleanly
+type CheckpointRuntime interface {
+	// Checkpoint saves the state of the box running on instanceIP to its volume, keeping
+	// the newest keep checkpoints
+	Checkpoint(ctx context.Context, instanceIP string, keep int) (*Checkpoint, error)
+	// RecoverableCheckpoint returns the checkpoint the box on the volume attached to
+	// instanceIP can resume from, or nil if it was shut down cleanly or has none
+	RecoverableCheckpoint(ctx context.Context, instanceIP string) (*Checkpoint, error)
+	// ResumeCheckpoint starts the box on instanceIP from checkpoint instead of StartBox
+	ResumeCheckpoint(ctx context.Context, instanceIP string, checkpoint *Checkpoint, progress *ProgressReporter) error
+}
+
+// SupervisedRuntime is implemented by box runtimes whose boxes BoxSupervisor can watch
+type SupervisedRuntime interface {
+	// WatchBox watches the box running on instanceIP, passing incidents it survives to
+	// report, until ctx is done or the box was stopped (nil) or went down (the incident)
+	WatchBox(ctx context.Context, instanceIP string, report func(BoxIncident)) (*BoxIncident, error)
+	// ConsoleTail returns the last lines of the box's console output
+	ConsoleTail(ctx context.Context, instanceIP string, lines int) (string, error)
+	// RestartPolicy returns the restart policy of the box on instanceIP, one of the Restart* constants
+	RestartPolicy(ctx context.Context, instanceIP string) (string, error)
+	SetRestartPolicy(ctx context.Context, instanceIP, policy string) error
+}
+
+// MemoryCompactor is implemented by box runtimes that can hand a box's free memory back to the host
+type MemoryCompactor interface {
+	// CompactMemory frees what memory the box on instanceIP can spare and returns the
+	// disk space that reclaimed, in bytes
+	CompactMemory(ctx context.Context, instanceIP string) (int64, error)
+}
+
+// PortExposer is implemented by box runtimes that can forward a port of the instance to the box
+type PortExposer interface {
+	// ExposePort forwards TCP port of the instance to guestPort of the box on instanceIP
+	// until the box stops
+	ExposePort(ctx context.Context, instanceIP string, port, guestPort int) error
+}
+
+// EgressRuntime is implemented by box runtimes that can limit where a box connects to
+type EgressRuntime interface {
+	// EgressPolicy returns the egress policy of the box on instanceIP
+	EgressPolicy(ctx context.Context, instanceIP string) (*EgressPolicy, error)
+	// SetEgressPolicy records policy for the box on instanceIP and enforces it right away
+	SetEgressPolicy(ctx context.Context, instanceIP string, policy *EgressPolicy) error
+	// EgressDenied returns what the box's policy denied since it was applied
+	EgressDenied(ctx context.Context, instanceIP string) (*EgressDenied, error)
+}
+
+// MetricsRuntime is implemented by box runtimes whose resource usage BoxMetricsCollector can sample
+type MetricsRuntime interface {
+	// CollectMetrics samples the resource usage of the box running on instanceIP
+	CollectMetrics(ctx context.Context, instanceIP string) (*BoxSample, error)
+}
+
+// CheckpointChooser decides whether a box that was not shut down cleanly resumes from
+// checkpoint or starts afresh
+type CheckpointChooser func(ctx context.Context, checkpoint *Checkpoint) bool
+
+// Provider bundles the backends BoxPool, ResourceAllocator and the SSH server run on.
+// NewAzureProvider runs them on Azure, NewAWSProvider on EC2, LocalHost.Provider on the
+// server's own host and MemoryCloud.Provider in memory.
+type Provider struct {
+	Compute     ComputeProvider
+	Volumes     VolumeProvider
+	Snapshots   SnapshotProvider
+	Network     NetworkProvider
+	Inventory   InventoryProvider
+	Allocations AllocationStore
+	Claims      ClaimStore
+	Events      EventStore
+	Runtime     BoxRuntime // runs BoxRuntimeVM boxes
+	BridgedVMs  BoxRuntime // runs BoxRuntimeBridgedVM boxes, nil if the backend can't
+	Containers  BoxRuntime // runs BoxRuntimeContainer boxes, nil if the backend can't
+}
+
+// ErrUnsupportedRuntime is returned for box runtimes the provider has no BoxRuntime for
+var ErrUnsupportedRuntime = errors.New("box runtime not supported")
+
+// RuntimeFor returns the BoxRuntime running boxes of the given runtime; empty means BoxRuntimeVM
+func (p *Provider) RuntimeFor(runtime string) (BoxRuntime, error) {
+	switch runtime {
+	case "", BoxRuntimeVM:
+		return p.Runtime, nil
+	case BoxRuntimeBridgedVM:
+		if p.BridgedVMs != nil {
+			return p.BridgedVMs, nil
+		}
+	case BoxRuntimeContainer:
+		if p.Containers != nil {
+			return p.Containers, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedRuntime, runtime)
+}
+
+var (
+	_ ComputeProvider   = (*AzureProvider)(nil)
+	_ VolumeProvider    = (*AzureProvider)(nil)
+	_ SnapshotProvider  = (*AzureProvider)(nil)
+	_ NetworkProvider   = (*AzureProvider)(nil)
+	_ InventoryProvider = (*AzureProvider)(nil)
+	_ AllocationStore   = (*AzureProvider)(nil)
+	_ EventStore        = (*AzureProvider)(nil)
+	_ BoxRuntime        = (*QEMUManager)(nil)
+	_ BoxChecker        = (*QEMUManager)(nil)
+	_ LiveMigrator      = (*QEMUManager)(nil)
+	_ CheckpointRuntime = (*QEMUManager)(nil)
+	_ SupervisedRuntime = (*QEMUManager)(nil)
+	_ MetricsRuntime    = (*QEMUManager)(nil)
+	_ MemoryCompactor   = (*QEMUManager)(nil)
+	_ EgressRuntime     = (*QEMUManager)(nil)
+	_ PortExposer       = (*QEMUManager)(nil)
+
+	_ ComputeProvider   = (*AWSProvider)(nil)
+	_ VolumeProvider    = (*AWSProvider)(nil)
+	_ SnapshotProvider  = (*AWSProvider)(nil)
+	_ NetworkProvider   = (*AWSProvider)(nil)
+	_ InventoryProvider = (*AWSProvider)(nil)
+	_ AllocationStore   = (*AWSProvider)(nil)
+	_ EventStore        = (*AWSProvider)(nil)
+
+	_ ComputeProvider   = (*MemoryCloud)(nil)
+	_ VolumeProvider    = (*MemoryCloud)(nil)
+	_ SnapshotProvider  = (*MemoryCloud)(nil)
+	_ NetworkProvider   = (*MemoryCloud)(nil)
+	_ InventoryProvider = (*MemoryCloud)(nil)
+	_ AllocationStore   = (*MemoryCloud)(nil)
+	_ EventStore        = (*MemoryCloud)(nil)
+	_ BoxRuntime        = (*MemoryCloud)(nil)
+	_ BoxChecker        = (*MemoryCloud)(nil)
+	_ PortExposer       = (*MemoryCloud)(nil)
+
+	_ ComputeProvider   = (*LocalHost)(nil)
+	_ VolumeProvider    = (*LocalHost)(nil)
+	_ SnapshotProvider  = (*LocalHost)(nil)
+	_ NetworkProvider   = (*LocalHost)(nil)
+	_ InventoryProvider = (*LocalHost)(nil)
+	_ AllocationStore   = (*LocalHost)(nil)
+	_ EventStore        = (*LocalHost)(nil)
+	_ BoxRuntime        = (*LocalHost)(nil)
+	_ BoxChecker        = (*LocalHost)(nil)
+
+	_ BoxRuntime = (*ContainerManager)(nil)
+	_ BoxChecker = (*ContainerManager)(nil)
+)
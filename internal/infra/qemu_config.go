@@ -0,0 +1,277 @@
+package infra
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// QEMUConfigPath is where the golden build records the QEMU configuration on the volume,
+// next to the saved state it belongs to
+const QEMUConfigPath = "/mnt/userdata/qemu-memory/qemu-config.json"
+
+// QEMUConfig is the QEMU launch configuration of a box VM. Saved state only restores into
+// the machine it was saved from, so the golden build records its configuration on the
+// volume and resume launches from that record instead of rebuilding it.
+type QEMUConfig struct {
+	Machine   string        `json:"machine"` // machine type, e.g. "pc"
+	Accel     string        `json:"accel"`
+	CPUModel  string        `json:"cpuModel"` // -cpu argument, e.g. "host,+kvmclock"
+	CPUs      int           `json:"cpus"`
+	MemoryMB  int           `json:"memoryMB"`
+	Memory    MemoryBackend `json:"memory"`
+	RTC       string        `json:"rtc"`
+	Drives    []QEMUDrive   `json:"drives"`
+	Netdevs   []QEMUNetdev  `json:"netdevs"`
+	Chardevs  []QEMUChardev `json:"chardevs"`
+	RNG       bool          `json:"rng"`               // virtio-rng fed from the host's /dev/urandom
+	PVPanic   bool          `json:"pvpanic,omitempty"` // lets the guest report kernel panics as GUEST_PANICKED
+	Balloon   bool          `json:"balloon,omitempty"` // virtio-balloon with free-page reporting, see CompactMemory
+	SerialLog string        `json:"serialLog"`
+	QMPSocket string        `json:"qmpSocket"`
+
+	// EventsSocket is a second QMP monitor that BoxSupervisor stays connected to, leaving
+	// QMPSocket free. Monitors aren't part of the saved state, so it is set at launch.
+	EventsSocket string `json:"-"`
+}
+
+// MemoryBackend is the file guest RAM lives in, shared so saved state can skip it
+type MemoryBackend struct {
+	Path     string `json:"path"`
+	Share    bool   `json:"share"`
+	Prealloc bool   `json:"prealloc"` // touch every page at launch; doesn't affect saved state
+}
+
+// QEMUDrive is a disk or CD-ROM image
+type QEMUDrive struct {
+	File      string `json:"file"`
+	Format    string `json:"format,omitempty"`    // e.g. "qcow2"; unset for CD-ROMs
+	Interface string `json:"interface,omitempty"` // e.g. "virtio"
+	Media     string `json:"media,omitempty"`     // "cdrom" for CD-ROMs
+}
+
+// QEMUNetdev is a network backend with the virtio NIC on top of it
+type QEMUNetdev struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`    // e.g. "user"
+	Options string `json:"options"` // backend options after type and id, e.g. "hostfwd=tcp::2222-:22"
+}
+
+// QEMUChardev is a unix socket chardev behind a virtio serial port, e.g. for the guest agent
+type QEMUChardev struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Port string `json:"port"` // virtio serial port name the guest sees
+}
+
+// boxQEMUConfig is the configuration box VMs are built and resumed with, for a volume
+// mounted at workingDir and the guest's SSH forwarded to sshPort
+func boxQEMUConfig(workingDir string, sshPort int) QEMUConfig {
+	return QEMUConfig{
+		Machine:  "pc",
+		Accel:    "kvm",
+		CPUModel: "host,+kvmclock,+kvm-asyncpf",
+		CPUs:     8,
+		MemoryMB: 24 * 1024,
+		Memory: MemoryBackend{
+			Path:     workingDir + "/qemu-memory/ubuntu-mem",
+			Share:    true,
+			Prealloc: false, // would fill the holes free-page reporting punches
+		},
+		RTC: "base=utc,driftfix=slew",
+		Drives: []QEMUDrive{
+			{File: workingDir + "/qemu-disks/ubuntu-base.qcow2", Format: "qcow2", Interface: "virtio"},
+			{File: workingDir + "/qemu-disks/cloud-init.iso", Media: "cdrom"},
+		},
+		Netdevs: []QEMUNetdev{
+			{ID: "net0", Type: "user", Options: fmt.Sprintf("hostfwd=tcp::%d-:22,dns=8.8.8.8", sshPort)},
+		},
+		Chardevs: []QEMUChardev{
+			{ID: "qga0", Path: QEMUGuestAgentSocket, Port: "org.qemu.guest_agent.0"},
+		},
+		RNG:       true,
+		PVPanic:   true,
+		Balloon:   true,
+		SerialLog: workingDir + "/qemu-serial.log",
+		QMPSocket: QEMUMonitorSocket,
+	}
+}
+
+// legacyQEMUConfig is the configuration boxes were resumed with before the golden build
+// recorded one. Volumes from those builds have no record, and their state only restores
+// into this exact machine, so it is frozen rather than derived from boxQEMUConfig.
+func legacyQEMUConfig() QEMUConfig {
+	return QEMUConfig{
+		Machine:  "pc",
+		Accel:    "kvm",
+		CPUModel: "host,+kvmclock,+kvm-asyncpf",
+		CPUs:     8,
+		MemoryMB: 24 * 1024,
+		Memory:   MemoryBackend{Path: QEMUMemoryPath, Share: true},
+		RTC:      "base=utc,driftfix=slew",
+		Drives: []QEMUDrive{
+			{File: QEMUBaseDiskPath, Format: "qcow2", Interface: "virtio"},
+			{File: QEMUCloudInitPath, Media: "cdrom"},
+		},
+		Netdevs: []QEMUNetdev{
+			{ID: "net0", Type: "user", Options: "hostfwd=tcp::2222-:22,dns=8.8.8.8"},
+		},
+		Chardevs: []QEMUChardev{
+			{ID: "qga0", Path: QEMUGuestAgentSocket, Port: "org.qemu.guest_agent.0"},
+		},
+		RNG:       true,
+		SerialLog: "/mnt/userdata/qemu-serial.log",
+		QMPSocket: QEMUMonitorSocket,
+	}
+}
+
+// Args renders the qemu-system-x86_64 arguments
+func (c *QEMUConfig) Args() []string {
+	memory := strconv.Itoa(c.MemoryMB) + "M"
+	if c.MemoryMB%1024 == 0 {
+		memory = strconv.Itoa(c.MemoryMB/1024) + "G"
+	}
+	args := []string{
+		"-machine", fmt.Sprintf("%s,accel=%s,memory-backend=mem", c.Machine, c.Accel),
+		"-cpu", c.CPUModel,
+		"-m", memory,
+		"-object", fmt.Sprintf("memory-backend-file,id=mem,size=%s,mem-path=%s,share=%s,prealloc=%s",
+			memory, c.Memory.Path, onOff(c.Memory.Share), onOff(c.Memory.Prealloc)),
+		"-smp", strconv.Itoa(c.CPUs),
+		"-rtc", c.RTC,
+	}
+
+	for _, drive := range c.Drives {
+		if drive.Media == "cdrom" {
+			args = append(args, "-cdrom", drive.File)
+			continue
+		}
+		spec := "file=" + drive.File
+		if drive.Format != "" {
+			spec += ",format=" + drive.Format
+		}
+		if drive.Interface != "" {
+			spec += ",if=" + drive.Interface
+		}
+		args = append(args, "-drive", spec)
+	}
+
+	if c.RNG {
+		args = append(args,
+			"-device", "virtio-rng-pci,rng=rng0",
+			"-object", "rng-random,id=rng0,filename=/dev/urandom")
+	}
+
+	for _, netdev := range c.Netdevs {
+		spec := netdev.Type + ",id=" + netdev.ID
+		if netdev.Options != "" {
+			spec += "," + netdev.Options
+		}
+		args = append(args,
+			"-device", "virtio-net-pci,netdev="+netdev.ID,
+			"-netdev", spec)
+	}
+
+	if c.PVPanic {
+		args = append(args, "-device", "pvpanic")
+	}
+
+	// QEMU discards the guest's free pages as it reports them, punching holes in the
+	// shared memory file
+	if c.Balloon {
+		args = append(args, "-device", "virtio-balloon-pci,id=balloon0,free-page-reporting=on")
+	}
+
+	if len(c.Chardevs) > 0 {
+		args = append(args, "-device", "virtio-serial")
+	}
+	for _, chardev := range c.Chardevs {
+		args = append(args,
+			"-device", fmt.Sprintf("virtserialport,chardev=%s,name=%s", chardev.ID, chardev.Port),
+			"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=%s", chardev.Path, chardev.ID))
+	}
+
+	args = append(args,
+		"-nographic",
+		"-serial", "file:"+c.SerialLog,
+		"-qmp", "unix:"+c.QMPSocket+",server=on,wait=off")
+	if c.EventsSocket != "" {
+		args = append(args, "-qmp", "unix:"+c.EventsSocket+",server=on,wait=off")
+	}
+	return append(args, "-monitor", "none")
+}
+
+// DiskDrives returns the writable drives, in the order DiskDevices names them
+func (c *QEMUConfig) DiskDrives() []QEMUDrive {
+	var drives []QEMUDrive
+	for _, drive := range c.Drives {
+		if drive.Media != "cdrom" {
+			drives = append(drives, drive)
+		}
+	}
+	return drives
+}
+
+// DiskDevices returns the QEMU device names of the writable drives. QEMU names drives
+// without an explicit id after their interface and index, e.g. "virtio0".
+func (c *QEMUConfig) DiskDevices() []string {
+	var devices []string
+	index := make(map[string]int)
+	for _, drive := range c.DiskDrives() {
+		iface := cmp.Or(drive.Interface, "ide")
+		devices = append(devices, fmt.Sprintf("%s%d", iface, index[iface]))
+		index[iface]++
+	}
+	return devices
+}
+
+// CommandLine renders the full QEMU command, quoted for a POSIX shell
+func (c *QEMUConfig) CommandLine() string {
+	return shellJoin(append([]string{"qemu-system-x86_64"}, c.Args()...))
+}
+
+// Marshal renders the configuration as recorded on the volume. Field order is fixed, so
+// equal configurations render identically, which golden snapshot names rely on.
+func (c *QEMUConfig) Marshal() []byte {
+	data, _ := json.Marshal(c) // plain strings, numbers and bools always marshal
+	return data
+}
+
+// parseQEMUConfig reads a configuration recorded by the golden build
+func parseQEMUConfig(data []byte) (*QEMUConfig, error) {
+	var config QEMUConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse QEMU config: %w", err)
+	}
+	if config.Machine == "" || config.MemoryMB == 0 || config.Memory.Path == "" {
+		return nil, fmt.Errorf("incomplete QEMU config")
+	}
+	return &config, nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// shellJoin quotes args for a POSIX shell where they aren't plainly safe
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+,.:/@%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = shellQuote(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,107 @@
+package infra
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestQEMUConfigRoundTrip(t *testing.T) {
+	config := boxQEMUConfig("/mnt/userdata", BoxSSHPort)
+	config.Memory.Prealloc = true
+	parsed, err := parseQEMUConfig(config.Marshal())
+	if err != nil {
+		t.Fatalf("parseQEMUConfig: %v", err)
+	}
+	if !reflect.DeepEqual(*parsed, config) {
+		t.Fatalf("got %+v back, want %+v", *parsed, config)
+	}
+	if got, want := parsed.Args(), config.Args(); !slices.Equal(got, want) {
+		t.Fatalf("parsed config renders\n  %q\nwant\n  %q", got, want)
+	}
+	if got := string(parsed.Marshal()); got != string(config.Marshal()) {
+		t.Fatalf("parsed config marshals to %s, want %s", got, config.Marshal())
+	}
+
+	// The events monitor is chosen at launch and never recorded
+	config.EventsSocket = QEMUEventsSocket
+	if parsed, _ := parseQEMUConfig(config.Marshal()); parsed.EventsSocket != "" {
+		t.Fatalf("events socket %s recorded", parsed.EventsSocket)
+	}
+
+	for _, data := range []string{`{`, `{}`, `{"machine":"pc","memoryMB":1024}`} {
+		if _, err := parseQEMUConfig([]byte(data)); err == nil {
+			t.Errorf("parseQEMUConfig accepted %s", data)
+		}
+	}
+}
+
+// TestBoxQEMUConfigArgs pins the command line new boxes are built with. State saved with
+// it only restores into the same machine, so any change here needs a new golden snapshot.
+func TestBoxQEMUConfigArgs(t *testing.T) {
+	want := []string{
+		"-machine", "pc,accel=kvm,memory-backend=mem",
+		"-cpu", "host,+kvmclock,+kvm-asyncpf",
+		"-m", "24G",
+		"-object", "memory-backend-file,id=mem,size=24G,mem-path=/mnt/userdata/qemu-memory/ubuntu-mem,share=on,prealloc=off",
+		"-smp", "8",
+		"-rtc", "base=utc,driftfix=slew",
+		"-drive", "file=/mnt/userdata/qemu-disks/ubuntu-base.qcow2,format=qcow2,if=virtio",
+		"-cdrom", "/mnt/userdata/qemu-disks/cloud-init.iso",
+		"-device", "virtio-rng-pci,rng=rng0",
+		"-object", "rng-random,id=rng0,filename=/dev/urandom",
+		"-device", "virtio-net-pci,netdev=net0",
+		"-netdev", "user,id=net0,hostfwd=tcp::2222-:22,dns=8.8.8.8",
+		"-device", "pvpanic",
+		"-device", "virtio-balloon-pci,id=balloon0,free-page-reporting=on",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		"-chardev", "socket,path=/tmp/qga.sock,server=on,wait=off,id=qga0",
+		"-nographic",
+		"-serial", "file:/mnt/userdata/qemu-serial.log",
+		"-qmp", "unix:/tmp/qemu-monitor.sock,server=on,wait=off",
+		"-monitor", "none",
+	}
+	config := boxQEMUConfig("/mnt/userdata", BoxSSHPort)
+	if got := config.Args(); !slices.Equal(got, want) {
+		t.Fatalf("box config renders\n  %q\nwant\n  %q", got, want)
+	}
+
+	// Resume adds the supervisor's monitor after the recorded one
+	config.EventsSocket = QEMUEventsSocket
+	args := config.Args()
+	if got := args[len(args)-4:]; !slices.Equal(got, []string{"-qmp", "unix:/tmp/qemu-events.sock,server=on,wait=off", "-monitor", "none"}) {
+		t.Fatalf("got %q at the end, want the events monitor", got)
+	}
+}
+
+func TestLegacyQEMUConfigMatchesBaseline(t *testing.T) {
+	// The command line boxes were resumed with before the golden build recorded its
+	// configuration. Only the QMP monitor options use the spelling newer QEMU wants, and
+	// monitors aren't part of the saved state.
+	want := []string{
+		"-machine", "pc,accel=kvm,memory-backend=mem",
+		"-cpu", "host,+kvmclock,+kvm-asyncpf",
+		"-m", "24G",
+		"-object", "memory-backend-file,id=mem,size=24G,mem-path=/mnt/userdata/qemu-memory/ubuntu-mem,share=on,prealloc=off",
+		"-smp", "8",
+		"-rtc", "base=utc,driftfix=slew",
+		"-drive", "file=/mnt/userdata/qemu-disks/ubuntu-base.qcow2,format=qcow2,if=virtio",
+		"-cdrom", "/mnt/userdata/qemu-disks/cloud-init.iso",
+		"-device", "virtio-rng-pci,rng=rng0",
+		"-object", "rng-random,id=rng0,filename=/dev/urandom",
+		"-device", "virtio-net-pci,netdev=net0",
+		"-netdev", "user,id=net0,hostfwd=tcp::2222-:22,dns=8.8.8.8",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		"-chardev", "socket,path=/tmp/qga.sock,server=on,wait=off,id=qga0",
+		"-nographic",
+		"-serial", "file:/mnt/userdata/qemu-serial.log",
+		"-qmp", "unix:/tmp/qemu-monitor.sock,server=on,wait=off",
+		"-monitor", "none",
+	}
+	config := legacyQEMUConfig()
+	if got := config.Args(); !slices.Equal(got, want) {
+		t.Fatalf("legacy config renders\n  %q\nwant\n  %q", got, want)
+	}
+}
@@ -2,41 +2,44 @@ package infra
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"shellbox/internal/qga"
+	"shellbox/internal/qmp"
 	"shellbox/internal/sshutil"
 	"strings"
 	"time"
 )
 
+// qemuPIDCommand prints the PID of the instance's QEMU and fails if it isn't running.
+// pgrep -x matches the process name, which the kernel cuts to 15 characters; pgrep -f
+// would also match the shell running the command, whose command line names QEMU too.
+const qemuPIDCommand = "pgrep -x qemu-system-x86"
+
+// qemuKillCommand kills the instance's QEMU without letting it clean up
+const qemuKillCommand = "pkill -KILL -x qemu-system-x86"
+
 // QEMUManager handles QEMU VM operations on instances
 type QEMUManager struct {
-	clients *AzureClients
+	dataDisk string // path the instances see the volume at
+	network  string // QEMUNetworkUser or QEMUNetworkTap
 }
 
-// NewQEMUManager creates a new QEMU manager
-func NewQEMUManager(clients *AzureClients) *QEMUManager {
+// NewQEMUManager creates a new QEMU manager for instances that see volumes at dataDisk.Path,
+// running boxes in network mode, one of the QEMUNetwork* constants
+func NewQEMUManager(dataDisk DataDiskLayout, network string) *QEMUManager {
 	return &QEMUManager{
-		clients: clients,
+		dataDisk: dataDisk.Path,
+		network:  network,
 	}
 }
 
-// StartQEMUWithVolume starts QEMU VM with the attached volume using memory-mapped file persistence
-func (qm *QEMUManager) StartQEMUWithVolume(ctx context.Context, instanceIP, _ string) error {
-	// Wait for volume to be available and then start QEMU
-	startCmd := `
-# Wait for data disk to be available
-while [ ! -e /dev/disk/azure/scsi1/lun0 ]; do
-    echo "Waiting for data disk..."
-    sleep 2
-done
-
-# Mount data disk if not already mounted
-if ! mountpoint -q /mnt/userdata; then
-    sudo mkdir -p /mnt/userdata
-    sudo mount /dev/disk/azure/scsi1/lun0 /mnt/userdata
-fi
-
+// StartBox implements BoxRuntime: it starts the QEMU VM with the attached volume using
+// memory-mapped file persistence. Each step is reported to progress, which may be nil.
+func (qm *QEMUManager) StartBox(ctx context.Context, instanceIP, _ string, progress *ProgressReporter) error {
+	// Wait for volume to be available and check it holds saved state
+	prepareCmd := qm.mountVolumeScript() + `
 # Change to working directory
 cd /mnt/userdata
 
@@ -73,43 +76,125 @@ if ! file ` + QEMUStatePath + ` | grep -q "QEMU"; then
         exit 1
     fi
 fi
+`
+
+	slog.Info("Starting QEMU with volume", "instanceIP", instanceIP)
+	err := progress.Step("Starting QEMU", func() error {
+		output, err := sshutil.ExecuteCommandWithOutput(ctx, prepareCmd, AdminUsername, instanceIP)
+		if err != nil {
+			slog.Error("Volume is not ready for QEMU", "error", err, "output", output)
+			return err
+		}
+
+		config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+		if err != nil {
+			return err
+		}
+		output, err = sshutil.ExecuteCommandWithOutput(ctx, qm.qemuResumeScript(config), AdminUsername, instanceIP)
+		if err != nil {
+			slog.Error("Failed to start QEMU", "error", err, "output", output)
+			return err
+		}
+		slog.Info("QEMU start command completed", "output", output)
+
+		// Before the VM runs, so it never runs unrestricted
+		return qm.applyStoredEgressPolicy(ctx, instanceIP)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start QEMU: %w", err)
+	}
+
+	err = progress.Step("Restoring VM state", func() error {
+		return withQMP(ctx, instanceIP, func(client *qmp.Client) error {
+			return restoreVMState(ctx, client, QEMUStatePath, boxMigrationCapabilities)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore VM state: %w", err)
+	}
+
+	// Use guest agent to refresh network configuration
+	err = progress.Step("Refreshing guest network", func() error {
+		return qm.refreshGuestNetwork(ctx, instanceIP)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := markBoxRunning(ctx, instanceIP); err != nil {
+		return err
+	}
+
+	// Skip SSH connectivity test - the actual user connection will handle retries
+	// This eliminates redundant SSH testing and saves ~4-5 seconds
+	slog.Info("QEMU started, ready for user connection",
+		"instanceIP", instanceIP)
+	return nil
+}
+
+// mountVolumeScript waits for the attached volume and mounts it at /mnt/userdata
+func (qm *QEMUManager) mountVolumeScript() string {
+	return `
+# Wait for data disk to be available
+while [ ! -e ` + qm.dataDisk + ` ]; do
+    echo "Waiting for data disk..."
+    sleep 2
+done
+
+# Mount data disk if not already mounted
+if ! mountpoint -q /mnt/userdata; then
+    sudo mkdir -p /mnt/userdata
+    sudo mount ` + qm.dataDisk + ` /mnt/userdata
+fi
+`
+}
 
+// loadVolumeQEMUConfig reads the QEMU configuration recorded on the volume mounted on
+// instanceIP. Volumes from golden snapshots that predate the record get the legacy one.
+func loadVolumeQEMUConfig(ctx context.Context, instanceIP string) (*QEMUConfig, error) {
+	result, err := sshutil.Run(ctx, "cat "+QEMUConfigPath, AdminUsername, instanceIP)
+	if err != nil {
+		if result != nil && result.ExitCode > 0 {
+			slog.Warn("Volume has no recorded QEMU config, using the legacy one", "instanceIP", instanceIP)
+			config := legacyQEMUConfig()
+			return &config, nil
+		}
+		return nil, fmt.Errorf("failed to read QEMU config: %w", err)
+	}
+	return parseQEMUConfig([]byte(result.Stdout))
+}
+
+// qemuResumeScript starts QEMU from config paused and waiting for incoming state, and waits
+// for its QMP socket. Restored RAM lives in the backend file, so it isn't preallocated.
+// The events monitor is added for BoxSupervisor. In tap mode the network is set up and
+// the box moved onto it; otherwise what a previous box left of one is removed.
+func (qm *QEMUManager) qemuResumeScript(config *QEMUConfig) string {
+	resume := *config
+	resume.Memory.Prealloc = false
+	resume.EventsSocket = QEMUEventsSocket
+	networkSetup := boxTapNetwork.teardownScript()
+	if qm.network == QEMUNetworkTap {
+		resume = boxTapNetwork.withTapNetwork(resume)
+		networkSetup = boxTapNetwork.hostScript()
+	}
+	qemuCmd := resume.CommandLine() + " -S -incoming defer > /mnt/userdata/qemu.log 2>&1 < /dev/null &"
+
+	return networkSetup + `
 # Start QEMU VM with memory-mapped file and load saved state
 echo "Starting QEMU with saved state..."
-sudo sh -c 'nohup qemu-system-x86_64 \
-   -machine pc,accel=kvm,memory-backend=mem \
-   -cpu host,+kvmclock,+kvm-asyncpf \
-   -m 24G \
-   -object memory-backend-file,id=mem,size=24G,mem-path=` + QEMUMemoryPath + `,share=on,prealloc=off \
-   -smp 8 \
-   -rtc base=utc,driftfix=slew \
-   -drive file=` + QEMUBaseDiskPath + `,format=qcow2,if=virtio \
-   -cdrom ` + QEMUCloudInitPath + ` \
-   -device virtio-rng-pci,rng=rng0 \
-   -object rng-random,id=rng0,filename=/dev/urandom \
-   -device virtio-net-pci,netdev=net0 \
-   -netdev user,id=net0,hostfwd=tcp::2222-:22,dns=8.8.8.8 \
-   -device virtio-serial \
-   -device virtserialport,chardev=qga0,name=org.qemu.guest_agent.0 \
-   -chardev socket,path=` + QEMUGuestAgentSocket + `,server=on,wait=off,id=qga0 \
-   -nographic \
-   -serial file:/mnt/userdata/qemu-serial.log \
-   -qmp unix:` + QEMUMonitorSocket + `,server,nowait \
-   -monitor none \
-   -incoming defer > /mnt/userdata/qemu.log 2>&1 < /dev/null &'
+sudo sh -c ` + shellQuote("nohup "+qemuCmd) + `
 
 # Brief sleep to ensure process starts
 sleep 2
 
 # Check if QEMU started and capture status
-if pgrep -f qemu-system-x86_64 > /dev/null; then
-    QEMU_PID=$(pgrep -f qemu-system-x86_64)
+if QEMU_PID=$(` + qemuPIDCommand + ` -o); then
     echo "SUCCESS: QEMU started with PID: $QEMU_PID"
     
     # Wait for QMP socket to be created
     echo "Waiting for QMP socket..."
     SOCKET_WAIT=0
-    while [ ! -S ` + QEMUMonitorSocket + ` ]; do
+    while [ ! -S ` + shellQuote(resume.QMPSocket) + ` ]; do
         if [ $SOCKET_WAIT -ge 10 ]; then
             echo "ERROR: QMP socket not created after 10 seconds"
             exit 1
@@ -119,25 +204,6 @@ if pgrep -f qemu-system-x86_64 > /dev/null; then
         SOCKET_WAIT=$((SOCKET_WAIT + 1))
     done
     echo "QMP socket is ready"
-    
-    # Initialize QMP and load the saved state
-    echo "Initializing QMP and loading saved state..."
-    (
-    echo '{"execute":"qmp_capabilities"}'
-    sleep 0.5
-    # Set migration capabilities to match the source
-    echo '{"execute":"migrate-set-capabilities", "arguments":{"capabilities":[{"capability": "xbzrle", "state": false}, {"capability": "x-ignore-shared", "state": true}, {"capability": "auto-converge", "state": false}, {"capability": "postcopy-ram", "state": false}]}}'
-    sleep 0.5
-    echo '{"execute":"migrate-incoming", "arguments":{"uri":"exec:cat ` + QEMUStatePath + `"}}'
-    ) | sudo socat - UNIX-CONNECT:` + QEMUMonitorSocket + `
-    
-    # Check if the migration command succeeded
-    if [ ${PIPESTATUS[1]} -ne 0 ]; then
-        echo "ERROR: Failed to execute migration command via QMP"
-        exit 1
-    fi
-    
-    # Migration is synchronous - when the command returns, it's complete
 else
     echo "ERROR: Failed to start QEMU"
     # Check if log file exists and show any errors
@@ -150,136 +216,179 @@ else
     exit 1
 fi
 `
+}
 
-	slog.Info("Starting QEMU with volume", "instanceIP", instanceIP)
-	output, err := sshutil.ExecuteCommandWithOutput(ctx, startCmd, AdminUsername, instanceIP)
-	if err != nil {
-		slog.Error("Failed to start QEMU", "error", err, "output", output)
-		return fmt.Errorf("failed to start QEMU: %w", err)
-	}
-	slog.Info("QEMU start command completed", "output", output)
+// restoreVMState loads the state in stateFile into a QEMU started with -incoming defer, waits
+// for the incoming migration to complete and resumes the VM. capabilities must match the ones
+// the state was saved with.
+func restoreVMState(ctx context.Context, client *qmp.Client, stateFile string, capabilities []qmp.MigrationCapability) error {
+	events, unsubscribe := client.Subscribe(16)
+	defer unsubscribe()
 
-	// Migration is synchronous - it's already complete if the command succeeded
-	slog.Info("Incoming migration completed (synchronous operation)")
+	if err := client.MigrateSetCapabilities(ctx, capabilities...); err != nil {
+		return err
+	}
+	if err := client.MigrateIncoming(ctx, "exec:cat "+stateFile); err != nil {
+		return err
+	}
+	if err := qmp.WaitForMigration(ctx, events); err != nil {
+		return err
+	}
+	slog.Info("Incoming migration completed")
 
-	// Resume the VM after migration completes
-	resumeCmd := `(echo '{"execute":"qmp_capabilities"}'; sleep 0.1; echo '{"execute":"cont"}') | sudo socat - UNIX-CONNECT:` + QEMUMonitorSocket + ` || true`
-	if _, err := sshutil.ExecuteCommandWithOutput(ctx, resumeCmd, AdminUsername, instanceIP); err != nil {
-		slog.Warn("Failed to resume VM", "error", err)
+	if err := client.Cont(ctx); err != nil {
+		return fmt.Errorf("failed to resume VM: %w", err)
 	}
 	slog.Info("VM resumed after migration")
+	return nil
+}
 
-	// Use guest agent to refresh network configuration
-	slog.Info("Using guest agent to refresh network configuration")
-
+// refreshGuestNetwork releases and renews the guest's DHCP lease through the guest agent,
+// since the restored VM still holds the lease from when its state was saved.
+// Failures are only logged; the returned error is set only when ctx is done.
+// In tap mode the guest gets its static address instead, which it can't do without.
+func (qm *QEMUManager) refreshGuestNetwork(ctx context.Context, instanceIP string) error {
 	// Give VM a moment to stabilize after resume
-	time.Sleep(300 * time.Millisecond)
+	if err := sleepWithContext(ctx, 300*time.Millisecond); err != nil {
+		return err
+	}
+	if qm.network == QEMUNetworkTap {
+		return qm.configureGuestTapNetwork(ctx, instanceIP)
+	}
 
-	// Release DHCP lease
-	slog.Info("Releasing DHCP lease")
-	if err := qm.SendGuestExecCommand(ctx, instanceIP, "/sbin/dhclient", []string{"-r", "eth0"}); err != nil {
-		// Fallback to alternative path if /sbin/dhclient doesn't exist
-		if err := qm.SendGuestExecCommand(ctx, instanceIP, "/usr/sbin/dhclient", []string{"-r", "eth0"}); err != nil {
+	slog.Info("Using guest agent to refresh network configuration")
+
+	err := qm.GuestAgent(ctx, instanceIP, func(agent *qga.Client) error {
+		// Release DHCP lease
+		slog.Info("Releasing DHCP lease")
+		if err := runDHClient(ctx, agent, "-r", "eth0"); err != nil {
 			slog.Warn("Failed to release DHCP lease", "error", err)
 		}
-	}
 
-	// Brief pause between release and renew
-	time.Sleep(100 * time.Millisecond)
+		// Brief pause between release and renew
+		if err := sleepWithContext(ctx, 100*time.Millisecond); err != nil {
+			return err
+		}
 
-	// Renew DHCP lease
-	slog.Info("Renewing DHCP lease")
-	if err := qm.SendGuestExecCommand(ctx, instanceIP, "/sbin/dhclient", []string{"eth0"}); err != nil {
-		// Fallback to alternative path if /sbin/dhclient doesn't exist
-		if err := qm.SendGuestExecCommand(ctx, instanceIP, "/usr/sbin/dhclient", []string{"eth0"}); err != nil {
+		// Renew DHCP lease
+		slog.Info("Renewing DHCP lease")
+		if err := runDHClient(ctx, agent, "eth0"); err != nil {
 			slog.Warn("Failed to renew DHCP lease", "error", err)
 		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Failed to refresh network via guest agent", "error", err)
+		return ctx.Err()
 	}
 
 	slog.Info("Network refresh completed via guest agent")
+	return ctx.Err()
+}
 
-	// Skip SSH connectivity test - the actual user connection will handle retries
-	// This eliminates redundant SSH testing and saves ~4-5 seconds
-	slog.Info("QEMU started, ready for user connection",
-		"instanceIP", instanceIP)
-	return nil
+// runDHClient runs dhclient in the guest, falling back to /usr/sbin if /sbin/dhclient doesn't exist
+func runDHClient(ctx context.Context, agent *qga.Client, args ...string) error {
+	err := guestExec(ctx, agent, "/sbin/dhclient", args)
+	if err != nil && ctx.Err() == nil {
+		err = guestExec(ctx, agent, "/usr/sbin/dhclient", args)
+	}
+	return err
 }
 
-// StopQEMU stops the QEMU VM cleanly
-func (qm *QEMUManager) StopQEMU(ctx context.Context, instanceIP string) error {
-	stopCmd := `
-# Quit QEMU cleanly using QMP
-(echo '{"execute":"qmp_capabilities"}'; sleep 0.1; echo '{"execute":"quit"}') | sudo socat - UNIX-CONNECT:/tmp/qemu-monitor.sock || true
+// StopBox implements BoxRuntime by stopping the QEMU VM cleanly. The guest's free memory
+// is handed back first and zeroed pages are punched out of the memory file after, so the
+// volume keeps only the memory the guest still uses.
+func (qm *QEMUManager) StopBox(ctx context.Context, instanceIP string) error {
+	compactCtx, cancelCompact := context.WithTimeout(ctx, memoryCompactionTimeout)
+	if _, err := qm.CompactMemory(compactCtx, instanceIP); err != nil && !errors.Is(err, ErrNoMemoryBalloon) {
+		slog.Warn("Failed to compact guest memory before stopping", "instanceIP", instanceIP, "error", err)
+	}
+	cancelCompact()
 
-# Fallback: kill QEMU if monitor command fails
-sudo pkill qemu-system-x86_64 || true
-`
+	quitCtx, cancel := context.WithTimeout(ctx, QMPCommandTimeout)
+	defer cancel()
+	err := withQMP(quitCtx, instanceIP, func(client *qmp.Client) error {
+		return client.Quit(quitCtx)
+	})
+	if err != nil {
+		slog.Warn("Failed to quit QEMU over QMP, killing it", "instanceIP", instanceIP, "error", err)
+		if err := sshutil.ExecuteCommand(ctx, "sudo pkill -x qemu-system-x86 || true", AdminUsername, instanceIP); err != nil {
+			slog.Warn("Error stopping QEMU (expected during shutdown)", "instanceIP", instanceIP, "error", err)
+			// Don't return error - stopping QEMU often causes connection issues
+		}
+	}
+
+	if err := digMemoryHoles(ctx, instanceIP); err != nil {
+		slog.Warn("Failed to shrink memory file", "instanceIP", instanceIP, "error", err)
+	}
+
+	if err := applyEgressPolicy(ctx, instanceIP, &EgressPolicy{Mode: EgressAllowAll}); err != nil {
+		slog.Warn("Failed to remove egress rules", "instanceIP", instanceIP, "error", err)
+	}
+	if qm.network == QEMUNetworkTap {
+		if err := sshutil.ExecuteCommand(ctx, boxTapNetwork.teardownScript(), AdminUsername, instanceIP); err != nil {
+			slog.Warn("Failed to remove tap network", "instanceIP", instanceIP, "error", err)
+		}
+	}
 
-	if err := sshutil.ExecuteCommand(ctx, stopCmd, AdminUsername, instanceIP); err != nil {
-		slog.Warn("Error stopping QEMU (expected during shutdown)", "instanceIP", instanceIP, "error", err)
-		// Don't return error - stopping QEMU often causes connection issues
+	// The box was shut down cleanly, so it has no checkpoint to resume from
+	if err := sshutil.ExecuteCommand(ctx, "sudo rm -f "+QEMURunMarkerPath, AdminUsername, instanceIP); err != nil {
+		slog.Warn("Failed to remove run marker", "instanceIP", instanceIP, "error", err)
 	}
 
 	slog.Info("QEMU stopped", "instanceIP", instanceIP)
 	return nil
 }
 
-// SendGuestExecCommand executes a command inside the guest VM using QEMU Guest Agent
-func (qm *QEMUManager) SendGuestExecCommand(ctx context.Context, instanceIP, command string, args []string) error {
-	// Build the guest-exec JSON command
-	argsJSON := ""
-	if len(args) > 0 {
-		quotedArgs := make([]string, len(args))
-		for i, arg := range args {
-			quotedArgs[i] = fmt.Sprintf("%q", arg)
-		}
-		argsJSON = fmt.Sprintf(`, "arg": [%s]`, strings.Join(quotedArgs, ", "))
+// BoxRunning implements BoxChecker by looking for the QEMU process on the instance
+func (qm *QEMUManager) BoxRunning(ctx context.Context, instanceIP string) (bool, error) {
+	output, err := sshutil.ExecuteCommandWithOutput(ctx, qemuPIDCommand+" > /dev/null && echo running || true", AdminUsername, instanceIP)
+	if err != nil {
+		return false, fmt.Errorf("failed to look for QEMU: %w", err)
 	}
+	return strings.TrimSpace(output) == "running", nil
+}
 
-	guestExecCmd := fmt.Sprintf(`
-# Wait for guest agent socket to be available
-SOCKET_WAIT=0
-while [ ! -S %s ]; do
-    if [ $SOCKET_WAIT -ge 5 ]; then
-        echo "ERROR: Guest agent socket not available after 5 seconds"
-        exit 1
-    fi
-    sleep 1
-    SOCKET_WAIT=$((SOCKET_WAIT + 1))
-done
-
-# Execute command via guest agent
-EXEC_RESULT=$(echo '{"execute":"guest-exec", "arguments":{"path":"%s"%s, "capture-output":true}}' | sudo socat - UNIX-CONNECT:%s 2>&1)
-
-# Extract PID from result
-PID=$(echo "$EXEC_RESULT" | grep -o '"pid":[0-9]*' | cut -d: -f2)
+// GuestAgent connects to the QEMU guest agent of the box on instanceIP and runs fn with it
+func (qm *QEMUManager) GuestAgent(ctx context.Context, instanceIP string, fn func(*qga.Client) error) error {
+	sshClient, release, err := sshutil.Acquire(ctx, AdminUsername, instanceIP)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", instanceIP, err)
+	}
+	defer release()
 
-if [ -z "$PID" ]; then
-    echo "ERROR: Failed to execute command via guest agent"
-    echo "Result: $EXEC_RESULT"
-    exit 1
-fi
+	if err := takeOverSocket(sshClient, QEMUGuestAgentSocket); err != nil {
+		return err
+	}
+	agent, err := qga.Dial(ctx, sshClient, QEMUGuestAgentSocket)
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
 
-# Wait for command to complete and get status
-sleep 0.5
-STATUS_RESULT=$(echo '{"execute":"guest-exec-status", "arguments":{"pid":'$PID'}}' | sudo socat - UNIX-CONNECT:%s 2>&1)
+	return fn(agent)
+}
 
-# Check if command succeeded
-if echo "$STATUS_RESULT" | grep -q '"exitcode":0'; then
-    echo "Command executed successfully"
-else
-    echo "ERROR: Command failed"
-    echo "Status: $STATUS_RESULT"
-    exit 1
-fi
-`, QEMUGuestAgentSocket, command, argsJSON, QEMUGuestAgentSocket, QEMUGuestAgentSocket)
+// SendGuestExecCommand executes a command inside the guest VM using QEMU Guest Agent and
+// waits for it to exit successfully
+func (qm *QEMUManager) SendGuestExecCommand(ctx context.Context, instanceIP, command string, args []string) error {
+	return qm.GuestAgent(ctx, instanceIP, func(agent *qga.Client) error {
+		return guestExec(ctx, agent, command, args)
+	})
+}
 
-	output, err := sshutil.ExecuteCommandWithOutput(ctx, guestExecCmd, AdminUsername, instanceIP)
+// guestExec runs command in the guest, failing unless it exits with status 0
+func guestExec(ctx context.Context, agent *qga.Client, command string, args []string) error {
+	result, err := agent.Exec(ctx, qga.ExecRequest{Path: command, Args: args})
 	if err != nil {
-		slog.Error("Failed to execute guest command", "command", command, "args", args, "error", err, "output", output)
 		return fmt.Errorf("failed to execute guest command %s: %w", command, err)
 	}
+	if result.ExitCode != 0 || result.Signal != 0 {
+		slog.Error("Guest command failed", "command", command, "args", args,
+			"exitCode", result.ExitCode, "signal", result.Signal, "stderr", string(result.Stderr))
+		return fmt.Errorf("guest command %s exited with code %d", command, result.ExitCode)
+	}
 
-	slog.Info("Guest command executed", "command", command, "args", args, "output", output)
+	slog.Info("Guest command executed", "command", command, "args", args, "stdout", string(result.Stdout))
 	return nil
 }
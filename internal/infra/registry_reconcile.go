@@ -0,0 +1,118 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ReconcileResult summarizes the drift one reconciliation pass found and fixed
+type ReconcileResult struct {
+	Added        int // resources found in Azure but missing from the registry
+	Removed      int // registry entries whose resource no longer exists
+	StatusDrifts int // resources whose tags disagree with the registry (the registry wins)
+}
+
+// ReconcileRegistry compares the resource registry with what Resource Graph sees in Azure.
+// Resources missing from the registry are added from their tags, and entries whose resource
+// is gone are removed once they are old enough to rule out Resource Graph lag. Status
+// differences are only reported: the registry is authoritative and tags lag behind it.
+func ReconcileRegistry(ctx context.Context, clients *AzureClients, graph *ResourceGraphQueries) (*ReconcileResult, error) {
+	result := &ReconcileResult{}
+
+	instances, err := graph.GetAllInstances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances in resource graph: %w", err)
+	}
+	if err := reconcileRole(ctx, clients, ResourceRoleInstance, instances, result); err != nil {
+		return nil, err
+	}
+
+	volumes, err := graph.GetAllVolumes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes in resource graph: %w", err)
+	}
+	if err := reconcileRole(ctx, clients, ResourceRoleVolume, volumes, result); err != nil {
+		return nil, err
+	}
+
+	slog.Info("resource registry reconciled", "added", result.Added, "removed", result.Removed, "statusDrifts", result.StatusDrifts)
+	return result, nil
+}
+
+func reconcileRole(ctx context.Context, clients *AzureClients, role string, actual []ResourceInfo, result *ReconcileResult) error {
+	entries, err := ListResourceRegistry(ctx, clients, role, "")
+	if err != nil {
+		return fmt.Errorf("failed to list %s registry entries: %w", role, err)
+	}
+
+	registered := make(map[string]*ResourceRegistryEntity, len(entries))
+	for i := range entries {
+		registered[entries[i].RowKey] = &entries[i]
+	}
+
+	seen := make(map[string]bool, len(actual))
+	for i := range actual {
+		resource := &actual[i]
+		if resource.ResourceID == "" {
+			continue
+		}
+		seen[resource.ResourceID] = true
+
+		entry, ok := registered[resource.ResourceID]
+		if !ok {
+			slog.Warn("registry drift: resource missing from registry", "role", role, "resourceID", resource.ResourceID, "status", resource.Status)
+			if err := WriteResourceRegistry(ctx, clients, registryEntryFromTags(role, resource)); err != nil {
+				slog.Warn("Failed to add resource to registry", "role", role, "resourceID", resource.ResourceID, "error", err)
+				continue
+			}
+			result.Added++
+			continue
+		}
+
+		if entry.Status != resource.Status {
+			slog.Info("registry drift: tag status differs from registry", "role", role, "resourceID", resource.ResourceID, "registryStatus", entry.Status, "tagStatus", resource.Status)
+			result.StatusDrifts++
+		}
+	}
+
+	for id, entry := range registered {
+		if seen[id] || time.Since(entry.CreatedAt) < RegistryOrphanGracePeriod {
+			continue
+		}
+		slog.Warn("registry drift: resource no longer exists", "role", role, "resourceID", id, "status", entry.Status)
+		if err := DeleteResourceRegistry(ctx, clients, role, id); err != nil {
+			slog.Warn("Failed to remove orphaned registry entry", "role", role, "resourceID", id, "error", err)
+			continue
+		}
+		result.Removed++
+	}
+	return nil
+}
+
+// registryEntryFromTags builds a registry entry for a resource from its Azure tags
+func registryEntryFromTags(role string, resource *ResourceInfo) *ResourceRegistryEntity {
+	now := time.Now().UTC()
+	entry := &ResourceRegistryEntity{
+		PartitionKey: role,
+		RowKey:       resource.ResourceID,
+		Timestamp:    now,
+		Status:       resource.Status,
+		UserID:       resource.Tags[TagKeyUserID],
+		BoxName:      resource.Tags[TagKeyBoxName],
+		Runtime:      resource.Tags[TagKeyRuntime],
+		CreatedAt:    now,
+		LastActivity: now,
+	}
+	if role == ResourceRoleInstance {
+		entry.VMName = resource.Name
+	}
+	if resource.CreatedAt != nil {
+		entry.CreatedAt = *resource.CreatedAt
+	}
+	if resource.LastUsed != nil {
+		entry.LastActivity = *resource.LastUsed
+	}
+	return entry
+}
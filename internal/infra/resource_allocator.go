@@ -1,10 +1,21 @@
 package infra
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Capacity errors returned when the pool has nothing to hand out. Callers can wait
+// for capacity with an AllocationQueue instead of failing.
+var (
+	ErrNoFreeInstances = errors.New("no free running instances available")
+	ErrNoFreeVolumes   = errors.New("no free volumes available")
 )
 
 // AllocatedResources represents resources allocated to a user session
@@ -12,28 +23,66 @@ type AllocatedResources struct {
 	InstanceID string
 	VolumeID   string
 	InstanceIP string
+	Runtime    string // box runtime, one of the BoxRuntime* constants
 }
 
 // ResourceAllocator manages dynamic allocation of instances and volumes
 type ResourceAllocator struct {
-	clients         *AzureClients
-	resourceQueries *ResourceGraphQueries
-	qemuManager     *QEMUManager
+	provider *Provider
+	owner    string // identifies this server process on persisted allocations
+
+	mu               sync.Mutex
+	releaseListeners []func(instanceID string)
 }
 
 // NewResourceAllocator creates a new resource allocator
-func NewResourceAllocator(clients *AzureClients, resourceQueries *ResourceGraphQueries) *ResourceAllocator {
+func NewResourceAllocator(provider *Provider) *ResourceAllocator {
 	return &ResourceAllocator{
-		clients:         clients,
-		resourceQueries: resourceQueries,
-		qemuManager:     NewQEMUManager(clients),
+		provider: provider,
+		owner:    newAllocationOwner(),
 	}
 }
 
-// AllocateResourcesForUser finds an existing volume for a user and box, then allocates a new instance for it
-func (ra *ResourceAllocator) AllocateResourcesForUser(ctx context.Context, userID, boxName string) (*AllocatedResources, error) {
+// OnRelease registers fn to be called with the instance of every allocation this process
+// releases, before its box is stopped
+func (ra *ResourceAllocator) OnRelease(fn func(instanceID string)) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.releaseListeners = append(ra.releaseListeners, fn)
+}
+
+// resourceIDs returns the resource IDs of resources, in order
+func resourceIDs(resources []ResourceInfo) []string {
+	ids := make([]string, len(resources))
+	for i, resource := range resources {
+		ids[i] = resource.ResourceID
+	}
+	return ids
+}
+
+// AllocateResourcesForUser finds an existing volume for a user and box, then allocates a new instance for it,
+// unless the box already runs.
+// Each step is reported to progress, which may be nil. If the box was not shut down cleanly,
+// choose decides whether it resumes from its latest checkpoint; a nil choose always starts it afresh.
+func (ra *ResourceAllocator) AllocateResourcesForUser(ctx context.Context, userID, boxName string, progress *ProgressReporter, choose CheckpointChooser) (*AllocatedResources, error) {
+	// A box that already runs, e.g. one RecoverAllocations took over after a restart, is
+	// connected to where it runs
+	running, err := ra.findBoxAllocation(ctx, userID, boxName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up running box: %w", err)
+	}
+	if running != nil {
+		slog.Info("connecting to running box", "allocationID", running.RowKey, "instanceID", running.InstanceID, "userID", userID, "boxName", boxName)
+		return &AllocatedResources{
+			InstanceID: running.InstanceID,
+			VolumeID:   running.VolumeID,
+			InstanceIP: running.InstanceIP,
+			Runtime:    cmp.Or(running.Runtime, BoxRuntimeVM),
+		}, nil
+	}
+
 	// Find existing volume by userID and boxName
-	existingVolumes, err := ra.resourceQueries.GetVolumesByUserAndBox(ctx, userID, boxName)
+	existingVolumes, err := ra.provider.Inventory.GetVolumesByUserAndBox(ctx, userID, boxName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query existing volumes: %w", err)
 	}
@@ -42,130 +91,261 @@ func (ra *ResourceAllocator) AllocateResourcesForUser(ctx context.Context, userI
 	}
 	volume := existingVolumes[0]
 
+	allocation := newAllocation(ra.owner, userID, boxName, "", volume.ResourceID)
+	allocation.Runtime = volume.Tags[TagKeyRuntime]
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := ra.claimAndRunAllocation(ctx, allocation, func(ctx context.Context, instanceIP string) error {
+		if checkpoint := chooseCheckpoint(ctx, runtime, instanceIP, choose); checkpoint != nil {
+			return runtime.(CheckpointRuntime).ResumeCheckpoint(ctx, instanceIP, checkpoint, progress)
+		}
+		return runtime.StartBox(ctx, instanceIP, allocation.VolumeID, progress)
+	}, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("existing resources allocated", "allocationID", allocation.RowKey, "instanceID", allocation.InstanceID, "volumeID", volume.ResourceID, "userID", userID, "boxName", boxName)
+	return resources, nil
+}
+
+// chooseCheckpoint returns the checkpoint the box on instanceIP resumes from, or nil if it
+// starts afresh because runtime can't resume checkpoints, there is none, or choose declined
+func chooseCheckpoint(ctx context.Context, runtime BoxRuntime, instanceIP string, choose CheckpointChooser) *Checkpoint {
+	checkpointer, ok := runtime.(CheckpointRuntime)
+	if !ok || choose == nil {
+		return nil
+	}
+	checkpoint, err := checkpointer.RecoverableCheckpoint(ctx, instanceIP)
+	if err != nil {
+		slog.Warn("Failed to look for a checkpoint, starting box afresh", "instanceIP", instanceIP, "error", err)
+		return nil
+	}
+	if checkpoint == nil {
+		return nil
+	}
+	if !choose(ctx, checkpoint) {
+		slog.Info("Checkpoint declined, starting box afresh", "instanceIP", instanceIP, "checkpoint", checkpoint.ID)
+		return nil
+	}
+	return checkpoint
+}
+
+// claimAndRunAllocation claims a free running instance for the allocation and runs the
+// allocation steps on it, booting the box with boot. A failed or cancelled allocation is
+// rolled back.
+func (ra *ResourceAllocator) claimAndRunAllocation(ctx context.Context, allocation *AllocationEntity, boot func(ctx context.Context, instanceIP string) error, progress *ProgressReporter) (*AllocatedResources, error) {
 	// Find available running instance
-	freeInstances, err := ra.resourceQueries.GetRunningInstancesByStatus(ctx, ResourceStatusFree)
+	freeInstances, err := ra.provider.Inventory.GetRunningInstancesByStatus(ctx, ResourceStatusFree)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query free running instances: %w", err)
 	}
 	if len(freeInstances) == 0 {
-		return nil, fmt.Errorf("no free running instances available")
+		return nil, ErrNoFreeInstances
+	}
+
+	// Resource Graph may still list instances a concurrent allocation just took, so the
+	// instance is claimed first; exactly one claimer wins and the others try the next one
+	i, err := ClaimFirst(ctx, ra.provider.Claims, resourceIDs(freeInstances), allocation.RowKey, DefaultClaimTTL)
+	if err != nil {
+		if errors.Is(err, ErrAlreadyClaimed) {
+			return nil, ErrNoFreeInstances
+		}
+		return nil, fmt.Errorf("failed to claim instance: %w", err)
+	}
+	allocation.InstanceID = freeInstances[i].ResourceID
+
+	// Everything from here on changes state in Azure or on the instance, and is tracked
+	// as a persisted allocation so a crashed server can be recovered from. If a step fails,
+	// or ctx is cancelled because the user went away, the steps done so far are undone.
+	resources, err := ra.runAllocationSteps(ctx, allocation, boot, progress)
+	if err != nil {
+		ra.abortAllocation(ctx, allocation, err)
+		if ctx.Err() != nil {
+			slog.Info("allocation cancelled", "instanceID", allocation.InstanceID, "volumeID", allocation.VolumeID, "userID", allocation.UserID, "boxName", allocation.BoxName)
+			return nil, fmt.Errorf("allocation cancelled: %w", ctx.Err())
+		}
+		return nil, err
+	}
+	return resources, nil
+}
+
+// runAllocationSteps marks the resources as in use, attaches the volume and boots the box
+// with boot, advancing the allocation state as it goes and stopping at the first failed
+// step or as soon as ctx is cancelled
+func (ra *ResourceAllocator) runAllocationSteps(ctx context.Context, allocation *AllocationEntity, boot func(ctx context.Context, instanceIP string) error, progress *ProgressReporter) (*AllocatedResources, error) {
+	if err := ra.transition(ctx, allocation, AllocationStateReserved); err != nil {
+		return nil, err
 	}
-	instance := freeInstances[0]
 
 	// Mark instance as connected and set userID
-	if err := UpdateInstanceStatusAndUser(ctx, ra.clients, instance.ResourceID, ResourceStatusConnected, userID); err != nil {
+	err := progress.Step("Reserving instance", func() error {
+		return ra.provider.Inventory.UpdateInstanceStatusAndUser(ctx, allocation.InstanceID, ResourceStatusConnected, allocation.UserID)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to mark instance as connected: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// Mark volume as attached and set userID and boxName
-	if err := UpdateVolumeStatusUserAndBox(ctx, ra.clients, volume.ResourceID, ResourceStatusAttached, userID, boxName); err != nil {
-		ra.rollbackInstanceStatus(ctx, instance.ResourceID)
+	err = progress.Step("Reserving volume", func() error {
+		return ra.provider.Inventory.UpdateVolumeStatusUserAndBox(ctx, allocation.VolumeID, ResourceStatusAttached, allocation.UserID, allocation.BoxName)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to mark volume as attached: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// Attach volume to instance
-	if err := AttachVolumeToInstance(ctx, ra.clients, instance.ResourceID, volume.ResourceID); err != nil {
-		ra.rollbackAllocation(ctx, instance.ResourceID, volume.ResourceID)
+	// Attach volume to instance. Once the attach request was sent the disk may end up
+	// attached even if we don't see the result, which the attaching state accounts for.
+	if err := ra.transition(ctx, allocation, AllocationStateAttaching); err != nil {
+		return nil, err
+	}
+	err = progress.Step("Attaching disk", func() error {
+		return ra.provider.Volumes.AttachVolume(ctx, allocation.InstanceID, allocation.VolumeID)
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to attach volume to instance: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// Get instance IP and start QEMU
-	instanceIP, err := ra.getInstanceIPAndStartQEMU(ctx, &instance, &volume)
+	// Get instance IP and boot the box
+	err = progress.Step("Looking up instance address", func() error {
+		var err error
+		allocation.InstanceIP, err = ra.provider.Compute.GetInstancePrivateIP(ctx, allocation.InstanceID)
+		return err
+	})
 	if err != nil {
-		ra.rollbackAllocation(ctx, instance.ResourceID, volume.ResourceID)
+		return nil, fmt.Errorf("failed to get instance IP: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	slog.Info("existing resources allocated", "instanceID", instance.ResourceID, "volumeID", volume.ResourceID, "userID", userID, "boxName", boxName)
+	if err := ra.transition(ctx, allocation, AllocationStateBooting); err != nil {
+		return nil, err
+	}
+	if err := boot(ctx, allocation.InstanceIP); err != nil {
+		return nil, fmt.Errorf("failed to start box: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := ra.transition(ctx, allocation, AllocationStateConnected); err != nil {
+		return nil, err
+	}
 
 	return &AllocatedResources{
-		InstanceID: instance.ResourceID,
-		VolumeID:   volume.ResourceID,
-		InstanceIP: instanceIP,
+		InstanceID: allocation.InstanceID,
+		VolumeID:   allocation.VolumeID,
+		InstanceIP: allocation.InstanceIP,
+		Runtime:    cmp.Or(allocation.Runtime, BoxRuntimeVM),
 	}, nil
 }
 
-// ReserveVolumeForUser reserves a free volume for a user with a specific box name
-func (ra *ResourceAllocator) ReserveVolumeForUser(ctx context.Context, userID, boxName string) (string, error) {
+// abortAllocation releases a partially completed allocation. It runs on a context detached
+// from ctx's cancellation, since the usual reason for aborting is that ctx was cancelled.
+func (ra *ResourceAllocator) abortAllocation(ctx context.Context, allocation *AllocationEntity, cause error) {
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), AllocationCleanupTimeout)
+	defer cancel()
+
+	if allocation.State == AllocationStateFree {
+		// Nothing was reserved yet, only the claim has to go
+		if err := ra.provider.Claims.Release(cleanupCtx, allocation.InstanceID, allocation.RowKey); err != nil {
+			slog.Warn("Failed to release instance claim", "instanceID", allocation.InstanceID, "error", err)
+		}
+		return
+	}
+
+	allocation.LastError = cause.Error()
+	if err := ra.releaseAllocation(cleanupCtx, allocation); err != nil {
+		slog.Warn("Failed to roll back allocation", "allocationID", allocation.RowKey, "error", err)
+	}
+}
+
+// ReserveVolumeForUser reserves a free volume for a user with a specific box name. The box
+// will run with runtime, one of the BoxRuntime* constants.
+func (ra *ResourceAllocator) ReserveVolumeForUser(ctx context.Context, userID, boxName, runtime string) (string, error) {
+	if _, err := ra.provider.RuntimeFor(runtime); err != nil {
+		return "", err
+	}
+	if runtime == BoxRuntimeVM {
+		// VM boxes are recorded without a runtime, like the ones created before there was a choice
+		runtime = ""
+	}
+
 	// Find available volume from pool
-	freeVolumes, err := ra.resourceQueries.GetVolumesByStatus(ctx, ResourceStatusFree)
+	freeVolumes, err := ra.provider.Inventory.GetVolumesByStatus(ctx, ResourceStatusFree)
 	if err != nil {
 		return "", fmt.Errorf("failed to query free volumes: %w", err)
 	}
 	if len(freeVolumes) == 0 {
-		return "", fmt.Errorf("no free volumes available - please try again in a few minutes while the system creates more capacity")
+		return "", ErrNoFreeVolumes
 	}
-	volume := freeVolumes[0]
 
-	// Mark volume as attached and set userID and boxName (reserved for user)
-	if err := UpdateVolumeStatusUserAndBox(ctx, ra.clients, volume.ResourceID, ResourceStatusAttached, userID, boxName); err != nil {
-		return "", fmt.Errorf("failed to reserve volume: %w", err)
-	}
-
-	slog.Info("volume reserved", "volumeID", volume.ResourceID, "userID", userID, "boxName", boxName)
-	return volume.ResourceID, nil
-}
-
-// getInstanceIPAndStartQEMU retrieves the instance IP and starts QEMU with the attached volume
-func (ra *ResourceAllocator) getInstanceIPAndStartQEMU(ctx context.Context, instance, volume *ResourceInfo) (string, error) {
-	// Get instance IP
-	instanceIP, err := GetInstancePrivateIP(ctx, ra.clients, instance.ResourceID)
+	claimOwner := uuid.New().String()
+	i, err := ClaimFirst(ctx, ra.provider.Claims, resourceIDs(freeVolumes), claimOwner, DefaultClaimTTL)
 	if err != nil {
-		return "", fmt.Errorf("failed to get instance IP: %w", err)
+		if errors.Is(err, ErrAlreadyClaimed) {
+			return "", ErrNoFreeVolumes
+		}
+		return "", fmt.Errorf("failed to claim volume: %w", err)
 	}
-
-	// Start QEMU with attached volume
-	if err := ra.qemuManager.StartQEMUWithVolume(ctx, instanceIP, volume.ResourceID); err != nil {
-		return "", fmt.Errorf("failed to start QEMU: %w", err)
+	volume := freeVolumes[i]
+	releaseClaim := func() {
+		if releaseErr := ra.provider.Claims.Release(context.WithoutCancel(ctx), volume.ResourceID, claimOwner); releaseErr != nil {
+			slog.Warn("Failed to release volume claim", "volumeID", volume.ResourceID, "error", releaseErr)
+		}
 	}
 
-	return instanceIP, nil
-}
-
-// rollbackInstanceStatus rolls back instance status with error logging
-func (ra *ResourceAllocator) rollbackInstanceStatus(ctx context.Context, instanceID string) {
-	if rollbackErr := UpdateInstanceStatus(ctx, ra.clients, instanceID, ResourceStatusFree); rollbackErr != nil {
-		slog.Warn("Failed to rollback instance status", "error", rollbackErr)
+	// Record the runtime while the volume is still free, so a box never shows up with the
+	// wrong one. A previous reservation that failed halfway may have left a different one.
+	if volume.Tags[TagKeyRuntime] != runtime {
+		if err := ra.provider.Inventory.UpdateVolumeRuntime(ctx, volume.ResourceID, runtime); err != nil {
+			releaseClaim()
+			return "", fmt.Errorf("failed to record box runtime: %w", err)
+		}
 	}
-}
 
-// rollbackAllocation rolls back both instance and volume status
-func (ra *ResourceAllocator) rollbackAllocation(ctx context.Context, instanceID, volumeID string) {
-	ra.rollbackInstanceStatus(ctx, instanceID)
-	if rollbackErr := UpdateVolumeStatus(ctx, ra.clients, volumeID, ResourceStatusFree); rollbackErr != nil {
-		slog.Warn("Failed to rollback volume status", "error", rollbackErr)
+	// Mark volume as attached and set userID and boxName (reserved for user)
+	if err := ra.provider.Inventory.UpdateVolumeStatusUserAndBox(ctx, volume.ResourceID, ResourceStatusAttached, userID, boxName); err != nil {
+		releaseClaim()
+		return "", fmt.Errorf("failed to reserve volume: %w", err)
 	}
+
+	slog.Info("volume reserved", "volumeID", volume.ResourceID, "userID", userID, "boxName", boxName, "runtime", cmp.Or(runtime, BoxRuntimeVM))
+	return volume.ResourceID, nil
 }
 
-// ReleaseResources marks allocated resources as free and stops QEMU
+// ReleaseResources stops the box, detaches the volume and returns the instance to the pool.
+// The volume remains attached to its user and keeps their data.
 func (ra *ResourceAllocator) ReleaseResources(ctx context.Context, instanceID, volumeID string) error {
-	// Get instance IP for QEMU operations
-	instanceIP, err := GetInstancePrivateIP(ctx, ra.clients, instanceID)
+	allocation, err := ra.findActiveAllocation(ctx, instanceID)
 	if err != nil {
-		slog.Warn("Failed to get instance IP for cleanup", "instanceID", instanceID, "error", err)
-	} else {
-		// Stop QEMU (best effort)
-		if err := ra.qemuManager.StopQEMU(ctx, instanceIP); err != nil {
-			slog.Warn("Failed to stop QEMU during cleanup", "instanceIP", instanceIP, "error", err)
-		}
+		slog.Warn("Failed to look up allocation for release", "instanceID", instanceID, "error", err)
 	}
-
-	// Detach volume from instance before marking as free
-	if err := DetachVolumeFromInstance(ctx, ra.clients, instanceID, volumeID); err != nil {
-		slog.Warn("Failed to detach volume during cleanup", "instanceID", instanceID, "volumeID", volumeID, "error", err)
-	}
-
-	// Mark instance as free (volume remains attached to user)
-	var errs []error
-
-	if err := UpdateInstanceStatus(ctx, ra.clients, instanceID, ResourceStatusFree); err != nil {
-		errs = append(errs, fmt.Errorf("failed to free instance: %w", err))
+	if allocation == nil {
+		// Without the record there is no telling which volume to detach
+		if volumeID == "" {
+			return fmt.Errorf("no allocation found for instance %s", instanceID)
+		}
+		// Not tracked (e.g. the record could not be read), release as if fully connected
+		allocation = newAllocation(ra.owner, "", "", instanceID, volumeID)
+		allocation.State = AllocationStateConnected
 	}
 
-	// Note: Volume remains attached to user and keeps their data
-
-	if len(errs) > 0 {
-		return errors.Join(errs...)
+	if err := ra.releaseAllocation(ctx, allocation); err != nil {
+		return err
 	}
 
 	slog.Info("resources released", "instanceID", instanceID, "volumeID", volumeID)
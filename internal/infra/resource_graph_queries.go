@@ -63,6 +63,13 @@ const (
 | where tags['%s'] =~ '%s'
 | where tags['%s'] =~ '%s'
 | where resourceGroup =~ '%s'
+| project name, id, tags, location`
+
+	// Get all resources of a role, for reconciliation
+	queryResourcesByRole = `Resources
+| where type =~ '%s'
+| where tags['%s'] =~ '%s'
+| where resourceGroup =~ '%s'
 | project name, id, tags, location`
 
 	// Get oldest free resources for scale-down
@@ -144,6 +151,28 @@ func (rq *ResourceGraphQueries) GetInstancesByStatus(ctx context.Context, status
 	return rq.executeResourceQuery(ctx, query)
 }
 
+// GetAllInstances returns all pool instances regardless of status
+func (rq *ResourceGraphQueries) GetAllInstances(ctx context.Context) ([]ResourceInfo, error) {
+	query := fmt.Sprintf(queryResourcesByRole,
+		AzureResourceTypeVM,
+		TagKeyRole,
+		ResourceRoleInstance,
+		rq.resourceGroup)
+
+	return rq.executeResourceQuery(ctx, query)
+}
+
+// GetAllVolumes returns all pool volumes regardless of status
+func (rq *ResourceGraphQueries) GetAllVolumes(ctx context.Context) ([]ResourceInfo, error) {
+	query := fmt.Sprintf(queryResourcesByRole,
+		AzureResourceTypeDisk,
+		TagKeyRole,
+		ResourceRoleVolume,
+		rq.resourceGroup)
+
+	return rq.executeResourceQuery(ctx, query)
+}
+
 // GetVolumesByStatus returns volumes with specific status
 func (rq *ResourceGraphQueries) GetVolumesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
 	query := fmt.Sprintf(queryResourcesByStatus,
@@ -2,6 +2,7 @@ package infra
 
 import (
 	"fmt"
+	"strings"
 )
 
 type ResourceNamer struct {
@@ -79,6 +80,31 @@ func (r *ResourceNamer) VolumePoolDiskName(volumeID string) string {
 	return fmt.Sprintf("shellbox-%s-volume-%s", r.suffix, volumeID)
 }
 
+// Kinds of per-box resources, as named by the Box*Name functions
+const (
+	BoxResourceVM       = "vm"
+	BoxResourceNIC      = "nic"
+	BoxResourceNSG      = "nsg"
+	BoxResourceOSDisk   = "os-disk"
+	BoxResourceDataDisk = "data-disk"
+)
+
+// ParseBoxResourceName reverses the Box*Name functions: it returns the box ID and resource kind
+// of a per-box resource name, or ok=false if name doesn't follow the box naming pattern
+func (r *ResourceNamer) ParseBoxResourceName(name string) (boxID, kind string, ok bool) {
+	rest, found := strings.CutPrefix(name, fmt.Sprintf("shellbox-%s-box-", r.suffix))
+	if !found {
+		return "", "", false
+	}
+	// Longest kinds first, "-disk" suffixes would otherwise be ambiguous
+	for _, kind := range []string{BoxResourceDataDisk, BoxResourceOSDisk, BoxResourceVM, BoxResourceNIC, BoxResourceNSG} {
+		if id, found := strings.CutSuffix(rest, "-"+kind); found && id != "" {
+			return id, kind, true
+		}
+	}
+	return "", "", false
+}
+
 // EventLogTableName returns the suffixed table name for EventLog
 func (r *ResourceNamer) EventLogTableName() string {
 	cleanSuffix := r.cleanSuffixForTable()
@@ -91,6 +117,18 @@ func (r *ResourceNamer) ResourceRegistryTableName() string {
 	return fmt.Sprintf("%s%s", tableResourceRegistry, cleanSuffix)
 }
 
+// AllocationsTableName returns the suffixed table name for Allocations
+func (r *ResourceNamer) AllocationsTableName() string {
+	cleanSuffix := r.cleanSuffixForTable()
+	return fmt.Sprintf("%s%s", tableAllocations, cleanSuffix)
+}
+
+// ClaimsTableName returns the suffixed table name for Claims
+func (r *ResourceNamer) ClaimsTableName() string {
+	cleanSuffix := r.cleanSuffixForTable()
+	return fmt.Sprintf("%s%s", tableClaims, cleanSuffix)
+}
+
 // cleanSuffixForTable removes invalid characters from suffix for Azure Table names
 // Table names can only contain alphanumeric characters
 func (r *ResourceNamer) cleanSuffixForTable() string {
@@ -0,0 +1,171 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ResourceQueries answers the inventory questions the pool and the allocator ask about
+// instances and volumes. ResourceRegistry is the authoritative implementation;
+// ResourceGraphQueries sees the same resources through eventually consistent tags and is
+// used to reconcile the registry against what actually exists in Azure.
+type ResourceQueries interface {
+	CountInstancesByStatus(ctx context.Context) (*ResourceCounts, error)
+	CountVolumesByStatus(ctx context.Context) (*ResourceCounts, error)
+	GetVolumesByStatus(ctx context.Context, status string) ([]ResourceInfo, error)
+	GetVolumesByUserAndBox(ctx context.Context, userID, boxName string) ([]ResourceInfo, error)
+	GetOldestFreeVolumes(ctx context.Context, limit int) ([]ResourceInfo, error)
+	GetRunningInstancesByStatus(ctx context.Context, status string) ([]ResourceInfo, error)
+	GetOldestFreeRunningInstances(ctx context.Context, limit int) ([]ResourceInfo, error)
+}
+
+var (
+	_ ResourceQueries = (*ResourceRegistry)(nil)
+	_ ResourceQueries = (*ResourceGraphQueries)(nil)
+)
+
+// ResourceRegistry answers inventory queries from the ResourceRegistry table. Status updates
+// write the registry before anything else, so unlike Resource Graph it reflects them at once.
+type ResourceRegistry struct {
+	clients *AzureClients
+}
+
+// NewResourceRegistry creates a registry-backed ResourceQueries
+func NewResourceRegistry(clients *AzureClients) *ResourceRegistry {
+	return &ResourceRegistry{clients: clients}
+}
+
+// CountInstancesByStatus returns count of instances grouped by status
+func (r *ResourceRegistry) CountInstancesByStatus(ctx context.Context) (*ResourceCounts, error) {
+	return r.count(ctx, ResourceRoleInstance)
+}
+
+// CountVolumesByStatus returns count of volumes grouped by status
+func (r *ResourceRegistry) CountVolumesByStatus(ctx context.Context) (*ResourceCounts, error) {
+	return r.count(ctx, ResourceRoleVolume)
+}
+
+// GetVolumesByStatus returns volumes with specific status
+func (r *ResourceRegistry) GetVolumesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
+	return r.list(ctx, ResourceRoleVolume, fmt.Sprintf("Status eq '%s'", status))
+}
+
+// GetVolumesByUserAndBox returns volumes for a specific user and box name
+func (r *ResourceRegistry) GetVolumesByUserAndBox(ctx context.Context, userID, boxName string) ([]ResourceInfo, error) {
+	filter := fmt.Sprintf("UserID eq '%s' and BoxName eq '%s'", escapeODataString(userID), escapeODataString(boxName))
+	return r.list(ctx, ResourceRoleVolume, filter)
+}
+
+// GetOldestFreeVolumes returns the least recently used free volumes, up to limit
+func (r *ResourceRegistry) GetOldestFreeVolumes(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	return r.oldestFree(ctx, ResourceRoleVolume, limit)
+}
+
+// GetRunningInstancesByStatus returns instances with specific status. Pool instances are
+// created running and deleted rather than stopped, so every registered instance is running.
+func (r *ResourceRegistry) GetRunningInstancesByStatus(ctx context.Context, status string) ([]ResourceInfo, error) {
+	return r.list(ctx, ResourceRoleInstance, fmt.Sprintf("Status eq '%s'", status))
+}
+
+// GetOldestFreeRunningInstances returns the least recently used free instances, up to limit
+func (r *ResourceRegistry) GetOldestFreeRunningInstances(ctx context.Context, limit int) ([]ResourceInfo, error) {
+	return r.oldestFree(ctx, ResourceRoleInstance, limit)
+}
+
+func (r *ResourceRegistry) count(ctx context.Context, role string) (*ResourceCounts, error) {
+	entries, err := ListResourceRegistry(ctx, r.clients, role, "")
+	if err != nil {
+		return nil, err
+	}
+	return countRegistryEntries(entries), nil
+}
+
+func (r *ResourceRegistry) list(ctx context.Context, role, filter string) ([]ResourceInfo, error) {
+	entries, err := ListResourceRegistry(ctx, r.clients, role, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	namer := NewResourceNamer(r.clients.Suffix)
+	resources := make([]ResourceInfo, len(entries))
+	for i := range entries {
+		resources[i] = registryResourceInfo(namer, &entries[i])
+	}
+	return resources, nil
+}
+
+func (r *ResourceRegistry) oldestFree(ctx context.Context, role string, limit int) ([]ResourceInfo, error) {
+	resources, err := r.list(ctx, role, fmt.Sprintf("Status eq '%s'", ResourceStatusFree))
+	if err != nil {
+		return nil, err
+	}
+	return oldestFirst(resources, limit), nil
+}
+
+// countRegistryEntries groups registry entries by status
+func countRegistryEntries(entries []ResourceRegistryEntity) *ResourceCounts {
+	counts := &ResourceCounts{}
+	for i := range entries {
+		switch entries[i].Status {
+		case ResourceStatusFree:
+			counts.Free++
+		case ResourceStatusConnected:
+			counts.Connected++
+		case ResourceStatusAttached:
+			counts.Attached++
+		}
+		counts.Total++
+	}
+	return counts
+}
+
+// oldestFirst sorts resources by last use and returns at most limit of them
+func oldestFirst(resources []ResourceInfo, limit int) []ResourceInfo {
+	slices.SortFunc(resources, func(a, b ResourceInfo) int {
+		return a.LastUsed.Compare(*b.LastUsed)
+	})
+	return resources[:min(limit, len(resources))]
+}
+
+// registryResourceInfo converts a registry entry to the ResourceInfo shape Resource Graph queries return
+func registryResourceInfo(namer *ResourceNamer, entry *ResourceRegistryEntity) ResourceInfo {
+	createdAt := entry.CreatedAt
+	lastUsed := entry.LastActivity
+
+	info := ResourceInfo{
+		Role:       entry.PartitionKey,
+		Status:     entry.Status,
+		ResourceID: entry.RowKey,
+		CreatedAt:  &createdAt,
+		LastUsed:   &lastUsed,
+		Tags: map[string]string{
+			TagKeyRole:   entry.PartitionKey,
+			TagKeyStatus: entry.Status,
+		},
+	}
+	if entry.UserID != "" {
+		info.Tags[TagKeyUserID] = entry.UserID
+	}
+	if entry.BoxName != "" {
+		info.Tags[TagKeyBoxName] = entry.BoxName
+	}
+	if entry.Runtime != "" {
+		info.Tags[TagKeyRuntime] = entry.Runtime
+	}
+
+	if entry.PartitionKey == ResourceRoleInstance {
+		info.Name = namer.BoxVMName(entry.RowKey)
+		info.Tags[TagKeyInstanceID] = entry.RowKey
+	} else {
+		info.Name = namer.VolumePoolDiskName(entry.RowKey)
+		info.Tags[TagKeyVolumeID] = entry.RowKey
+	}
+	return info
+}
+
+// escapeODataString escapes a value for use inside a quoted OData filter string
+func escapeODataString(value string) string {
+	return strings.ReplaceAll(value, "'", "''")
+}
@@ -35,3 +35,16 @@ func RetryOperation(ctx context.Context, operation func(context.Context) error,
 		}
 	}
 }
+
+// sleepWithContext pauses for d, returning early with ctx's error if ctx is done first
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,549 @@
+package infra
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"shellbox/internal/qga"
+	"shellbox/internal/qmp"
+	"shellbox/internal/sshutil"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Restart policies, recorded on the box's volume. They decide what BoxSupervisor does
+// when a box goes down without being stopped.
+const (
+	RestartNever   = "never"    // leave the box down
+	RestartOnCrash = "on-crash" // restart after a panic, hang or QEMU exiting, not after the guest powered off
+	RestartAlways  = "always"   // restart whenever the box goes down
+
+	DefaultRestartPolicy = RestartOnCrash
+)
+
+// Box incident kinds
+const (
+	IncidentPanic      = "panic"       // the guest kernel panicked
+	IncidentHung       = "hung"        // the guest agent stopped answering while the VM ran
+	IncidentExited     = "exited"      // QEMU went away without being stopped
+	IncidentPoweredOff = "powered-off" // the guest shut itself down
+	IncidentReset      = "reset"       // the guest rebooted
+	IncidentIOError    = "io-error"    // a disk reported an I/O error
+)
+
+// Supervisor defaults
+const (
+	SupervisorScanInterval    = 30 * time.Second // how often new connected boxes are picked up
+	SupervisorPingInterval    = 30 * time.Second // how often the guest agent is pinged
+	SupervisorPingTimeout     = 10 * time.Second
+	SupervisorMaxPingFailures = 3 // missed pings in a row before a box counts as hung
+	SupervisorMaxRestarts     = 3 // restarts within SupervisorRestartWindow before giving up
+	SupervisorRestartWindow   = 10 * time.Minute
+	SupervisorConsoleLines    = 50 // serial log lines recorded with a crash
+)
+
+// errNoEventsMonitor is returned by WatchBox for boxes launched without an events monitor
+var errNoEventsMonitor = errors.New("box has no events monitor")
+
+// BoxIncident is something that happened to a running box
+type BoxIncident struct {
+	Kind    string    // one of the Incident* constants
+	Detail  string    // what QEMU or the supervisor reported
+	Fatal   bool      // the box is down
+	At      time.Time // when it happened
+	Healthy time.Time // last time the box was known to be fine
+}
+
+// IsValidRestartPolicy reports whether policy is one of the Restart* constants
+func IsValidRestartPolicy(policy string) bool {
+	return policy == RestartNever || policy == RestartOnCrash || policy == RestartAlways
+}
+
+// WatchBox implements SupervisedRuntime. It listens to the events monitor of the QEMU on
+// instanceIP and pings the guest agent while the VM runs.
+func (qm *QEMUManager) WatchBox(ctx context.Context, instanceIP string, report func(BoxIncident)) (*BoxIncident, error) {
+	sshClient, release, err := sshutil.Acquire(ctx, AdminUsername, instanceIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", instanceIP, err)
+	}
+	defer release()
+
+	healthy := time.Now()
+	check := fmt.Sprintf("%s > /dev/null || exit 3\ntest -S %s || exit 4\nsudo chown %s %s",
+		qemuPIDCommand, QEMUEventsSocket, AdminUsername, QEMUEventsSocket)
+	if _, err := sshutil.RunCommand(sshClient, check); err != nil {
+		var exitErr *ssh.ExitError
+		switch {
+		case errors.As(err, &exitErr) && exitErr.ExitStatus() == 3:
+			return &BoxIncident{Kind: IncidentExited, Detail: "QEMU is not running", Fatal: true, At: healthy, Healthy: healthy}, nil
+		case errors.As(err, &exitErr) && exitErr.ExitStatus() == 4:
+			return nil, errNoEventsMonitor
+		}
+		return nil, fmt.Errorf("failed to take over events monitor: %w", err)
+	}
+
+	client, err := qmp.Dial(ctx, sshClient, QEMUEventsSocket)
+	if err != nil {
+		// Nothing listens on a socket left behind by a QEMU that went away since the check
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.ConnectionFailed {
+			return &BoxIncident{Kind: IncidentExited, Detail: "QEMU is not running", Fatal: true, At: time.Now(), Healthy: healthy}, nil
+		}
+		return nil, err
+	}
+	defer client.Close()
+	events, unsubscribe := client.Subscribe(64)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(SupervisorPingInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case event, ok := <-events:
+			if !ok {
+				// No SHUTDOWN came first, so QEMU was killed or crashed
+				return &BoxIncident{Kind: IncidentExited, Detail: "QEMU exited unexpectedly", Fatal: true, At: time.Now(), Healthy: healthy}, nil
+			}
+			incident, stopped := classifyBoxEvent(&event)
+			if stopped {
+				return nil, nil
+			}
+			if incident == nil {
+				continue
+			}
+			incident.Healthy = healthy
+			if incident.Fatal {
+				return incident, nil
+			}
+			report(*incident)
+		case <-ticker.C:
+			// A VM paused for a checkpoint or migration can't answer
+			status, err := client.QueryStatus(ctx)
+			if err != nil || !status.Running {
+				failures = 0
+				continue
+			}
+			pingCtx, cancel := context.WithTimeout(ctx, SupervisorPingTimeout)
+			err = qm.GuestAgent(pingCtx, instanceIP, func(agent *qga.Client) error {
+				return agent.Ping(pingCtx)
+			})
+			cancel()
+			if err == nil {
+				healthy = time.Now()
+				failures = 0
+				continue
+			}
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			failures++
+			slog.Warn("Guest agent did not answer", "instanceIP", instanceIP, "failures", failures, "error", err)
+			if failures >= SupervisorMaxPingFailures {
+				detail := fmt.Sprintf("guest agent did not answer %d pings: %v", failures, err)
+				return &BoxIncident{Kind: IncidentHung, Detail: detail, Fatal: true, At: time.Now(), Healthy: healthy}, nil
+			}
+		}
+	}
+}
+
+// classifyBoxEvent turns a QMP event into an incident, or reports that the box was stopped
+// by the host, e.g. by StopBox. Other events give neither.
+func classifyBoxEvent(event *qmp.Event) (incident *BoxIncident, stopped bool) {
+	var data struct {
+		Reason    string `json:"reason"`
+		Action    string `json:"action"`
+		Device    string `json:"device"`
+		Operation string `json:"operation"`
+		NoSpace   bool   `json:"nospace"`
+	}
+	_ = json.Unmarshal(event.Data, &data) // events without data leave it empty
+
+	switch event.Name {
+	case "SHUTDOWN":
+		switch data.Reason {
+		case "host-qmp-quit", "host-signal":
+			return nil, true
+		case "guest-shutdown":
+			incident = &BoxIncident{Kind: IncidentPoweredOff, Detail: "the guest powered off", Fatal: true}
+		case "guest-panic":
+			incident = &BoxIncident{Kind: IncidentPanic, Detail: "the guest kernel panicked", Fatal: true}
+		default:
+			incident = &BoxIncident{Kind: IncidentExited, Detail: "QEMU shut down: " + data.Reason, Fatal: true}
+		}
+	case "GUEST_PANICKED":
+		incident = &BoxIncident{Kind: IncidentPanic, Detail: "the guest kernel panicked (action " + data.Action + ")", Fatal: true}
+	case "RESET":
+		incident = &BoxIncident{Kind: IncidentReset, Detail: "the box rebooted: " + data.Reason}
+	case "BLOCK_IO_ERROR":
+		detail := fmt.Sprintf("%s error on %s (action %s)", data.Operation, data.Device, data.Action)
+		if data.NoSpace {
+			detail += ", the host disk is full"
+		}
+		incident = &BoxIncident{Kind: IncidentIOError, Detail: detail}
+	default:
+		return nil, false
+	}
+	incident.At = event.Time()
+	return incident, false
+}
+
+// ConsoleTail implements SupervisedRuntime by reading the end of the box's serial log
+func (qm *QEMUManager) ConsoleTail(ctx context.Context, instanceIP string, lines int) (string, error) {
+	config, err := loadVolumeQEMUConfig(ctx, instanceIP)
+	if err != nil {
+		return "", err
+	}
+	result, err := sshutil.Run(ctx, fmt.Sprintf("sudo tail -n %d %s", lines, shellQuote(config.SerialLog)), AdminUsername, instanceIP)
+	if err != nil {
+		return "", fmt.Errorf("failed to read serial log: %w", err)
+	}
+	return result.Stdout, nil
+}
+
+// RestartPolicy implements SupervisedRuntime by reading the policy recorded on the volume
+func (qm *QEMUManager) RestartPolicy(ctx context.Context, instanceIP string) (string, error) {
+	result, err := sshutil.Run(ctx, "cat "+RestartPolicyPath, AdminUsername, instanceIP)
+	if err != nil {
+		if result != nil && result.ExitCode > 0 {
+			return DefaultRestartPolicy, nil
+		}
+		return "", fmt.Errorf("failed to read restart policy: %w", err)
+	}
+	policy := strings.TrimSpace(result.Stdout)
+	if !IsValidRestartPolicy(policy) {
+		slog.Warn("Invalid restart policy on volume, using the default", "instanceIP", instanceIP, "policy", policy)
+		return DefaultRestartPolicy, nil
+	}
+	return policy, nil
+}
+
+// SetRestartPolicy implements SupervisedRuntime by recording policy on the volume
+func (qm *QEMUManager) SetRestartPolicy(ctx context.Context, instanceIP, policy string) error {
+	if !IsValidRestartPolicy(policy) {
+		return fmt.Errorf("invalid restart policy %q", policy)
+	}
+	if err := sshutil.ExecuteCommand(ctx, fmt.Sprintf("echo %s | sudo tee %s > /dev/null", policy, RestartPolicyPath), AdminUsername, instanceIP); err != nil {
+		return fmt.Errorf("failed to write restart policy: %w", err)
+	}
+	return nil
+}
+
+// BoxIncidentReport is what BoxSupervisor tells its listeners about an incident
+type BoxIncidentReport struct {
+	BoxIncident
+	InstanceID string
+	InstanceIP string
+	UserID     string
+	BoxName    string
+	Policy     string // restart policy that applied, for fatal incidents
+	Restarted  bool   // the box went down and runs again
+	From       string // checkpoint the box was restarted from, empty for a fresh boot
+	Err        error  // why a restart that was due failed
+}
+
+// BoxSupervisor watches the connected boxes whose runtime supports it, records the
+// incidents it notices and restarts boxes that went down according to their restart
+// policy, from their newest checkpoint when there is one
+type BoxSupervisor struct {
+	provider *Provider
+
+	mu        sync.Mutex
+	watching  map[string]context.CancelFunc // by allocation ID, kept after a box is down for good
+	listeners []func(*BoxIncidentReport)
+}
+
+// NewBoxSupervisor creates a supervisor for the boxes allocated on provider
+func NewBoxSupervisor(provider *Provider) *BoxSupervisor {
+	return &BoxSupervisor{
+		provider: provider,
+		watching: make(map[string]context.CancelFunc),
+	}
+}
+
+// OnIncident registers fn to be called for every incident, after any restart. Call it
+// before Run.
+func (s *BoxSupervisor) OnIncident(fn func(*BoxIncidentReport)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Run keeps a watch on every connected box until ctx is done
+func (s *BoxSupervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(SupervisorScanInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.scan(ctx); err != nil {
+			slog.Error("box supervisor scan failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan starts watching newly connected boxes and stops watching released ones
+func (s *BoxSupervisor) scan(ctx context.Context) error {
+	allocations, err := s.provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list active allocations: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	connected := make(map[string]bool)
+	for _, allocation := range allocations {
+		if allocation.State != AllocationStateConnected || allocation.InstanceIP == "" {
+			continue
+		}
+		runtime, err := s.provider.RuntimeFor(allocation.Runtime)
+		if err != nil {
+			continue
+		}
+		supervised, ok := runtime.(SupervisedRuntime)
+		if !ok {
+			continue
+		}
+		connected[allocation.RowKey] = true
+		if _, ok := s.watching[allocation.RowKey]; ok {
+			continue
+		}
+
+		watchCtx, cancel := context.WithCancel(ctx)
+		s.watching[allocation.RowKey] = cancel
+		go s.supervise(watchCtx, allocation, runtime, supervised)
+	}
+
+	for allocationID, cancel := range s.watching {
+		if !connected[allocationID] {
+			cancel()
+			delete(s.watching, allocationID)
+		}
+	}
+	return nil
+}
+
+// supervise watches one box until it is stopped, released, or down for good. A box that is
+// down stays that way until its allocation is released.
+func (s *BoxSupervisor) supervise(ctx context.Context, allocation AllocationEntity, runtime BoxRuntime, supervised SupervisedRuntime) {
+	slog.Info("supervising box", "instanceID", allocation.InstanceID, "boxName", allocation.BoxName)
+	var restarts []time.Time
+	for {
+		incident, err := supervised.WatchBox(ctx, allocation.InstanceIP, func(incident BoxIncident) {
+			s.handleIncident(ctx, &allocation, supervised, &BoxIncidentReport{BoxIncident: incident})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errNoEventsMonitor) {
+			slog.Warn("box can't be supervised, it was started without an events monitor", "instanceID", allocation.InstanceID)
+			return
+		}
+		if err != nil {
+			slog.Warn("lost watch on box, retrying", "instanceID", allocation.InstanceID, "error", err)
+			if sleepWithContext(ctx, SupervisorScanInterval) != nil {
+				return
+			}
+			continue
+		}
+		if incident == nil {
+			slog.Info("box stopped, no longer supervising", "instanceID", allocation.InstanceID)
+			return
+		}
+
+		report := &BoxIncidentReport{BoxIncident: *incident}
+		report.Policy, err = supervised.RestartPolicy(ctx, allocation.InstanceIP)
+		if err != nil {
+			slog.Warn("failed to read restart policy, using the default", "instanceID", allocation.InstanceID, "error", err)
+			report.Policy = DefaultRestartPolicy
+		}
+
+		restarts = slices.DeleteFunc(restarts, func(t time.Time) bool {
+			return time.Since(t) > SupervisorRestartWindow
+		})
+		switch {
+		case !restartWanted(report.Policy, incident):
+		case len(restarts) >= SupervisorMaxRestarts:
+			report.Err = fmt.Errorf("gave up after %d restarts within %s", len(restarts), SupervisorRestartWindow)
+		default:
+			restarts = append(restarts, time.Now())
+			report.From, report.Err = s.restart(ctx, &allocation, runtime, incident)
+			report.Restarted = report.Err == nil
+		}
+		s.handleIncident(ctx, &allocation, supervised, report)
+		if !report.Restarted {
+			return
+		}
+	}
+}
+
+// restartWanted reports whether policy restarts a box after incident
+func restartWanted(policy string, incident *BoxIncident) bool {
+	switch policy {
+	case RestartAlways:
+		return true
+	case RestartOnCrash:
+		return incident.Kind != IncidentPoweredOff
+	}
+	return false
+}
+
+// restart boots a box that went down again, from its newest checkpoint taken while it was
+// still healthy if there is one. It returns the checkpoint's ID, empty for a fresh boot.
+func (s *BoxSupervisor) restart(ctx context.Context, allocation *AllocationEntity, runtime BoxRuntime, incident *BoxIncident) (string, error) {
+	instanceIP := allocation.InstanceIP
+	slog.Info("restarting box", "instanceID", allocation.InstanceID, "incident", incident.Kind)
+
+	// A box that powered itself off asked for a fresh boot. The checkpoint must be looked
+	// up before StopBox, which records the box as shut down cleanly.
+	var checkpoint *Checkpoint
+	checkpointer, ok := runtime.(CheckpointRuntime)
+	if ok && incident.Kind != IncidentPoweredOff {
+		found, err := checkpointer.RecoverableCheckpoint(ctx, instanceIP)
+		switch {
+		case err != nil:
+			slog.Warn("failed to look for a checkpoint, restarting box afresh", "instanceID", allocation.InstanceID, "error", err)
+		case found != nil && found.Created.Before(incident.Healthy):
+			checkpoint = found
+		}
+	}
+
+	if err := runtime.StopBox(ctx, instanceIP); err != nil {
+		return "", fmt.Errorf("failed to stop crashed box: %w", err)
+	}
+	if checkpoint != nil {
+		err := checkpointer.ResumeCheckpoint(ctx, instanceIP, checkpoint, nil)
+		if err == nil {
+			return checkpoint.ID, nil
+		}
+		slog.Warn("failed to resume checkpoint, restarting box afresh", "instanceID", allocation.InstanceID, "checkpoint", checkpoint.ID, "error", err)
+		if err := runtime.StopBox(ctx, instanceIP); err != nil {
+			return "", fmt.Errorf("failed to stop box: %w", err)
+		}
+	}
+	if err := runtime.StartBox(ctx, instanceIP, allocation.VolumeID, nil); err != nil {
+		return "", fmt.Errorf("failed to start box: %w", err)
+	}
+	return "", nil
+}
+
+// handleIncident records an incident and tells the listeners about it
+func (s *BoxSupervisor) handleIncident(ctx context.Context, allocation *AllocationEntity, supervised SupervisedRuntime, report *BoxIncidentReport) {
+	report.InstanceID = allocation.InstanceID
+	report.InstanceIP = allocation.InstanceIP
+	report.UserID = allocation.UserID
+	report.BoxName = allocation.BoxName
+	slog.Warn("box incident", "instanceID", report.InstanceID, "boxName", report.BoxName, "kind", report.Kind, "detail", report.Detail,
+		"fatal", report.Fatal, "policy", report.Policy, "restarted", report.Restarted, "from", report.From, "error", report.Err)
+
+	// Reboots are the guest's own business
+	if report.Kind != IncidentReset {
+		s.recordIncident(ctx, supervised, report)
+	}
+
+	s.mu.Lock()
+	listeners := slices.Clone(s.listeners)
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn(report)
+	}
+}
+
+// recordIncident writes a box_crash event with the end of the box's serial log
+func (s *BoxSupervisor) recordIncident(ctx context.Context, supervised SupervisedRuntime, report *BoxIncidentReport) {
+	console, err := supervised.ConsoleTail(ctx, report.InstanceIP, SupervisorConsoleLines)
+	if err != nil {
+		slog.Warn("Failed to read box console for crash event", "instanceID", report.InstanceID, "error", err)
+	}
+	details := map[string]any{
+		"kind":       report.Kind,
+		"detail":     report.Detail,
+		"fatal":      report.Fatal,
+		"instanceIP": report.InstanceIP,
+		"boxName":    report.BoxName,
+		"console":    console,
+	}
+	if report.Fatal {
+		details["policy"] = report.Policy
+		details["restarted"] = report.Restarted
+		details["from"] = report.From
+		if report.Err != nil {
+			details["error"] = report.Err.Error()
+		}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		slog.Warn("Failed to encode crash event", "error", err)
+		return
+	}
+
+	now := time.Now()
+	crashEvent := EventLogEntity{
+		PartitionKey: now.Format("2006-01-02"),
+		RowKey:       fmt.Sprintf("%s_box_crash_%s", now.Format("20060102T150405"), report.InstanceID),
+		Timestamp:    now,
+		EventType:    EventTypeBoxCrash,
+		UserKey:      report.UserID,
+		BoxID:        report.InstanceID,
+		Details:      string(detailsJSON),
+	}
+	if err := s.provider.Events.WriteEvent(ctx, &crashEvent); err != nil {
+		slog.Warn("Failed to log box crash event", "error", err)
+	}
+}
+
+// ErrBoxNotRunning is returned for operations that need a user's box to be running
+var ErrBoxNotRunning = errors.New("box is not running")
+
+// SetBoxRestartPolicy records the restart policy of a user's running box. The policy is
+// kept on the box's volume, so it sticks across connects.
+func (ra *ResourceAllocator) SetBoxRestartPolicy(ctx context.Context, userID, boxName, policy string) error {
+	allocation, supervised, err := ra.supervisedBox(ctx, userID, boxName)
+	if err != nil {
+		return err
+	}
+	return supervised.SetRestartPolicy(ctx, allocation.InstanceIP, policy)
+}
+
+// BoxRestartPolicy returns the restart policy of a user's running box
+func (ra *ResourceAllocator) BoxRestartPolicy(ctx context.Context, userID, boxName string) (string, error) {
+	allocation, supervised, err := ra.supervisedBox(ctx, userID, boxName)
+	if err != nil {
+		return "", err
+	}
+	return supervised.RestartPolicy(ctx, allocation.InstanceIP)
+}
+
+// supervisedBox returns the allocation of a user's running box and its runtime
+func (ra *ResourceAllocator) supervisedBox(ctx context.Context, userID, boxName string) (*AllocationEntity, SupervisedRuntime, error) {
+	allocation, err := ra.findBoxAllocation(ctx, userID, boxName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find box: %w", err)
+	}
+	if allocation == nil {
+		return nil, nil, ErrBoxNotRunning
+	}
+	runtime, err := ra.provider.RuntimeFor(allocation.Runtime)
+	if err != nil {
+		return nil, nil, err
+	}
+	supervised, ok := runtime.(SupervisedRuntime)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s boxes have no restart policy", cmp.Or(allocation.Runtime, BoxRuntimeVM))
+	}
+	return allocation, supervised, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
@@ -159,16 +160,23 @@ type EventLogEntity struct {
 	Details      string    `json:"Details,omitempty"`
 }
 
-// ResourceRegistryEntity represents an entry in the ResourceRegistry table
+// ResourceRegistryEntity represents an entry in the ResourceRegistry table.
+// PartitionKey is the resource role and RowKey the instanceID or volumeID.
 type ResourceRegistryEntity struct {
 	PartitionKey string    `json:"PartitionKey"`
 	RowKey       string    `json:"RowKey"`
 	Timestamp    time.Time `json:"Timestamp"`
 	Status       string    `json:"Status"`
+	UserID       string    `json:"UserID,omitempty"`
+	BoxName      string    `json:"BoxName,omitempty"`
+	Runtime      string    `json:"Runtime,omitempty"` // box runtime of volumes, empty for BoxRuntimeVM
 	VMName       string    `json:"VMName,omitempty"`
 	CreatedAt    time.Time `json:"CreatedAt"`
 	LastActivity time.Time `json:"LastActivity"`
 	Metadata     string    `json:"Metadata,omitempty"`
+
+	// ETag of the entry as last read, used for conditional updates
+	ETag azcore.ETag `json:"-"`
 }
 
 // writeTableEntity is a generic function for writing entities to Azure Tables
@@ -189,6 +197,57 @@ func writeTableEntity(ctx context.Context, clients *AzureClients, tableName stri
 	return nil
 }
 
+// upsertTableEntity inserts an entity into an Azure Table, replacing any existing entity with the same keys
+func upsertTableEntity(ctx context.Context, clients *AzureClients, tableName string, entity interface{}) error {
+	if clients.TableClient == nil {
+		return fmt.Errorf("table client not available")
+	}
+
+	tableClient := clients.TableClient.NewClient(tableName)
+	entityBytes, err := json.Marshal(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entity: %w", err)
+	}
+	_, err = tableClient.UpsertEntity(ctx, entityBytes, &aztables.UpsertEntityOptions{
+		UpdateMode: aztables.UpdateModeReplace,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upsert entity in table %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// listTableEntities returns all entities of an Azure Table matching an OData filter (empty for all)
+func listTableEntities[T any](ctx context.Context, clients *AzureClients, tableName, filter string) ([]T, error) {
+	if clients.TableClient == nil {
+		return nil, fmt.Errorf("table client not available")
+	}
+
+	var options *aztables.ListEntitiesOptions
+	if filter != "" {
+		options = &aztables.ListEntitiesOptions{Filter: to.Ptr(filter)}
+	}
+
+	tableClient := clients.TableClient.NewClient(tableName)
+	pager := tableClient.NewListEntitiesPager(options)
+
+	var entities []T
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list entities in table %s: %w", tableName, err)
+		}
+		for _, raw := range page.Entities {
+			var entity T
+			if err := json.Unmarshal(raw, &entity); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal entity from table %s: %w", tableName, err)
+			}
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
 // WriteEventLog writes an entry to the EventLog table
 func WriteEventLog(ctx context.Context, clients *AzureClients, event *EventLogEntity) error {
 	namer := NewResourceNamer(clients.Suffix)
@@ -203,6 +262,144 @@ func WriteResourceRegistry(ctx context.Context, clients *AzureClients, resource
 	return writeTableEntity(ctx, clients, tableName, resource)
 }
 
-// UpdateResourceRegistry updates an existing entry in the ResourceRegistry table
+// registryUpdateAttempts bounds how often a conflicting registry update is retried
+const registryUpdateAttempts = 5
+
+// ErrRegistryConflict is returned when a registry entry changed since it was read
+var ErrRegistryConflict = errors.New("resource registry entry was modified concurrently")
+
+// GetResourceRegistry reads a single entry from the ResourceRegistry table, or returns nil if it doesn't exist
+func GetResourceRegistry(ctx context.Context, clients *AzureClients, role, resourceID string) (*ResourceRegistryEntity, error) {
+	if clients.TableClient == nil {
+		return nil, fmt.Errorf("table client not available")
+	}
+
+	namer := NewResourceNamer(clients.Suffix)
+	tableClient := clients.TableClient.NewClient(namer.ResourceRegistryTableName())
+	resp, err := tableClient.GetEntity(ctx, role, resourceID, nil)
+	if err != nil {
+		if isStatusCode(err, http.StatusNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get registry entry %s/%s: %w", role, resourceID, err)
+	}
+
+	var entry ResourceRegistryEntity
+	if err := json.Unmarshal(resp.Value, &entry); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal registry entry: %w", err)
+	}
+	entry.ETag = resp.ETag
+	return &entry, nil
+}
+
+// ReplaceResourceRegistry replaces an entry in the ResourceRegistry table, but only if it is unchanged
+// since it was read (its ETag still matches). Returns ErrRegistryConflict otherwise.
+func ReplaceResourceRegistry(ctx context.Context, clients *AzureClients, entry *ResourceRegistryEntity) error {
+	if clients.TableClient == nil {
+		return fmt.Errorf("table client not available")
+	}
+
+	namer := NewResourceNamer(clients.Suffix)
+	tableClient := clients.TableClient.NewClient(namer.ResourceRegistryTableName())
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry entry: %w", err)
+	}
+
+	resp, err := tableClient.UpdateEntity(ctx, entryBytes, &aztables.UpdateEntityOptions{
+		IfMatch:    &entry.ETag,
+		UpdateMode: aztables.UpdateModeReplace,
+	})
+	if err != nil {
+		if isStatusCode(err, http.StatusPreconditionFailed) {
+			return ErrRegistryConflict
+		}
+		return fmt.Errorf("failed to update registry entry %s/%s: %w", entry.PartitionKey, entry.RowKey, err)
+	}
+	entry.ETag = resp.ETag
+	return nil
+}
+
+// UpdateResourceRegistry applies update to an entry in the ResourceRegistry table using optimistic
+// concurrency: the entry is read, modified and written back only if nobody changed it in between,
+// retrying on conflicts. A missing entry is created, so resources that predate the registry or
+// were missed by reconciliation are picked up on their first status change.
+func UpdateResourceRegistry(ctx context.Context, clients *AzureClients, role, resourceID string, update func(*ResourceRegistryEntity)) error {
+	for range registryUpdateAttempts {
+		entry, err := GetResourceRegistry(ctx, clients, role, resourceID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if entry == nil {
+			entry = &ResourceRegistryEntity{
+				PartitionKey: role,
+				RowKey:       resourceID,
+				CreatedAt:    now,
+			}
+			entry.Timestamp = now
+			entry.LastActivity = now
+			update(entry)
+			err = WriteResourceRegistry(ctx, clients, entry)
+			if isStatusCode(err, http.StatusConflict) {
+				continue // created concurrently, update that entry instead
+			}
+			return err
+		}
+
+		entry.Timestamp = now
+		entry.LastActivity = now
+		update(entry)
+		err = ReplaceResourceRegistry(ctx, clients, entry)
+		if errors.Is(err, ErrRegistryConflict) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("failed to update registry entry %s/%s after %d attempts: %w", role, resourceID, registryUpdateAttempts, ErrRegistryConflict)
+}
+
+// DeleteResourceRegistry removes an entry from the ResourceRegistry table. Deleting a missing entry is not an error.
+func DeleteResourceRegistry(ctx context.Context, clients *AzureClients, role, resourceID string) error {
+	if clients.TableClient == nil {
+		return fmt.Errorf("table client not available")
+	}
+
+	namer := NewResourceNamer(clients.Suffix)
+	tableClient := clients.TableClient.NewClient(namer.ResourceRegistryTableName())
+	_, err := tableClient.DeleteEntity(ctx, role, resourceID, nil)
+	if err != nil && !isStatusCode(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete registry entry %s/%s: %w", role, resourceID, err)
+	}
+	return nil
+}
+
+// ListResourceRegistry returns registry entries of a role, optionally narrowed by an OData filter
+func ListResourceRegistry(ctx context.Context, clients *AzureClients, role, filter string) ([]ResourceRegistryEntity, error) {
+	query := fmt.Sprintf("PartitionKey eq '%s'", role)
+	if filter != "" {
+		query = fmt.Sprintf("%s and (%s)", query, filter)
+	}
+
+	// ETags come back as entity metadata, so they are read alongside the entity
+	type registryRow struct {
+		ResourceRegistryEntity
+		ODataETag string `json:"odata.etag"`
+	}
+
+	namer := NewResourceNamer(clients.Suffix)
+	rows, err := listTableEntities[registryRow](ctx, clients, namer.ResourceRegistryTableName(), query)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]ResourceRegistryEntity, len(rows))
+	for i, row := range rows {
+		entries[i] = row.ResourceRegistryEntity
+		entries[i].ETag = azcore.ETag(row.ODataETag)
+	}
+	return entries, nil
+}
 
 // CleanupTestTables deletes test tables with the given suffix (for test cleanup)
@@ -0,0 +1,272 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+)
+
+// fakeTableService serves the entity operations of the Table Storage REST API, with ETags
+// and conditional writes
+type fakeTableService struct {
+	mu       sync.Mutex
+	entities map[string][]byte // by table/partitionKey/rowKey
+	etags    map[string]string
+	version  int
+	lost     int // writes refused on a conflict or ETag mismatch
+
+	// Held reads block until all of them arrived, see holdReads
+	readsHeld int
+	readsDone chan struct{}
+}
+
+var fakeEntityPath = regexp.MustCompile(`^/([^(/]+)\(PartitionKey='([^']*)',RowKey='([^']*)'\)$`)
+
+func newFakeTableService() *fakeTableService {
+	return &fakeTableService{
+		entities: make(map[string][]byte),
+		etags:    make(map[string]string),
+	}
+}
+
+// holdReads makes the next n reads wait for each other, so n concurrent claimers all see
+// the same claim before any of them writes
+func (f *fakeTableService) holdReads(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readsHeld = n
+	f.readsDone = make(chan struct{})
+}
+
+func (f *fakeTableService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	if r.Method == http.MethodPost {
+		// Insert: /<table>
+		var entity aztables.Entity
+		if err := json.Unmarshal(body, &entity); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := r.URL.Path[1:] + "/" + entity.PartitionKey + "/" + entity.RowKey
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.entities[key]; ok {
+			f.lost++
+			http.Error(w, `{"odata.error":{"code":"EntityAlreadyExists"}}`, http.StatusConflict)
+			return
+		}
+		f.store(key, body)
+		w.Header().Set("ETag", f.etags[key])
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	match := fakeEntityPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.Error(w, "unexpected path "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	key := match[1] + "/" + match[2] + "/" + match[3]
+
+	if r.Method == http.MethodGet {
+		f.holdRead()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, exists := f.entities[key]
+	ifMatch := r.Header.Get("If-Match")
+	if r.Method != http.MethodGet && ifMatch != "" && ifMatch != "*" && ifMatch != f.etags[key] {
+		f.lost++
+		http.Error(w, `{"odata.error":{"code":"UpdateConditionNotSatisfied"}}`, http.StatusPreconditionFailed)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.Error(w, `{"odata.error":{"code":"ResourceNotFound"}}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", f.etags[key])
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(current)
+	case http.MethodPut:
+		f.store(key, body)
+		w.Header().Set("ETag", f.etags[key])
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !exists {
+			http.Error(w, `{"odata.error":{"code":"ResourceNotFound"}}`, http.StatusNotFound)
+			return
+		}
+		delete(f.entities, key)
+		delete(f.etags, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+// store records an entity under a new ETag; f.mu must be held
+func (f *fakeTableService) store(key string, body []byte) {
+	f.version++
+	f.entities[key] = body
+	f.etags[key] = fmt.Sprintf(`W/"datetime'%d'"`, f.version)
+}
+
+func (f *fakeTableService) holdRead() {
+	f.mu.Lock()
+	if f.readsHeld == 0 {
+		f.mu.Unlock()
+		return
+	}
+	f.readsHeld--
+	done := f.readsDone
+	if f.readsHeld == 0 {
+		close(done)
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// newFakeTableClients returns clients whose table client talks to service
+func newFakeTableClients(t *testing.T, service *fakeTableService) *AzureClients {
+	t.Helper()
+	server := httptest.NewServer(service)
+	t.Cleanup(server.Close)
+	tableClient, err := aztables.NewServiceClientWithNoCredential(server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create table client: %v", err)
+	}
+	return &AzureClients{Suffix: "test", TableClient: tableClient}
+}
+
+// entity returns the stored entity of table with the given keys, or nil if there is none
+func (f *fakeTableService) entity(table, partitionKey, rowKey string) map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.entities[table+"/"+partitionKey+"/"+rowKey]
+	if !ok {
+		return nil
+	}
+	var entity map[string]any
+	_ = json.Unmarshal(data, &entity)
+	return entity
+}
+
+func TestWriteAllocationDeletesReleased(t *testing.T) {
+	ctx := context.Background()
+	service := newFakeTableService()
+	clients := newFakeTableClients(t, service)
+	table := NewResourceNamer(clients.Suffix).AllocationsTableName()
+
+	allocation := newAllocation("owner", "user-1", "dev1", "instance-0", "volume-0")
+	for _, state := range []string{AllocationStateReserved, AllocationStateReleasing} {
+		if err := allocation.transitionTo(state); err != nil {
+			t.Fatalf("transition to %s: %v", state, err)
+		}
+		if err := WriteAllocation(ctx, clients, allocation); err != nil {
+			t.Fatalf("WriteAllocation(%s): %v", state, err)
+		}
+		if got := service.entity(table, allocationPartitionKey, allocation.RowKey); got == nil || got["State"] != state {
+			t.Fatalf("got stored allocation %v, want one in state %s", got, state)
+		}
+	}
+
+	// Released allocations are dropped instead of piling up in the partition
+	if err := allocation.transitionTo(AllocationStateFree); err != nil {
+		t.Fatalf("transition to free: %v", err)
+	}
+	if err := WriteAllocation(ctx, clients, allocation); err != nil {
+		t.Fatalf("WriteAllocation(free): %v", err)
+	}
+	if got := service.entity(table, allocationPartitionKey, allocation.RowKey); got != nil {
+		t.Fatalf("released allocation kept: %v", got)
+	}
+	// Releasing again, e.g. when recovery repeats an interrupted release, is fine
+	if err := WriteAllocation(ctx, clients, allocation); err != nil {
+		t.Fatalf("WriteAllocation of a deleted allocation: %v", err)
+	}
+}
+
+func TestUpdateResourceRegistryRetriesConflicts(t *testing.T) {
+	ctx := context.Background()
+	service := newFakeTableService()
+	clients := newFakeTableClients(t, service)
+	table := NewResourceNamer(clients.Suffix).ResourceRegistryTableName()
+
+	// Updaters that all read the same entry, or all find none, each get their change in
+	updateConcurrently := func(round string) {
+		t.Helper()
+		service.holdReads(registryUpdateAttempts)
+		var wg sync.WaitGroup
+		errs := make([]error, registryUpdateAttempts)
+		for i := range registryUpdateAttempts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = UpdateResourceRegistry(ctx, clients, ResourceRoleInstance, "instance-0", func(entry *ResourceRegistryEntity) {
+					entry.Status = ResourceStatusFree
+					entry.Metadata += fmt.Sprintf("%s%d,", round, i)
+				})
+			}()
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("updater %d: %v", i, err)
+			}
+		}
+	}
+	updateConcurrently("create")
+	updateConcurrently("update")
+
+	entry := service.entity(table, ResourceRoleInstance, "instance-0")
+	metadata, _ := entry["Metadata"].(string)
+	for _, round := range []string{"create", "update"} {
+		for i := range registryUpdateAttempts {
+			if n := strings.Count(metadata, fmt.Sprintf("%s%d,", round, i)); n != 1 {
+				t.Errorf("%s by updater %d applied %d times, want once: %q", round, i, n, metadata)
+			}
+		}
+	}
+	if service.lost < 2*(registryUpdateAttempts-1) {
+		t.Errorf("got %d lost writes, want every updater but one per round to lose", service.lost)
+	}
+
+	// An entry that keeps changing under the updater is given up on
+	key := table + "/" + ResourceRoleInstance + "/instance-0"
+	calls := 0
+	err := UpdateResourceRegistry(ctx, clients, ResourceRoleInstance, "instance-0", func(entry *ResourceRegistryEntity) {
+		calls++
+		service.mu.Lock()
+		service.store(key, service.entities[key])
+		service.mu.Unlock()
+		entry.Status = ResourceStatusConnected
+	})
+	if !errors.Is(err, ErrRegistryConflict) {
+		t.Fatalf("got %v, want ErrRegistryConflict", err)
+	}
+	if calls != registryUpdateAttempts {
+		t.Errorf("got %d attempts, want %d", calls, registryUpdateAttempts)
+	}
+	if status := service.entity(table, ResourceRoleInstance, "instance-0")["Status"]; status != ResourceStatusFree {
+		t.Errorf("got status %v, want the conflicting update not applied", status)
+	}
+}
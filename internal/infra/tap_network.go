@@ -0,0 +1,153 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"shellbox/internal/qga"
+	"strings"
+)
+
+// Networking modes of box VMs
+const (
+	QEMUNetworkUser = "user" // user-mode SLIRP with the guest's SSH forwarded, the default
+	QEMUNetworkTap  = "tap"  // tap device on a host bridge with NAT, see tapNetwork
+)
+
+// tapNetwork is the private subnet a box on a tap device lives in. Each instance runs a
+// single box, so the bridge and its subnet are the box's own, and a box that moves to
+// another instance finds the same addresses there.
+type tapNetwork struct {
+	Bridge  string
+	Tap     string
+	Subnet  string // CIDR of the box's subnet
+	Gateway string // the bridge's address, which NATs the box's traffic
+	GuestIP string
+	Prefix  int
+	DNS     string
+}
+
+// boxTapNetwork is the network of boxes in QEMUNetworkTap mode. The subnet stays clear of
+// the cloud VNets and of libvirt's default 192.168.122.0/24.
+var boxTapNetwork = tapNetwork{
+	Bridge:  "shellbox0",
+	Tap:     "shellbox-tap0",
+	Subnet:  "192.168.200.0/30",
+	Gateway: "192.168.200.1",
+	GuestIP: "192.168.200.2",
+	Prefix:  30,
+	DNS:     "8.8.8.8",
+}
+
+// netdev returns the tap backend that replaces the user-mode one with the same ID. Netdev
+// backends aren't part of the saved state, so a box saved on SLIRP resumes on a tap device.
+func (n *tapNetwork) netdev(id string) QEMUNetdev {
+	return QEMUNetdev{
+		ID:      id,
+		Type:    "tap",
+		Options: fmt.Sprintf("ifname=%s,script=no,downscript=no,vhost=on", n.Tap),
+	}
+}
+
+// withTapNetwork returns config with its user-mode netdevs moved to the tap device
+func (n *tapNetwork) withTapNetwork(config QEMUConfig) QEMUConfig {
+	config.Netdevs = append([]QEMUNetdev(nil), config.Netdevs...)
+	for i, netdev := range config.Netdevs {
+		if netdev.Type == "user" {
+			config.Netdevs[i] = n.netdev(netdev.ID)
+		}
+	}
+	return config
+}
+
+// firewallRules are the iptables rules of the network as table, chain and rule spec: NAT
+// for the box's subnet and forwarding of BoxSSHPort to the guest's SSH
+func (n *tapNetwork) firewallRules() [][]string {
+	return [][]string{
+		{"nat", "POSTROUTING", "-s", n.Subnet, "!", "-o", n.Bridge, "-j", "MASQUERADE"},
+		{"nat", "PREROUTING", "-p", "tcp", "--dport", fmt.Sprint(BoxSSHPort), "-j", "DNAT", "--to-destination", n.GuestIP + ":22"},
+		{"filter", "FORWARD", "-i", n.Bridge, "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-o", n.Bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		{"filter", "FORWARD", "-o", n.Bridge, "-d", n.GuestIP, "-p", "tcp", "--dport", "22", "-j", "ACCEPT"},
+	}
+}
+
+// exposureComment tags the firewall rules of exposed ports, so teardownScript finds them
+const exposureComment = "shellbox-expose"
+
+// exposureRules are the iptables rules forwarding port of the instance to guestPort of the
+// guest, as table, chain and rule spec
+func (n *tapNetwork) exposureRules(port, guestPort int) [][]string {
+	return [][]string{
+		{"nat", "PREROUTING", "-p", "tcp", "--dport", fmt.Sprint(port), "-m", "comment", "--comment", exposureComment, "-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", n.GuestIP, guestPort)},
+		{"filter", "FORWARD", "-o", n.Bridge, "-d", n.GuestIP, "-p", "tcp", "--dport", fmt.Sprint(guestPort), "-m", "comment", "--comment", exposureComment, "-j", "ACCEPT"},
+	}
+}
+
+// exposeScript adds the rules of exposureRules
+func (n *tapNetwork) exposeScript(port, guestPort int) string {
+	var script strings.Builder
+	for _, rule := range n.exposureRules(port, guestPort) {
+		table, chain, spec := rule[0], rule[1], shellJoin(rule[2:])
+		fmt.Fprintf(&script, "sudo iptables -t %s -C %s %s 2> /dev/null || sudo iptables -t %s -I %s %s\n", table, chain, spec, table, chain, spec)
+	}
+	return script.String()
+}
+
+// hostScript creates the bridge and tap device and the firewall rules. Every step can run
+// again on an instance that already has it.
+func (n *tapNetwork) hostScript() string {
+	var script strings.Builder
+	fmt.Fprintf(&script, `
+# Bridge the box's tap device into its private subnet
+sudo ip link show %[1]s > /dev/null 2>&1 || sudo ip link add %[1]s type bridge
+sudo ip addr replace %[2]s/%[3]d dev %[1]s
+sudo ip link set %[1]s up
+sudo ip link show %[4]s > /dev/null 2>&1 || sudo ip tuntap add dev %[4]s mode tap
+sudo ip link set %[4]s master %[1]s up
+sudo sysctl -qw net.ipv4.ip_forward=1
+`, n.Bridge, n.Gateway, n.Prefix, n.Tap)
+	for _, rule := range n.firewallRules() {
+		table, chain, spec := rule[0], rule[1], shellJoin(rule[2:])
+		fmt.Fprintf(&script, "sudo iptables -t %s -C %s %s 2> /dev/null || sudo iptables -t %s -A %s %s\n", table, chain, spec, table, chain, spec)
+	}
+	return script.String()
+}
+
+// teardownScript removes what hostScript and exposeScript set up. Instances run other
+// boxes after this one, and the forwarding of BoxSSHPort would take their SSH.
+func (n *tapNetwork) teardownScript() string {
+	var script strings.Builder
+	script.WriteString("\n# Remove the tap network of a previous box\n")
+	for _, rule := range n.firewallRules() {
+		table, chain, spec := rule[0], rule[1], shellJoin(rule[2:])
+		fmt.Fprintf(&script, "while sudo iptables -t %s -D %s %s 2> /dev/null; do :; done\n", table, chain, spec)
+	}
+	fmt.Fprintf(&script, "for table in nat filter; do sudo iptables -t $table -S | grep -- '--comment %s' | sed 's/^-A /-D /' | while read -r rule; do sudo iptables -t $table $rule; done; done\n", exposureComment)
+	fmt.Fprintf(&script, "sudo ip link del %s 2> /dev/null || true\nsudo ip link del %s 2> /dev/null || true\n", n.Tap, n.Bridge)
+	return script.String()
+}
+
+// guestScript moves the guest's eth0 from the DHCP lease it got from SLIRP to its static
+// address on the subnet
+func (n *tapNetwork) guestScript() string {
+	return fmt.Sprintf(`(dhclient -x eth0 || /usr/sbin/dhclient -x eth0 || true) 2> /dev/null
+ip addr flush dev eth0
+ip addr add %s/%d dev eth0
+ip link set eth0 up
+ip route replace default via %s
+resolvectl dns eth0 %s 2> /dev/null || echo 'nameserver %s' > /etc/resolv.conf`,
+		n.GuestIP, n.Prefix, n.Gateway, n.DNS, n.DNS)
+}
+
+// configureGuestTapNetwork gives the resumed guest its static address through the guest agent
+func (qm *QEMUManager) configureGuestTapNetwork(ctx context.Context, instanceIP string) error {
+	slog.Info("Configuring guest tap network", "instanceIP", instanceIP, "guestIP", boxTapNetwork.GuestIP)
+	err := qm.GuestAgent(ctx, instanceIP, func(agent *qga.Client) error {
+		return guestExec(ctx, agent, "/bin/sh", []string{"-c", boxTapNetwork.guestScript()})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure guest network: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package infra
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// checkShellSyntax fails the test if script doesn't parse as a shell script
+func checkShellSyntax(t *testing.T, name, script string) {
+	t.Helper()
+	if output, err := exec.Command("sh", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Errorf("%s doesn't parse: %v\n%s\n%s", name, err, output, script)
+	}
+}
+
+func TestWithTapNetwork(t *testing.T) {
+	config := boxQEMUConfig("/mnt/userdata", BoxSSHPort)
+	tap := boxTapNetwork.withTapNetwork(config)
+
+	if got := strings.Join(tap.Args(), " "); !strings.Contains(got, "-netdev tap,id=net0,ifname=shellbox-tap0,script=no,downscript=no,vhost=on") ||
+		strings.Contains(got, "hostfwd") {
+		t.Errorf("tap config renders %s, want net0 on the tap device", got)
+	}
+	// The NIC keeps its netdev ID, which the saved state refers to
+	if !strings.Contains(strings.Join(tap.Args(), " "), "-device virtio-net-pci,netdev=net0") {
+		t.Errorf("tap config lost the NIC of net0")
+	}
+	if config.Netdevs[0].Type != "user" {
+		t.Errorf("withTapNetwork changed the config it was given")
+	}
+}
+
+func TestTapHostScripts(t *testing.T) {
+	setup := boxTapNetwork.hostScript()
+	teardown := boxTapNetwork.teardownScript()
+	checkShellSyntax(t, "host script", setup)
+	checkShellSyntax(t, "teardown script", teardown)
+
+	for _, want := range []string{
+		"sudo ip link show shellbox0 > /dev/null 2>&1 || sudo ip link add shellbox0 type bridge\n",
+		"sudo ip addr replace 192.168.200.1/30 dev shellbox0\n",
+		"sudo ip link set shellbox-tap0 master shellbox0 up\n",
+		"sudo sysctl -qw net.ipv4.ip_forward=1\n",
+		// Rules are only added if missing, so the script runs again on every resume
+		"sudo iptables -t nat -C POSTROUTING -s 192.168.200.0/30 '!' -o shellbox0 -j MASQUERADE 2> /dev/null || sudo iptables -t nat -A POSTROUTING -s 192.168.200.0/30 '!' -o shellbox0 -j MASQUERADE\n",
+		"-A PREROUTING -p tcp --dport 2222 -j DNAT --to-destination 192.168.200.2:22\n",
+	} {
+		if !strings.Contains(setup, want) {
+			t.Errorf("host script lacks %q:\n%s", want, setup)
+		}
+	}
+
+	// Every rule set up is deleted, however many times it was added
+	for _, rule := range boxTapNetwork.firewallRules() {
+		want := "while sudo iptables -t " + rule[0] + " -D " + rule[1] + " " + shellJoin(rule[2:]) + " 2> /dev/null; do :; done\n"
+		if !strings.Contains(teardown, want) {
+			t.Errorf("teardown script lacks %q:\n%s", want, teardown)
+		}
+	}
+	for _, want := range []string{"sudo ip link del shellbox-tap0", "sudo ip link del shellbox0"} {
+		if !strings.Contains(teardown, want) {
+			t.Errorf("teardown script lacks %q:\n%s", want, teardown)
+		}
+	}
+}
+
+func TestTapGuestScript(t *testing.T) {
+	script := boxTapNetwork.guestScript()
+	checkShellSyntax(t, "guest script", script)
+	for _, want := range []string{
+		"ip addr add 192.168.200.2/30 dev eth0\n",
+		"ip route replace default via 192.168.200.1\n",
+		"resolvectl dns eth0 8.8.8.8",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("guest script lacks %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestQEMUResumeScriptNetwork(t *testing.T) {
+	config := boxQEMUConfig("/mnt/userdata", BoxSSHPort)
+
+	// Boxes on a tap device get the network set up before QEMU opens the tap
+	script := NewQEMUManager(DataDiskLayout{}, QEMUNetworkTap).qemuResumeScript(&config)
+	checkShellSyntax(t, "tap resume script", script)
+	setup, start := strings.Index(script, "ip tuntap add"), strings.Index(script, "Starting QEMU")
+	if setup < 0 || start < setup || !strings.Contains(script, "-netdev tap,id=net0") {
+		t.Errorf("tap resume script doesn't set up the tap device before QEMU:\n%s", script)
+	}
+
+	// Boxes on SLIRP clear the forwarding a previous tap box left, which would take their SSH
+	script = NewQEMUManager(DataDiskLayout{}, QEMUNetworkUser).qemuResumeScript(&config)
+	checkShellSyntax(t, "user resume script", script)
+	if !strings.Contains(script, "-D PREROUTING") || strings.Contains(script, "ip tuntap add") || strings.Contains(script, "-netdev tap") {
+		t.Errorf("user resume script doesn't clear the tap network:\n%s", script)
+	}
+	if !strings.Contains(script, "hostfwd=tcp::2222-:22") {
+		t.Errorf("user resume script lost the SSH forward:\n%s", script)
+	}
+}
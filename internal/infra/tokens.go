@@ -0,0 +1,73 @@
+package infra
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenSigner signs the short-lived tokens of links handed out over SSH, e.g. preview
+// and web login links. A token carries a purpose and a few fields like the user ID, so
+// one kind of token can't pass for another. The key is new on every start, so a restart
+// ends all tokens.
+type TokenSigner struct {
+	key []byte
+}
+
+// NewTokenSigner creates a token signer with a random key
+func NewTokenSigner() (*TokenSigner, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate token key: %w", err)
+	}
+	return &TokenSigner{key: key}, nil
+}
+
+// Sign returns a token for purpose carrying fields that is valid until expires
+func (s *TokenSigner) Sign(purpose string, expires time.Time, fields ...string) string {
+	payload, _ := json.Marshal(append([]string{purpose, strconv.FormatInt(expires.Unix(), 10)}, fields...))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+// Verify checks that token was signed by s for purpose and hasn't expired, and returns
+// its fields and when it expires
+func (s *TokenSigner) Verify(purpose, token string) ([]string, time.Time, bool) {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return nil, time.Time{}, false
+	}
+	var fields []string
+	if err := json.Unmarshal(payload, &fields); err != nil || len(fields) < 2 || fields[0] != purpose {
+		return nil, time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	if !time.Now().Before(expires) {
+		return nil, time.Time{}, false
+	}
+	return fields[2:], expires, true
+}
+
+// mac returns the MAC of a token payload
+func (s *TokenSigner) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -112,12 +112,6 @@ func CreateVolumeWithTags(ctx context.Context, clients *AzureClients, resourceGr
 		Tags:       *tags,
 	}
 
-	// Wait for the volume to be visible in Resource Graph before returning
-	err = waitForVolumeInResourceGraph(ctx, clients, tags.VolumeID, tags)
-	if err != nil {
-		return nil, fmt.Errorf("waiting for volume in resource graph: %w", err)
-	}
-
 	return volumeInfo, nil
 }
 
@@ -170,12 +164,6 @@ func CreateVolumeFromSnapshot(ctx context.Context, clients *AzureClients, resour
 		Tags:       *tags,
 	}
 
-	// Wait for the volume to be visible in Resource Graph before returning
-	err = waitForVolumeInResourceGraph(ctx, clients, tags.VolumeID, tags)
-	if err != nil {
-		return nil, fmt.Errorf("waiting for volume in resource graph: %w", err)
-	}
-
 	return volumeInfo, nil
 }
 
@@ -223,8 +211,15 @@ func VolumeTagsToMap(tags *VolumeTags) map[string]*string {
 	}
 }
 
-// UpdateVolumeStatus updates the status tag of a volume
+// UpdateVolumeStatus updates the status of a volume in the resource registry and its status tag
 func UpdateVolumeStatus(ctx context.Context, clients *AzureClients, volumeID, status string) error {
+	err := UpdateResourceRegistry(ctx, clients, ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update volume in registry: %w", err)
+	}
+
 	namer := NewResourceNamer(clients.Suffix)
 	volumeName := namer.VolumePoolDiskName(volumeID)
 
@@ -253,21 +248,20 @@ func UpdateVolumeStatus(ctx context.Context, clients *AzureClients, volumeID, st
 		return fmt.Errorf("failed to update volume status: %w", err)
 	}
 
-	// Wait for the volume tags to be visible in Resource Graph before returning
-	expectedTags := map[string]string{
-		TagKeyStatus:   status,
-		TagKeyLastUsed: lastUsedTime,
-	}
-	err = waitForVolumeTagsInResourceGraph(ctx, clients, volumeID, expectedTags)
-	if err != nil {
-		return fmt.Errorf("waiting for volume tags in resource graph: %w", err)
-	}
-
 	return nil
 }
 
-// UpdateVolumeStatusUserAndBox updates the status, userID, and boxName tags of a volume
+// UpdateVolumeStatusUserAndBox updates the status, userID, and boxName of a volume in the resource registry and its tags
 func UpdateVolumeStatusUserAndBox(ctx context.Context, clients *AzureClients, volumeID, status, userID, boxName string) error {
+	err := UpdateResourceRegistry(ctx, clients, ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Status = status
+		entry.UserID = userID
+		entry.BoxName = boxName
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update volume in registry: %w", err)
+	}
+
 	namer := NewResourceNamer(clients.Suffix)
 	volumeName := namer.VolumePoolDiskName(volumeID)
 
@@ -298,16 +292,39 @@ func UpdateVolumeStatusUserAndBox(ctx context.Context, clients *AzureClients, vo
 		return fmt.Errorf("failed to update volume status: %w", err)
 	}
 
-	// Wait for the volume tags to be visible in Resource Graph before returning
-	expectedTags := map[string]string{
-		TagKeyStatus:   status,
-		TagKeyLastUsed: lastUsedTime,
-		TagKeyUserID:   userID,
-		TagKeyBoxName:  boxName,
+	return nil
+}
+
+// UpdateVolumeRuntime records which box runtime a volume's box runs with
+func UpdateVolumeRuntime(ctx context.Context, clients *AzureClients, volumeID, runtime string) error {
+	err := UpdateResourceRegistry(ctx, clients, ResourceRoleVolume, volumeID, func(entry *ResourceRegistryEntity) {
+		entry.Runtime = runtime
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update volume in registry: %w", err)
+	}
+
+	namer := NewResourceNamer(clients.Suffix)
+	volumeName := namer.VolumePoolDiskName(volumeID)
+
+	volume, err := clients.DisksClient.Get(ctx, clients.ResourceGroupName, volumeName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get volume for runtime update: %w", err)
+	}
+
+	if volume.Tags == nil {
+		volume.Tags = make(map[string]*string)
 	}
-	err = waitForVolumeTagsInResourceGraph(ctx, clients, volumeID, expectedTags)
+	volume.Tags[TagKeyRuntime] = to.Ptr(runtime)
+
+	poller, err := clients.DisksClient.BeginCreateOrUpdate(ctx, clients.ResourceGroupName, volumeName, volume.Disk, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start volume runtime update: %w", err)
+	}
+
+	_, err = poller.PollUntilDone(ctx, &DefaultPollOptions)
 	if err != nil {
-		return fmt.Errorf("waiting for volume tags in resource graph: %w", err)
+		return fmt.Errorf("failed to update volume runtime: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,190 @@
+// Package qga is a client for the QEMU guest agent running inside VMs.
+package qga
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+
+	"shellbox/internal/qmp"
+)
+
+// syncDelimiter is the 0xFF byte the agent sends before a guest-sync-delimited reply, and
+// that resets the agent's parser when sent by us
+const syncDelimiter = 0xFF
+
+// ErrClosed is returned for commands on a client that was closed, or broken by a
+// cancelled command
+var ErrClosed = errors.New("guest agent connection closed")
+
+// Error is an error reply from the guest agent
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("guest agent error: %s - %s", e.Class, e.Desc)
+}
+
+type request struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+// Client runs guest agent commands. The agent answers one command at a time without
+// request IDs, so commands are serialized, and a command abandoned mid-reply leaves the
+// stream unusable: cancelling one closes the client.
+type Client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	dec    *json.Decoder
+	closed bool
+}
+
+// NewClient synchronizes with the agent on conn, discarding anything left over from
+// earlier connections. The client owns conn and closes it on Close.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.sync(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to sync with guest agent: %w", err)
+	}
+	return c, nil
+}
+
+// Dial connects to the guest agent unix socket at path through dialer
+func Dial(ctx context.Context, dialer qmp.Dialer, path string) (*Client, error) {
+	conn, err := qmp.DialUnix(ctx, dialer, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent socket %s: %w", path, err)
+	}
+	return NewClient(ctx, conn)
+}
+
+// DialLocal connects to the guest agent unix socket at path on this host
+func DialLocal(ctx context.Context, path string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent socket %s: %w", path, err)
+	}
+	return NewClient(ctx, conn)
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+// Execute runs command with args, which are marshalled to JSON and may be nil, and
+// unmarshals the reply into result, which may be nil
+func (c *Client) Execute(ctx context.Context, command string, args, result any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+
+	var resp response
+	err := c.exchange(ctx, func() error {
+		if err := json.NewEncoder(c.conn).Encode(request{Execute: command, Arguments: args}); err != nil {
+			return err
+		}
+		return c.dec.Decode(&resp)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", command, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %w", command, resp.Error)
+	}
+	if result != nil && len(resp.Return) > 0 {
+		if err := json.Unmarshal(resp.Return, result); err != nil {
+			return fmt.Errorf("failed to parse %s reply: %w", command, err)
+		}
+	}
+	return nil
+}
+
+// Sync checks that the agent is responsive
+func (c *Client) Sync(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.sync(ctx)
+}
+
+// sync runs guest-sync-delimited, skipping everything before the delimiter and any
+// replies to earlier commands. The caller holds mu, or c isn't shared yet.
+func (c *Client) sync(ctx context.Context) error {
+	id := rand.Int64N(1 << 53) // the agent parses IDs as JSON numbers
+	return c.exchange(ctx, func() error {
+		// A leading 0xFF makes the agent drop any partial command from before
+		data, err := json.Marshal(request{Execute: "guest-sync-delimited", Arguments: map[string]int64{"id": id}})
+		if err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(append([]byte{syncDelimiter}, data...)); err != nil {
+			return err
+		}
+
+		for {
+			if _, err := c.reader.ReadBytes(syncDelimiter); err != nil {
+				return err
+			}
+			dec := json.NewDecoder(c.reader)
+			var resp struct {
+				Return int64 `json:"return"`
+			}
+			if err := dec.Decode(&resp); err != nil {
+				return err
+			}
+			if resp.Return == id {
+				c.dec = dec
+				return nil
+			}
+			// A stale sync reply: look for the next delimiter, including in what dec read ahead
+			c.reader = bufio.NewReader(io.MultiReader(dec.Buffered(), c.reader))
+		}
+	})
+}
+
+// exchange runs fn, which talks to the agent, so that it stops when ctx is done. Any
+// failure closes the client, since a late reply would be taken for the next command's.
+// Connections through SSH don't support deadlines, so cancelling closes the connection.
+func (c *Client) exchange(ctx context.Context, fn func() error) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.Close()
+	})
+	err := fn()
+	if !stop() || err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		c.closed = true
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package qga
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAgent is the guest end of a guest agent connection. It answers guest-sync-delimited
+// itself and every other command with handle.
+type fakeAgent struct {
+	t      *testing.T
+	conn   net.Conn
+	handle func(command string, args json.RawMessage) any // a reply value or an *Error
+
+	mu       sync.Mutex
+	commands []string
+
+	// staleSyncs is how many replies to earlier syncs precede the real one, as left in
+	// the socket by a client that went away
+	staleSyncs int
+}
+
+// skipDelimiters drops the 0xFF bytes the client sends ahead of syncs
+type skipDelimiters struct{ r io.Reader }
+
+func (s skipDelimiters) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	return copy(p, bytes.ReplaceAll(p[:n], []byte{syncDelimiter}, nil)), err
+}
+
+func newFakeAgent(t *testing.T, handle func(command string, args json.RawMessage) any) (*fakeAgent, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	return &fakeAgent{t: t, conn: server, handle: handle}, client
+}
+
+func (a *fakeAgent) serve() {
+	dec := json.NewDecoder(skipDelimiters{a.conn})
+	for {
+		var req struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		a.mu.Lock()
+		a.commands = append(a.commands, req.Execute)
+		staleSyncs := a.staleSyncs
+		a.mu.Unlock()
+
+		if req.Execute == "guest-sync-delimited" {
+			var args struct {
+				ID int64 `json:"id"`
+			}
+			_ = json.Unmarshal(req.Arguments, &args)
+			var out bytes.Buffer
+			out.WriteString(`{"return": {}}` + "\n") // a reply to some earlier command
+			for i := range staleSyncs {
+				fmt.Fprintf(&out, "\xff{\"return\": %d}\n", args.ID+int64(i)+1)
+			}
+			fmt.Fprintf(&out, "\xff{\"return\": %d}\n", args.ID)
+			a.mu.Lock()
+			a.staleSyncs = 0
+			a.mu.Unlock()
+			if _, err := a.conn.Write(out.Bytes()); err != nil {
+				return
+			}
+			continue
+		}
+
+		reply := map[string]any{"return": a.handle(req.Execute, req.Arguments)}
+		if agentErr, ok := reply["return"].(*Error); ok {
+			reply = map[string]any{"error": agentErr}
+		}
+		if err := json.NewEncoder(a.conn).Encode(reply); err != nil {
+			return
+		}
+	}
+}
+
+// count returns how often command was received
+func (a *fakeAgent) count(command string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for _, c := range a.commands {
+		if c == command {
+			n++
+		}
+	}
+	return n
+}
+
+// connect returns a client synced with an agent answering commands with handle
+func connect(t *testing.T, handle func(command string, args json.RawMessage) any) (*Client, *fakeAgent) {
+	t.Helper()
+	agent, conn := newFakeAgent(t, handle)
+	agent.staleSyncs = 2
+	go agent.serve()
+	client, err := NewClient(context.Background(), conn)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, agent
+}
+
+func TestSync(t *testing.T) {
+	client, agent := connect(t, func(command string, _ json.RawMessage) any {
+		return map[string]any{}
+	})
+
+	// Leftovers from before the sync don't end up as replies to commands
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping after sync: %v", err)
+	}
+	agent.mu.Lock()
+	agent.staleSyncs = 1
+	agent.mu.Unlock()
+	if err := client.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping after second sync: %v", err)
+	}
+	if got := agent.count("guest-sync-delimited"); got != 2 {
+		t.Errorf("got %d syncs, want 2", got)
+	}
+
+	// An agent that never answers
+	_, conn := newFakeAgent(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewClient(ctx, conn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v from a silent agent, want the deadline", err)
+	}
+}
+
+func TestExecuteCancelClosesClient(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	client, _ := connect(t, func(command string, _ json.RawMessage) any {
+		if command == "guest-fsfreeze-freeze" {
+			<-block
+		}
+		return 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.FSFreeze(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+	// The late reply would be taken for the next command's, so the client is done
+	if err := client.Ping(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v after a cancelled command, want ErrClosed", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	polls := 0
+	client, agent := connect(t, func(command string, args json.RawMessage) any {
+		switch command {
+		case "guest-exec":
+			var req struct {
+				Path    string   `json:"path"`
+				Arg     []string `json:"arg"`
+				Input   string   `json:"input-data"`
+				Capture bool     `json:"capture-output"`
+			}
+			_ = json.Unmarshal(args, &req)
+			if req.Path == "missing" {
+				return &Error{Class: "GenericError", Desc: "Failed to execute child process"}
+			}
+			if req.Path != "sh" || len(req.Arg) != 2 || !req.Capture || req.Input != base64.StdEncoding.EncodeToString([]byte("input")) {
+				t.Errorf("got guest-exec %s", args)
+			}
+			return map[string]any{"pid": 4242}
+		case "guest-exec-status":
+			if !strings.Contains(string(args), "4242") {
+				t.Errorf("polled %s, want pid 4242", args)
+			}
+			if polls++; polls < 3 {
+				return map[string]any{"exited": false}
+			}
+			return map[string]any{
+				"exited":        true,
+				"exitcode":      2,
+				"out-data":      base64.StdEncoding.EncodeToString([]byte("out\n")),
+				"err-data":      base64.StdEncoding.EncodeToString([]byte("err\n")),
+				"err-truncated": true,
+			}
+		}
+		return &Error{Class: "CommandNotFound", Desc: command}
+	})
+
+	result, err := client.Exec(context.Background(), ExecRequest{Path: "sh", Args: []string{"-c", "cat; exit 2"}, Input: []byte("input")})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if string(result.Stdout) != "out\n" || string(result.Stderr) != "err\n" || result.ExitCode != 2 || !result.Truncated {
+		t.Errorf("got %+v", result)
+	}
+	if got := agent.count("guest-exec-status"); got != 3 {
+		t.Errorf("got %d polls, want 3", got)
+	}
+
+	// Failing to start is an error, a failing process isn't
+	_, err = client.Exec(context.Background(), ExecRequest{Path: "missing"})
+	var agentErr *Error
+	if !errors.As(err, &agentErr) {
+		t.Errorf("got %v for a command the agent refused, want its error", err)
+	}
+}
+
+func TestReadWriteFile(t *testing.T) {
+	const maxWrite = 40000 // the agent takes less than asked, as write(2) may
+	files := map[string][]byte{"/proc/loadavg": []byte("0.50 0.25 0.10 1/123 4567\n")}
+	handles := map[int64]string{}
+	offsets := map[int64]int{}
+	var lastHandle int64
+	client, agent := connect(t, func(command string, args json.RawMessage) any {
+		var req struct {
+			Path   string `json:"path"`
+			Mode   string `json:"mode"`
+			Handle int64  `json:"handle"`
+			Count  int    `json:"count"`
+			Buf    string `json:"buf-b64"`
+		}
+		_ = json.Unmarshal(args, &req)
+		switch command {
+		case "guest-file-open":
+			if _, ok := files[req.Path]; !ok && req.Mode == "r" {
+				return &Error{Class: "GenericError", Desc: "No such file"}
+			}
+			if req.Mode == "w" {
+				files[req.Path] = nil
+			}
+			lastHandle++
+			handles[lastHandle] = req.Path
+			return lastHandle
+		case "guest-file-read":
+			data := files[handles[req.Handle]][offsets[req.Handle]:]
+			n := min(len(data), req.Count)
+			offsets[req.Handle] += n
+			return map[string]any{"count": n, "buf-b64": base64.StdEncoding.EncodeToString(data[:n]), "eof": n == len(data)}
+		case "guest-file-write":
+			data, _ := base64.StdEncoding.DecodeString(req.Buf)
+			data = data[:min(len(data), maxWrite)]
+			files[handles[req.Handle]] = append(files[handles[req.Handle]], data...)
+			return map[string]any{"count": len(data), "eof": false}
+		case "guest-file-close":
+			delete(handles, req.Handle)
+			return map[string]any{}
+		}
+		return &Error{Class: "CommandNotFound", Desc: command}
+	})
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10000) // a few chunks and a bit
+	if err := client.WriteFile(ctx, "/tmp/file", data); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if !bytes.Equal(files["/tmp/file"], data) {
+		t.Fatalf("guest has %d bytes, want the %d written", len(files["/tmp/file"]), len(data))
+	}
+	if got, want := agent.count("guest-file-write"), (len(data)+maxWrite-1)/maxWrite; got != want {
+		t.Errorf("got %d writes, want %d", got, want)
+	}
+
+	got, err := client.ReadFile(ctx, "/tmp/file")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want the %d written", len(got), len(data))
+	}
+	if got, want := agent.count("guest-file-read"), (len(data)+fileChunkSize-1)/fileChunkSize; got != want {
+		t.Errorf("got %d reads, want %d", got, want)
+	}
+	if len(handles) != 0 {
+		t.Errorf("handles left open: %v", handles)
+	}
+
+	if _, err := client.ReadFile(ctx, "/missing"); err == nil {
+		t.Errorf("ReadFile of a missing file succeeded")
+	}
+
+	// Agents without guest-get-load have the load read from /proc
+	load, err := client.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *load != (LoadAverage{Load1: 0.5, Load5: 0.25, Load15: 0.1}) {
+		t.Errorf("got load %+v", *load)
+	}
+}
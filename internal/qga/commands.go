@@ -0,0 +1,340 @@
+package qga
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Ping checks that the agent answers commands
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Execute(ctx, "guest-ping", nil, nil)
+}
+
+// ExecRequest describes a process to start in the guest
+type ExecRequest struct {
+	Path  string   // executable, looked up in the guest's PATH
+	Args  []string // arguments, not including the executable
+	Env   []string // KEY=value entries; the agent's environment when empty
+	Input []byte   // written to stdin, which is closed afterwards
+}
+
+// ExecResult is the outcome of a finished process
+type ExecResult struct {
+	ExitCode  int
+	Signal    int // terminating signal, 0 when the process exited normally
+	Stdout    []byte
+	Stderr    []byte
+	Truncated bool // the agent caps captured output, dropping the rest
+}
+
+// Exec status polling backs off from execPollInitial to execPollMax
+const (
+	execPollInitial = 50 * time.Millisecond
+	execPollMax     = time.Second
+)
+
+// Exec runs a process in the guest and waits for it to exit, capturing its output. A
+// non-zero exit code isn't an error; check ExitCode.
+func (c *Client) Exec(ctx context.Context, req ExecRequest) (*ExecResult, error) {
+	args := map[string]any{"path": req.Path, "capture-output": true}
+	if len(req.Args) > 0 {
+		args["arg"] = req.Args
+	}
+	if len(req.Env) > 0 {
+		args["env"] = req.Env
+	}
+	if len(req.Input) > 0 {
+		args["input-data"] = base64.StdEncoding.EncodeToString(req.Input)
+	}
+
+	var started struct {
+		PID int64 `json:"pid"`
+	}
+	if err := c.Execute(ctx, "guest-exec", args, &started); err != nil {
+		return nil, err
+	}
+
+	interval := execPollInitial
+	for {
+		var status struct {
+			Exited       bool   `json:"exited"`
+			ExitCode     int    `json:"exitcode"`
+			Signal       int    `json:"signal"`
+			OutData      string `json:"out-data"`
+			ErrData      string `json:"err-data"`
+			OutTruncated bool   `json:"out-truncated"`
+			ErrTruncated bool   `json:"err-truncated"`
+		}
+		if err := c.Execute(ctx, "guest-exec-status", map[string]any{"pid": started.PID}, &status); err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			stdout, err := base64.StdEncoding.DecodeString(status.OutData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode stdout: %w", err)
+			}
+			stderr, err := base64.StdEncoding.DecodeString(status.ErrData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode stderr: %w", err)
+			}
+			return &ExecResult{
+				ExitCode:  status.ExitCode,
+				Signal:    status.Signal,
+				Stdout:    stdout,
+				Stderr:    stderr,
+				Truncated: status.OutTruncated || status.ErrTruncated,
+			}, nil
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		interval = min(interval*2, execPollMax)
+	}
+}
+
+// fileChunkSize is how much each guest-file-read or guest-file-write moves; replies are
+// single JSON lines, so chunks stay small
+const fileChunkSize = 64 * 1024
+
+// FileOpen opens path in the guest with an fopen mode such as "r", "w" or "a" and returns
+// a handle for the other file commands
+func (c *Client) FileOpen(ctx context.Context, path, mode string) (int64, error) {
+	var handle int64
+	if err := c.Execute(ctx, "guest-file-open", map[string]any{"path": path, "mode": mode}, &handle); err != nil {
+		return 0, err
+	}
+	return handle, nil
+}
+
+// FileRead reads up to count bytes from handle, reporting whether the end of the file was reached
+func (c *Client) FileRead(ctx context.Context, handle int64, count int) ([]byte, bool, error) {
+	var result struct {
+		Count  int    `json:"count"`
+		BufB64 string `json:"buf-b64"`
+		EOF    bool   `json:"eof"`
+	}
+	if err := c.Execute(ctx, "guest-file-read", map[string]any{"handle": handle, "count": count}, &result); err != nil {
+		return nil, false, err
+	}
+	data, err := base64.StdEncoding.DecodeString(result.BufB64)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode file data: %w", err)
+	}
+	return data, result.EOF, nil
+}
+
+// FileWrite writes data to handle and returns how many bytes were written
+func (c *Client) FileWrite(ctx context.Context, handle int64, data []byte) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	args := map[string]any{"handle": handle, "buf-b64": base64.StdEncoding.EncodeToString(data)}
+	if err := c.Execute(ctx, "guest-file-write", args, &result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// FileClose closes handle
+func (c *Client) FileClose(ctx context.Context, handle int64) error {
+	return c.Execute(ctx, "guest-file-close", map[string]any{"handle": handle}, nil)
+}
+
+// ReadFile reads the whole file at path in the guest
+func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	handle, err := c.FileOpen(ctx, path, "r")
+	if err != nil {
+		return nil, err
+	}
+	defer c.FileClose(ctx, handle)
+
+	var data []byte
+	for {
+		chunk, eof, err := c.FileRead(ctx, handle, fileChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if eof || len(chunk) == 0 {
+			return data, nil
+		}
+	}
+}
+
+// WriteFile replaces the file at path in the guest with data
+func (c *Client) WriteFile(ctx context.Context, path string, data []byte) error {
+	handle, err := c.FileOpen(ctx, path, "w")
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		chunk := data[:min(len(data), fileChunkSize)]
+		n, err := c.FileWrite(ctx, handle, chunk)
+		if err != nil {
+			_ = c.FileClose(ctx, handle)
+			return err
+		}
+		if n == 0 {
+			_ = c.FileClose(ctx, handle)
+			return fmt.Errorf("short write to %s", path)
+		}
+		data = data[n:]
+	}
+	return c.FileClose(ctx, handle)
+}
+
+// OSInfo describes the guest operating system
+type OSInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+}
+
+// OSInfo returns the guest operating system
+func (c *Client) OSInfo(ctx context.Context) (*OSInfo, error) {
+	var info OSInfo
+	if err := c.Execute(ctx, "guest-get-osinfo", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SetTime sets the guest clock to t, or from the hardware clock when t is zero. VMs
+// restored from saved state resume with the clock from when the state was saved.
+func (c *Client) SetTime(ctx context.Context, t time.Time) error {
+	if t.IsZero() {
+		return c.Execute(ctx, "guest-set-time", nil, nil)
+	}
+	return c.Execute(ctx, "guest-set-time", map[string]any{"time": t.UnixNano()}, nil)
+}
+
+// Filesystem freeze states
+const (
+	FSFrozen = "frozen"
+	FSThawed = "thawed"
+)
+
+// FSFreezeStatus reports whether the guest filesystems are frozen
+func (c *Client) FSFreezeStatus(ctx context.Context) (string, error) {
+	var status string
+	if err := c.Execute(ctx, "guest-fsfreeze-status", nil, &status); err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// FSFreeze flushes and freezes the guest filesystems, e.g. before a disk snapshot, and
+// returns how many were frozen. Always pair it with FSThaw.
+func (c *Client) FSFreeze(ctx context.Context) (int, error) {
+	var count int
+	if err := c.Execute(ctx, "guest-fsfreeze-freeze", nil, &count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// FSThaw unfreezes the guest filesystems and returns how many were thawed
+func (c *Client) FSThaw(ctx context.Context) (int, error) {
+	var count int
+	if err := c.Execute(ctx, "guest-fsfreeze-thaw", nil, &count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// MemoryBlock is a hot-pluggable block of guest memory
+type MemoryBlock struct {
+	PhysIndex  uint64 `json:"phys-index"`
+	Online     bool   `json:"online"`
+	CanOffline bool   `json:"can-offline"`
+}
+
+// MemoryBlocks returns the guest's memory blocks
+func (c *Client) MemoryBlocks(ctx context.Context) ([]MemoryBlock, error) {
+	var blocks []MemoryBlock
+	if err := c.Execute(ctx, "guest-get-memory-blocks", nil, &blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// MemoryBlockSize returns the size of each memory block in bytes
+func (c *Client) MemoryBlockSize(ctx context.Context) (int64, error) {
+	var info struct {
+		Size int64 `json:"size"`
+	}
+	if err := c.Execute(ctx, "guest-get-memory-block-info", nil, &info); err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// LoadAverage is the guest's 1, 5 and 15 minute load average
+type LoadAverage struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// Load returns the guest's load average. Agents older than QEMU 9.1 lack guest-get-load,
+// so it falls back to reading /proc/loadavg.
+func (c *Client) Load(ctx context.Context) (*LoadAverage, error) {
+	var load LoadAverage
+	err := c.Execute(ctx, "guest-get-load", nil, &load)
+	if err == nil {
+		return &load, nil
+	}
+	var agentErr *Error
+	if !errors.As(err, &agentErr) || agentErr.Class != "CommandNotFound" {
+		return nil, err
+	}
+
+	data, err := c.ReadFile(ctx, "/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscan(string(data), &load.Load1, &load.Load5, &load.Load15); err != nil {
+		return nil, fmt.Errorf("failed to parse /proc/loadavg: %w", err)
+	}
+	return &load, nil
+}
+
+// InterfaceStats are the traffic counters of a guest network interface
+type InterfaceStats struct {
+	RxBytes   uint64 `json:"rx-bytes"`
+	RxPackets uint64 `json:"rx-packets"`
+	RxErrors  uint64 `json:"rx-errs"`
+	RxDropped uint64 `json:"rx-dropped"`
+	TxBytes   uint64 `json:"tx-bytes"`
+	TxPackets uint64 `json:"tx-packets"`
+	TxErrors  uint64 `json:"tx-errs"`
+	TxDropped uint64 `json:"tx-dropped"`
+}
+
+// NetworkInterface is a guest network interface
+type NetworkInterface struct {
+	Name            string          `json:"name"`
+	HardwareAddress string          `json:"hardware-address"`
+	Statistics      *InterfaceStats `json:"statistics,omitempty"` // missing on old agents
+}
+
+// NetworkInterfaces returns the guest's network interfaces and their counters
+func (c *Client) NetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	var interfaces []NetworkInterface
+	if err := c.Execute(ctx, "guest-network-get-interfaces", nil, &interfaces); err != nil {
+		return nil, err
+	}
+	return interfaces, nil
+}
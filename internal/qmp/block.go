@@ -0,0 +1,137 @@
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// NBDServerStart starts QEMU's built-in NBD server listening on host:port
+func (c *Client) NBDServerStart(ctx context.Context, host, port string) error {
+	addr := map[string]any{
+		"type": "inet",
+		"data": map[string]any{"host": host, "port": port},
+	}
+	return c.Execute(ctx, "nbd-server-start", map[string]any{"addr": addr}, nil)
+}
+
+// NBDExport exports a block device over the running NBD server under the device's name,
+// so it can be reached as nbd://host:port/<device>
+func (c *Client) NBDExport(ctx context.Context, device string, writable bool) error {
+	args := map[string]any{
+		"type":      "nbd",
+		"id":        device,
+		"node-name": device, // device names are accepted as well as node names
+		"name":      device,
+		"writable":  writable,
+	}
+	return c.Execute(ctx, "block-export-add", args, nil)
+}
+
+// NBDServerStop stops the NBD server, removing its exports
+func (c *Client) NBDServerStop(ctx context.Context) error {
+	return c.Execute(ctx, "nbd-server-stop", nil, nil)
+}
+
+// DriveMirror describes a mirror job copying a block device to a target
+type DriveMirror struct {
+	Device   string `json:"device"`
+	Target   string `json:"target"`              // file name or URI, e.g. "nbd://host:port/export"
+	Format   string `json:"format,omitempty"`    // target format, e.g. "raw"
+	Sync     string `json:"sync"`                // "full" copies the whole device
+	Mode     string `json:"mode,omitempty"`      // "existing" writes to a target that already exists
+	CopyMode string `json:"copy-mode,omitempty"` // "write-blocking" keeps the target in step once ready
+}
+
+// DriveMirror starts mirroring a block device. The job emits BLOCK_JOB_READY once the
+// target caught up and keeps mirroring new writes until it is cancelled or completed.
+func (c *Client) DriveMirror(ctx context.Context, mirror DriveMirror) error {
+	return c.Execute(ctx, "drive-mirror", mirror, nil)
+}
+
+// BlockJobCancel ends the block job on device. A mirror that is ready finishes copying
+// pending writes first, leaving the target consistent.
+func (c *Client) BlockJobCancel(ctx context.Context, device string) error {
+	return c.Execute(ctx, "block-job-cancel", map[string]any{"device": device}, nil)
+}
+
+// BlockJobInfo is the state of a running block job
+type BlockJobInfo struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Len    int64  `json:"len"`    // bytes to process, may grow while the job runs
+	Offset int64  `json:"offset"` // bytes processed
+	Ready  bool   `json:"ready"`
+	Status string `json:"status"`
+}
+
+// QueryBlockJobs returns the running block jobs
+func (c *Client) QueryBlockJobs(ctx context.Context) ([]BlockJobInfo, error) {
+	var jobs []BlockJobInfo
+	if err := c.Execute(ctx, "query-block-jobs", nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// SnapshotInternal takes a snapshot called name inside the qcow2 image behind device
+func (c *Client) SnapshotInternal(ctx context.Context, device, name string) error {
+	return c.Execute(ctx, "blockdev-snapshot-internal-sync", map[string]any{"device": device, "name": name}, nil)
+}
+
+// DeleteSnapshotInternal deletes the internal snapshot called name from device's image
+func (c *Client) DeleteSnapshotInternal(ctx context.Context, device, name string) error {
+	return c.Execute(ctx, "blockdev-snapshot-delete-internal-sync", map[string]any{"device": device, "name": name}, nil)
+}
+
+// Block job events
+const (
+	EventBlockJobReady     = "BLOCK_JOB_READY"
+	EventBlockJobCompleted = "BLOCK_JOB_COMPLETED"
+	EventBlockJobCancelled = "BLOCK_JOB_CANCELLED"
+)
+
+// WaitForBlockJobs waits on events, which must be subscribed before the jobs were started,
+// until the block jobs on all devices sent the event name. A job that ends before, or ends
+// with an error, fails the wait.
+func WaitForBlockJobs(ctx context.Context, events <-chan Event, devices []string, name string) error {
+	pending := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		pending[device] = true
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var jobErr error
+	_, err := WaitForEvent(ctx, events, func(event *Event) bool {
+		var data struct {
+			Device string `json:"device"`
+			Error  string `json:"error"`
+		}
+		if json.Unmarshal(event.Data, &data) != nil || !pending[data.Device] {
+			return false
+		}
+		switch {
+		case data.Error != "":
+			jobErr = fmt.Errorf("block job on %s failed: %s", data.Device, data.Error)
+			return true
+		case event.Name == name:
+			delete(pending, data.Device)
+			return len(pending) == 0
+		case event.Name == EventBlockJobCompleted || event.Name == EventBlockJobCancelled:
+			jobErr = fmt.Errorf("block job on %s ended early (%s)", data.Device, event.Name)
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for block jobs: %w", err)
+	}
+	return jobErr
+}
+
+// MigrateCancel cancels the running outgoing migration; the VM keeps running on the source
+func (c *Client) MigrateCancel(ctx context.Context) error {
+	return c.Execute(ctx, "migrate_cancel", nil, nil)
+}
@@ -0,0 +1,285 @@
+// Package qmp is a client for the QEMU Machine Protocol.
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned for commands on a client whose connection is gone
+var ErrClosed = errors.New("QMP connection closed")
+
+// Error is an error reply from QEMU
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("QMP error: %s - %s", e.Class, e.Desc)
+}
+
+// Version is the QEMU version from the greeting
+type Version struct {
+	QEMU struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Micro int `json:"micro"`
+	} `json:"qemu"`
+	Package string `json:"package"`
+}
+
+// Greeting is the first message QEMU sends on a new connection
+type Greeting struct {
+	Version      Version  `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Event is an asynchronous event, e.g. STOP, RESUME, SHUTDOWN or MIGRATION
+type Event struct {
+	Name      string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Time returns when QEMU emitted the event
+func (e *Event) Time() time.Time {
+	return time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*int64(time.Microsecond))
+}
+
+// message is anything QEMU sends: the greeting, a reply or an event
+type message struct {
+	QMP    *Greeting       `json:"QMP,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Event
+}
+
+type request struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+	ID        string `json:"id"`
+}
+
+// Client sends commands over one QMP connection. Replies are matched to commands by
+// request ID, so it is safe for concurrent use; events go to subscribers.
+type Client struct {
+	conn     net.Conn
+	greeting Greeting
+	nextID   atomic.Uint64
+
+	writeMu sync.Mutex
+	enc     *json.Encoder
+
+	mu          sync.Mutex
+	pending     map[string]chan *message
+	subscribers map[chan Event]struct{}
+	err         error
+	done        chan struct{}
+}
+
+// NewClient reads the greeting on conn and negotiates capabilities. The client owns conn
+// and closes it on Close.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:        conn,
+		enc:         json.NewEncoder(conn),
+		pending:     make(map[string]chan *message),
+		subscribers: make(map[chan Event]struct{}),
+		done:        make(chan struct{}),
+	}
+
+	// Connections through SSH don't support deadlines, so cancelling closes the connection
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	dec := json.NewDecoder(conn)
+	var greeting message
+	err := dec.Decode(&greeting)
+	if !stop() || err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read QMP greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+	c.greeting = *greeting.QMP
+
+	go c.readLoop(dec)
+
+	if err := c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to negotiate QMP capabilities: %w", err)
+	}
+	return c, nil
+}
+
+// Greeting returns what QEMU announced when the connection opened
+func (c *Client) Greeting() Greeting {
+	return c.greeting
+}
+
+// Close closes the connection, failing commands still waiting for replies
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// Done is closed once the connection is gone
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Subscribe returns a channel receiving every event from now on, and a function ending
+// the subscription. Events are dropped for subscribers that fall more than buffer events
+// behind. The channel is closed when the subscription ends or the connection closes.
+func (c *Client) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		close(ch)
+		return ch, func() {}
+	}
+	c.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if _, ok := c.subscribers[ch]; ok {
+				delete(c.subscribers, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// Execute runs command with args, which are marshalled to JSON and may be nil, and
+// unmarshals the reply into result, which may be nil
+func (c *Client) Execute(ctx context.Context, command string, args, result any) error {
+	id := strconv.FormatUint(c.nextID.Add(1), 10)
+	reply := make(chan *message, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.pending[id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	err := c.enc.Encode(request{Execute: command, Arguments: args, ID: id})
+	c.writeMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %w", command, err)
+	}
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return fmt.Errorf("%s: %w", command, c.closeErr())
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%s: %w", command, msg.Error)
+		}
+		if result != nil && len(msg.Return) > 0 {
+			if err := json.Unmarshal(msg.Return, result); err != nil {
+				return fmt.Errorf("failed to parse %s reply: %w", command, err)
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitForEvent waits for the next event accepted by match, e.g. a MIGRATION event with a
+// final status. Subscribe first when the event may arrive before WaitForEvent is called.
+func WaitForEvent(ctx context.Context, events <-chan Event, match func(*Event) bool) (*Event, error) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil, ErrClosed
+			}
+			if match(&event) {
+				return &event, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// readLoop dispatches replies and events until the connection fails
+func (c *Client) readLoop(dec *json.Decoder) {
+	var err error
+	for {
+		var msg message
+		if err = dec.Decode(&msg); err != nil {
+			break
+		}
+
+		c.mu.Lock()
+		switch {
+		case msg.Name != "":
+			for ch := range c.subscribers {
+				select {
+				case ch <- msg.Event:
+				default:
+				}
+			}
+		case msg.ID != "":
+			if reply, ok := c.pending[msg.ID]; ok {
+				reply <- &msg
+				delete(c.pending, msg.ID)
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.err = fmt.Errorf("%w: %w", ErrClosed, err)
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	for ch := range c.subscribers {
+		close(ch)
+		delete(c.subscribers, ch)
+	}
+	c.mu.Unlock()
+	close(c.done)
+}
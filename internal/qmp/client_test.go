@@ -0,0 +1,339 @@
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeQEMU is the QEMU end of a QMP connection, driven by the test
+type fakeQEMU struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+func newFakeQEMU(t *testing.T) (*fakeQEMU, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	return &fakeQEMU{t: t, conn: server, dec: json.NewDecoder(server), enc: json.NewEncoder(server)}, client
+}
+
+func (q *fakeQEMU) send(msg any) {
+	if err := q.enc.Encode(msg); err != nil {
+		q.t.Errorf("sending %v: %v", msg, err)
+	}
+}
+
+func (q *fakeQEMU) greet() {
+	q.send(map[string]any{"QMP": map[string]any{
+		"version":      map[string]any{"qemu": map[string]any{"major": 8, "minor": 2, "micro": 1}, "package": "Debian 1:8.2.1"},
+		"capabilities": []string{"oob"},
+	}})
+}
+
+// next reads the next command, failing the test unless it is command
+func (q *fakeQEMU) next(command string) request {
+	var req struct {
+		request
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := q.dec.Decode(&req); err != nil {
+		q.t.Errorf("reading %s: %v", command, err)
+		return request{}
+	}
+	if req.Execute != command {
+		q.t.Errorf("got command %s, want %s", req.Execute, command)
+	}
+	if req.ID == "" {
+		q.t.Errorf("%s sent without an ID", req.Execute)
+	}
+	req.request.Arguments = req.Arguments
+	return req.request
+}
+
+func (q *fakeQEMU) reply(id string, result any) {
+	q.send(map[string]any{"return": result, "id": id})
+}
+
+func (q *fakeQEMU) event(name string, data any) {
+	q.send(map[string]any{"event": name, "data": data, "timestamp": map[string]any{"seconds": 1700000000, "microseconds": 500}})
+}
+
+// connect returns a client that went through the greeting and capabilities negotiation
+func connect(t *testing.T) (*Client, *fakeQEMU) {
+	t.Helper()
+	qemu, conn := newFakeQEMU(t)
+	go func() {
+		qemu.greet()
+		req := qemu.next("qmp_capabilities")
+		qemu.reply(req.ID, map[string]any{})
+	}()
+	client, err := NewClient(context.Background(), conn)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, qemu
+}
+
+func TestNewClient(t *testing.T) {
+	client, _ := connect(t)
+	greeting := client.Greeting()
+	if v := greeting.Version.QEMU; v.Major != 8 || v.Minor != 2 || v.Micro != 1 {
+		t.Errorf("got version %+v, want 8.2.1", v)
+	}
+	if len(greeting.Capabilities) != 1 || greeting.Capabilities[0] != "oob" {
+		t.Errorf("got capabilities %v, want oob", greeting.Capabilities)
+	}
+
+	// Something other than QEMU on the socket
+	qemu, conn := newFakeQEMU(t)
+	go qemu.event("STOP", nil)
+	if _, err := NewClient(context.Background(), conn); err == nil || !strings.Contains(err.Error(), "greeting") {
+		t.Errorf("got %v for a connection without greeting, want a greeting error", err)
+	}
+
+	// QEMU refusing the capabilities
+	qemu, conn = newFakeQEMU(t)
+	go func() {
+		qemu.greet()
+		req := qemu.next("qmp_capabilities")
+		qemu.send(map[string]any{"error": map[string]any{"class": "CommandNotFound", "desc": "nope"}, "id": req.ID})
+	}()
+	if _, err := NewClient(context.Background(), conn); err == nil || !strings.Contains(err.Error(), "capabilities") {
+		t.Errorf("got %v for refused capabilities, want a negotiation error", err)
+	}
+
+	// A socket that never greets
+	_, conn = newFakeQEMU(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewClient(ctx, conn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v for a silent socket, want the deadline", err)
+	}
+}
+
+func TestExecuteOutOfOrderReplies(t *testing.T) {
+	client, qemu := connect(t)
+	ctx := context.Background()
+
+	type result struct {
+		status    *StatusInfo
+		migration *MigrationInfo
+		err       error
+	}
+	statusDone := make(chan result, 1)
+	migrationDone := make(chan result, 1)
+	go func() {
+		status, err := client.QueryStatus(ctx)
+		statusDone <- result{status: status, err: err}
+	}()
+	first := qemu.next("query-status")
+	go func() {
+		migration, err := client.QueryMigrate(ctx)
+		migrationDone <- result{migration: migration, err: err}
+	}()
+	second := qemu.next("query-migrate")
+
+	// The later command is answered first, with an event and a stray reply in between
+	qemu.reply(second.ID, map[string]any{"status": "active"})
+	qemu.event("RESUME", nil)
+	qemu.reply("no-such-id", map[string]any{"status": "bogus"})
+	qemu.reply(first.ID, map[string]any{"running": true, "status": "running"})
+
+	if r := <-statusDone; r.err != nil || !r.status.Running || r.status.Status != "running" {
+		t.Errorf("query-status got %+v, %v", r.status, r.err)
+	}
+	if r := <-migrationDone; r.err != nil || r.migration.Status != "active" {
+		t.Errorf("query-migrate got %+v, %v", r.migration, r.err)
+	}
+}
+
+func TestExecuteErrorReply(t *testing.T) {
+	client, qemu := connect(t)
+	go func() {
+		req := qemu.next("query-balloon")
+		qemu.send(map[string]any{"error": map[string]any{"class": "DeviceNotActive", "desc": "No balloon device has been activated"}, "id": req.ID})
+	}()
+
+	_, err := client.QueryBalloon(context.Background())
+	var qmpErr *Error
+	if !errors.As(err, &qmpErr) || qmpErr.Class != "DeviceNotActive" {
+		t.Fatalf("got %v, want the DeviceNotActive error", err)
+	}
+	if !strings.Contains(err.Error(), "query-balloon") {
+		t.Errorf("error %q doesn't name the command", err)
+	}
+
+	// Arguments reach QEMU as given, and HMP output counts as failure
+	go func() {
+		req := qemu.next("human-monitor-command")
+		var args map[string]string
+		_ = json.Unmarshal(req.Arguments.(json.RawMessage), &args)
+		if args["command-line"] != "hostfwd_add tcp::8080-:80" {
+			t.Errorf("got arguments %v", args)
+		}
+		qemu.reply(req.ID, "Could not set up host forwarding rule\r\n")
+	}()
+	err = client.HumanMonitorCommand(context.Background(), "hostfwd_add tcp::8080-:80")
+	if err == nil || !strings.Contains(err.Error(), "Could not set up") {
+		t.Fatalf("got %v, want the HMP output as error", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	client, qemu := connect(t)
+	ctx := context.Background()
+	events, unsubscribe := client.Subscribe(8)
+	other, unsubscribeOther := client.Subscribe(1)
+
+	go func() {
+		qemu.event("STOP", nil)
+		qemu.event("MIGRATION", map[string]any{"status": "active"})
+		qemu.event("MIGRATION", map[string]any{"status": "completed"})
+	}()
+	event, err := WaitForEvent(ctx, events, func(event *Event) bool { return event.Name == "STOP" })
+	if err != nil {
+		t.Fatalf("WaitForEvent: %v", err)
+	}
+	if want := time.Unix(1700000000, 500*int64(time.Microsecond)); !event.Time().Equal(want) {
+		t.Errorf("got event time %v, want %v", event.Time(), want)
+	}
+	if err := WaitForMigration(ctx, events); err != nil {
+		t.Fatalf("WaitForMigration: %v", err)
+	}
+
+	// A subscriber that falls behind loses events instead of holding up the others
+	if event := <-other; event.Name != "STOP" {
+		t.Errorf("slow subscriber got %s first, want STOP", event.Name)
+	}
+	unsubscribeOther()
+	unsubscribeOther()
+	for range other {
+	}
+
+	go qemu.event("MIGRATION", map[string]any{"status": "failed"})
+	if err := WaitForMigration(ctx, events); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("got %v, want the migration failure", err)
+	}
+
+	unsubscribe()
+	if _, err := WaitForEvent(ctx, events, func(*Event) bool { return true }); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v after unsubscribing, want ErrClosed", err)
+	}
+}
+
+func TestWaitForBlockJobs(t *testing.T) {
+	client, qemu := connect(t)
+	ctx := context.Background()
+	jobEvent := func(name, device, jobErr string) {
+		data := map[string]any{"device": device, "type": "mirror", "len": 100, "offset": 100, "speed": 0}
+		if jobErr != "" {
+			data["error"] = jobErr
+		}
+		qemu.event(name, data)
+	}
+
+	events, unsubscribe := client.Subscribe(16)
+	defer unsubscribe()
+	go func() {
+		jobEvent(EventBlockJobReady, "virtio0", "")
+		jobEvent(EventBlockJobReady, "ide0", "") // not waited for
+		jobEvent(EventBlockJobReady, "virtio1", "")
+	}()
+	if err := WaitForBlockJobs(ctx, events, []string{"virtio0", "virtio1"}, EventBlockJobReady); err != nil {
+		t.Fatalf("WaitForBlockJobs: %v", err)
+	}
+
+	go jobEvent("BLOCK_JOB_ERROR", "virtio0", "No space left on device")
+	if err := WaitForBlockJobs(ctx, events, []string{"virtio0"}, EventBlockJobReady); err == nil || !strings.Contains(err.Error(), "No space") {
+		t.Errorf("got %v, want the job error", err)
+	}
+
+	go jobEvent(EventBlockJobCancelled, "virtio1", "")
+	if err := WaitForBlockJobs(ctx, events, []string{"virtio1"}, EventBlockJobReady); err == nil || !strings.Contains(err.Error(), "ended early") {
+		t.Errorf("got %v, want the early end reported", err)
+	}
+
+	if err := WaitForBlockJobs(ctx, events, nil, EventBlockJobReady); err != nil {
+		t.Errorf("waiting for no jobs: %v", err)
+	}
+}
+
+func TestCloseFailsPendingCalls(t *testing.T) {
+	client, qemu := connect(t)
+	events, _ := client.Subscribe(1)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Stop(context.Background()) }()
+	qemu.next("stop")
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("pending command got %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pending command still waiting after Close")
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Errorf("Done not closed")
+	}
+	if !isClosed(events) {
+		t.Errorf("subscription still open")
+	}
+
+	if err := client.Cont(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("command after Close got %v, want ErrClosed", err)
+	}
+	if late, _ := client.Subscribe(1); !isClosed(late) {
+		t.Errorf("subscription after Close is open")
+	}
+	if err := client.Quit(context.Background()); err != nil {
+		t.Errorf("Quit on a closed connection: %v", err)
+	}
+}
+
+func isClosed(events <-chan Event) bool {
+	select {
+	case _, ok := <-events:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func TestExecuteContextCancel(t *testing.T) {
+	client, qemu := connect(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.Stop(ctx) }()
+	req := qemu.next("stop")
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the cancellation", err)
+	}
+
+	// A late reply to the abandoned command doesn't confuse the next one
+	qemu.reply(req.ID, map[string]any{})
+	go func() {
+		req := qemu.next("query-status")
+		qemu.reply(req.ID, map[string]any{"running": false, "status": "paused"})
+	}()
+	status, err := client.QueryStatus(context.Background())
+	if err != nil || status.Status != "paused" {
+		t.Fatalf("got %+v, %v, want paused", status, err)
+	}
+}
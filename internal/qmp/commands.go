@@ -0,0 +1,197 @@
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StatusInfo is the run state of the VM
+type StatusInfo struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"` // e.g. running, paused, inmigrate, postmigrate
+}
+
+// QueryStatus returns the VM's run state
+func (c *Client) QueryStatus(ctx context.Context) (*StatusInfo, error) {
+	var status StatusInfo
+	if err := c.Execute(ctx, "query-status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Stop pauses the VM
+func (c *Client) Stop(ctx context.Context) error {
+	return c.Execute(ctx, "stop", nil, nil)
+}
+
+// Cont resumes a paused VM, or one that finished an incoming migration
+func (c *Client) Cont(ctx context.Context) error {
+	return c.Execute(ctx, "cont", nil, nil)
+}
+
+// SystemPowerdown asks the guest to power off, like pressing the power button
+func (c *Client) SystemPowerdown(ctx context.Context) error {
+	return c.Execute(ctx, "system_powerdown", nil, nil)
+}
+
+// Quit exits QEMU immediately. QEMU may close the connection before replying, which
+// counts as success.
+func (c *Client) Quit(ctx context.Context) error {
+	err := c.Execute(ctx, "quit", nil, nil)
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// KeyValue is a key for SendKey, by QEMU key code name, e.g. "ctrl" or "a"
+type KeyValue struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// SendKey presses the keys named by their QEMU key code names together and releases them
+func (c *Client) SendKey(ctx context.Context, keys ...string) error {
+	values := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, KeyValue{Type: "qcode", Data: key})
+	}
+	return c.Execute(ctx, "send-key", map[string]any{"keys": values}, nil)
+}
+
+// MigrationCapability turns a migration capability on or off
+type MigrationCapability struct {
+	Capability string `json:"capability"`
+	State      bool   `json:"state"`
+}
+
+// MigrateSetCapabilities sets migration capabilities; both ends of a migration need the same ones
+func (c *Client) MigrateSetCapabilities(ctx context.Context, capabilities ...MigrationCapability) error {
+	return c.Execute(ctx, "migrate-set-capabilities", map[string]any{"capabilities": capabilities}, nil)
+}
+
+// MigrationParameters tunes migrations. Zero fields are left unchanged.
+type MigrationParameters struct {
+	MaxBandwidth   *int64 `json:"max-bandwidth,omitempty"`    // bytes per second, 0 for unlimited
+	DowntimeLimit  int64  `json:"downtime-limit,omitempty"`   // milliseconds
+	MaxCPUThrottle int    `json:"max-cpu-throttle,omitempty"` // percent
+}
+
+// MigrateSetParameters sets migration parameters
+func (c *Client) MigrateSetParameters(ctx context.Context, params MigrationParameters) error {
+	return c.Execute(ctx, "migrate-set-parameters", params, nil)
+}
+
+// Migrate starts migrating the VM's state to uri, e.g. "exec:cat > file". It returns once
+// the migration started; wait with WaitForMigration.
+func (c *Client) Migrate(ctx context.Context, uri string) error {
+	return c.Execute(ctx, "migrate", map[string]any{"uri": uri}, nil)
+}
+
+// MigrateIncoming starts loading state from uri into a QEMU started with -incoming defer.
+// It returns once the migration started; wait with WaitForMigration.
+func (c *Client) MigrateIncoming(ctx context.Context, uri string) error {
+	return c.Execute(ctx, "migrate-incoming", map[string]any{"uri": uri}, nil)
+}
+
+// MigrationInfo is the state of the current or last migration
+type MigrationInfo struct {
+	Status           string `json:"status"`
+	TotalTime        int64  `json:"total-time,omitempty"`        // milliseconds
+	ExpectedDowntime int64  `json:"expected-downtime,omitempty"` // milliseconds
+	Downtime         int64  `json:"downtime,omitempty"`          // milliseconds
+	SetupTime        int64  `json:"setup-time,omitempty"`        // milliseconds
+	ErrorDesc        string `json:"error-desc,omitempty"`
+	RAM              *struct {
+		Transferred    int64   `json:"transferred"`  // bytes
+		Remaining      int64   `json:"remaining"`    // bytes
+		Total          int64   `json:"total"`        // bytes
+		Duplicate      int64   `json:"duplicate"`    // pages
+		Skipped        int64   `json:"skipped"`      // pages
+		Normal         int64   `json:"normal"`       // pages
+		NormalBytes    int64   `json:"normal-bytes"` // bytes
+		DirtyPages     int64   `json:"dirty-pages-rate"`
+		MBps           float64 `json:"mbps"` // MB/s
+		DirtySyncCount int64   `json:"dirty-sync-count"`
+	} `json:"ram,omitempty"`
+}
+
+// QueryMigrate returns the migration state; Status is "none" when there was no migration
+func (c *Client) QueryMigrate(ctx context.Context) (*MigrationInfo, error) {
+	var info MigrationInfo
+	if err := c.Execute(ctx, "query-migrate", nil, &info); err != nil {
+		return nil, err
+	}
+	if info.Status == "" {
+		info.Status = "none"
+	}
+	return &info, nil
+}
+
+// Migration statuses that end a migration
+const (
+	MigrationCompleted = "completed"
+	MigrationFailed    = "failed"
+	MigrationCancelled = "cancelled"
+)
+
+// MigrationPreSwitchover is the status a migration with the pause-before-switchover
+// capability waits in, with the VM stopped, until MigrateContinue
+const MigrationPreSwitchover = "pre-switchover"
+
+// WaitForMigration waits for the MIGRATION event ending the migration on events, which
+// must be subscribed before the migration was started, and fails unless it completed
+func WaitForMigration(ctx context.Context, events <-chan Event) error {
+	return WaitForMigrationStatus(ctx, events, MigrationCompleted)
+}
+
+// WaitForMigrationStatus waits for the MIGRATION event reporting status on events, which
+// must be subscribed before the migration was started. A migration that ends otherwise
+// fails the wait.
+func WaitForMigrationStatus(ctx context.Context, events <-chan Event, want string) error {
+	var status string
+	_, err := WaitForEvent(ctx, events, func(event *Event) bool {
+		if event.Name != "MIGRATION" {
+			return false
+		}
+		var data struct {
+			Status string `json:"status"`
+		}
+		if json.Unmarshal(event.Data, &data) != nil {
+			return false
+		}
+		status = data.Status
+		return status == want || status == MigrationCompleted || status == MigrationFailed || status == MigrationCancelled
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for migration: %w", err)
+	}
+	if status != want {
+		return fmt.Errorf("migration %s", status)
+	}
+	return nil
+}
+
+// MigrateContinue lets a migration paused in status go on, e.g. MigrationPreSwitchover
+func (c *Client) MigrateContinue(ctx context.Context, status string) error {
+	return c.Execute(ctx, "migrate-continue", map[string]any{"state": status}, nil)
+}
+
+// HumanMonitorCommand runs a human monitor (HMP) command line, for commands QMP has no
+// equivalent of, e.g. hostfwd_add. HMP commands report failure as text rather than as an
+// error, so any output is returned as one.
+func (c *Client) HumanMonitorCommand(ctx context.Context, commandLine string) error {
+	var output string
+	args := map[string]any{"command-line": commandLine}
+	if err := c.Execute(ctx, "human-monitor-command", args, &output); err != nil {
+		return err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%s: %s", commandLine, output)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// BlockStats are the I/O counters of a block device since QEMU started
+type BlockStats struct {
+	ReadBytes        int64 `json:"rd_bytes"`
+	WriteBytes       int64 `json:"wr_bytes"`
+	ReadOperations   int64 `json:"rd_operations"`
+	WriteOperations  int64 `json:"wr_operations"`
+	FlushOperations  int64 `json:"flush_operations"`
+	ReadTotalTimeNs  int64 `json:"rd_total_time_ns"`
+	WriteTotalTimeNs int64 `json:"wr_total_time_ns"`
+}
+
+// DeviceBlockStats are the counters of one block device
+type DeviceBlockStats struct {
+	Device   string     `json:"device"`
+	NodeName string     `json:"node-name"`
+	Stats    BlockStats `json:"stats"`
+}
+
+// QueryBlockStats returns the I/O counters of all block devices
+func (c *Client) QueryBlockStats(ctx context.Context) ([]DeviceBlockStats, error) {
+	var stats []DeviceBlockStats
+	if err := c.Execute(ctx, "query-blockstats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// BalloonInfo is the size of guest RAM left to the guest by the balloon
+type BalloonInfo struct {
+	Actual int64 `json:"actual"` // bytes
+}
+
+// QueryBalloon returns the balloon state. It fails with class DeviceNotActive when the
+// VM has no balloon device.
+func (c *Client) QueryBalloon(ctx context.Context) (*BalloonInfo, error) {
+	var info BalloonInfo
+	if err := c.Execute(ctx, "query-balloon", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Stats targets
+const (
+	StatsTargetVM   = "vm"
+	StatsTargetVCPU = "vcpu"
+)
+
+// StatsResult are the statistics one provider, e.g. "kvm", keeps for one object, e.g. a vCPU
+type StatsResult struct {
+	Provider string `json:"provider"`
+	QOMPath  string `json:"qom-path,omitempty"`
+	Stats    []struct {
+		Name  string          `json:"name"`
+		Value json.RawMessage `json:"value"` // a number, bool or histogram
+	} `json:"stats"`
+}
+
+// Counters returns the statistics with plain numeric values
+func (r *StatsResult) Counters() map[string]uint64 {
+	counters := make(map[string]uint64, len(r.Stats))
+	for _, stat := range r.Stats {
+		var value uint64
+		if json.Unmarshal(stat.Value, &value) == nil {
+			counters[stat.Name] = value
+		}
+	}
+	return counters
+}
+
+// QueryStats returns the statistics QEMU's providers keep for target, one of the
+// StatsTarget* constants
+func (c *Client) QueryStats(ctx context.Context, target string) ([]StatsResult, error) {
+	var results []StatsResult
+	if err := c.Execute(ctx, "query-stats", map[string]any{"target": target}, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
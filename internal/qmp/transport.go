@@ -0,0 +1,58 @@
+package qmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Dialer opens stream connections; *ssh.Client is one, reaching unix sockets on the
+// remote host through the SSH connection
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Dial connects to the QMP unix socket at path through dialer
+func Dial(ctx context.Context, dialer Dialer, path string) (*Client, error) {
+	conn, err := DialUnix(ctx, dialer, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP socket %s: %w", path, err)
+	}
+	return NewClient(ctx, conn)
+}
+
+// DialLocal connects to the QMP unix socket at path on this host
+func DialLocal(ctx context.Context, path string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP socket %s: %w", path, err)
+	}
+	return NewClient(ctx, conn)
+}
+
+// DialUnix connects to the unix socket at path through dialer, which doesn't take a
+// context, giving up when ctx is done
+func DialUnix(ctx context.Context, dialer Dialer, path string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial("unix", path)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -2,7 +2,11 @@ package sshserver
 
 import (
 	"bytes"
+	"fmt"
+	"net/netip"
+	"shellbox/internal/infra"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -16,6 +20,26 @@ const (
 	ActionVersion = "version"
 	ActionWhoami  = "whoami"
 	ActionError   = "error"
+
+	ActionRestartPolicy = "restart-policy"
+	ActionTop           = "top"
+	ActionCompact       = "compact"
+	ActionPolicy        = "policy"
+	ActionStatus        = "status"
+	ActionExpose        = "expose"
+	ActionExposures     = "exposures"
+	ActionPreview       = "preview"
+	ActionWebLogin      = "web-login"
+
+	// Admin actions, only available to the server's admin keys
+	ActionAdminMigrate = "admin-migrate"
+)
+
+// Resume modes of the connect command, for boxes that were not shut down cleanly
+const (
+	ResumeAsk        = "ask"        // ask the user whether to resume from the latest checkpoint
+	ResumeCheckpoint = "checkpoint" // resume from the latest checkpoint
+	ResumeFresh      = "fresh"      // start the box afresh
 )
 
 // CommandContext represents the SSH session context
@@ -31,6 +55,12 @@ type CommandResult struct {
 	Args     []string // Command arguments
 	Output   string   // Help/error messages from Cobra
 	ExitCode int
+	Runtime  string              // Box runtime for spinup, one of the infra.BoxRuntime* constants
+	Resume   string              // Resume mode for connect, one of the Resume* constants
+	Egress   *infra.EgressPolicy // Egress policy to set for policy, nil to show it
+	Port     int                 // Box port for expose
+	Allow    []netip.Prefix      // Sources allowed to connect for expose, empty for the caller's address
+	Public   *bool               // Whether preview makes the port public or private again, nil to leave it
 }
 
 // parseCommand parses an SSH command using Cobra and returns the result
@@ -91,27 +121,201 @@ func createCobraCommand(result *CommandResult) *cobra.Command {
 	rootCmd.SetHelpCommand(&cobra.Command{Hidden: true})
 
 	// spinup command
+	var runtime string
 	spinupCmd := &cobra.Command{
 		Use:   ActionSpinup + " [box_name]",
 		Short: "Create and start a development box",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
+			if runtime != infra.BoxRuntimeVM && runtime != infra.BoxRuntimeBridgedVM && runtime != infra.BoxRuntimeContainer {
+				return fmt.Errorf("invalid runtime %q: must be %s, %s or %s", runtime, infra.BoxRuntimeVM, infra.BoxRuntimeBridgedVM, infra.BoxRuntimeContainer)
+			}
 			result.Action = ActionSpinup
 			result.Args = args
 			result.ExitCode = 0
+			result.Runtime = runtime
 			return nil
 		},
 	}
+	spinupCmd.Flags().StringVar(&runtime, "runtime", infra.BoxRuntimeVM, "box runtime: vm for a full VM, vm-bridged for a full VM with faster bridged networking, container for a lightweight container")
 
 	// connect command
+	var resume string
 	connectCmd := &cobra.Command{
 		Use:   ActionConnect + " <box_name>",
 		Short: "Connect to an existing development box",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(_ *cobra.Command, args []string) error {
+			if resume != ResumeAsk && resume != ResumeCheckpoint && resume != ResumeFresh {
+				return fmt.Errorf("invalid resume mode %q: must be %s, %s or %s", resume, ResumeAsk, ResumeCheckpoint, ResumeFresh)
+			}
 			result.Action = ActionConnect
 			result.Args = args
 			result.ExitCode = 0
+			result.Resume = resume
+			return nil
+		},
+	}
+	connectCmd.Flags().StringVar(&resume, "resume", ResumeAsk, "after an unclean shutdown: ask, checkpoint to resume from the latest checkpoint, fresh to start afresh")
+
+	// restart-policy command
+	restartPolicyCmd := &cobra.Command{
+		Use:   ActionRestartPolicy + " <box_name> [never|on-crash|always]",
+		Short: "Show or set what happens when a running box crashes",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			if len(args) == 2 && !infra.IsValidRestartPolicy(args[1]) {
+				return fmt.Errorf("invalid restart policy %q: must be %s, %s or %s", args[1], infra.RestartNever, infra.RestartOnCrash, infra.RestartAlways)
+			}
+			result.Action = ActionRestartPolicy
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+
+	// top command
+	topCmd := &cobra.Command{
+		Use:   ActionTop + " <box_name>",
+		Short: "Show recent resource usage of a running box",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			result.Action = ActionTop
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+
+	// compact command
+	compactCmd := &cobra.Command{
+		Use:   ActionCompact + " <box_name>",
+		Short: "Hand a running box's free memory back and shrink its saved memory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			result.Action = ActionCompact
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+
+	// policy command
+	policyCmd := &cobra.Command{
+		Use:   ActionPolicy + " <box_name> egress [allow-all|deny-all|allow <destination>...]",
+		Short: "Show or set where a running box may connect to",
+		Long: `Show or set where a running box may connect to. Destinations are hostnames,
+IP addresses or CIDRs with an optional port, e.g. github.com:22 or 10.1.0.0/16.`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			if args[1] != "egress" {
+				return fmt.Errorf("unknown policy %q: must be egress", args[1])
+			}
+			if len(args) > 2 {
+				policy, err := parseEgressPolicy(args[2:])
+				if err != nil {
+					return err
+				}
+				result.Egress = policy
+			}
+			result.Action = ActionPolicy
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+
+	// status command
+	statusCmd := &cobra.Command{
+		Use:   ActionStatus + " <box_name>",
+		Short: "Show the status of a running box",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			result.Action = ActionStatus
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+
+	// expose command
+	var allow []string
+	exposeCmd := &cobra.Command{
+		Use:   ActionExpose + " <box_name> <port>",
+		Short: "Make a port of a running box reachable through the server",
+		Long: `Make a TCP port of a running box reachable on a random port of the server. Only
+your current address may connect unless --allow lists the addresses that may.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			port, err := strconv.Atoi(args[1])
+			if err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid port %q", args[1])
+			}
+			prefixes, err := parseAllowedSources(allow)
+			if err != nil {
+				return err
+			}
+			result.Action = ActionExpose
+			result.Args = args
+			result.Port = port
+			result.Allow = prefixes
+			result.ExitCode = 0
+			return nil
+		},
+	}
+	exposeCmd.Flags().StringSliceVar(&allow, "allow", nil, "IP addresses or CIDRs that may connect, instead of your current address")
+
+	// exposures command
+	exposuresCmd := &cobra.Command{
+		Use:   ActionExposures,
+		Short: "List the exposed ports of your boxes",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			result.Action = ActionExposures
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+
+	// preview command
+	var public, private bool
+	previewCmd := &cobra.Command{
+		Use:   ActionPreview + " <box_name> <port>",
+		Short: "Print an HTTPS link to a web server of a running box",
+		Long: `Print an HTTPS link to a web server of a running box. The link signs you in to
+the preview; other visitors are turned away unless the port is made public.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			port, err := strconv.Atoi(args[1])
+			if err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid port %q", args[1])
+			}
+			result.Action = ActionPreview
+			result.Args = args
+			result.Port = port
+			switch {
+			case public && private:
+				return fmt.Errorf("--public and --private exclude each other")
+			case public, private:
+				result.Public = &public
+			}
+			result.ExitCode = 0
+			return nil
+		},
+	}
+	previewCmd.Flags().BoolVar(&public, "public", false, "let anyone open the preview without a link")
+	previewCmd.Flags().BoolVar(&private, "private", false, "require a link to open the preview again")
+
+	// web-login command
+	webLoginCmd := &cobra.Command{
+		Use:   ActionWebLogin + " [box_name]",
+		Short: "Print a link that signs a browser in to the web terminal",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			result.Action = ActionWebLogin
+			result.Args = args
+			result.ExitCode = 0
 			return nil
 		},
 	}
@@ -155,11 +359,74 @@ func createCobraCommand(result *CommandResult) *cobra.Command {
 		},
 	}
 
-	rootCmd.AddCommand(spinupCmd, connectCmd, helpCmd, versionCmd, whoamiCmd)
+	// admin commands, hidden from help since only admin keys may run them
+	adminCmd := &cobra.Command{
+		Use:    "admin",
+		Short:  "Operate the shellbox deployment",
+		Hidden: true,
+	}
+	adminMigrateCmd := &cobra.Command{
+		Use:   "migrate <instance_id>",
+		Short: "Live-migrate the box running on an instance to a free instance",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			result.Action = ActionAdminMigrate
+			result.Args = args
+			result.ExitCode = 0
+			return nil
+		},
+	}
+	adminCmd.AddCommand(adminMigrateCmd)
+
+	rootCmd.AddCommand(spinupCmd, connectCmd, restartPolicyCmd, topCmd, compactCmd, policyCmd, statusCmd, exposeCmd, exposuresCmd, previewCmd, webLoginCmd, helpCmd, versionCmd, whoamiCmd, adminCmd)
 
 	return rootCmd
 }
 
+// parseEgressPolicy parses the egress policy arguments of the policy command
+func parseEgressPolicy(args []string) (*infra.EgressPolicy, error) {
+	var policy *infra.EgressPolicy
+	switch args[0] {
+	case infra.EgressAllowAll, infra.EgressDenyAll:
+		policy = &infra.EgressPolicy{Mode: args[0]}
+		if len(args) > 1 {
+			return nil, fmt.Errorf("%s takes no destinations", args[0])
+		}
+	case "allow":
+		policy = &infra.EgressPolicy{Mode: infra.EgressAllowlist}
+		for _, arg := range args[1:] {
+			rule, err := infra.ParseEgressRule(arg)
+			if err != nil {
+				return nil, err
+			}
+			policy.Allow = append(policy.Allow, rule)
+		}
+	default:
+		return nil, fmt.Errorf("invalid egress policy %q: must be %s, %s or allow <destination>...", args[0], infra.EgressAllowAll, infra.EgressDenyAll)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// parseAllowedSources parses the IP addresses and CIDRs of the expose command's --allow flag
+func parseAllowedSources(sources []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(sources))
+	for _, source := range sources {
+		if addr, err := netip.ParseAddr(source); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q: must be an IP address or CIDR", source)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 // parseArgs splits a command line into arguments
 // Simple implementation - could be enhanced for quotes, escaping, etc.
 func ParseArgs(cmdLine string) []string {
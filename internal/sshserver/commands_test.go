@@ -0,0 +1,31 @@
+package sshserver
+
+import (
+	"testing"
+
+	"shellbox/internal/infra"
+)
+
+func TestParseSpinupRuntime(t *testing.T) {
+	for _, tt := range []struct {
+		cmdLine string
+		runtime string // empty if the command is refused
+	}{
+		{"spinup dev1", infra.BoxRuntimeVM},
+		{"spinup dev1 --runtime container", infra.BoxRuntimeContainer},
+		{"spinup --runtime=container dev1", infra.BoxRuntimeContainer},
+		{"spinup dev1 --runtime vm-bridged", infra.BoxRuntimeBridgedVM},
+		{"spinup dev1 --runtime docker", ""},
+	} {
+		result := parseCommand(tt.cmdLine)
+		if tt.runtime == "" {
+			if result.Action != ActionError || result.ExitCode != 1 {
+				t.Errorf("%s: got %+v, want it refused", tt.cmdLine, result)
+			}
+			continue
+		}
+		if result.Action != ActionSpinup || result.Runtime != tt.runtime || len(result.Args) != 1 || result.Args[0] != "dev1" {
+			t.Errorf("%s: got %+v, want spinup of dev1 with runtime %s", tt.cmdLine, result, tt.runtime)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package sshserver
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// spinnerFrames are the frames of the spinner shown next to a running step on a PTY
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+const spinnerInterval = 100 * time.Millisecond
+
+// sessionProgress renders allocation steps on the user's stderr. With a PTY the running
+// step gets an animated spinner with a live timer; without one (e.g. when output is piped)
+// every step start and finish is printed as a plain line.
+type sessionProgress struct {
+	w   io.Writer
+	pty bool
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newSessionProgress(w io.Writer, pty bool) *sessionProgress {
+	return &sessionProgress{w: w, pty: pty}
+}
+
+// StepStarted implements infra.ProgressOutput
+func (p *sessionProgress) StepStarted(name string) {
+	if !p.pty {
+		fmt.Fprintf(p.w, "==> %s...\n", name)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go p.spin(name, time.Now(), p.stop, p.stopped)
+}
+
+// StepFinished implements infra.ProgressOutput
+func (p *sessionProgress) StepFinished(name string, elapsed time.Duration, err error) {
+	if !p.pty {
+		if err != nil {
+			fmt.Fprintf(p.w, "    %s failed after %s: %v\n", name, formatElapsed(elapsed), err)
+			return
+		}
+		fmt.Fprintf(p.w, "    %s done in %s\n", name, formatElapsed(elapsed))
+		return
+	}
+
+	p.mu.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		<-p.stopped
+		p.stop = nil
+	}
+	p.mu.Unlock()
+
+	mark := "✓"
+	if err != nil {
+		mark = "✗"
+	}
+	// PTYs need an explicit carriage return, and \033[K clears what's left of the spinner line
+	fmt.Fprintf(p.w, "\r\033[K%s %s (%s)\r\n", mark, name, formatElapsed(elapsed))
+}
+
+func (p *sessionProgress) spin(name string, start time.Time, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(spinnerInterval)
+	defer ticker.Stop()
+
+	for frame := 0; ; frame++ {
+		fmt.Fprintf(p.w, "\r\033[K%s %s (%s)", spinnerFrames[frame%len(spinnerFrames)], name, formatElapsed(time.Since(start)))
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func formatElapsed(d time.Duration) string {
+	return d.Round(100 * time.Millisecond).String()
+}
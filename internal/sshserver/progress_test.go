@@ -0,0 +1,73 @@
+package sshserver
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a strings.Builder safe for the spinner to write to
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestSessionProgressPlain(t *testing.T) {
+	var out syncBuffer
+	progress := newSessionProgress(&out, false)
+	progress.StepStarted("Attaching disk")
+	progress.StepFinished("Attaching disk", 1234*time.Millisecond, nil)
+	progress.StepStarted("Starting QEMU")
+	progress.StepFinished("Starting QEMU", 50*time.Millisecond, errors.New("no KVM"))
+
+	want := "==> Attaching disk...\n    Attaching disk done in 1.2s\n==> Starting QEMU...\n    Starting QEMU failed after 100ms: no KVM\n"
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSessionProgressSpinner(t *testing.T) {
+	var out syncBuffer
+	progress := newSessionProgress(&out, true)
+	progress.StepStarted("Attaching disk")
+	time.Sleep(3 * spinnerInterval)
+	progress.StepFinished("Attaching disk", 300*time.Millisecond, nil)
+	spun := out.String()
+	progress.StepStarted("Starting QEMU")
+	progress.StepFinished("Starting QEMU", time.Second, errors.New("no KVM"))
+
+	// The spinner redraws the step's line until it ends, replaced by the result
+	if frames := strings.Count(spun, "\r\033[K"); frames < 3 {
+		t.Errorf("got %d redraws, want the spinner to animate:\n%q", frames, spun)
+	}
+	if !strings.HasPrefix(spun, "\r\033[K"+spinnerFrames[0]+" Attaching disk (") || !strings.Contains(spun, spinnerFrames[1]) {
+		t.Errorf("got %q, want spinner frames", spun)
+	}
+	if !strings.HasSuffix(spun, "\r\033[K✓ Attaching disk (300ms)\r\n") {
+		t.Errorf("got %q, want the finished step", spun)
+	}
+	if got := out.String(); !strings.HasSuffix(got, "\r\033[K✗ Starting QEMU (1s)\r\n") {
+		t.Errorf("got %q, want the failed step", got)
+	}
+
+	// Nothing is drawn once the step finished
+	written := out.String()
+	time.Sleep(2 * spinnerInterval)
+	if out.String() != written {
+		t.Errorf("spinner still running after the step finished")
+	}
+}
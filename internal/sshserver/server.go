@@ -5,12 +5,18 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/netip"
 	"shellbox/internal/infra"
-	"shellbox/internal/sshutil"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	gssh "github.com/gliderlabs/ssh" // alias to avoid confusion with crypto/ssh
@@ -22,37 +28,65 @@ import (
 type Server struct {
 	port         int
 	boxSSHConfig *ssh.ClientConfig
-	clients      *infra.AzureClients
+	dialBox      func(ctx context.Context, network, addr string) (net.Conn, error)
+	provider     *infra.Provider
 	allocator    *infra.ResourceAllocator
 	logger       *slog.Logger
+
+	// FIFO queues for users waiting on pool capacity
+	instanceQueue *infra.AllocationQueue
+	volumeQueue   *infra.AllocationQueue
+
+	// Live shell sessions per instance and when the last one on an instance ended, see
+	// HasActiveSession and LastSessionEnded
+	sessionsMu     sync.Mutex
+	activeSessions map[string]map[*liveSession]struct{}
+	sessionsEnded  map[string]time.Time
+
+	// User IDs allowed to run admin commands, see LoadAdminKeys
+	admins map[string]bool
+
+	// Resource usage of running boxes for the top command, see SetBoxMetrics
+	metrics *infra.BoxMetricsCollector
+
+	// Exposed ports of boxes, ended when their box is released
+	exposures *infra.ExposureManager
+
+	// HTTPS previews of box ports, see SetPreviewProxy
+	preview *infra.PreviewProxy
+
+	// Browser terminal, see EnableWebTerminal
+	web *webTerminal
 }
 
-// New creates a new SSH server instance
-func New(port int, clients *infra.AzureClients) (*Server, error) {
-	// Load SSH key from local filesystem (copied during deployment)
-	privateKey, _, err := sshutil.LoadKeyPair()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load SSH key from file: %w", err)
-	}
+// boxDialTimeout bounds connecting to a box's SSH port
+const boxDialTimeout = 10 * time.Second
 
-	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
-	}
+// New creates a new SSH server instance, logging in to boxes with signer
+func New(port int, signer ssh.Signer, provider *infra.Provider, pool *infra.BoxPool) *Server {
+	allocator := infra.NewResourceAllocator(provider)
+
+	// Waiting users are served as soon as the pool reports new capacity
+	instanceQueue := infra.NewAllocationQueue(infra.ResourceRoleInstance, pool)
+	volumeQueue := infra.NewAllocationQueue(infra.ResourceRoleVolume, pool)
+	pool.OnCapacityAdded(infra.ResourceRoleInstance, instanceQueue.Notify)
+	pool.OnCapacityAdded(infra.ResourceRoleVolume, volumeQueue.Notify)
 
-	// Create resource allocator
-	resourceQueries := infra.NewResourceGraphQueries(
-		clients.ResourceGraphClient,
-		clients.SubscriptionID,
-		clients.ResourceGroupName,
-	)
-	allocator := infra.NewResourceAllocator(clients, resourceQueries)
+	exposures := infra.NewExposureManager(allocator)
+	allocator.OnRelease(exposures.ReleaseInstance)
 
+	boxDialer := &net.Dialer{Timeout: boxDialTimeout}
 	return &Server{
-		port:      port,
-		clients:   clients,
-		allocator: allocator,
-		logger:    infra.NewLogger(),
+		port:           port,
+		dialBox:        boxDialer.DialContext,
+		provider:       provider,
+		allocator:      allocator,
+		instanceQueue:  instanceQueue,
+		volumeQueue:    volumeQueue,
+		exposures:      exposures,
+		activeSessions: make(map[string]map[*liveSession]struct{}),
+		sessionsEnded:  make(map[string]time.Time),
+		logger:         infra.NewLogger(),
 		boxSSHConfig: &ssh.ClientConfig{
 			User: infra.SystemUserUbuntu,
 			Auth: []ssh.AuthMethod{
@@ -63,20 +97,47 @@ func New(port int, clients *infra.AzureClients) (*Server, error) {
 			// 2. Connections are within Azure VNet with strict NSG rules
 			// 3. Network architecture prevents MITM attacks (see network.txt)
 			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         10 * time.Second,
+			Timeout:         boxDialTimeout,
 		},
-	}, nil
+	}
+}
+
+// Allocator returns the resource allocator the server connects users with
+func (s *Server) Allocator() *infra.ResourceAllocator {
+	return s.allocator
+}
+
+// RecoverAllocations takes over the running boxes a previous server process left behind
+// and rolls back its unfinished allocations
+func (s *Server) RecoverAllocations(ctx context.Context) error {
+	return s.allocator.RecoverAllocations(ctx)
+}
+
+// SetBoxMetrics sets where the top command reads the resource usage of boxes from
+func (s *Server) SetBoxMetrics(metrics *infra.BoxMetricsCollector) {
+	s.metrics = metrics
+}
+
+// Exposures returns the exposed and forwarded ports of the boxes connected through the server
+func (s *Server) Exposures() *infra.ExposureManager {
+	return s.exposures
+}
+
+// SetPreviewProxy enables the preview command with the proxy serving previews
+func (s *Server) SetPreviewProxy(preview *infra.PreviewProxy) {
+	s.preview = preview
 }
 
 // dialBoxAtIP establishes connection to the box at specified IP with retry logic
-func (s *Server) dialBoxAtIP(boxIP string) (*ssh.Client, error) {
+func (s *Server) dialBoxAtIP(ctx context.Context, boxIP string) (*ssh.Client, error) {
 	var client *ssh.Client
 	var lastErr error
 
 	// Use RetryOperation to handle connection attempts with retries
-	err := infra.RetryOperation(context.Background(), func(_ context.Context) error {
+	addr := net.JoinHostPort(boxIP, strconv.Itoa(infra.BoxSSHPort))
+	err := infra.RetryOperation(ctx, func(ctx context.Context) error {
 		var err error
-		client, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", boxIP, infra.BoxSSHPort), s.boxSSHConfig)
+		client, err = s.dialBoxSSH(ctx, addr)
 		if err != nil {
 			lastErr = err
 			return fmt.Errorf("SSH connection not yet ready: %w", err)
@@ -84,12 +145,30 @@ func (s *Server) dialBoxAtIP(boxIP string) (*ssh.Client, error) {
 		return nil
 	}, 30*time.Second, 500*time.Millisecond, "SSH connectivity to box")
 	if err != nil {
+		if lastErr == nil {
+			// Cancelled before the first attempt
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to connect after retries: %w", lastErr)
 	}
 
 	return client, nil
 }
 
+// dialBoxSSH opens an SSH connection to the box at addr
+func (s *Server) dialBoxSSH(ctx context.Context, addr string) (*ssh.Client, error) {
+	conn, err := s.dialBox(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, s.boxSSHConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
 // handleSCP handles SCP file transfer sessions
 func (s *Server) handleSCP(_ gssh.Session) error {
 	// TODO: For now, SCP will need resource allocation similar to shell sessions
@@ -129,6 +208,7 @@ Usage:
 
 Examples:
   ssh shellbox.dev connect dev1
+  ssh shellbox.dev restart-policy dev1 always
   ssh shellbox.dev spinup myproject
 
 For more help:
@@ -142,7 +222,7 @@ For more help:
 	}
 }
 
-func (s *Server) handleShellSession(ctx CommandContext, sess gssh.Session, resources *infra.AllocatedResources) {
+func (s *Server) handleShellSession(ctx CommandContext, sess gssh.Session, resources *infra.AllocatedResources, timings []infra.StepTiming) {
 	if _, err := sess.Write([]byte("\n\nHI FROM SHELLBOX!\n\n")); err != nil {
 		s.logger.Error("Error writing to SSH session", "error", err)
 		return
@@ -151,6 +231,9 @@ func (s *Server) handleShellSession(ctx CommandContext, sess gssh.Session, resou
 	// Generate session ID for logging
 	sessionID := fmt.Sprintf("sess_%d", time.Now().UnixNano())
 
+	live, untrack := s.trackSession(resources.InstanceID, sess.Stderr())
+	defer untrack()
+
 	// Log the allocated resources
 	s.logger.Info("starting shell session", "sessionID", sessionID, "userKeyHash", ctx.UserID, "instanceID", resources.InstanceID, "volumeID", resources.VolumeID)
 
@@ -164,32 +247,30 @@ func (s *Server) handleShellSession(ctx CommandContext, sess gssh.Session, resou
 		SessionID:    sessionID,
 		UserKey:      ctx.UserID,
 		BoxID:        resources.InstanceID,
-		Details:      fmt.Sprintf(`{"remote_addr":%q,"instanceIP":%q,"volumeID":%q}`, sess.RemoteAddr(), resources.InstanceIP, resources.VolumeID),
+		Details:      fmt.Sprintf(`{"remote_addr":%q,"instanceIP":%q,"volumeID":%q,"runtime":%q}`, sess.RemoteAddr(), resources.InstanceIP, resources.VolumeID, resources.Runtime),
 	}
-	if err := infra.WriteEventLog(context.Background(), s.clients, &sessionEvent); err != nil {
+	if err := s.provider.Events.WriteEvent(context.Background(), &sessionEvent); err != nil {
 		s.logger.Warn("Failed to log session start event", "error", err)
 	}
 
+	// The box outlives the session, so its user can come back to it, e.g. after a dropped
+	// connection. The orphan reconciler releases boxes that go without a session for long.
 	bctx := context.Background()
-	// XXXXXXX
-	// Ensure resources are cleaned
-	// defer func() {
-	// 	s.logger.Info("releasing resources", "sessionID", sessionID)
-	// 	if err := s.allocator.ReleaseResources(bctx, resources.InstanceID, resources.VolumeID); err != nil {
-	// 		s.logger.Error("Failed to release resources", "error", err, "sessionID", sessionID)
-	// 	}
-	// }()
 
 	// Connect to allocated instance
-	client, err := s.dialBoxAtIP(resources.InstanceIP)
+	client, err := s.dialBoxAtIP(sess.Context(), resources.InstanceIP)
 	if err != nil {
 		s.logger.Error("Failed to connect to allocated instance", "error", err, "sessionID", sessionID)
 		fmt.Fprintf(sess.Stderr(), "Error connecting to allocated instance: %v\n", err)
 		return
 	}
-	defer client.Close()
 
-	// Log successful resource allocation and connection
+	// Log successful resource allocation and connection, including how long each allocation step took
+	stepsJSON, err := json.Marshal(timings)
+	if err != nil {
+		s.logger.Warn("Failed to encode allocation step timings", "error", err)
+		stepsJSON = []byte("[]")
+	}
 	connectEvent := infra.EventLogEntity{
 		PartitionKey: now.Format("2006-01-02"),
 		RowKey:       fmt.Sprintf("%s_resource_connect", time.Now().Format("20060102T150405")),
@@ -198,48 +279,77 @@ func (s *Server) handleShellSession(ctx CommandContext, sess gssh.Session, resou
 		SessionID:    sessionID,
 		UserKey:      ctx.UserID,
 		BoxID:        resources.InstanceID,
-		Details:      fmt.Sprintf(`{"instanceIP":%q,"volumeID":%q}`, resources.InstanceIP, resources.VolumeID),
+		Details:      fmt.Sprintf(`{"instanceIP":%q,"volumeID":%q,"runtime":%q,"steps":%s}`, resources.InstanceIP, resources.VolumeID, resources.Runtime, stepsJSON),
 	}
-	if err := infra.WriteEventLog(bctx, s.clients, &connectEvent); err != nil {
+	if err := s.provider.Events.WriteEvent(bctx, &connectEvent); err != nil {
 		s.logger.Warn("Failed to log resource connection", "error", err)
 	}
 
+	// Run the box's shell. When the box is migrated or restarted, its network connections
+	// are gone, so the session reconnects. The shell runs in a tmux session on the box, so
+	// after a migration it reattaches to the same shell, processes and all.
+	input := newSessionInput(sess, s.logger)
+	shellName := boxShellSessionPrefix + sessionID
+	for {
+		move, err := s.runBoxShell(sess, client, input, shellName, live.moved)
+		if err != nil {
+			s.logger.Error("Failed to handle IO", "error", err, "sessionID", sessionID)
+		}
+		if move == nil {
+			s.endBoxShell(client, shellName)
+			client.Close()
+			return
+		}
+		client.Close()
+
+		fmt.Fprintf(sess.Stderr(), "\r\n[shellbox] %s\r\n", move.notice)
+		if move.resources == nil {
+			s.logger.Info("ending session, box is down", "sessionID", sessionID)
+			return
+		}
+		s.logger.Info("reconnecting session to box", "sessionID", sessionID, "instanceID", move.resources.InstanceID, "instanceIP", move.resources.InstanceIP)
+		client, err = s.dialBoxAtIP(sess.Context(), move.resources.InstanceIP)
+		if err != nil {
+			s.logger.Error("Failed to reconnect to box", "error", err, "sessionID", sessionID)
+			fmt.Fprintf(sess.Stderr(), "Error reconnecting to box: %v\n", err)
+			return
+		}
+	}
+}
+
+// runBoxShell runs the shell named shellName on the box behind client for the user's
+// session until either ends, or until the box moves or goes down, in which case it returns
+// the move
+func (s *Server) runBoxShell(sess gssh.Session, client *ssh.Client, input *sessionInput, shellName string, moved <-chan boxMove) (*boxMove, error) {
 	boxSession, err := client.NewSession()
 	if err != nil {
 		s.logger.Error("Failed to create box session", "error", err)
 		fmt.Fprintf(sess.Stderr(), "Error creating session: %v\n", err)
-		return
+		return nil, err
 	}
 	defer boxSession.Close()
 
-	if err := s.setupPty(sess, boxSession); err != nil {
-		s.logger.Error("Failed to setup PTY", "error", err)
-		return
+	if err := input.attach(boxSession); err != nil {
+		return nil, err
 	}
-
-	if err := s.handleIO(sess, boxSession); err != nil {
-		s.logger.Error("Failed to handle IO", "error", err)
-	}
-}
-
-func (s *Server) setupPty(sess gssh.Session, boxSession *ssh.Session) error {
-	if pty, winCh, isPty := sess.Pty(); isPty {
-		if err := boxSession.RequestPty(pty.Term, pty.Window.Height, pty.Window.Width, ssh.TerminalModes{}); err != nil {
-			return fmt.Errorf("failed to request PTY: %w", err)
-		}
-
-		go func() {
-			for win := range winCh {
-				if err := boxSession.WindowChange(win.Height, win.Width); err != nil {
-					s.logger.Error("Failed to change window size", "error", err)
-				}
-			}
-		}()
+	defer input.detach(boxSession)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleIO(sess, boxSession, input, shellName)
+	}()
+
+	select {
+	case err := <-done:
+		return nil, err
+	case move := <-moved:
+		boxSession.Close()
+		<-done
+		return &move, nil
 	}
-	return nil
 }
 
-func (s *Server) handleIO(sess gssh.Session, boxSession *ssh.Session) error {
+func (s *Server) handleIO(sess gssh.Session, boxSession *ssh.Session, input *sessionInput, shellName string) error {
 	stdin, err := boxSession.StdinPipe()
 	if err != nil {
 		return fmt.Errorf("failed to get stdin pipe: %w", err)
@@ -253,15 +363,21 @@ func (s *Server) handleIO(sess gssh.Session, boxSession *ssh.Session) error {
 		return fmt.Errorf("failed to get stderr pipe: %w", err)
 	}
 
-	if err := boxSession.Shell(); err != nil {
+	// tmux needs a terminal; without one the session gets a plain shell
+	if input.pty != nil {
+		err = boxSession.Start(boxShellCommand(shellName))
+	} else {
+		err = boxSession.Shell()
+	}
+	if err != nil {
 		return fmt.Errorf("failed to start shell: %w", err)
 	}
 
+	stop := make(chan struct{})
+	defer close(stop)
+	go input.pump(stdin, stop)
+
 	var g errgroup.Group
-	g.Go(func() error {
-		_, err := io.Copy(stdin, sess)
-		return err
-	})
 	g.Go(func() error {
 		_, err := io.Copy(sess, stdout)
 		return err
@@ -301,12 +417,32 @@ func (s *Server) handleCommandSession(sess gssh.Session) {
 		s.handleSpinupCommand(ctx, result, sess)
 	case ActionConnect:
 		s.handleConnectCommand(ctx, result, sess)
+	case ActionRestartPolicy:
+		s.handleRestartPolicyCommand(ctx, result, sess)
+	case ActionTop:
+		s.handleTopCommand(ctx, result, sess)
+	case ActionCompact:
+		s.handleCompactCommand(ctx, result, sess)
+	case ActionPolicy:
+		s.handlePolicyCommand(ctx, result, sess)
+	case ActionStatus:
+		s.handleStatusCommand(ctx, result, sess)
+	case ActionExpose:
+		s.handleExposeCommand(ctx, result, sess)
+	case ActionExposures:
+		s.handleExposuresCommand(ctx, result, sess)
+	case ActionPreview:
+		s.handlePreviewCommand(ctx, result, sess)
+	case ActionWebLogin:
+		s.handleWebLoginCommand(ctx, result, sess)
 	case ActionHelp:
 		s.handleHelpCommand(ctx, result, sess)
 	case ActionVersion:
 		s.handleVersionCommand(ctx, result, sess)
 	case ActionWhoami:
 		s.handleWhoamiCommand(ctx, result, sess)
+	case ActionAdminMigrate:
+		s.handleAdminMigrateCommand(ctx, result, sess)
 	case ActionError:
 		// Send error message to user
 		if _, err := sess.Write([]byte(result.Output + "\n")); err != nil {
@@ -361,10 +497,16 @@ func (s *Server) handleSpinupCommand(ctx CommandContext, result CommandResult, s
 	}
 
 	boxName := result.Args[0]
-	s.logger.Info("Spinup command received", "user", ctx.UserID, "box", boxName)
+	s.logger.Info("Spinup command received", "user", ctx.UserID, "box", boxName, "runtime", result.Runtime)
 
-	// Reserve volume for user with box name
-	volumeID, err := s.allocator.ReserveVolumeForUser(context.Background(), ctx.UserID, boxName)
+	// Reserve volume for user with box name, waiting in line if the pool is empty.
+	// The wait ends early if the user disconnects.
+	var volumeID string
+	err := s.volumeQueue.Do(sess.Context(), ctx.UserID, func(_ context.Context) error {
+		var err error
+		volumeID, err = s.allocator.ReserveVolumeForUser(context.Background(), ctx.UserID, boxName, result.Runtime)
+		return err
+	}, s.queueStatusWriter(sess, "volume"))
 	if err != nil {
 		errorMsg := fmt.Sprintf("Failed to create box '%s': %v\n", boxName, err)
 		if _, writeErr := sess.Write([]byte(errorMsg)); writeErr != nil {
@@ -376,11 +518,12 @@ func (s *Server) handleSpinupCommand(ctx CommandContext, result CommandResult, s
 		return
 	}
 
-	s.logger.Info("Box created successfully", "user", ctx.UserID, "box", boxName, "volumeID", volumeID)
+	s.logger.Info("Box created successfully", "user", ctx.UserID, "box", boxName, "volumeID", volumeID, "runtime", result.Runtime)
 
-	successMsg := fmt.Sprintf("Box '%s' created successfully!\n\nVolume ID: %s\n\nTo connect to your box, use:\n  ssh ubuntu@shellbox.dev connect %s\n",
+	successMsg := fmt.Sprintf("Box '%s' created successfully!\n\nVolume ID: %s\nRuntime: %s\n\nTo connect to your box, use:\n  ssh ubuntu@shellbox.dev connect %s\n",
 		boxName,
 		volumeID,
+		result.Runtime,
 		boxName)
 
 	if _, err := sess.Write([]byte(successMsg)); err != nil {
@@ -406,8 +549,23 @@ func (s *Server) handleConnectCommand(ctx CommandContext, result CommandResult,
 	boxName := result.Args[0]
 	s.logger.Info("Connect command received", "user", ctx.UserID, "box", boxName)
 
-	// Allocate resources for this user and box
-	allocatedResources, err := s.allocator.AllocateResourcesForUser(context.Background(), ctx.UserID, boxName)
+	// Show live progress on the user's stderr while the box is being prepared
+	_, _, isPty := sess.Pty()
+	progress := infra.NewProgressReporter(newSessionProgress(sess.Stderr(), isPty))
+
+	// Allocate resources for this user and box, waiting in line if the pool is empty.
+	// Both the wait and the allocation itself are bound to the SSH session, so if the
+	// user disconnects the allocation is cancelled and everything done so far is undone.
+	var allocatedResources *infra.AllocatedResources
+	err := s.instanceQueue.Do(sess.Context(), ctx.UserID, func(allocCtx context.Context) error {
+		var err error
+		allocatedResources, err = s.allocator.AllocateResourcesForUser(allocCtx, ctx.UserID, boxName, progress, s.checkpointChooser(sess, result.Resume))
+		return err
+	}, s.queueStatusWriter(sess, "instance"))
+	if err != nil && sess.Context().Err() != nil {
+		s.logger.Info("Connect cancelled, user disconnected", "user", ctx.UserID, "box", boxName, "error", err)
+		return
+	}
 	if err != nil {
 		errorMsg := fmt.Sprintf("Failed to connect to box '%s': %v\n", boxName, err)
 		if _, writeErr := sess.Write([]byte(errorMsg)); writeErr != nil {
@@ -422,7 +580,394 @@ func (s *Server) handleConnectCommand(ctx CommandContext, result CommandResult,
 	s.logger.Info("Box connection established", "user", ctx.UserID, "box", boxName, "instanceID", allocatedResources.InstanceID, "volumeID", allocatedResources.VolumeID)
 
 	// Call the shell session handler with allocated resources
-	s.handleShellSession(ctx, sess, allocatedResources)
+	s.handleShellSession(ctx, sess, allocatedResources, progress.Timings())
+}
+
+// queueStatusWriter returns a callback that tells a waiting user where they stand in an allocation queue
+func (s *Server) queueStatusWriter(sess gssh.Session, resource string) func(infra.QueueStatus) {
+	return func(status infra.QueueStatus) {
+		msg := fmt.Sprintf("No free %s available right now, you are #%d in line (estimated wait ~%s). Keep this session open...\n",
+			resource, status.Position, status.EstimatedWait.Round(time.Second))
+		if _, err := sess.Stderr().Write([]byte(msg)); err != nil {
+			s.logger.Error("Error writing queue status", "error", err)
+		}
+	}
+}
+
+// checkpointChooser decides, following the connect command's resume mode, whether a box
+// that was not shut down cleanly resumes from its latest checkpoint. Asking needs a PTY;
+// without one the box starts afresh.
+func (s *Server) checkpointChooser(sess gssh.Session, mode string) infra.CheckpointChooser {
+	return func(_ context.Context, checkpoint *infra.Checkpoint) bool {
+		age := time.Since(checkpoint.Created).Round(time.Second)
+		var msg string
+		switch mode {
+		case ResumeCheckpoint:
+			msg = fmt.Sprintf("Resuming your box from the checkpoint taken %s ago\n", age)
+		case ResumeFresh:
+			return false
+		default:
+			if _, _, isPty := sess.Pty(); isPty {
+				return s.confirm(sess, fmt.Sprintf("Your box was not shut down cleanly. Resume it from the checkpoint taken %s ago?\r\n"+
+					"Changes made to its disk since then will be lost. [Y/n] ", age))
+			}
+			msg = fmt.Sprintf("Your box was not shut down cleanly and has a checkpoint from %s ago. Starting it afresh; connect with --resume checkpoint to resume from the checkpoint instead.\n", age)
+		}
+		if _, err := sess.Stderr().Write([]byte(msg)); err != nil {
+			s.logger.Error("Error writing checkpoint notice", "error", err)
+		}
+		return mode == ResumeCheckpoint
+	}
+}
+
+// confirm asks a yes/no question on the user's terminal, which is in raw mode, and reads
+// the answer a byte at a time, echoing it. An empty answer is a yes.
+func (s *Server) confirm(sess gssh.Session, question string) bool {
+	if _, err := sess.Stderr().Write([]byte(question)); err != nil {
+		s.logger.Error("Error writing question", "error", err)
+		return false
+	}
+
+	var answer []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := sess.Read(b); err != nil {
+			return false
+		}
+		switch b[0] {
+		case '\r', '\n':
+			if _, err := sess.Stderr().Write([]byte("\r\n")); err != nil {
+				s.logger.Error("Error writing answer", "error", err)
+			}
+			reply := strings.ToLower(strings.TrimSpace(string(answer)))
+			return reply == "" || reply == "y" || reply == "yes"
+		case 0x03: // Ctrl-C
+			return false
+		case 0x7f, '\b':
+			if len(answer) > 0 {
+				answer = answer[:len(answer)-1]
+				_, _ = sess.Stderr().Write([]byte("\b \b"))
+			}
+		default:
+			answer = append(answer, b[0])
+			_, _ = sess.Stderr().Write(b)
+		}
+	}
+}
+
+// handleRestartPolicyCommand shows or sets the restart policy of a running box
+func (s *Server) handleRestartPolicyCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+
+	var msg string
+	var err error
+	if len(result.Args) == 2 {
+		policy := result.Args[1]
+		s.logger.Info("Restart policy command received", "user", ctx.UserID, "box", boxName, "policy", policy)
+		if err = s.allocator.SetBoxRestartPolicy(sess.Context(), ctx.UserID, boxName, policy); err == nil {
+			msg = fmt.Sprintf("Restart policy of box '%s' set to %s\n", boxName, policy)
+		}
+	} else {
+		var policy string
+		if policy, err = s.allocator.BoxRestartPolicy(sess.Context(), ctx.UserID, boxName); err == nil {
+			msg = fmt.Sprintf("Restart policy of box '%s': %s\n", boxName, policy)
+		}
+	}
+
+	exitCode := 0
+	if err != nil {
+		exitCode = 1
+		msg = fmt.Sprintf("Failed to access restart policy of box '%s': %v\n", boxName, err)
+		if errors.Is(err, infra.ErrBoxNotRunning) {
+			msg = fmt.Sprintf("Box '%s' is not running; connect to it first\n", boxName)
+		}
+	}
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing restart policy result", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// topSamples is how many samples the top command shows
+const topSamples = 20
+
+// handleTopCommand shows the recent resource usage of a running box, newest last
+func (s *Server) handleTopCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+	s.logger.Info("Top command received", "user", ctx.UserID, "box", boxName)
+
+	var rates []infra.BoxRate
+	if s.metrics != nil {
+		rates = infra.BoxRates(s.metrics.Recent(ctx.UserID, boxName, topSamples+1))
+	}
+
+	exitCode := 0
+	var out strings.Builder
+	if len(rates) == 0 {
+		exitCode = 1
+		fmt.Fprintf(&out, "No resource usage recorded for box '%s' yet; it must be running", boxName)
+		if s.metrics != nil {
+			fmt.Fprintf(&out, " for at least %s", 2*s.metrics.Interval())
+		}
+		out.WriteString("\n")
+	} else {
+		w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "TIME\tCPU%\tMEM USED\tLOAD1\tDISK R/s\tDISK W/s\tNET RX/s\tNET TX/s\t")
+		for _, rate := range rates {
+			mem, load, rx, tx := "-", "-", "-", "-"
+			if rate.GuestMetricsValid {
+				mem = formatBytes(float64(rate.MemUsedBytes))
+				load = fmt.Sprintf("%.2f", rate.Load1)
+				rx = formatBytes(rate.NetRxPerSec)
+				tx = formatBytes(rate.NetTxPerSec)
+			}
+			fmt.Fprintf(w, "%s\t%.1f\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+				rate.Time.Format(time.TimeOnly), rate.CPUPercent, mem, load,
+				formatBytes(rate.DiskReadPerSec), formatBytes(rate.DiskWritePerSec), rx, tx)
+		}
+		_ = w.Flush()
+	}
+
+	if _, err := sess.Write([]byte(out.String())); err != nil {
+		s.logger.Error("Error writing top output", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// handleCompactCommand has a running box hand its free memory back and reports the disk
+// space that reclaimed
+func (s *Server) handleCompactCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+	s.logger.Info("Compact command received", "user", ctx.UserID, "box", boxName)
+
+	if _, err := fmt.Fprintf(sess, "Compacting memory of box '%s'...\n", boxName); err != nil {
+		s.logger.Error("Error writing compact progress", "error", err)
+	}
+
+	exitCode := 0
+	reclaimed, err := s.allocator.CompactBox(sess.Context(), ctx.UserID, boxName)
+	msg := fmt.Sprintf("Reclaimed %s of disk space from box '%s'\n", formatBytes(float64(reclaimed)), boxName)
+	if err != nil {
+		exitCode = 1
+		switch {
+		case errors.Is(err, infra.ErrBoxNotRunning):
+			msg = fmt.Sprintf("Box '%s' is not running; connect to it first\n", boxName)
+		case errors.Is(err, infra.ErrNoMemoryBalloon):
+			msg = fmt.Sprintf("Box '%s' was created before memory compaction was supported\n", boxName)
+		default:
+			msg = fmt.Sprintf("Failed to compact box '%s': %v\n", boxName, err)
+		}
+	}
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing compact result", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// handlePolicyCommand shows or sets the egress policy of a running box
+func (s *Server) handlePolicyCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+
+	var msg string
+	var err error
+	if result.Egress != nil {
+		s.logger.Info("Egress policy command received", "user", ctx.UserID, "box", boxName, "policy", result.Egress.String())
+		if err = s.allocator.SetBoxEgressPolicy(sess.Context(), ctx.UserID, boxName, result.Egress); err == nil {
+			msg = fmt.Sprintf("Egress policy of box '%s' set to %s\n", boxName, result.Egress)
+		}
+	} else {
+		var policy *infra.EgressPolicy
+		if policy, err = s.allocator.BoxEgressPolicy(sess.Context(), ctx.UserID, boxName); err == nil {
+			msg = fmt.Sprintf("Egress policy of box '%s': %s\n", boxName, policy)
+		}
+	}
+
+	exitCode := 0
+	if err != nil {
+		exitCode = 1
+		msg = fmt.Sprintf("Failed to access egress policy of box '%s': %v\n", boxName, err)
+		if errors.Is(err, infra.ErrBoxNotRunning) {
+			msg = fmt.Sprintf("Box '%s' is not running; connect to it first\n", boxName)
+		}
+	}
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing egress policy result", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// handleStatusCommand shows the status of a running box
+func (s *Server) handleStatusCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+	s.logger.Info("Status command received", "user", ctx.UserID, "box", boxName)
+
+	exitCode := 0
+	var out strings.Builder
+	status, err := s.allocator.BoxStatus(sess.Context(), ctx.UserID, boxName)
+	switch {
+	case errors.Is(err, infra.ErrBoxNotRunning):
+		exitCode = 1
+		fmt.Fprintf(&out, "Box '%s' is not running\n", boxName)
+	case err != nil:
+		exitCode = 1
+		fmt.Fprintf(&out, "Failed to get status of box '%s': %v\n", boxName, err)
+	default:
+		fmt.Fprintf(&out, "Box:            %s\n", status.BoxName)
+		fmt.Fprintf(&out, "State:          running since %s\n", status.ConnectedAt.Format(time.RFC3339))
+		fmt.Fprintf(&out, "Runtime:        %s\n", status.Runtime)
+		if status.RestartPolicy != "" {
+			fmt.Fprintf(&out, "Restart policy: %s\n", status.RestartPolicy)
+		}
+		if status.Egress != nil {
+			fmt.Fprintf(&out, "Egress policy:  %s\n", status.Egress)
+			denied := status.EgressDenied
+			fmt.Fprintf(&out, "Egress denied:  %d TCP, %d UDP, %d other packets\n", denied.TCP, denied.UDP, denied.Other)
+		}
+	}
+
+	if _, err := sess.Write([]byte(out.String())); err != nil {
+		s.logger.Error("Error writing status", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// handleExposeCommand makes a port of a running box reachable through the server
+func (s *Server) handleExposeCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+	allowed := result.Allow
+	if len(allowed) == 0 {
+		source, err := netip.ParseAddrPort(ctx.RemoteAddr)
+		if err == nil {
+			addr := source.Addr().Unmap()
+			allowed = []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}
+		}
+	}
+	s.logger.Info("Expose command received", "user", ctx.UserID, "box", boxName, "port", result.Port, "allowed", allowed)
+
+	exitCode := 0
+	var msg string
+	exposure, err := s.exposures.Expose(sess.Context(), ctx.UserID, boxName, result.Port, allowed)
+	switch {
+	case errors.Is(err, infra.ErrBoxNotRunning):
+		exitCode = 1
+		msg = fmt.Sprintf("Box '%s' is not running; connect to it first\n", boxName)
+	case err != nil:
+		exitCode = 1
+		msg = fmt.Sprintf("Failed to expose port %d of box '%s': %v\n", result.Port, boxName, err)
+	default:
+		msg = fmt.Sprintf("Port %d of box '%s' is exposed on port %d of this server to %s\n",
+			exposure.GuestPort, boxName, exposure.Port, formatPrefixes(exposure.Allowed))
+	}
+
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing expose result", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// handleExposuresCommand lists the exposed ports of the user's boxes
+func (s *Server) handleExposuresCommand(ctx CommandContext, _ CommandResult, sess gssh.Session) {
+	s.logger.Info("Exposures command received", "user", ctx.UserID)
+
+	var out strings.Builder
+	exposures := s.exposures.List(ctx.UserID)
+	if len(exposures) == 0 {
+		out.WriteString("No exposed ports\n")
+	} else {
+		w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BOX\tBOX PORT\tSERVER PORT\tALLOWED\tSINCE")
+		for _, exposure := range exposures {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", exposure.BoxName, exposure.GuestPort, exposure.Port,
+				formatPrefixes(exposure.Allowed), exposure.CreatedAt.Format(time.RFC3339))
+		}
+		_ = w.Flush()
+	}
+
+	if _, err := sess.Write([]byte(out.String())); err != nil {
+		s.logger.Error("Error writing exposures", "error", err)
+	}
+	if err := sess.Exit(0); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// handlePreviewCommand prints the HTTPS preview link of a port of a running box and
+// makes the port public or private
+func (s *Server) handlePreviewCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	boxName := result.Args[0]
+	s.logger.Info("Preview command received", "user", ctx.UserID, "box", boxName, "port", result.Port)
+
+	exitCode := 1
+	var msg string
+	switch {
+	case s.preview == nil:
+		msg = "Previews are not enabled on this server\n"
+	case !s.preview.ValidBoxName(boxName):
+		msg = fmt.Sprintf("Box '%s' can't be previewed: preview hostnames need box names of lowercase letters, digits and dashes\n", boxName)
+	default:
+		var err error
+		if result.Public != nil {
+			err = s.exposures.SetPublic(sess.Context(), ctx.UserID, boxName, result.Port, *result.Public)
+		} else {
+			err = s.exposures.Forward(sess.Context(), ctx.UserID, boxName, result.Port)
+		}
+		public := s.exposures.Public(ctx.UserID, boxName, result.Port)
+		switch {
+		case errors.Is(err, infra.ErrBoxNotRunning):
+			msg = fmt.Sprintf("Box '%s' is not running; connect to it first\n", boxName)
+		case err != nil:
+			msg = fmt.Sprintf("Failed to preview port %d of box '%s': %v\n", result.Port, boxName, err)
+		case public:
+			exitCode = 0
+			msg = fmt.Sprintf("Port %d of box '%s' is public at:\n  %s\n", result.Port, boxName, s.preview.URL(ctx.UserID, boxName, result.Port))
+		default:
+			exitCode = 0
+			link, expires := s.preview.Link(ctx.UserID, boxName, result.Port)
+			msg = fmt.Sprintf("Preview of port %d of box '%s', signs you in until %s:\n  %s\n", result.Port, boxName, expires.Format(time.RFC3339), link)
+		}
+	}
+
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing preview result", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
+
+// formatPrefixes formats the sources of an exposure, e.g. 203.0.113.7/32,10.0.0.0/8
+func formatPrefixes(prefixes []netip.Prefix) string {
+	parts := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		parts[i] = prefix.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. 1.5M
+func formatBytes(n float64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", n, units[i])
 }
 
 // handleHelpCommand handles the help command
@@ -431,14 +976,43 @@ func (s *Server) handleHelpCommand(_ CommandContext, _ CommandResult, sess gssh.
 
 Available commands:
   spinup <box_name>    Create and start a development box
+    --runtime container  Run the box as a lightweight container instead of a VM
+    --runtime vm-bridged Run the VM on bridged networking, faster and with ICMP
   connect <box_name>   Connect to an existing development box
+    --resume checkpoint  Resume from the latest checkpoint after an unclean shutdown
+    --resume fresh       Start afresh after an unclean shutdown (default: ask)
+  restart-policy <box_name> [never|on-crash|always]
+                       Show or set what happens when the running box crashes
+  top <box_name>       Show recent resource usage of the running box
+  compact <box_name>   Hand the running box's free memory back to shrink its saved memory
+  policy <box_name> egress [allow-all|deny-all|allow <destination>...]
+                       Show or set where the running box may connect to
+  status <box_name>    Show the status of the running box
+  expose <box_name> <port>
+                       Make a port of the running box reachable on a port of this server
+    --allow <ip|cidr>,...  Addresses that may connect (default: your current address)
+  exposures            List the exposed ports of your boxes
+  preview <box_name> <port>
+                       Print an HTTPS link to a web server of the running box
+    --public             Let anyone open the preview without a link (--private to undo)
+  web-login [box_name] Print a link that signs a browser in to the web terminal
   help                 Show this help information  
   version              Show version information
   whoami               Show current user information
 
 Examples:
   ssh shellbox.dev spinup dev1
+  ssh shellbox.dev spinup --runtime container tools
   ssh shellbox.dev connect dev1
+  ssh shellbox.dev restart-policy dev1 always
+  ssh shellbox.dev top dev1
+  ssh shellbox.dev compact dev1
+  ssh shellbox.dev policy dev1 egress allow github.com:22 pypi.org:443
+  ssh shellbox.dev status dev1
+  ssh shellbox.dev expose dev1 3000
+  ssh shellbox.dev exposures
+  ssh shellbox.dev preview dev1 3000
+  ssh shellbox.dev web-login dev1
   ssh shellbox.dev help
   ssh shellbox.dev whoami
 
@@ -491,7 +1065,13 @@ func (s *Server) handleWhoamiCommand(ctx CommandContext, _ CommandResult, sess g
 
 // Run starts the SSH server
 func (s *Server) Run() error {
-	server := gssh.Server{
+	s.logger.Info("Starting SSH server", "port", s.port)
+	return s.sshServer().ListenAndServe()
+}
+
+// sshServer is the server users connect to
+func (s *Server) sshServer() *gssh.Server {
+	return &gssh.Server{
 		Addr: fmt.Sprintf(":%d", s.port),
 		PublicKeyHandler: func(_ gssh.Context, _ gssh.PublicKey) bool {
 			// Accept any key
@@ -499,7 +1079,4 @@ func (s *Server) Run() error {
 		},
 		Handler: s.handleSession,
 	}
-
-	s.logger.Info("Starting SSH server", "port", s.port)
-	return server.ListenAndServe()
 }
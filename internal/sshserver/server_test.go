@@ -0,0 +1,267 @@
+package sshserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shellbox/internal/infra"
+
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	return signer
+}
+
+// serve runs server on a local port until the test ends and returns its address
+func serve(t *testing.T, server *gssh.Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// fakeBox is the SSH server of every box: a shell greeting its user and echoing one line
+type fakeBox struct {
+	addr   string
+	dialed chan string // box addresses the server connected to
+	killed chan string // tmux kill-session commands ending shells
+}
+
+func newFakeBox(t *testing.T, signer ssh.Signer) *fakeBox {
+	t.Helper()
+	box := &fakeBox{dialed: make(chan string, 16), killed: make(chan string, 16)}
+	box.addr = serve(t, &gssh.Server{
+		Handler: func(sess gssh.Session) {
+			if strings.HasPrefix(sess.RawCommand(), "tmux kill-session") {
+				box.killed <- sess.RawCommand()
+				return
+			}
+			fmt.Fprintf(sess, "shell of %s\n", sess.User())
+			if pty, _, ok := sess.Pty(); ok {
+				fmt.Fprintf(sess, "terminal %dx%d\n", pty.Window.Width, pty.Window.Height)
+			}
+			line, _ := bufio.NewReader(sess).ReadString('\n')
+			fmt.Fprintf(sess, "echo: %s", line)
+		},
+		PublicKeyHandler: func(_ gssh.Context, key gssh.PublicKey) bool {
+			return gssh.KeysEqual(key, signer.PublicKey())
+		},
+	})
+	return box
+}
+
+// dial connects every box address to the fake box
+func (b *fakeBox) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	b.dialed <- addr
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, b.addr)
+}
+
+// runCommand runs command on the server as the holder of userKey, with input as stdin,
+// returning its output whatever its exit status
+func runCommand(t *testing.T, addr string, userKey ssh.Signer, command, input string) string {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(input)
+	output, err := session.CombinedOutput(command)
+	var exitErr *ssh.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("%s: %v\n%s", command, err, output)
+	}
+	return string(output)
+}
+
+// newTestServer returns a server on an in-memory cloud whose boxes all are the returned
+// fake box
+func newTestServer(t *testing.T) (*Server, *infra.Provider, *fakeBox) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cloud := infra.NewMemoryCloud(infra.MemoryProviderConfig{})
+	provider := cloud.Provider()
+	golden, err := cloud.EnsureGoldenSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("EnsureGoldenSnapshot: %v", err)
+	}
+	poolConfig := infra.PoolConfig{
+		MinFreeInstances:  1,
+		MaxFreeInstances:  2,
+		MaxTotalInstances: 2,
+		MinFreeVolumes:    1,
+		MaxFreeVolumes:    2,
+		MaxTotalVolumes:   2,
+		CheckInterval:     20 * time.Millisecond,
+		ScaleDownCooldown: time.Minute,
+	}
+	pool := infra.NewBoxPool(provider, &infra.VMConfig{VMSize: "memory"}, poolConfig, golden)
+	go pool.MaintainPool(ctx)
+
+	boxKey := newTestSigner(t)
+	box := newFakeBox(t, boxKey)
+	server := New(0, boxKey, provider, pool)
+	server.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	server.dialBox = box.dial
+	return server, provider, box
+}
+
+func TestSpinupConnect(t *testing.T) {
+	ctx := context.Background()
+	server, provider, box := newTestServer(t)
+	addr := serve(t, server.sshServer())
+	userKey := newTestSigner(t)
+
+	output := runCommand(t, addr, userKey, "spinup dev1", "")
+	if !strings.Contains(output, "Box 'dev1' created successfully") {
+		t.Fatalf("spinup printed:\n%s", output)
+	}
+
+	output = runCommand(t, addr, userKey, "connect dev1", "hello\n")
+	for _, want := range []string{"HI FROM SHELLBOX", "shell of " + infra.SystemUserUbuntu, "echo: hello"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("connect printed:\n%s\nwant %q in it", output, want)
+		}
+	}
+
+	allocations, err := provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		t.Fatalf("ListActiveAllocations: %v", err)
+	}
+	if len(allocations) != 1 || allocations[0].State != infra.AllocationStateConnected {
+		t.Fatalf("got allocations %+v, want the box connected", allocations)
+	}
+	allocation := allocations[0]
+	if got, want := <-box.dialed, net.JoinHostPort(allocation.InstanceIP, strconv.Itoa(infra.BoxSSHPort)); got != want {
+		t.Errorf("dialed %s, want the box at %s", got, want)
+	}
+	select {
+	case <-box.killed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("tmux session of the shell not ended")
+	}
+
+	// The box outlives the session for the reconciler to release
+	if server.HasActiveSession(allocation.InstanceID) {
+		t.Errorf("session still active after the user left")
+	}
+	if ended := server.LastSessionEnded(allocation.InstanceID); ended.IsZero() {
+		t.Errorf("end of the session not recorded")
+	}
+
+	// Connecting again joins the running box
+	output = runCommand(t, addr, userKey, "connect dev1", "again\n")
+	if !strings.Contains(output, "echo: again") {
+		t.Fatalf("second connect printed:\n%s", output)
+	}
+	allocations, err = provider.Allocations.ListActiveAllocations(ctx)
+	if err != nil {
+		t.Fatalf("ListActiveAllocations: %v", err)
+	}
+	if len(allocations) != 1 || allocations[0].InstanceID != allocation.InstanceID {
+		t.Fatalf("got allocations %+v after reconnecting, want the same box", allocations)
+	}
+
+	// Other users don't see the box
+	output = runCommand(t, addr, newTestSigner(t), "connect dev1", "")
+	if !strings.Contains(output, "Failed to connect to box 'dev1'") {
+		t.Fatalf("another user's connect printed:\n%s", output)
+	}
+}
+
+// steadyMetricsRuntime is a box runtime sampled every ten seconds using half a CPU
+type steadyMetricsRuntime struct {
+	infra.BoxRuntime
+	mu      sync.Mutex
+	samples int
+}
+
+func (r *steadyMetricsRuntime) CollectMetrics(context.Context, string) (*infra.BoxSample, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples++
+	return &infra.BoxSample{
+		Time:       time.Date(2026, 5, 1, 12, 0, 10*r.samples, 0, time.UTC),
+		CPUSeconds: 5 * float64(r.samples),
+	}, nil
+}
+
+func TestTopCommand(t *testing.T) {
+	ctx := context.Background()
+	server, provider, _ := newTestServer(t)
+	provider.Runtime = &steadyMetricsRuntime{BoxRuntime: provider.Runtime}
+	metrics := infra.NewBoxMetricsCollector(provider, infra.MetricsConfig{Interval: time.Second, History: 10})
+	server.SetBoxMetrics(metrics)
+	addr := serve(t, server.sshServer())
+	userKey := newTestSigner(t)
+
+	if output := runCommand(t, addr, userKey, "spinup dev1", ""); !strings.Contains(output, "created successfully") {
+		t.Fatalf("spinup printed:\n%s", output)
+	}
+	if output := runCommand(t, addr, userKey, "top dev1", ""); !strings.Contains(output, "No resource usage recorded for box 'dev1' yet; it must be running for at least 2s") {
+		t.Errorf("top without samples printed:\n%s", output)
+	}
+
+	// Connecting keeps the box allocated for the collector to sample
+	runCommand(t, addr, userKey, "connect dev1", "hello\n")
+	for range 3 {
+		if err := metrics.CollectAll(ctx); err != nil {
+			t.Fatalf("CollectAll: %v", err)
+		}
+	}
+	output := runCommand(t, addr, userKey, "top dev1", "")
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "CPU%") {
+		t.Fatalf("top printed:\n%s\nwant a header and two rows", output)
+	}
+	// Guest columns are blank without the guest agent
+	if fields := strings.Fields(lines[2]); !slices.Equal(fields, []string{"12:00:30", "50.0", "-", "-", "0B", "0B", "-", "-"}) {
+		t.Errorf("got row %q", lines[2])
+	}
+
+	// Other users see none of it
+	if output := runCommand(t, addr, newTestSigner(t), "top dev1", ""); !strings.Contains(output, "No resource usage recorded") {
+		t.Errorf("another user's top printed:\n%s", output)
+	}
+}
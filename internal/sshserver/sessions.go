@@ -0,0 +1,353 @@
+package sshserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"shellbox/internal/infra"
+	"sync"
+	"time"
+
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// boxShellSessionPrefix names the tmux sessions users' shells run in on their box
+const boxShellSessionPrefix = "shellbox-"
+
+// boxShellCommand attaches to the tmux session name on the box, creating it if the box has
+// none, e.g. on the first connect or after the box restarted. Boxes without tmux get a
+// login shell.
+func boxShellCommand(name string) string {
+	return fmt.Sprintf(`if command -v tmux > /dev/null; then exec tmux new-session -A -s %s; fi; exec "${SHELL:-/bin/sh}" -l`, name)
+}
+
+// endBoxShell ends the tmux session name on the box behind client once its user is gone,
+// like a shell that loses its terminal. Failures are only logged.
+func (s *Server) endBoxShell(client *ssh.Client, name string) {
+	boxSession, err := client.NewSession()
+	if err != nil {
+		s.logger.Debug("Failed to end box shell", "shell", name, "error", err)
+		return
+	}
+	defer boxSession.Close()
+	if err := boxSession.Run("tmux kill-session -t " + name + " 2> /dev/null || true"); err != nil {
+		s.logger.Debug("Failed to end box shell", "shell", name, "error", err)
+	}
+}
+
+// liveSession is a user's shell session on a box. It follows the box when the box is
+// migrated to another instance or restarted after a crash.
+type liveSession struct {
+	instanceID string    // guarded by Server.sessionsMu
+	notices    io.Writer // the user's stderr, for notices about their box
+	moved      chan boxMove
+}
+
+// boxMove tells a live session its box shell is gone and why
+type boxMove struct {
+	resources *infra.AllocatedResources // where the box runs now, nil if it is down
+	notice    string
+}
+
+// HasActiveSession implements infra.SessionChecker
+func (s *Server) HasActiveSession(instanceID string) bool {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return len(s.activeSessions[instanceID]) > 0
+}
+
+// LastSessionEnded implements infra.SessionChecker
+func (s *Server) LastSessionEnded(instanceID string) time.Time {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return s.sessionsEnded[instanceID]
+}
+
+// trackSession records a live session on an instance until the returned function is called
+func (s *Server) trackSession(instanceID string, notices io.Writer) (*liveSession, func()) {
+	session := &liveSession{
+		instanceID: instanceID,
+		notices:    notices,
+		moved:      make(chan boxMove, 1),
+	}
+
+	s.sessionsMu.Lock()
+	if s.activeSessions[instanceID] == nil {
+		s.activeSessions[instanceID] = make(map[*liveSession]struct{})
+	}
+	s.activeSessions[instanceID][session] = struct{}{}
+	s.sessionsMu.Unlock()
+
+	return session, func() {
+		s.sessionsMu.Lock()
+		defer s.sessionsMu.Unlock()
+		delete(s.activeSessions[session.instanceID], session)
+		if len(s.activeSessions[session.instanceID]) == 0 {
+			delete(s.activeSessions, session.instanceID)
+			s.sessionsEnded[session.instanceID] = time.Now()
+		}
+	}
+}
+
+// moveSessions switches the live sessions on instanceID over to where the box runs now, or
+// ends them if move has no resources
+func (s *Server) moveSessions(instanceID string, move boxMove) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	sessions := s.activeSessions[instanceID]
+	if len(sessions) == 0 {
+		return
+	}
+	if move.resources != nil && move.resources.InstanceID != instanceID {
+		delete(s.activeSessions, instanceID)
+		if s.activeSessions[move.resources.InstanceID] == nil {
+			s.activeSessions[move.resources.InstanceID] = make(map[*liveSession]struct{})
+		}
+		for session := range sessions {
+			session.instanceID = move.resources.InstanceID
+			s.activeSessions[move.resources.InstanceID][session] = struct{}{}
+		}
+	}
+	for session := range sessions {
+		// Only the latest move matters
+		select {
+		case <-session.moved:
+		default:
+		}
+		session.moved <- move
+	}
+	toInstance := ""
+	if move.resources != nil {
+		toInstance = move.resources.InstanceID
+	}
+	s.logger.Info("moved sessions", "fromInstance", instanceID, "toInstance", toInstance, "sessions", len(sessions))
+}
+
+// notifySessions writes a notice to the users of the live sessions on instanceID
+func (s *Server) notifySessions(instanceID, notice string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for session := range s.activeSessions[instanceID] {
+		if _, err := fmt.Fprintf(session.notices, "\r\n[shellbox] %s\r\n", notice); err != nil {
+			s.logger.Error("Error writing box notice", "error", err)
+		}
+	}
+}
+
+// HandleBoxIncident tells the users of a box what happened to it, and moves their sessions
+// to the restarted box or ends them if it went down for good. Register it with
+// infra.BoxSupervisor.OnIncident.
+func (s *Server) HandleBoxIncident(report *infra.BoxIncidentReport) {
+	if !report.Fatal {
+		s.notifySessions(report.InstanceID, "Your box reported: "+report.Detail)
+		return
+	}
+
+	var notice string
+	switch {
+	case report.Restarted && report.From != "":
+		notice = fmt.Sprintf("Your box went down (%s) and was restarted from checkpoint %s, reconnecting...", report.Detail, report.From)
+	case report.Restarted:
+		notice = fmt.Sprintf("Your box went down (%s) and was restarted, reconnecting...", report.Detail)
+	case report.Err != nil:
+		notice = fmt.Sprintf("Your box went down (%s) and could not be restarted: %v", report.Detail, report.Err)
+	default:
+		notice = fmt.Sprintf("Your box went down (%s) and was not restarted, its restart policy is %s", report.Detail, report.Policy)
+	}
+
+	move := boxMove{notice: notice}
+	if report.Restarted {
+		move.resources = &infra.AllocatedResources{InstanceID: report.InstanceID, InstanceIP: report.InstanceIP}
+	}
+	s.moveSessions(report.InstanceID, move)
+}
+
+// MigrateBox live-migrates the box on instanceID to a free instance and moves the users'
+// sessions along with it
+func (s *Server) MigrateBox(ctx context.Context, instanceID string, progress *infra.ProgressReporter) (*infra.AllocatedResources, error) {
+	resources, err := s.allocator.MigrateBox(ctx, instanceID, progress)
+	if err != nil {
+		return nil, err
+	}
+	s.moveSessions(instanceID, boxMove{resources: resources, notice: "Your box moved to a new host, reconnecting..."})
+	return resources, nil
+}
+
+// LoadAdminKeys allows the keys in an authorized_keys file to run admin commands. Call it
+// before Run.
+func (s *Server) LoadAdminKeys(path string) error {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from the server's command line
+	if err != nil {
+		return fmt.Errorf("failed to read admin keys: %w", err)
+	}
+
+	admins := make(map[string]bool)
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse admin keys: %w", err)
+		}
+		admins[generateUserID(key)] = true
+		data = rest
+	}
+
+	s.admins = admins
+	s.logger.Info("loaded admin keys", "path", path, "count", len(admins))
+	return nil
+}
+
+// isAdmin reports whether userID may run admin commands
+func (s *Server) isAdmin(userID string) bool {
+	return userID != "" && s.admins[userID]
+}
+
+// handleAdminMigrateCommand live-migrates the box on an instance, e.g. before the instance
+// goes into maintenance
+func (s *Server) handleAdminMigrateCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	if !s.isAdmin(ctx.UserID) {
+		s.logger.Warn("Admin command refused", "user", ctx.UserID, "action", result.Action)
+		if _, err := sess.Write([]byte("Permission denied\n")); err != nil {
+			s.logger.Error("Error writing permission error", "error", err)
+		}
+		if err := sess.Exit(1); err != nil {
+			s.logger.Error("Error during exit(1)", "error", err)
+		}
+		return
+	}
+
+	instanceID := result.Args[0]
+	s.logger.Info("Migrate command received", "user", ctx.UserID, "instanceID", instanceID)
+
+	_, _, isPty := sess.Pty()
+	progress := infra.NewProgressReporter(newSessionProgress(sess.Stderr(), isPty))
+
+	// Unlike a connect, the migration carries on if the admin disconnects: stopping it
+	// halfway only rolls it back
+	migrateCtx, cancel := context.WithTimeout(context.WithoutCancel(sess.Context()), infra.MigrationTimeout)
+	defer cancel()
+	resources, err := s.MigrateBox(migrateCtx, instanceID, progress)
+	if err != nil {
+		s.logger.Error("Box migration failed", "instanceID", instanceID, "error", err)
+		if _, writeErr := fmt.Fprintf(sess, "Failed to migrate box on instance %s: %v\n", instanceID, err); writeErr != nil {
+			s.logger.Error("Error writing migrate error message", "error", writeErr)
+		}
+		if exitErr := sess.Exit(1); exitErr != nil {
+			s.logger.Error("Error during exit(1)", "error", exitErr)
+		}
+		return
+	}
+
+	msg := fmt.Sprintf("Box moved from instance %s to %s (%s), volume %s\n", instanceID, resources.InstanceID, resources.InstanceIP, resources.VolumeID)
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing migrate result", "error", err)
+	}
+	if err := sess.Exit(0); err != nil {
+		s.logger.Error("Error during exit(0)", "error", err)
+	}
+}
+
+// sessionInput reads a user's keystrokes and window changes once and hands them to the
+// current box shell, so the session can carry on in a new shell when the box moves
+type sessionInput struct {
+	chunks chan []byte // closed once the user closed stdin
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	window gssh.Window
+	pty    *gssh.Pty
+	box    *ssh.Session
+}
+
+func newSessionInput(sess gssh.Session, logger *slog.Logger) *sessionInput {
+	in := &sessionInput{
+		chunks: make(chan []byte),
+		logger: logger,
+	}
+	if pty, winCh, isPty := sess.Pty(); isPty {
+		in.pty = &pty
+		in.window = pty.Window
+		go in.forwardWindowChanges(winCh)
+	}
+	go in.read(sess)
+	return in
+}
+
+func (in *sessionInput) read(sess gssh.Session) {
+	defer close(in.chunks)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := sess.Read(buf)
+		if n > 0 {
+			select {
+			case in.chunks <- bytes.Clone(buf[:n]):
+			case <-sess.Context().Done():
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (in *sessionInput) forwardWindowChanges(winCh <-chan gssh.Window) {
+	for win := range winCh {
+		in.mu.Lock()
+		in.window = win
+		box := in.box
+		in.mu.Unlock()
+
+		if box != nil {
+			if err := box.WindowChange(win.Height, win.Width); err != nil {
+				in.logger.Error("Failed to change window size", "error", err)
+			}
+		}
+	}
+}
+
+// attach makes boxSession the current box shell, requesting a PTY sized like the user's
+// terminal if the user has one
+func (in *sessionInput) attach(boxSession *ssh.Session) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.pty != nil {
+		if err := boxSession.RequestPty(in.pty.Term, in.window.Height, in.window.Width, ssh.TerminalModes{}); err != nil {
+			return fmt.Errorf("failed to request PTY: %w", err)
+		}
+	}
+	in.box = boxSession
+	return nil
+}
+
+// detach forgets boxSession if it is still the current box shell
+func (in *sessionInput) detach(boxSession *ssh.Session) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.box == boxSession {
+		in.box = nil
+	}
+}
+
+// pump writes the user's input to stdin until stop is closed, closing stdin once the user
+// closed theirs
+func (in *sessionInput) pump(stdin io.WriteCloser, stop <-chan struct{}) {
+	for {
+		select {
+		case chunk, ok := <-in.chunks:
+			if !ok {
+				stdin.Close()
+				return
+			}
+			if _, err := stdin.Write(chunk); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
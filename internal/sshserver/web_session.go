@@ -0,0 +1,238 @@
+package sshserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+)
+
+// webControl is a control message of the browser terminal: resize from the browser,
+// exit to it
+type webControl struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+	Code int    `json:"code,omitempty"` // exit code
+}
+
+// webFrame is a WebSocket message, terminal data if binary and a webControl if text
+type webFrame struct {
+	data []byte
+	text bool
+}
+
+// webFrameCodec sends and receives webFrames, keeping their message type
+var webFrameCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		frame := v.(webFrame)
+		if frame.text {
+			return frame.data, websocket.TextFrame, nil
+		}
+		return frame.data, websocket.BinaryFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		frame := v.(*webFrame)
+		frame.data = data
+		frame.text = payloadType == websocket.TextFrame
+		return nil
+	},
+}
+
+// webSession adapts the WebSocket of a browser terminal to gssh.Session, so the browser
+// runs the same connect and shell flow as an SSH client. It always has a PTY, sized and
+// resized by the browser.
+type webSession struct {
+	ws      *websocket.Conn
+	command []string
+	ctx     *webContext
+	cancel  context.CancelFunc
+
+	input       *io.PipeReader
+	inputWriter *io.PipeWriter
+	windows     chan gssh.Window // holds the latest resize until the shell picks it up
+
+	mu       sync.Mutex
+	window   gssh.Window
+	exitOnce sync.Once
+}
+
+var _ gssh.Session = (*webSession)(nil)
+
+func newWebSession(ws *websocket.Conn, userID, sessionID string, command []string, window gssh.Window) *webSession {
+	request := ws.Request()
+	ctx, cancel := context.WithCancel(request.Context())
+	input, inputWriter := io.Pipe()
+	var localAddr net.Addr
+	if addr, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr
+	}
+	var remoteAddr net.Addr = &net.TCPAddr{}
+	if addr, err := netip.ParseAddrPort(request.RemoteAddr); err == nil {
+		remoteAddr = net.TCPAddrFromAddrPort(addr)
+	}
+	return &webSession{
+		ws:      ws,
+		command: command,
+		ctx: &webContext{
+			Context:    ctx,
+			user:       userID,
+			sessionID:  sessionID,
+			remoteAddr: remoteAddr,
+			localAddr:  localAddr,
+		},
+		cancel:      cancel,
+		input:       input,
+		inputWriter: inputWriter,
+		windows:     make(chan gssh.Window, 1),
+		window:      window,
+	}
+}
+
+// receive reads the browser's messages until the WebSocket closes, which ends the session
+func (s *webSession) receive(logger *slog.Logger) {
+	defer s.cancel()
+	defer s.inputWriter.Close()
+	for {
+		var frame webFrame
+		if err := webFrameCodec.Receive(s.ws, &frame); err != nil {
+			return
+		}
+		if !frame.text {
+			if _, err := s.inputWriter.Write(frame.data); err != nil {
+				return
+			}
+			continue
+		}
+
+		var control webControl
+		if err := json.Unmarshal(frame.data, &control); err != nil {
+			logger.Warn("Invalid web terminal message", "error", err)
+			continue
+		}
+		if control.Type == "resize" && control.Cols > 0 && control.Rows > 0 {
+			window := gssh.Window{Width: control.Cols, Height: control.Rows}
+			s.mu.Lock()
+			s.window = window
+			s.mu.Unlock()
+			select {
+			case <-s.windows:
+			default:
+			}
+			s.windows <- window
+		}
+	}
+}
+
+func (s *webSession) Read(p []byte) (int, error) {
+	return s.input.Read(p)
+}
+
+func (s *webSession) Write(p []byte) (int, error) {
+	if err := webFrameCodec.Send(s.ws, webFrame{data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *webSession) Close() error {
+	s.cancel()
+	return s.ws.Close()
+}
+
+func (s *webSession) CloseWrite() error {
+	return nil
+}
+
+func (s *webSession) SendRequest(string, bool, []byte) (bool, error) {
+	return false, nil
+}
+
+// Stderr goes to the same terminal as stdout
+func (s *webSession) Stderr() io.ReadWriter {
+	return webStderr{s}
+}
+
+// Exit tells the browser the session ended with code and closes the WebSocket
+func (s *webSession) Exit(code int) error {
+	var err error
+	s.exitOnce.Do(func() {
+		message, _ := json.Marshal(webControl{Type: "exit", Code: code})
+		err = webFrameCodec.Send(s.ws, webFrame{data: message, text: true})
+		s.Close()
+	})
+	return err
+}
+
+func (s *webSession) User() string                  { return s.ctx.user }
+func (s *webSession) RemoteAddr() net.Addr          { return s.ctx.remoteAddr }
+func (s *webSession) LocalAddr() net.Addr           { return s.ctx.localAddr }
+func (s *webSession) Environ() []string             { return nil }
+func (s *webSession) Command() []string             { return s.command }
+func (s *webSession) RawCommand() string            { return strings.Join(s.command, " ") }
+func (s *webSession) Subsystem() string             { return "" }
+func (s *webSession) PublicKey() gssh.PublicKey     { return nil }
+func (s *webSession) Context() gssh.Context         { return s.ctx }
+func (s *webSession) Permissions() gssh.Permissions { return *s.ctx.Permissions() }
+func (s *webSession) Signals(chan<- gssh.Signal)    {}
+func (s *webSession) Break(chan<- bool)             {}
+
+func (s *webSession) Pty() (gssh.Pty, <-chan gssh.Window, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return gssh.Pty{Term: "xterm-256color", Window: s.window}, s.windows, true
+}
+
+// webStderr is the stderr of a webSession, which has no input of its own
+type webStderr struct {
+	*webSession
+}
+
+func (webStderr) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// webContext is the gssh.Context of a webSession
+type webContext struct {
+	context.Context
+	sync.Mutex
+
+	user       string
+	sessionID  string
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	values     sync.Map
+}
+
+var _ gssh.Context = (*webContext)(nil)
+
+func (c *webContext) User() string          { return c.user }
+func (c *webContext) SessionID() string     { return c.sessionID }
+func (c *webContext) ClientVersion() string { return "" }
+func (c *webContext) ServerVersion() string { return "" }
+func (c *webContext) RemoteAddr() net.Addr  { return c.remoteAddr }
+func (c *webContext) LocalAddr() net.Addr   { return c.localAddr }
+
+func (c *webContext) Permissions() *gssh.Permissions {
+	return &gssh.Permissions{Permissions: &ssh.Permissions{}}
+}
+
+func (c *webContext) SetValue(key, value any) {
+	c.values.Store(key, value)
+}
+
+func (c *webContext) Value(key any) any {
+	if value, ok := c.values.Load(key); ok {
+		return value
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,230 @@
+package sshserver
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"shellbox/internal/infra"
+	"strconv"
+	"sync"
+	"time"
+
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/net/websocket"
+)
+
+// Web terminal settings
+const (
+	webLoginTTL       = 5 * time.Minute
+	webSessionTTL     = 12 * time.Hour
+	webSessionCookie  = "__Host-shellbox_session" // the prefix keeps preview hostnames from setting it
+	webLoginPurpose   = "web-login"
+	webSessionPurpose = "web-session"
+	webMaxMessage     = 64 << 10
+)
+
+//go:embed web_terminal.html
+var webTerminalPage []byte
+
+// webTerminal is the browser terminal, for users without an SSH client. Browsers sign
+// in with a single-use link from the web-login command, then connect to boxes over a
+// WebSocket that runs the same flow as the connect command.
+type webTerminal struct {
+	host   string
+	tokens *infra.TokenSigner
+
+	mu         sync.Mutex
+	usedLogins map[string]time.Time // nonces of redeemed login links, kept until they expire
+}
+
+// EnableWebTerminal enables the web-login command and returns the handler of the browser
+// terminal, which must be served on https://<host>/
+func (s *Server) EnableWebTerminal(host string) (http.Handler, error) {
+	tokens, err := infra.NewTokenSigner()
+	if err != nil {
+		return nil, err
+	}
+	s.web = &webTerminal{
+		host:       host,
+		tokens:     tokens,
+		usedLogins: make(map[string]time.Time),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.serveWebTerminalPage)
+	mux.HandleFunc("GET /login", s.serveWebLogin)
+	mux.HandleFunc("GET /ws", s.serveWebTerminalSocket)
+	return mux, nil
+}
+
+// loginLink returns a link that signs a browser in as userID, opening boxName if set
+func (w *webTerminal) loginLink(userID, boxName string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate login nonce: %w", err)
+	}
+	token := w.tokens.Sign(webLoginPurpose, time.Now().Add(webLoginTTL), userID, hex.EncodeToString(nonce), boxName)
+	return fmt.Sprintf("https://%s/login?token=%s", w.host, token), nil
+}
+
+// redeemLogin checks a login token and that it wasn't used before, and returns its user
+// ID and box name
+func (w *webTerminal) redeemLogin(token string) (string, string, bool) {
+	fields, expires, ok := w.tokens.Verify(webLoginPurpose, token)
+	if !ok || len(fields) != 3 {
+		return "", "", false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for nonce, expiry := range w.usedLogins {
+		if now.After(expiry) {
+			delete(w.usedLogins, nonce)
+		}
+	}
+	if _, used := w.usedLogins[fields[1]]; used {
+		return "", "", false
+	}
+	w.usedLogins[fields[1]] = expires
+	return fields[0], fields[2], true
+}
+
+// user returns the user a request's session cookie signs in
+func (w *webTerminal) user(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(webSessionCookie)
+	if err != nil {
+		return "", false
+	}
+	fields, _, ok := w.tokens.Verify(webSessionPurpose, cookie.Value)
+	if !ok || len(fields) != 1 {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// serveWebTerminalPage serves the terminal page to signed-in browsers
+func (s *Server) serveWebTerminalPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	if _, ok := s.web.user(r); !ok {
+		http.Error(w, fmt.Sprintf("Sign in by opening the link from:\n\n  ssh %s web-login [box_name]\n", s.web.host), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(webTerminalPage)
+}
+
+// serveWebLogin redeems a login link: it signs the browser in with a session cookie and
+// sends it on to the terminal
+func (s *Server) serveWebLogin(w http.ResponseWriter, r *http.Request) {
+	userID, boxName, ok := s.web.redeemLogin(r.URL.Query().Get("token"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("This login link is invalid, expired or was used already. Get a new one with:\n\n  ssh %s web-login\n", s.web.host), http.StatusUnauthorized)
+		return
+	}
+	s.logger.Info("Web terminal login", "user", userID, "remoteAddr", r.RemoteAddr)
+
+	expires := time.Now().Add(webSessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     webSessionCookie,
+		Value:    s.web.tokens.Sign(webSessionPurpose, expires, userID),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	location := "/"
+	if boxName != "" {
+		location += "?box=" + url.QueryEscape(boxName)
+	}
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
+
+// serveWebTerminalSocket upgrades a signed-in browser's request to the WebSocket of a
+// terminal session on the box named by the box parameter
+func (s *Server) serveWebTerminalSocket(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.web.user(r)
+	if !ok {
+		http.Error(w, "not signed in", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	boxName := query.Get("box")
+	if boxName == "" {
+		http.Error(w, "box name required", http.StatusBadRequest)
+		return
+	}
+	window := gssh.Window{Width: 80, Height: 24}
+	if cols, err := strconv.Atoi(query.Get("cols")); err == nil && cols > 0 {
+		window.Width = cols
+	}
+	if rows, err := strconv.Atoi(query.Get("rows")); err == nil && rows > 0 {
+		window.Height = rows
+	}
+
+	server := websocket.Server{
+		// Cookies go along with WebSockets opened by any page, so only the terminal's own
+		// page may open one
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			if origin := r.Header.Get("Origin"); origin != "https://"+s.web.host {
+				return fmt.Errorf("origin %q not allowed", origin)
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			s.handleWebTerminalSession(ws, userID, boxName, window)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// handleWebTerminalSession connects a browser terminal to a box like the connect command
+func (s *Server) handleWebTerminalSession(ws *websocket.Conn, userID, boxName string, window gssh.Window) {
+	ws.MaxPayloadBytes = webMaxMessage
+	ctx := CommandContext{
+		UserID:    userID,
+		SessionID: fmt.Sprintf("web_%d", time.Now().UnixNano()),
+	}
+	sess := newWebSession(ws, userID, ctx.SessionID, []string{ActionConnect, boxName}, window)
+	ctx.RemoteAddr = sess.RemoteAddr().String()
+	defer sess.Close()
+	go sess.receive(s.logger)
+
+	s.logger.Info("Web terminal session started", "user", userID, "box", boxName, "remoteAddr", ctx.RemoteAddr)
+	s.handleConnectCommand(ctx, CommandResult{Action: ActionConnect, Args: []string{boxName}, Resume: ResumeAsk}, sess)
+	if err := sess.Exit(0); err != nil {
+		s.logger.Debug("Web terminal closed before exit", "error", err)
+	}
+}
+
+// handleWebLoginCommand prints a link that signs a browser in to the web terminal
+func (s *Server) handleWebLoginCommand(ctx CommandContext, result CommandResult, sess gssh.Session) {
+	s.logger.Info("Web login command received", "user", ctx.UserID)
+
+	exitCode := 1
+	var msg string
+	boxName := ""
+	if len(result.Args) > 0 {
+		boxName = result.Args[0]
+	}
+	if s.web == nil {
+		msg = "The web terminal is not enabled on this server\n"
+	} else if link, err := s.web.loginLink(ctx.UserID, boxName); err != nil {
+		msg = fmt.Sprintf("Failed to create login link: %v\n", err)
+	} else {
+		exitCode = 0
+		msg = fmt.Sprintf("Open this link in your browser within %s; it works once and keeps the browser signed in for %s:\n  %s\n",
+			webLoginTTL, webSessionTTL, link)
+	}
+
+	if _, err := sess.Write([]byte(msg)); err != nil {
+		s.logger.Error("Error writing web login link", "error", err)
+	}
+	if err := sess.Exit(exitCode); err != nil {
+		s.logger.Error("Error during exit", "error", err)
+	}
+}
@@ -0,0 +1,304 @@
+package sshserver
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gssh "github.com/gliderlabs/ssh"
+	"golang.org/x/net/websocket"
+)
+
+const webTestHost = "shellbox.example.com"
+
+// newTestWebTerminal enables the web terminal on server and returns its handler
+func newTestWebTerminal(t *testing.T, server *Server) http.Handler {
+	t.Helper()
+	handler, err := server.EnableWebTerminal(webTestHost)
+	if err != nil {
+		t.Fatalf("EnableWebTerminal: %v", err)
+	}
+	return handler
+}
+
+// serveWeb sends a GET request for path to handler, with cookie if set
+func serveWeb(handler http.Handler, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "https://"+webTestHost+path, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestWebLogin(t *testing.T) {
+	server := &Server{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := newTestWebTerminal(t, server)
+
+	link, err := server.web.loginLink("user1", "dev 1")
+	if err != nil {
+		t.Fatalf("loginLink: %v", err)
+	}
+	path, ok := strings.CutPrefix(link, "https://"+webTestHost)
+	if !ok {
+		t.Fatalf("got link %s, want one to %s", link, webTestHost)
+	}
+
+	// The link signs the browser in and opens the box
+	w := serveWeb(handler, path, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if location := w.Header().Get("Location"); location != "/?box=dev+1" {
+		t.Errorf("redirected to %s, want /?box=dev+1", location)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != webSessionCookie {
+		t.Fatalf("got cookies %v, want the session cookie", cookies)
+	}
+	cookie := cookies[0]
+	if !cookie.Secure || !cookie.HttpOnly || cookie.Path != "/" || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("got cookie %+v, want a secure HTTP-only lax cookie for all paths", cookie)
+	}
+	if w := serveWeb(handler, "/", cookie); w.Code != http.StatusOK {
+		t.Errorf("terminal page with the cookie: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// It works once
+	if w := serveWeb(handler, path, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("second use: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	} else if len(w.Result().Cookies()) != 0 {
+		t.Errorf("second use set a cookie")
+	}
+
+	tokens := server.web.tokens
+	for name, token := range map[string]string{
+		"expired":       tokens.Sign(webLoginPurpose, time.Now().Add(-time.Second), "user1", "nonce", ""),
+		"session token": tokens.Sign(webSessionPurpose, time.Now().Add(time.Hour), "user1"),
+		"no nonce":      tokens.Sign(webLoginPurpose, time.Now().Add(time.Hour), "user1"),
+		"garbage":       "not-a-token",
+	} {
+		if w := serveWeb(handler, "/login?token="+token, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestWebLoginNonceExpiry(t *testing.T) {
+	server := &Server{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	newTestWebTerminal(t, server)
+	web := server.web
+
+	// A redeemed nonce is kept as long as its link is valid
+	expires := time.Now().Add(time.Minute)
+	token := web.tokens.Sign(webLoginPurpose, expires, "user1", "nonce1", "")
+	if _, _, ok := web.redeemLogin(token); !ok {
+		t.Fatalf("fresh login refused")
+	}
+	if expiry, ok := web.usedLogins["nonce1"]; !ok || expiry.Unix() != expires.Unix() {
+		t.Fatalf("got nonce kept until %v, want until %v", expiry, expires)
+	}
+	if _, _, ok := web.redeemLogin(token); ok {
+		t.Fatalf("login redeemed twice")
+	}
+
+	// Once the link can't be used any more, its nonce is dropped
+	web.usedLogins["nonce1"] = time.Now().Add(-time.Second)
+	userID, boxName, ok := web.redeemLogin(web.tokens.Sign(webLoginPurpose, expires, "user2", "nonce2", "dev1"))
+	if !ok || userID != "user2" || boxName != "dev1" {
+		t.Fatalf("got %q, %q, %v, want user2's login to dev1", userID, boxName, ok)
+	}
+	if _, ok := web.usedLogins["nonce1"]; ok {
+		t.Errorf("expired nonce kept")
+	}
+	if len(web.usedLogins) != 1 {
+		t.Errorf("got nonces %v, want only nonce2", web.usedLogins)
+	}
+}
+
+func TestWebSessionCookie(t *testing.T) {
+	server := &Server{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	handler := newTestWebTerminal(t, server)
+	tokens := server.web.tokens
+	sessionCookie := func(value string) *http.Cookie {
+		return &http.Cookie{Name: webSessionCookie, Value: value}
+	}
+
+	w := serveWeb(handler, "/", sessionCookie(tokens.Sign(webSessionPurpose, time.Now().Add(time.Hour), "user1")))
+	if w.Code != http.StatusOK || w.Body.String() != string(webTerminalPage) {
+		t.Fatalf("got status %d, want the terminal page", w.Code)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "frame-ancestors 'none'" {
+		t.Errorf("got Content-Security-Policy %q, want framing denied", csp)
+	}
+
+	for name, cookie := range map[string]*http.Cookie{
+		"login token":   sessionCookie(tokens.Sign(webLoginPurpose, time.Now().Add(time.Hour), "user1")),
+		"preview token": sessionCookie(tokens.Sign("preview", time.Now().Add(time.Hour), "user1")),
+		"expired":       sessionCookie(tokens.Sign(webSessionPurpose, time.Now().Add(-time.Second), "user1")),
+		"extra fields":  sessionCookie(tokens.Sign(webSessionPurpose, time.Now().Add(time.Hour), "user1", "dev1")),
+		"other name":    {Name: "shellbox_session", Value: tokens.Sign(webSessionPurpose, time.Now().Add(time.Hour), "user1")},
+		"no cookie":     nil,
+	} {
+		for _, path := range []string{"/", "/ws?box=dev1"} {
+			if w := serveWeb(handler, path, cookie); w.Code != http.StatusUnauthorized {
+				t.Errorf("%s on %s: got status %d, want %d", name, path, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+// dialWebTerminal opens the terminal WebSocket of box on ts from origin, signed in as userID
+func dialWebTerminal(server *Server, ts *httptest.Server, userID, query, origin string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?"+query, origin)
+	if err != nil {
+		return nil, err
+	}
+	cookie := &http.Cookie{Name: webSessionCookie, Value: server.web.tokens.Sign(webSessionPurpose, time.Now().Add(time.Hour), userID)}
+	config.Header.Set("Cookie", cookie.String())
+	return websocket.DialConfig(config)
+}
+
+// readWebTerminal reads terminal output from ws until it contains want, returning the
+// exit message if one comes first
+func readWebTerminal(t *testing.T, ws *websocket.Conn, want string) *webControl {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var output strings.Builder
+	for !strings.Contains(output.String(), want) {
+		var frame webFrame
+		if err := webFrameCodec.Receive(ws, &frame); err != nil {
+			t.Fatalf("reading %q: %v, got:\n%s", want, err, output.String())
+		}
+		if frame.text {
+			var control webControl
+			if err := json.Unmarshal(frame.data, &control); err != nil {
+				t.Fatalf("invalid control message %s: %v", frame.data, err)
+			}
+			return &control
+		}
+		output.Write(frame.data)
+	}
+	return nil
+}
+
+func TestWebTerminalSocket(t *testing.T) {
+	server, _, box := newTestServer(t)
+	ts := httptest.NewServer(newTestWebTerminal(t, server))
+	defer ts.Close()
+
+	userKey := newTestSigner(t)
+	userID := generateUserID(userKey.PublicKey())
+	if output := runCommand(t, serve(t, server.sshServer()), userKey, "spinup dev1", ""); !strings.Contains(output, "created successfully") {
+		t.Fatalf("spinup printed:\n%s", output)
+	}
+
+	// Only the terminal's own page may open the socket
+	for _, origin := range []string{"https://evil.example.com", "http://" + webTestHost, "https://3000-dev1-" + userID + ".preview." + webTestHost} {
+		if ws, err := dialWebTerminal(server, ts, userID, "box=dev1", origin); err == nil {
+			ws.Close()
+			t.Errorf("socket opened from %s", origin)
+		}
+	}
+	select {
+	case addr := <-box.dialed:
+		t.Fatalf("refused socket connected to the box at %s", addr)
+	default:
+	}
+
+	ws, err := dialWebTerminal(server, ts, userID, "box=dev1&cols=100&rows=30", "https://"+webTestHost)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	if exit := readWebTerminal(t, ws, "terminal 100x30"); exit != nil {
+		t.Fatalf("session exited with %d before the shell started", exit.Code)
+	}
+	if err := webFrameCodec.Send(ws, webFrame{data: []byte("hello\n")}); err != nil {
+		t.Fatalf("sending input: %v", err)
+	}
+	if exit := readWebTerminal(t, ws, "echo: hello"); exit != nil {
+		t.Fatalf("session exited with %d before echoing", exit.Code)
+	}
+	if exit := readWebTerminal(t, ws, "\x00never"); exit == nil || exit.Type != "exit" || exit.Code != 0 {
+		t.Fatalf("got %+v at the end of the shell, want exit 0", exit)
+	}
+}
+
+func TestWebSessionResize(t *testing.T) {
+	sessions := make(chan *webSession, 1)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		sess := newWebSession(ws, "user1", "web_1", []string{ActionConnect, "dev1"}, gssh.Window{Width: 80, Height: 24})
+		sessions <- sess
+		sess.receive(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}))
+	defer ts.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	sess := <-sessions
+
+	pty, windows, ok := sess.Pty()
+	if !ok || pty.Window != (gssh.Window{Width: 80, Height: 24}) {
+		t.Fatalf("got PTY %+v, %v, want 80x24", pty, ok)
+	}
+
+	// send sends text frames as control messages, then input for the session to read back,
+	// which it only gets once the messages before were handled
+	send := func(controls ...string) {
+		t.Helper()
+		for _, control := range controls {
+			if err := webFrameCodec.Send(ws, webFrame{data: []byte(control), text: true}); err != nil {
+				t.Fatalf("sending %s: %v", control, err)
+			}
+		}
+		if err := webFrameCodec.Send(ws, webFrame{data: []byte("input")}); err != nil {
+			t.Fatalf("sending input: %v", err)
+		}
+		buf := make([]byte, len("input"))
+		if _, err := io.ReadFull(sess, buf); err != nil || string(buf) != "input" {
+			t.Fatalf("read %q, %v, want the input", buf, err)
+		}
+	}
+	windowOf := func(cols, rows int) gssh.Window {
+		return gssh.Window{Width: cols, Height: rows}
+	}
+
+	send(`{"type":"resize","cols":0,"rows":10}`, `not json`, `{"type":"resize","cols":120,"rows":40}`)
+	if window := <-windows; window != windowOf(120, 40) {
+		t.Errorf("got window %+v, want 120x40", window)
+	}
+	if pty, _, _ := sess.Pty(); pty.Window != windowOf(120, 40) {
+		t.Errorf("got PTY window %+v, want 120x40", pty.Window)
+	}
+
+	// A shell that isn't keeping up gets the latest size only
+	send(`{"type":"resize","cols":100,"rows":30}`, `{"type":"resize","cols":90,"rows":20}`)
+	if window := <-windows; window != windowOf(90, 20) {
+		t.Errorf("got window %+v, want 90x20", window)
+	}
+	select {
+	case window := <-windows:
+		t.Errorf("got stale window %+v", window)
+	default:
+	}
+
+	// The browser going away ends the session
+	ws.Close()
+	select {
+	case <-sess.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session context not done after the browser left")
+	}
+	if _, err := sess.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading after the browser left, want EOF", err)
+	}
+}
@@ -0,0 +1,63 @@
+package sshutil
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeys pins the first key each host presents (trust on first use). The hosts are our
+// own VMs, whose keys are generated at first boot, so there is nothing to check the first
+// key against; after that, a different key means something else answers at the address.
+type HostKeys struct {
+	mu   sync.Mutex
+	keys map[string]ssh.PublicKey // by host, without port
+}
+
+// knownHosts holds the keys Dial pins
+var knownHosts = NewHostKeys()
+
+// NewHostKeys creates an empty set of pinned keys
+func NewHostKeys() *HostKeys {
+	return &HostKeys{keys: make(map[string]ssh.PublicKey)}
+}
+
+// Check is an ssh.HostKeyCallback accepting key if it is the one pinned for the host,
+// pinning it if the host has none yet
+func (h *HostKeys) Check(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	host := hostOnly(hostname)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pinned, ok := h.keys[host]
+	if !ok {
+		h.keys[host] = key
+		return nil
+	}
+	if !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+		return fmt.Errorf("host key of %s changed from %s to %s", host, ssh.FingerprintSHA256(pinned), ssh.FingerprintSHA256(key))
+	}
+	return nil
+}
+
+// Forget drops the key pinned for hostname, so the next host there is trusted afresh
+func (h *HostKeys) Forget(hostname string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.keys, hostOnly(hostname))
+}
+
+// ForgetHostKey drops the key Dial pinned for hostname. Call it whenever a VM is created
+// or deleted at that address, as private IPs are handed out again to new VMs.
+func ForgetHostKey(hostname string) {
+	knownHosts.Forget(hostname)
+}
+
+func hostOnly(hostname string) string {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		return host
+	}
+	return hostname
+}
@@ -0,0 +1,66 @@
+package sshutil
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeysTrustOnFirstUse(t *testing.T) {
+	hostKeys := NewHostKeys()
+	first, second := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+
+	if err := hostKeys.Check("10.0.0.4:22", nil, first); err != nil {
+		t.Fatalf("first key: %v", err)
+	}
+	if err := hostKeys.Check("10.0.0.4:22", nil, first); err != nil {
+		t.Fatalf("same key again: %v", err)
+	}
+	if err := hostKeys.Check("10.0.0.4:2222", nil, second); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("got %v for a different key on another port, want it refused", err)
+	}
+	if err := hostKeys.Check("10.0.0.5:22", nil, second); err != nil {
+		t.Fatalf("key of another host: %v", err)
+	}
+
+	// A new VM at the address brings its own key
+	hostKeys.Forget("10.0.0.4")
+	if err := hostKeys.Check("10.0.0.4:22", nil, second); err != nil {
+		t.Fatalf("new key after Forget: %v", err)
+	}
+	if err := hostKeys.Check("10.0.0.4:22", nil, first); err == nil {
+		t.Fatalf("old key accepted after the new one was pinned")
+	}
+}
+
+func TestDialRefusesChangedHostKey(t *testing.T) {
+	ctx := context.Background()
+	hostKeys := NewHostKeys()
+	server := newTestServer(t)
+	client, err := dialConfig(ctx, server.addr, server.clientConfig(hostKeys))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client.Close()
+
+	// Another server answering at the same address, e.g. for a deleted VM
+	impostor := newTestServer(t)
+	impostor.clientKey = server.clientKey
+	config := impostor.clientConfig(hostKeys)
+	config.HostKeyCallback = func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		return hostKeys.Check(server.addr, remote, key)
+	}
+	if _, err := dialConfig(ctx, impostor.addr, config); err == nil || !strings.Contains(err.Error(), "host key") {
+		t.Fatalf("got %v, want the changed host key refused", err)
+	}
+
+	hostKeys.Forget(server.addr)
+	client, err = dialConfig(ctx, impostor.addr, config)
+	if err != nil {
+		t.Fatalf("dial after Forget: %v", err)
+	}
+	client.Close()
+}
@@ -0,0 +1,196 @@
+package sshutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultIdleTimeout is how long an unused pooled connection stays open
+const DefaultIdleTimeout = 2 * time.Minute
+
+// sshPort and sshConnectTimeout match what the ssh command line used to get
+const (
+	sshPort           = "22"
+	sshConnectTimeout = 4 * time.Second
+)
+
+// Pool keeps one authenticated SSH connection per user and host, shared by all commands
+// to that host and closed once it has been unused for the idle timeout
+type Pool struct {
+	idleTimeout time.Duration
+	dial        func(ctx context.Context, username, hostname string) (*ssh.Client, error)
+
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+type pooledConn struct {
+	client   *ssh.Client
+	refs     int
+	lastUsed time.Time
+}
+
+// defaultPool backs the package-level helpers
+var defaultPool = NewPool(DefaultIdleTimeout)
+
+// NewPool creates an empty pool closing connections idle for idleTimeout
+func NewPool(idleTimeout time.Duration) *Pool {
+	return &Pool{
+		idleTimeout: idleTimeout,
+		dial:        Dial,
+		conns:       make(map[string]*pooledConn),
+	}
+}
+
+// Acquire returns the pooled connection to username@hostname, dialing one if needed. The
+// connection stays open until release is called; don't close it.
+func Acquire(ctx context.Context, username, hostname string) (*ssh.Client, func(), error) {
+	return defaultPool.Acquire(ctx, username, hostname)
+}
+
+// Acquire returns the pooled connection to username@hostname, dialing one if needed. The
+// connection stays open until release is called; don't close it.
+func (p *Pool) Acquire(ctx context.Context, username, hostname string) (*ssh.Client, func(), error) {
+	key := username + "@" + hostname
+
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	if !ok {
+		p.mu.Unlock()
+		client, err := p.dial(ctx, username, hostname)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.mu.Lock()
+		// Another caller may have connected while we were dialing
+		if conn, ok = p.conns[key]; ok {
+			client.Close()
+		} else {
+			conn = &pooledConn{client: client}
+			p.conns[key] = conn
+			go p.watch(key, conn)
+		}
+	}
+	conn.refs++
+	p.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { p.release(key, conn) })
+	}
+	return conn.client, release, nil
+}
+
+// Discard closes a pooled connection that stopped working, so the next Acquire redials
+func (p *Pool) Discard(client *ssh.Client) {
+	p.mu.Lock()
+	for key, conn := range p.conns {
+		if conn.client == client {
+			delete(p.conns, key)
+		}
+	}
+	p.mu.Unlock()
+	client.Close()
+}
+
+// Close closes every pooled connection
+func (p *Pool) Close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*pooledConn)
+	p.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.client.Close()
+	}
+}
+
+func (p *Pool) release(key string, conn *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.refs--
+	conn.lastUsed = time.Now()
+	if conn.refs == 0 {
+		time.AfterFunc(p.idleTimeout, func() { p.expire(key, conn) })
+	}
+}
+
+// expire closes conn if nobody used it for the idle timeout
+func (p *Pool) expire(key string, conn *pooledConn) {
+	p.mu.Lock()
+	idle := conn.refs == 0 && time.Since(conn.lastUsed) >= p.idleTimeout && p.conns[key] == conn
+	if idle {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+
+	if idle {
+		conn.client.Close()
+	}
+}
+
+// watch drops conn from the pool once the connection goes away
+func (p *Pool) watch(key string, conn *pooledConn) {
+	_ = conn.client.Wait()
+	p.mu.Lock()
+	if p.conns[key] == conn {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+}
+
+// Dial opens a native SSH connection to a remote host, authenticating with the key at SSHKeyPath.
+// The host's key is pinned on first use, see ForgetHostKey. Callers own the client and must
+// close it; most should use Acquire instead.
+func Dial(ctx context.Context, username, hostname string) (*ssh.Client, error) {
+	keyData, err := os.ReadFile(SSHKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: knownHosts.Check,
+		Timeout:         sshConnectTimeout,
+	}
+	return dialConfig(ctx, net.JoinHostPort(hostname, sshPort), config)
+}
+
+// dialConfig opens an SSH connection to addr, giving up after sshConnectTimeout
+func dialConfig(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: sshConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", addr, err)
+	}
+
+	// Bound the handshake by the connect timeout as well as ctx
+	deadline := time.Now().Add(sshConnectTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("SSH handshake with %s: %w", addr, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
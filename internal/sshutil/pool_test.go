@@ -0,0 +1,80 @@
+package sshutil
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoolIdleExpiry(t *testing.T) {
+	server := newTestServer(t)
+	pool := server.pool(100 * time.Millisecond)
+	ctx := context.Background()
+
+	first, releaseFirst, err := pool.Acquire(ctx, "tester", "box")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	second, releaseSecond, err := pool.Acquire(ctx, "tester", "box")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if first != second {
+		t.Fatalf("got two connections to the same host")
+	}
+	releaseFirst()
+	releaseFirst() // releasing twice counts once
+
+	// Still in use, so it outlives the idle timeout
+	time.Sleep(300 * time.Millisecond)
+	if _, err := pool.Run(ctx, "true", "tester", "box"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := server.connections.Load(); got != 1 {
+		t.Fatalf("got %d connections while one is held, want 1", got)
+	}
+
+	releaseSecond()
+	select {
+	case <-server.disconnects:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle connection not closed")
+	}
+	if _, err := pool.Run(ctx, "true", "tester", "box"); err != nil {
+		t.Fatalf("Run after expiry: %v", err)
+	}
+	if got := server.connections.Load(); got != 2 {
+		t.Fatalf("got %d connections, want a new one after expiry", got)
+	}
+}
+
+func TestPoolRetriesBrokenConnection(t *testing.T) {
+	server := newTestServer(t)
+	pool := server.pool(time.Minute)
+	ctx := context.Background()
+
+	// The first connection can't open sessions any more, like one to a rebooted host
+	server.rejectSessions.Store(1)
+	result, err := pool.Run(ctx, "echo ok", "tester", "box")
+	if err != nil || result.Stdout != "ok\n" {
+		t.Fatalf("got %+v, %v, want the command run on a new connection", result, err)
+	}
+	if got := server.connections.Load(); got != 2 {
+		t.Fatalf("got %d connections, want 2", got)
+	}
+	select {
+	case <-server.disconnects:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("broken connection not closed")
+	}
+
+	// Only one retry: a host refusing every session fails the command
+	server.rejectSessions.Store(2)
+	pool.Close()
+	if _, err := pool.Run(ctx, "true", "tester", "box"); err == nil {
+		t.Fatalf("Run succeeded without sessions")
+	}
+	if got := server.connections.Load(); got != 4 {
+		t.Fatalf("got %d connections, want 4", got)
+	}
+}
@@ -0,0 +1,319 @@
+package sshutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types, open flags and status codes, as in draft-ietf-secsh-filexfer-02
+const (
+	sftpVersion = 3
+
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpWrite    = 6
+	fxpFSetStat = 10
+	fxpStatus   = 101
+	fxpHandle   = 102
+
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+
+	attrPermissions = 0x04
+
+	fxOK = 0
+)
+
+// Upload tuning: writes are pipelined, keeping several chunks in flight
+const (
+	sftpChunkSize   = 32 * 1024
+	sftpMaxInflight = 16
+)
+
+// CopyFile copies a local file to a remote host over SFTP, keeping its permission bits,
+// and verifies the copy's checksum
+func CopyFile(ctx context.Context, localPath, remotePath, username, hostname string) error {
+	f, err := os.Open(localPath) // #nosec G304 -- callers pass paths they created
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", localPath, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", localPath, err)
+	}
+
+	return defaultPool.withPooled(ctx, username, hostname, func(client *ssh.Client) error {
+		return Upload(ctx, client, f, remotePath, info.Mode().Perm())
+	})
+}
+
+// Upload writes src to remotePath on client over SFTP with the given permission bits, then
+// compares the remote file's SHA-256 with what was sent
+func Upload(ctx context.Context, client *ssh.Client, src io.Reader, remotePath string, mode os.FileMode) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return &sessionError{err}
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("starting SFTP: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	conn := newSFTPConn(stdin, stdout)
+	hash := sha256.New()
+	err = conn.upload(io.TeeReader(src, hash), remotePath, mode)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", remotePath, err)
+	}
+
+	want := hex.EncodeToString(hash.Sum(nil))
+	var output lockedBuffer
+	if err := runSession(ctx, client, "sha256sum -- "+shellQuote(remotePath), &output, &output); err != nil {
+		return fmt.Errorf("verifying %s: %w: %s", remotePath, err, output.String())
+	}
+	if got, _, _ := strings.Cut(strings.TrimSpace(output.String()), " "); got != want {
+		return fmt.Errorf("checksum mismatch for %s: sent %s, remote has %s", remotePath, want, got)
+	}
+	return nil
+}
+
+// sftpConn speaks just enough SFTP to write a file
+type sftpConn struct {
+	w       io.Writer
+	r       *bufio.Reader
+	nextID  uint32
+	pending map[uint32]bool // IDs of requests still waiting for their reply
+}
+
+func newSFTPConn(w io.Writer, r io.Reader) *sftpConn {
+	return &sftpConn{w: w, r: bufio.NewReader(r), pending: make(map[uint32]bool)}
+}
+
+func (c *sftpConn) upload(src io.Reader, remotePath string, mode os.FileMode) error {
+	if err := c.send(fxpInit, uint32(sftpVersion)); err != nil {
+		return err
+	}
+	if typ, _, err := c.recv(); err != nil {
+		return err
+	} else if typ != fxpVersion {
+		return fmt.Errorf("unexpected SFTP packet %d during init", typ)
+	}
+
+	// Permissions on open only apply to new files; fsetstat below covers existing ones
+	attrs := []any{uint32(attrPermissions), uint32(mode)}
+	if err := c.request(fxpOpen, remotePath, uint32(fxfWrite|fxfCreat|fxfTrunc), attrs); err != nil {
+		return err
+	}
+	handle, err := c.recvHandle()
+	if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+
+	writeErr := c.writeAll(src, handle)
+	if writeErr == nil {
+		if writeErr = c.request(fxpFSetStat, handle, attrs); writeErr == nil {
+			writeErr = c.recvStatus()
+		}
+	}
+	if err := c.request(fxpClose, handle); err != nil {
+		return err
+	}
+	if err := c.recvStatus(); err != nil && writeErr == nil {
+		writeErr = fmt.Errorf("closing: %w", err)
+	}
+	return writeErr
+}
+
+// writeAll streams src into handle, keeping up to sftpMaxInflight writes unacknowledged
+func (c *sftpConn) writeAll(src io.Reader, handle string) error {
+	buf := make([]byte, sftpChunkSize)
+	var offset uint64
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if n > 0 {
+			if len(c.pending) == sftpMaxInflight {
+				if err := c.recvStatus(); err != nil {
+					return err
+				}
+			}
+			if err := c.request(fxpWrite, handle, offset, string(buf[:n])); err != nil {
+				return err
+			}
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	for len(c.pending) > 0 {
+		if err := c.recvStatus(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request sends a packet of typ with a new request ID ahead of fields, to be answered
+// by recvStatus or recvHandle
+func (c *sftpConn) request(typ byte, fields ...any) error {
+	c.nextID++
+	if err := c.send(typ, append([]any{c.nextID}, fields...)...); err != nil {
+		return err
+	}
+	c.pending[c.nextID] = true
+	return nil
+}
+
+// send writes a packet of typ with fields encoded as SFTP uint32, uint64, string or
+// nested field lists
+func (c *sftpConn) send(typ byte, fields ...any) error {
+	payload, err := appendFields([]byte{typ}, fields)
+	if err != nil {
+		return err
+	}
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload))) // #nosec G115 -- packets are far below 4GB
+	_, err = c.w.Write(append(packet, payload...))
+	return err
+}
+
+func appendFields(b []byte, fields []any) ([]byte, error) {
+	for _, field := range fields {
+		switch v := field.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v))) // #nosec G115 -- bounded by sftpChunkSize
+			b = append(b, v...)
+		case []any:
+			var err error
+			if b, err = appendFields(b, v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported SFTP field %T", field)
+		}
+	}
+	return b, nil
+}
+
+// recv reads one packet, returning its type and the payload after the type byte
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("invalid SFTP packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// recvStatus reads the status reply to a pending request, failing unless it reports success
+func (c *sftpConn) recvStatus() error {
+	typ, payload, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if typ != fxpStatus || len(payload) < 8 {
+		return fmt.Errorf("unexpected SFTP packet %d", typ)
+	}
+	if err := c.answer(payload); err != nil {
+		return err
+	}
+	return statusError(payload)
+}
+
+// recvHandle reads a handle reply; servers answer failed opens with a status instead
+func (c *sftpConn) recvHandle() (string, error) {
+	typ, payload, err := c.recv()
+	if err != nil {
+		return "", err
+	}
+	if len(payload) >= 4 {
+		if err := c.answer(payload); err != nil {
+			return "", err
+		}
+	}
+	if typ == fxpStatus && len(payload) >= 8 {
+		if err := statusError(payload); err != nil {
+			return "", err
+		}
+	}
+	if typ != fxpHandle || len(payload) < 8 {
+		return "", fmt.Errorf("unexpected SFTP packet %d", typ)
+	}
+	handle, _ := readString(payload[4:])
+	return handle, nil
+}
+
+// answer matches a reply to the pending request whose ID it starts with
+func (c *sftpConn) answer(payload []byte) error {
+	id := binary.BigEndian.Uint32(payload)
+	if !c.pending[id] {
+		return fmt.Errorf("SFTP reply to unknown request %d", id)
+	}
+	delete(c.pending, id)
+	return nil
+}
+
+// statusError decodes a status payload (id, code, message) into an error, nil for success
+func statusError(payload []byte) error {
+	code := binary.BigEndian.Uint32(payload[4:8])
+	if code == fxOK {
+		return nil
+	}
+	message, _ := readString(payload[8:])
+	return fmt.Errorf("SFTP status %d: %s", code, message)
+}
+
+func readString(b []byte) (string, []byte) {
+	if len(b) < 4 {
+		return "", nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return "", nil
+	}
+	return string(b[4 : 4+n]), b[4+n:]
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,102 @@
+package sshutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	return data
+}
+
+func checkFile(t *testing.T, path string, data []byte, mode os.FileMode) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading upload: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("uploaded %d bytes, remote has %d different ones", len(data), len(got))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Fatalf("remote file has mode %v, want %v", info.Mode().Perm(), mode)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	server := newTestServer(t)
+	server.reorderWrites = true
+	client := server.dial()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "upload")
+
+	// Larger than the writes kept in flight, with a partial last chunk
+	data := randomBytes(t, sftpMaxInflight*sftpChunkSize*2+1000)
+	if err := Upload(ctx, client, bytes.NewReader(data), path, 0o640); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	checkFile(t, path, data, 0o640)
+
+	// Overwriting truncates and applies the new mode too
+	data = randomBytes(t, 10)
+	if err := Upload(ctx, client, bytes.NewReader(data), path, 0o600); err != nil {
+		t.Fatalf("Upload over existing file: %v", err)
+	}
+	checkFile(t, path, data, 0o600)
+
+	if err := Upload(ctx, client, bytes.NewReader(nil), path, 0o600); err != nil {
+		t.Fatalf("Upload of empty file: %v", err)
+	}
+	checkFile(t, path, nil, 0o600)
+
+	err := Upload(ctx, client, bytes.NewReader(data), filepath.Join(path, "not-a-dir"), 0o600)
+	if err == nil || !strings.Contains(err.Error(), "opening") {
+		t.Fatalf("got error %v for a path under a file, want the open failure", err)
+	}
+}
+
+func TestUploadChecksumMismatch(t *testing.T) {
+	server := newTestServer(t)
+	server.corruptWrites = true
+	path := filepath.Join(t.TempDir(), "upload")
+
+	err := Upload(context.Background(), server.dial(), bytes.NewReader(randomBytes(t, 1000)), path, 0o600)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("got error %v, want a checksum mismatch", err)
+	}
+}
+
+func TestUploadRejectsUnknownReplies(t *testing.T) {
+	server := newTestServer(t)
+	server.wrongIDs = true
+	path := filepath.Join(t.TempDir(), "upload")
+
+	err := Upload(context.Background(), server.dial(), bytes.NewReader(randomBytes(t, 1000)), path, 0o600)
+	if err == nil || !strings.Contains(err.Error(), "unknown request") {
+		t.Fatalf("got error %v, want the reply to an unknown request refused", err)
+	}
+}
+
+func TestAppendFieldsUnsupported(t *testing.T) {
+	if _, err := appendFields(nil, []any{uint32(1), []any{"path", 7}}); err == nil {
+		t.Fatalf("appendFields accepted an int")
+	}
+	var buf bytes.Buffer
+	if err := newSFTPConn(&buf, nil).request(fxpClose, 7); err == nil || buf.Len() != 0 {
+		t.Fatalf("got %v with %d bytes sent, want an error and nothing sent", err, buf.Len())
+	}
+}
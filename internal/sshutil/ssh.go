@@ -1,16 +1,19 @@
 package sshutil
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -76,40 +79,136 @@ func LoadKeyPair() (privateKey, publicKey string, err error) {
 	return privateKey, publicKey, nil
 }
 
-// CopyFile copies a file to a remote host using scp
-func CopyFile(ctx context.Context, localPath, remotePath, username, hostname string) error {
-	scpDest := fmt.Sprintf("%s@%s:%s", username, hostname, remotePath)
-	cmd := exec.CommandContext(ctx, "scp", "-o", "StrictHostKeyChecking=no", "-o", "ConnectTimeout=4", "-i", SSHKeyPath, localPath, scpDest)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%w: %s", err, string(output))
+// CommandResult is the output of a remote command
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int // -1 when the command was killed by a signal or never reported a status
+}
+
+// Run executes a command on a remote host over the pooled SSH connection, capturing stdout
+// and stderr separately. A non-zero exit status is returned as an error along with the result.
+func Run(ctx context.Context, command, username, hostname string) (*CommandResult, error) {
+	return defaultPool.Run(ctx, command, username, hostname)
+}
+
+// Run executes a command on username@hostname over the pooled connection, like the
+// package-level Run
+func (p *Pool) Run(ctx context.Context, command, username, hostname string) (*CommandResult, error) {
+	var stdout, stderr bytes.Buffer
+	err := p.runPooled(ctx, command, username, hostname, &stdout, &stderr)
+	result := &CommandResult{Stdout: stdout.String(), Stderr: stderr.String()}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+		if exitErr.Signal() != "" {
+			result.ExitCode = -1
+		}
+	default:
+		result.ExitCode = -1
 	}
-	return nil
+	return result, err
 }
 
 // ExecuteCommand executes a command on a remote host using SSH
 func ExecuteCommand(ctx context.Context, command, username, hostname string) error {
-	cmd := exec.CommandContext(ctx, "ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=4",
-		"-i", SSHKeyPath,
-		fmt.Sprintf("%s@%s", username, hostname),
-		command)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("%w: %s", err, string(output))
-	}
-	return nil
+	_, err := ExecuteCommandWithOutput(ctx, command, username, hostname)
+	return err
 }
 
+// ExecuteCommandWithOutput executes a command on a remote host using SSH and returns its
+// combined stdout and stderr
 func ExecuteCommandWithOutput(ctx context.Context, command, username, hostname string) (string, error) {
-	cmd := exec.CommandContext(ctx, "ssh",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "ConnectTimeout=4",
-		"-i", SSHKeyPath,
-		fmt.Sprintf("%s@%s", username, hostname),
-		command)
-	output, err := cmd.CombinedOutput()
+	var output lockedBuffer
+	err := defaultPool.runPooled(ctx, command, username, hostname, &output, &output)
 	if err != nil {
-		return string(output), fmt.Errorf("%w: %s", err, string(output))
+		return output.String(), fmt.Errorf("%w: %s", err, output.String())
+	}
+	return output.String(), nil
+}
+
+// RunCommand runs command in a new session on client and returns its combined output
+func RunCommand(client *ssh.Client, command string) (string, error) {
+	var output lockedBuffer
+	if err := runSession(context.Background(), client, command, &output, &output); err != nil {
+		return output.String(), fmt.Errorf("%w: %s", err, output.String())
 	}
-	return string(output), nil
+	return output.String(), nil
+}
+
+// runPooled runs command on the pooled connection to username@hostname
+func (p *Pool) runPooled(ctx context.Context, command, username, hostname string, stdout, stderr io.Writer) error {
+	return p.withPooled(ctx, username, hostname, func(client *ssh.Client) error {
+		return runSession(ctx, client, command, stdout, stderr)
+	})
+}
+
+// withPooled runs fn with the pooled connection to username@hostname. A connection that
+// can no longer open sessions, e.g. after the host rebooted, is replaced once.
+func (p *Pool) withPooled(ctx context.Context, username, hostname string, fn func(*ssh.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		client, release, err := p.Acquire(ctx, username, hostname)
+		if err != nil {
+			return err
+		}
+		err = fn(client)
+		release()
+
+		var sessionErr *sessionError
+		if errors.As(err, &sessionErr) && attempt == 0 {
+			p.Discard(client)
+			continue
+		}
+		return err
+	}
+}
+
+// sessionError means a session couldn't be opened, so the command never ran
+type sessionError struct{ err error }
+
+func (e *sessionError) Error() string { return fmt.Sprintf("opening SSH session: %v", e.err) }
+func (e *sessionError) Unwrap() error { return e.err }
+
+// runSession runs command in a new session on client. Cancelling ctx kills the command.
+func runSession(ctx context.Context, client *ssh.Client, command string, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return &sessionError{err}
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		session.Close()
+	})
+	defer stop()
+
+	err = session.Run(command)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// lockedBuffer lets a session's stdout and stderr copiers share one buffer
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
@@ -0,0 +1,66 @@
+package sshutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunSplitsOutput(t *testing.T) {
+	server := newTestServer(t)
+	pool := server.pool(time.Minute)
+
+	result, err := pool.Run(context.Background(), "echo out; echo err >&2; exit 3", "tester", "box")
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("got error %v, want the exit status", err)
+	}
+	if result.Stdout != "out\n" || result.Stderr != "err\n" || result.ExitCode != 3 {
+		t.Fatalf("got %+v, want stdout, stderr and exit code 3 apart", result)
+	}
+
+	result, err = pool.Run(context.Background(), "printf ok", "tester", "box")
+	if err != nil || result.Stdout != "ok" || result.Stderr != "" || result.ExitCode != 0 {
+		t.Fatalf("got %+v, %v, want ok", result, err)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	server := newTestServer(t)
+	pool := server.pool(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result, err := pool.Run(ctx, "echo started; exec sleep 30", "tester", "box")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Run returned after %s", elapsed)
+	}
+	if result.Stdout != "started\n" || result.ExitCode != -1 {
+		t.Fatalf("got %+v, want the output so far and no exit code", result)
+	}
+
+	// The command is killed, not left running
+	select {
+	case err := <-server.finished:
+		if err == nil {
+			t.Fatalf("command finished cleanly")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("command still running")
+	}
+
+	// The connection survives for the next command
+	if _, err := pool.Run(context.Background(), "true", "tester", "box"); err != nil {
+		t.Fatalf("Run after cancel: %v", err)
+	}
+	if got := server.connections.Load(); got != 1 {
+		t.Fatalf("got %d connections, want 1", got)
+	}
+}
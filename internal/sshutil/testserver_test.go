@@ -0,0 +1,311 @@
+package sshutil
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server running exec requests with sh and serving an
+// SFTP subsystem on the local filesystem
+type testServer struct {
+	t         *testing.T
+	addr      string
+	config    *ssh.ServerConfig
+	clientKey ssh.Signer
+
+	rejectSessions atomic.Int32 // session channels still to reject, one per connection
+	connections    atomic.Int32
+	disconnects    chan struct{}
+	finished       chan error // exit of every command run
+
+	// Misbehaviours for SFTP clients to cope with
+	reorderWrites bool // answer pipelined writes in reverse order
+	wrongIDs      bool // answer writes with IDs nobody asked for
+	corruptWrites bool // flip the first byte of every write
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	return signer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := &testServer{
+		t:           t,
+		clientKey:   newTestSigner(t),
+		disconnects: make(chan struct{}, 16),
+		finished:    make(chan error, 16),
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(s.clientKey.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(newTestSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s.addr = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// clientConfig authenticates as the server expects, checking its key against hostKeys
+func (s *testServer) clientConfig(hostKeys *HostKeys) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "tester",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.clientKey)},
+		HostKeyCallback: hostKeys.Check,
+		Timeout:         sshConnectTimeout,
+	}
+}
+
+// dial connects to the server with a client the test closes
+func (s *testServer) dial() *ssh.Client {
+	s.t.Helper()
+	client, err := dialConfig(context.Background(), s.addr, s.clientConfig(NewHostKeys()))
+	if err != nil {
+		s.t.Fatalf("dial: %v", err)
+	}
+	s.t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// pool returns a pool whose connections all go to the server
+func (s *testServer) pool(idleTimeout time.Duration) *Pool {
+	hostKeys := NewHostKeys()
+	pool := NewPool(idleTimeout)
+	pool.dial = func(ctx context.Context, username, hostname string) (*ssh.Client, error) {
+		return dialConfig(ctx, s.addr, s.clientConfig(hostKeys))
+	}
+	s.t.Cleanup(pool.Close)
+	return pool
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.connections.Add(1)
+	go ssh.DiscardRequests(reqs)
+	reject := s.rejectSessions.Add(-1) >= 0
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" || reject {
+			_ = newChannel.Reject(ssh.Prohibited, "no sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+	_ = sshConn.Wait()
+	select {
+	case s.disconnects <- struct{}{}:
+	default:
+	}
+}
+
+func (s *testServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for req := range requests {
+		var payload struct{ Value string }
+		switch req.Type {
+		case "exec":
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go s.exec(ctx, channel, payload.Value)
+		case "subsystem":
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Value != "sftp" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go func() {
+				s.serveSFTP(channel)
+				channel.Close()
+			}()
+		case "signal":
+			cancel()
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *testServer) exec(ctx context.Context, channel ssh.Channel, command string) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	err := cmd.Run()
+	select {
+	case s.finished <- err:
+	default:
+	}
+
+	status := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		status = 127
+	}
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	channel.Close()
+}
+
+// serveSFTP answers the requests Upload sends, on files of the local filesystem
+func (s *testServer) serveSFTP(channel ssh.Channel) {
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var buf sftpBuffer
+	conn := newSFTPConn(&buf, channel)
+	var held [][]byte // write replies held back to send in reverse
+	reply := func(typ byte, id uint32, fields ...any) []byte {
+		if err := conn.send(typ, append([]any{id}, fields...)...); err != nil {
+			s.t.Errorf("encoding SFTP reply: %v", err)
+		}
+		return buf.take()
+	}
+	status := func(id uint32, err error) []byte {
+		if err != nil {
+			return reply(fxpStatus, id, uint32(4), err.Error(), "")
+		}
+		return reply(fxpStatus, id, uint32(fxOK), "", "")
+	}
+
+	for {
+		// Release held replies before waiting for more requests, as the client may be
+		// waiting for them
+		if conn.r.Buffered() == 0 || len(held) == 4 {
+			for _, packet := range slices.Backward(held) {
+				_, _ = channel.Write(packet)
+			}
+			held = held[:0]
+		}
+
+		typ, payload, err := conn.recv()
+		if err != nil {
+			return
+		}
+		if typ == fxpInit {
+			_, _ = channel.Write(reply(fxpVersion, sftpVersion))
+			continue
+		}
+
+		id := binary.BigEndian.Uint32(payload)
+		rest := payload[4:]
+		var packet []byte
+		switch typ {
+		case fxpOpen:
+			path, rest := readString(rest)
+			pflags := binary.BigEndian.Uint32(rest)
+			perm := os.FileMode(binary.BigEndian.Uint32(rest[8:]))
+			flags := os.O_WRONLY
+			if pflags&fxfCreat != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&fxfTrunc != 0 {
+				flags |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(path, flags, perm)
+			if err != nil {
+				packet = status(id, err)
+				break
+			}
+			handle := fmt.Sprintf("h%d", id)
+			files[handle] = f
+			packet = reply(fxpHandle, id, handle)
+		case fxpWrite:
+			handle, rest := readString(rest)
+			offset := binary.BigEndian.Uint64(rest)
+			data, _ := readString(rest[8:])
+			if s.corruptWrites {
+				data = "X" + data[1:]
+			}
+			_, err := files[handle].WriteAt([]byte(data), int64(offset))
+			if s.wrongIDs {
+				id += 1000
+			}
+			packet = status(id, err)
+			if s.reorderWrites {
+				held = append(held, packet)
+				continue
+			}
+		case fxpFSetStat:
+			handle, rest := readString(rest)
+			packet = status(id, files[handle].Chmod(os.FileMode(binary.BigEndian.Uint32(rest[4:]))))
+		case fxpClose:
+			handle, _ := readString(rest)
+			packet = status(id, files[handle].Close())
+			delete(files, handle)
+		default:
+			packet = status(id, fmt.Errorf("unsupported packet %d", typ))
+		}
+		_, _ = channel.Write(packet)
+	}
+}
+
+// sftpBuffer collects the packets an sftpConn sends, for the server to pass on
+type sftpBuffer struct{ packets []byte }
+
+func (b *sftpBuffer) Write(p []byte) (int, error) {
+	b.packets = append(b.packets, p...)
+	return len(p), nil
+}
+
+func (b *sftpBuffer) take() []byte {
+	packets := b.packets
+	b.packets = nil
+	return packets
+}